@@ -1,45 +1,210 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/mrsridharpadmanaben/TimberLog/pkg/api"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/compress"
 	"github.com/mrsridharpadmanaben/TimberLog/pkg/index"
 	"github.com/mrsridharpadmanaben/TimberLog/pkg/ingest"
 	"github.com/mrsridharpadmanaben/TimberLog/pkg/query"
 	"github.com/mrsridharpadmanaben/TimberLog/pkg/storage"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
 )
 
 func main() {
+	walRepair := flag.Bool("wal-repair", false, "drop damaged WAL records found in the middle of a file instead of refusing to start")
+	walDurability := flag.String("wal-durability", "batch", "when writes are acknowledged: write (fsync each), batch (group commit) or interval")
+	walSyncInterval := flag.Duration("wal-sync-interval", 100*time.Millisecond, "fsync period for -wal-durability=interval")
+	walMaxSize := flag.Int64("wal-max-size", 64<<20, "rotate the WAL file once it reaches this many bytes (0 = never)")
+	walMaxAge := flag.Duration("wal-max-age", time.Hour, "rotate the WAL file once it is this old (0 = never)")
+	segmentCodec := flag.String("segment-codec", "snappy", "codec sealed segments are compressed with: snappy, deflate or none")
+	retentionMaxAge := flag.Duration("retention-max-age", 0, "delete sealed segments whose newest log is older than this (0 = keep forever)")
+	retentionMaxBytes := flag.Int64("retention-max-bytes", 0, "delete the oldest sealed segments once all of them take more bytes (0 = unlimited)")
+	retentionInterval := flag.Duration("retention-interval", time.Minute, "how often retention runs")
+	compactionInterval := flag.Duration("compaction-interval", time.Minute, "how often small sealed segments are merged")
+	tailBuffer := flag.Int("tail-buffer", 256, "entries buffered per /tail client")
+	tailOnFull := flag.String("tail-on-full", "drop", "when a /tail client's buffer is full: drop (count missed entries) or disconnect")
+	syslogUDP := flag.String("syslog-udp", "", "address to receive syslog datagrams on, e.g. :514 (empty = off)")
+	syslogTCP := flag.String("syslog-tcp", "", "address to receive syslog over TCP on, e.g. :601 (empty = off)")
+	gelfUDP := flag.String("gelf-udp", "", "address to receive GELF datagrams on, e.g. :12201 (empty = off)")
+	gelfTCP := flag.String("gelf-tcp", "", "address to receive GELF over TCP on, e.g. :12201 (empty = off)")
+	grpcAddr := flag.String("grpc", "", "address to serve the gRPC API on over cleartext HTTP/2, e.g. :9090 (empty = off)")
+	indexOpenSegments := flag.Int("index-open-segments", index.DefaultMaxOpenSegments, "sealed segments whose index sidecars stay open, the least recently queried are closed past it (0 = unlimited)")
+	forwardAddr := flag.String("forward", "", "address to receive the Fluent Forward protocol on, e.g. :24224 (empty = off)")
+	esTimestampFields := flag.String("es-timestamp-fields", "", "comma separated _bulk document fields holding the timestamp, first present wins (empty = defaults)")
+	esLevelFields := flag.String("es-level-fields", "", "comma separated _bulk document fields holding the level (empty = defaults)")
+	esServiceFields := flag.String("es-service-fields", "", "comma separated _bulk document fields holding the service (empty = defaults)")
+	serviceMaxAge := map[string]time.Duration{}
+	flag.Func("retention-service", "per service max age as service=duration, repeatable (0 keeps the service forever); segments holding several services are kept for the longest, so a shorter one only applies to segments holding just that service", func(value string) error {
+		service, age, ok := strings.Cut(value, "=")
+		if !ok || service == "" {
+			return fmt.Errorf("expected service=duration, got %q", value)
+		}
+		duration, err := time.ParseDuration(age)
+		if err != nil {
+			return err
+		}
+		serviceMaxAge[service] = duration
+		return nil
+	})
+	flag.Parse()
+
+	// segments are shared by the services written at the time and kept for the longest of
+	// their max ages, a shorter override only applies to segments holding nothing else
+	for service, age := range serviceMaxAge {
+		if age != 0 && (*retentionMaxAge == 0 || age < *retentionMaxAge) {
+			log.Printf("[RETENTION] -retention-service %s=%s is shorter than -retention-max-age %s, it only applies to segments holding nothing but %s", service, age, *retentionMaxAge, service)
+		}
+	}
+
+	walOptions := storage.DefaultWALOptions()
+	walOptions.SyncInterval = *walSyncInterval
+	walOptions.MaxFileSize = *walMaxSize
+	walOptions.MaxFileAge = *walMaxAge
+	switch *walDurability {
+	case "write":
+		walOptions.Durability = storage.SyncEveryWrite
+	case "batch":
+		walOptions.Durability = storage.SyncBatch
+	case "interval":
+		walOptions.Durability = storage.SyncInterval
+	default:
+		log.Fatalf("unknown -wal-durability %q", *walDurability)
+	}
+
+	writeOptions := api.DefaultWriteOptions()
+	if *esTimestampFields != "" {
+		writeOptions.Elastic.TimestampFields = strings.Split(*esTimestampFields, ",")
+	}
+	if *esLevelFields != "" {
+		writeOptions.Elastic.LevelFields = strings.Split(*esLevelFields, ",")
+	}
+	if *esServiceFields != "" {
+		writeOptions.Elastic.ServiceFields = strings.Split(*esServiceFields, ",")
+	}
+
+	segmentOptions := storage.DefaultSegmentOptions()
+	codec, err := compress.ParseCodec(*segmentCodec)
+	if err != nil {
+		log.Fatalf("-segment-codec: %v", err)
+	}
+	segmentOptions.Codec = codec
+
 	mountDirectory := "./timberlog_data"
 
-	segmentManager, _ := storage.NewSegmentManager(mountDirectory, 1024*10)
+	segmentManager, _ := storage.NewSegmentManagerWithOptions(mountDirectory, 1024*10, segmentOptions)
 	manifest, _ := storage.NewManifest(mountDirectory)
-	walManager, _ := storage.NewWALManager(mountDirectory, mountDirectory+"/wal.meta")
+	walManager, _ := storage.NewWALManagerWithOptions(mountDirectory, mountDirectory+"/wal.meta", walOptions)
 
 	buffer := &ingest.MemoryBuffer{}
-	indexManager := index.NewIndexManager()
+	indexManager, err := index.NewIndexManagerWithBackend(index.DiskBackend(filepath.Join(mountDirectory, "index"), index.DefaultCachePages))
+	if err != nil {
+		log.Fatalf("[INDEX FAILED] %v", err)
+	}
+	indexManager.SetMaxOpenSegments(*indexOpenSegments)
 	ingestManager := ingest.NewIngestManager(buffer, walManager, segmentManager, manifest, indexManager, 1*time.Second)
 
-	if err := ingestManager.RecoverFromWAL(); err != nil {
-		log.Fatalf("[RECOVERY FAILED] %v", err)
+	recoveryMode := storage.RecoverStrict
+	if *walRepair {
+		recoveryMode = storage.RecoverRepair
+	}
+
+	if _, err := ingestManager.RecoverFromWALWithMode(recoveryMode); err != nil {
+		log.Fatalf("[RECOVERY FAILED] %v (restart with -wal-repair to drop damaged records)", err)
 	}
 
+	tailOptions := query.DefaultTailOptions()
+	tailOptions.BufferSize = *tailBuffer
+	switch *tailOnFull {
+	case "drop":
+		tailOptions.Policy = query.DropEntries
+	case "disconnect":
+		tailOptions.Policy = query.Disconnect
+	default:
+		log.Fatalf("unknown -tail-on-full %q", *tailOnFull)
+	}
+	tailHub := query.NewTailHubWithOptions(tailOptions)
+	ingestManager.OnAppend(func(entry *types.LogEntry) {
+		tailHub.Publish(*entry)
+	})
+	tailHub.SetPending(ingestManager.Pending)
+
 	ingestManager.StartBackgroundFlush()
 
+	retentionManager := storage.NewRetentionManager(mountDirectory, manifest, storage.RetentionPolicy{
+		MaxAge:        *retentionMaxAge,
+		MaxTotalBytes: *retentionMaxBytes,
+		ServiceMaxAge: serviceMaxAge,
+	}, *retentionInterval)
+	retentionManager.OnDelete(func(meta storage.SegmentMeta) error {
+		return indexManager.DropSegment(mountDirectory, meta.FileName)
+	})
+	retentionManager.Start()
+
+	compactor := storage.NewCompactor(segmentManager, manifest, indexManager, storage.CompactionOptions{
+		Interval: *compactionInterval,
+	})
+	compactor.Start()
+
 	queryEngine := query.NewQueryEngine(indexManager, manifest, segmentManager)
 
 	// Start servers
 	go func() {
-		ws := api.NewWriteServer(ingestManager)
+		ws := api.NewWriteServerWithOptions(ingestManager, writeOptions)
 		ws.Start(":8080")
 	}()
 
 	go func() {
-		qs := api.NewQueryServer(queryEngine)
+		qs := api.NewQueryServerWithTail(queryEngine, tailHub)
 		qs.Start(":8081")
 	}()
 
-	select {} // block main
+	if *syslogUDP != "" || *syslogTCP != "" {
+		syslogServer := api.NewSyslogServer(ingestManager)
+		if err := syslogServer.Start(*syslogUDP, *syslogTCP); err != nil {
+			log.Fatalf("[SYSLOG FAILED] %v", err)
+		}
+	}
+
+	if *grpcAddr != "" {
+		grpcServer := api.NewGRPCServer(ingestManager, queryEngine, tailHub)
+		if err := grpcServer.Start(*grpcAddr); err != nil {
+			log.Fatalf("[GRPC FAILED] %v", err)
+		}
+	}
+
+	if *gelfUDP != "" || *gelfTCP != "" {
+		gelfServer := api.NewGELFServer(ingestManager)
+		if err := gelfServer.Start(*gelfUDP, *gelfTCP); err != nil {
+			log.Fatalf("[GELF FAILED] %v", err)
+		}
+	}
+
+	if *forwardAddr != "" {
+		forwardServer := api.NewForwardServer(ingestManager)
+		if err := forwardServer.Start(*forwardAddr); err != nil {
+			log.Fatalf("[FORWARD FAILED] %v", err)
+		}
+	}
+
+	// block main until asked to stop, then flush and wait for compressions so no tmp file is left behind
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	log.Printf("[SHUTDOWN] flushing and closing storage")
+	retentionManager.Stop()
+	compactor.Stop()
+	if err := ingestManager.Close(); err != nil {
+		log.Printf("[SHUTDOWN] %v", err)
+	}
 }
@@ -0,0 +1,205 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+const (
+	maxBatchBytes   = 64 << 20 // decompressed request body
+	maxBatchLine    = 1 << 20  // one NDJSON line
+	maxBatchEntries = 100_000
+)
+
+// BatchError is one rejected entry of a batch
+type BatchError struct {
+	Line  int    `json:"line"` // 1-based NDJSON line or JSON array element
+	Error string `json:"error"`
+}
+
+// BatchResponse answers a batch write
+type BatchResponse struct {
+	Accepted int          `json:"accepted"`
+	Rejected int          `json:"rejected"`
+	Errors   []BatchError `json:"errors,omitempty"`
+}
+
+// rawBatchEntry is an undecoded entry and where it was in the request
+type rawBatchEntry struct {
+	line int
+	data []byte
+}
+
+// BatchHandler accepts many entries at once, as NDJSON or a JSON array, optionally
+// with Content-Encoding: gzip. Valid entries are written with one WAL group commit;
+// invalid ones are listed in the response. All rejected is a 400, a failed write a
+// 500 with nothing accepted.
+func (ws *WriteServer) BatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := requestBody(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer body.Close()
+
+	raw, err := readBatch(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries, response := decodeBatch(raw, time.Now())
+
+	if len(entries) > 0 {
+		if err := ws.ingestManager.AppendLogs(entries); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	status := http.StatusOK
+	if len(entries) == 0 && response.Rejected > 0 {
+		status = http.StatusBadRequest
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// requestBody returns the request body, decompressed
+func requestBody(r *http.Request) (io.ReadCloser, error) {
+	var body io.ReadCloser = r.Body
+
+	switch strings.ToLower(r.Header.Get("Content-Encoding")) {
+	case "", "identity":
+	case "gzip":
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+		body = reader
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", r.Header.Get("Content-Encoding"))
+	}
+
+	return body, nil
+}
+
+// readBatch splits the body into entries: a JSON array if it starts with '[', NDJSON otherwise
+func readBatch(body io.Reader) ([]rawBatchEntry, error) {
+	reader := bufio.NewReaderSize(&limitChecked{reader: body}, 64<<10)
+
+	first, err := peekNonSpace(reader)
+	if err == io.EOF {
+		return nil, errors.New("empty batch")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []rawBatchEntry
+
+	if first == '[' {
+		decoder := json.NewDecoder(reader)
+		decoder.Token() // '['
+		for decoder.More() {
+			var element json.RawMessage
+			if err := decoder.Decode(&element); err != nil {
+				return nil, fmt.Errorf("element %d: %w", len(entries)+1, err)
+			}
+			entries = append(entries, rawBatchEntry{line: len(entries) + 1, data: element})
+			if len(entries) > maxBatchEntries {
+				return nil, fmt.Errorf("more than %d entries", maxBatchEntries)
+			}
+		}
+		if _, err := decoder.Token(); err != nil {
+			return nil, fmt.Errorf("unterminated array: %w", err)
+		}
+		return entries, nil
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxBatchLine)
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		entries = append(entries, rawBatchEntry{line: line, data: bytes.Clone(data)})
+		if len(entries) > maxBatchEntries {
+			return nil, fmt.Errorf("more than %d entries", maxBatchEntries)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// decodeBatch decodes and normalizes every entry, collecting the rejected ones
+func decodeBatch(raw []rawBatchEntry, now time.Time) ([]*types.LogEntry, BatchResponse) {
+	var response BatchResponse
+	entries := make([]*types.LogEntry, 0, len(raw))
+
+	for _, item := range raw {
+		entry := &types.LogEntry{}
+		err := json.Unmarshal(item.data, entry)
+		if err == nil {
+			err = entry.Normalize(now)
+		}
+		if err != nil {
+			response.Rejected++
+			response.Errors = append(response.Errors, BatchError{Line: item.line, Error: err.Error()})
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	response.Accepted = len(entries)
+	return entries, response
+}
+
+func peekNonSpace(reader *bufio.Reader) (byte, error) {
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return b, reader.UnreadByte()
+	}
+}
+
+// limitChecked fails once more than maxBatchBytes were read, instead of cutting the body short
+type limitChecked struct {
+	reader io.Reader
+	read   int64
+}
+
+func (limited *limitChecked) Read(p []byte) (int, error) {
+	n, err := limited.reader.Read(p)
+	limited.read += int64(n)
+	if limited.read > maxBatchBytes {
+		return n, fmt.Errorf("request body larger than %d bytes", maxBatchBytes)
+	}
+	return n, err
+}
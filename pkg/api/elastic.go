@@ -0,0 +1,370 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+// ElasticOptions says which document fields fill the fixed LogEntry fields, the first
+// one present wins. Names are dotted paths that match a key as written ("log.level")
+// or nested objects ({"log": {"level": ...}}). Everything else becomes Properties.
+type ElasticOptions struct {
+	TimestampFields []string
+	LevelFields     []string
+	ServiceFields   []string
+	HostFields      []string
+	MessageFields   []string
+}
+
+// DefaultElasticOptions covers ECS (Filebeat) and the usual Fluent Bit and Vector records
+func DefaultElasticOptions() ElasticOptions {
+	return ElasticOptions{
+		TimestampFields: []string{"@timestamp", "timestamp", "time"},
+		LevelFields:     []string{"log.level", "level", "severity"},
+		ServiceFields:   []string{"service.name", "service", "app"},
+		HostFields:      []string{"host.name", "host.hostname", "host", "hostname"},
+		MessageFields:   []string{"message", "msg", "log"},
+	}
+}
+
+// ElasticBulkResponse is the _bulk response shippers read per item results from
+type ElasticBulkResponse struct {
+	Took   int64                        `json:"took"`
+	Errors bool                         `json:"errors"`
+	Items  []map[string]ElasticBulkItem `json:"items"` // action -> result, in request order
+}
+
+// ElasticBulkItem is the result of one action
+type ElasticBulkItem struct {
+	Index   string        `json:"_index"`
+	ID      string        `json:"_id"`
+	Version int           `json:"_version,omitempty"`
+	Result  string        `json:"result,omitempty"`
+	Status  int           `json:"status"`
+	Error   *ElasticError `json:"error,omitempty"`
+}
+
+// ElasticError is an error as Elasticsearch reports it
+type ElasticError struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// elasticAction is the metadata line of a bulk action
+type elasticAction struct {
+	Index string `json:"_index"`
+	ID    string `json:"_id"`
+}
+
+// ElasticBulkHandler is a subset of the Elasticsearch _bulk API (POST /_bulk and
+// /{index}/_bulk): index and create actions are stored, update and delete get a
+// per-item 400. A malformed action line fails the whole request like Elasticsearch
+// does; a failed write answers 429 for every stored item so shippers retry them.
+func (ws *WriteServer) ElasticBulkHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		elasticFail(w, http.StatusMethodNotAllowed, "illegal_argument_exception", "use POST")
+		return
+	}
+
+	body, err := requestBody(r)
+	if err != nil {
+		elasticFail(w, http.StatusBadRequest, "illegal_argument_exception", err.Error())
+		return
+	}
+	defer body.Close()
+
+	scanner := bufio.NewScanner(&limitChecked{reader: body})
+	scanner.Buffer(make([]byte, 0, 64<<10), maxBatchLine)
+	nextLine := func() ([]byte, bool) {
+		for scanner.Scan() {
+			if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+				return line, true
+			}
+		}
+		return nil, false
+	}
+
+	var response ElasticBulkResponse
+	var entries []*types.LogEntry
+	now := time.Now()
+
+	for {
+		line, ok := nextLine()
+		if !ok {
+			break
+		}
+
+		var actionLine map[string]elasticAction
+		if err := json.Unmarshal(line, &actionLine); err != nil || len(actionLine) != 1 {
+			elasticFail(w, http.StatusBadRequest, "illegal_argument_exception",
+				fmt.Sprintf("malformed action/metadata line [%d]", len(response.Items)*2+1))
+			return
+		}
+
+		var name string
+		var action elasticAction
+		for key, metadata := range actionLine {
+			name, action = key, metadata
+		}
+		if action.Index == "" {
+			action.Index = r.PathValue("index")
+		}
+
+		var document []byte
+		if name != "delete" {
+			if document, ok = nextLine(); !ok {
+				elasticFail(w, http.StatusBadRequest, "illegal_argument_exception",
+					fmt.Sprintf("%s action without a document", name))
+				return
+			}
+		}
+		if len(response.Items) >= maxBatchEntries {
+			elasticFail(w, http.StatusRequestEntityTooLarge, "illegal_argument_exception",
+				fmt.Sprintf("more than %d actions", maxBatchEntries))
+			return
+		}
+
+		item := ElasticBulkItem{Index: action.Index, ID: action.ID}
+		switch {
+		case name != "index" && name != "create":
+			item.Status = http.StatusBadRequest
+			item.Error = &ElasticError{Type: "action_request_validation_exception", Reason: name + " is not supported, logs are append only"}
+		case action.Index == "":
+			item.Status = http.StatusBadRequest
+			item.Error = &ElasticError{Type: "action_request_validation_exception", Reason: "index is missing"}
+		default:
+			entry, err := ws.elasticOptions.entry(document, now)
+			if err != nil {
+				item.Status = http.StatusBadRequest
+				item.Error = &ElasticError{Type: "mapper_parsing_exception", Reason: err.Error()}
+				break
+			}
+			entry.SetProperty("_index", action.Index)
+			if item.ID == "" {
+				item.ID = elasticID()
+			}
+			item.Version, item.Result, item.Status = 1, "created", http.StatusCreated
+			entries = append(entries, entry)
+		}
+
+		response.Items = append(response.Items, map[string]ElasticBulkItem{name: item})
+	}
+	if err := scanner.Err(); err != nil {
+		elasticFail(w, http.StatusBadRequest, "illegal_argument_exception", err.Error())
+		return
+	}
+
+	if len(entries) > 0 {
+		if err := ws.ingestManager.AppendLogs(entries); err != nil {
+			for _, results := range response.Items {
+				for name, item := range results {
+					if item.Status == http.StatusCreated {
+						results[name] = ElasticBulkItem{
+							Index:  item.Index,
+							ID:     item.ID,
+							Status: http.StatusTooManyRequests,
+							Error:  &ElasticError{Type: "es_rejected_execution_exception", Reason: err.Error()},
+						}
+					}
+				}
+			}
+		}
+	}
+
+	for _, results := range response.Items {
+		for _, item := range results {
+			response.Errors = response.Errors || item.Error != nil
+		}
+	}
+	response.Took = time.Since(start).Milliseconds()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// ElasticInfoHandler answers GET / the way Elasticsearch does, shippers check the version
+func (ws *WriteServer) ElasticInfoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"name":         "timberlog",
+		"cluster_name": "timberlog",
+		"version": map[string]string{
+			"number":                             "8.11.0",
+			"build_flavor":                       "default",
+			"minimum_wire_compatibility_version": "7.17.0",
+		},
+		"tagline": "You Know, for Search",
+	})
+}
+
+// entry maps a document onto a LogEntry
+func (options ElasticOptions) entry(document []byte, now time.Time) (*types.LogEntry, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(document, &fields); err != nil {
+		return nil, fmt.Errorf("failed to parse document: %v", err)
+	}
+	if fields == nil {
+		return nil, errors.New("document is not an object")
+	}
+	return options.mapFields(fields, now)
+}
+
+// mapFields takes the fixed fields out of a decoded record, the rest are Properties
+func (options ElasticOptions) mapFields(fields map[string]interface{}, now time.Time) (*types.LogEntry, error) {
+	entry := &types.LogEntry{}
+
+	if value, ok := takeField(fields, options.TimestampFields); ok {
+		timestamp, err := elasticTimestamp(value)
+		if err != nil {
+			return nil, err
+		}
+		entry.Timestamp = timestamp
+	}
+
+	// an unknown level stays a property, the entry is INFO
+	if value, ok := peekField(fields, options.LevelFields); ok {
+		if level, known := types.ParseLogLevel(toText(value)); known {
+			takeField(fields, options.LevelFields)
+			entry.Level = level
+		}
+	}
+
+	if value, ok := takeField(fields, options.ServiceFields); ok {
+		entry.Service = toText(value)
+	}
+	if value, ok := takeField(fields, options.HostFields); ok {
+		entry.Host = toText(value)
+	}
+	if value, ok := takeField(fields, options.MessageFields); ok {
+		entry.Message = toText(value)
+	}
+
+	entry.Properties = fields
+	if err := entry.Normalize(now); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// peekField returns the value of the first of names present in fields
+func peekField(fields map[string]interface{}, names []string) (any, bool) {
+	for _, name := range names {
+		if value, ok := fields[name]; ok {
+			return value, true
+		}
+
+		parent, ok := nestedParent(fields, name)
+		if ok {
+			if value, ok := parent[name[strings.LastIndexByte(name, '.')+1:]]; ok {
+				return value, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// takeField is peekField that also removes the field, and objects it leaves empty
+func takeField(fields map[string]interface{}, names []string) (any, bool) {
+	for _, name := range names {
+		if value, ok := fields[name]; ok {
+			delete(fields, name)
+			return value, true
+		}
+
+		parent, ok := nestedParent(fields, name)
+		if !ok {
+			continue
+		}
+		parts := strings.Split(name, ".")
+		value, ok := parent[parts[len(parts)-1]]
+		if !ok {
+			continue
+		}
+		delete(parent, parts[len(parts)-1])
+
+		// innermost first, so {"host": {"name": ...}} goes but {"host": {"ip": ...}} stays
+		for depth := len(parts) - 1; depth > 0; depth-- {
+			holder := fields
+			if depth > 1 {
+				holder, _ = nestedParent(fields, strings.Join(parts[:depth], "."))
+			}
+			if child, _ := holder[parts[depth-1]].(map[string]interface{}); len(child) > 0 {
+				break
+			}
+			delete(holder, parts[depth-1])
+		}
+		return value, true
+	}
+	return nil, false
+}
+
+// nestedParent returns the object holding the last part of a dotted name
+func nestedParent(fields map[string]interface{}, name string) (map[string]interface{}, bool) {
+	parts := strings.Split(name, ".")
+	if len(parts) < 2 {
+		return nil, false
+	}
+
+	current := fields
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := current[part].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current = next
+	}
+	return current, true
+}
+
+// elasticTimestamp reads a date as Elasticsearch's default mapping does: an RFC 3339
+// string (optionally without a zone, then UTC) or epoch milliseconds
+func elasticTimestamp(value any) (int64, error) {
+	switch timestamp := value.(type) {
+	case float64:
+		return int64(timestamp), nil
+	case int64:
+		return timestamp, nil
+	case string:
+		if millis, err := strconv.ParseInt(timestamp, 10, 64); err == nil {
+			return millis, nil
+		}
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999", "2006-01-02 15:04:05.999999999", time.DateOnly} {
+			if parsed, err := time.Parse(layout, timestamp); err == nil {
+				return parsed.UnixMilli(), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("failed to parse date field [%v]", value)
+}
+
+// elasticID is a random id shaped like the ones Elasticsearch generates
+func elasticID() string {
+	id := make([]byte, 15)
+	rand.Read(id)
+	return base64.RawURLEncoding.EncodeToString(id)
+}
+
+// elasticFail answers a request level error the way Elasticsearch does
+func elasticFail(w http.ResponseWriter, status int, errorType, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error":  ElasticError{Type: errorType, Reason: reason},
+		"status": status,
+	})
+}
@@ -0,0 +1,341 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/ingest"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/msgpack"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+// ErrInvalidForward means a message doesn't follow the Forward protocol
+var ErrInvalidForward = errors.New("invalid forward message")
+
+// ForwardOptions bound what a connection can hold on to
+type ForwardOptions struct {
+	IdleTimeout     time.Duration // a connection sending nothing for this long is closed, clients reconnect
+	MaxMessageBytes int64         // bytes one message may take off the connection, before it is decoded in full
+}
+
+func DefaultForwardOptions() ForwardOptions {
+	return ForwardOptions{
+		IdleTimeout:     5 * time.Minute,
+		MaxMessageBytes: 16 << 20,
+	}
+}
+
+// ForwardServer receives the Fluent Forward protocol (Fluentd's and Fluent Bit's
+// forward output) over TCP in Message, Forward and PackedForward mode, gzip
+// CompressedPackedForward included. Records are mapped with the _bulk default field
+// names and the tag is kept as a property, and as Service when the record names none.
+// A message with a chunk option is acknowledged once its entries are durable in the
+// WAL; if writing fails the connection is closed without an ack and the client resends.
+type ForwardServer struct {
+	ingestManager *ingest.IngestManager
+	fields        ElasticOptions
+	options       ForwardOptions
+	tcp           *tcpListener
+}
+
+func NewForwardServer(ingestManager *ingest.IngestManager) *ForwardServer {
+	return NewForwardServerWithOptions(ingestManager, DefaultForwardOptions())
+}
+
+// NewForwardServerWithOptions creates a server; zero option fields take their defaults
+func NewForwardServerWithOptions(ingestManager *ingest.IngestManager, options ForwardOptions) *ForwardServer {
+	defaults := DefaultForwardOptions()
+	if options.IdleTimeout <= 0 {
+		options.IdleTimeout = defaults.IdleTimeout
+	}
+	if options.MaxMessageBytes <= 0 {
+		options.MaxMessageBytes = defaults.MaxMessageBytes
+	}
+
+	fields := DefaultElasticOptions()
+	fields.TimestampFields = nil // the event time wins, time fields of the record are kept
+	return &ForwardServer{ingestManager: ingestManager, fields: fields, options: options}
+}
+
+// Start listens on addr and serves in the background
+func (fs *ForwardServer) Start(addr string) error {
+	tcp, err := listenTCP(addr, "FORWARD", fs.serveConn)
+	if err != nil {
+		return err
+	}
+	fs.tcp = tcp
+	return nil
+}
+
+// Addr is the address the listener is bound to
+func (fs *ForwardServer) Addr() net.Addr {
+	return fs.tcp.Addr()
+}
+
+// Stop closes the listener and open connections and waits until they are done
+func (fs *ForwardServer) Stop() {
+	fs.tcp.Stop()
+}
+
+func (fs *ForwardServer) serveConn(conn net.Conn) {
+	// a declared array or map length makes the decoder allocate per element, bounding
+	// the bytes of a message bounds that too
+	limited := &messageLimited{reader: conn, limit: fs.options.MaxMessageBytes}
+	decoder := msgpack.NewDecoder(limited)
+
+	for {
+		limited.read = 0
+		conn.SetReadDeadline(time.Now().Add(fs.options.IdleTimeout))
+		message, err := decoder.Decode()
+		if err != nil {
+			if !closedError(err) {
+				log.Printf("[FORWARD] closing connection from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		entries, chunk, err := fs.decodeMessage(message, time.Now())
+		if err != nil {
+			log.Printf("[FORWARD] closing connection from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+
+		if len(entries) > 0 {
+			if err := fs.ingestManager.AppendLogs(entries); err != nil {
+				log.Printf("[FORWARD] writing %d entries failed, closing connection: %v", len(entries), err)
+				return
+			}
+		}
+
+		if chunk == "" {
+			continue
+		}
+		if err := fs.ingestManager.Sync(); err != nil {
+			log.Printf("[FORWARD] WAL sync failed, not acknowledging %s: %v", chunk, err)
+			return
+		}
+		ack, _ := msgpack.Marshal(map[string]any{"ack": chunk})
+		if _, err := conn.Write(ack); err != nil {
+			return
+		}
+	}
+}
+
+// messageLimited fails once the message being decoded took more than limit bytes off
+// the connection. Bytes the decoder buffered ahead count toward the message they were read for.
+type messageLimited struct {
+	reader io.Reader
+	read   int64
+	limit  int64
+}
+
+func (limited *messageLimited) Read(p []byte) (int, error) {
+	n, err := limited.reader.Read(p)
+	limited.read += int64(n)
+	if limited.read > limited.limit {
+		return n, fmt.Errorf("%w: message larger than %d bytes", ErrInvalidForward, limited.limit)
+	}
+	return n, err
+}
+
+// decodeMessage returns the entries of one message and the chunk id to acknowledge.
+// The mode follows from the second element:
+//
+//	Message        [tag, time, record, option?]
+//	Forward        [tag, [[time, record], ...], option?]
+//	PackedForward  [tag, bin or str of concatenated [time, record], option?]
+func (fs *ForwardServer) decodeMessage(message any, now time.Time) ([]*types.LogEntry, string, error) {
+	array, ok := message.([]any)
+	if !ok || len(array) < 2 {
+		return nil, "", fmt.Errorf("%w: not an array of at least tag and entries", ErrInvalidForward)
+	}
+	tag, ok := textValue(array[0])
+	if !ok {
+		return nil, "", fmt.Errorf("%w: tag is not a string", ErrInvalidForward)
+	}
+
+	var events [][]any
+	var option any
+
+	switch second := array[1].(type) {
+	case []any:
+		for _, event := range second {
+			pair, ok := event.([]any)
+			if !ok || len(pair) < 2 {
+				return nil, "", fmt.Errorf("%w: entry is not [time, record]", ErrInvalidForward)
+			}
+			events = append(events, pair)
+		}
+		if len(array) > 2 {
+			option = array[2]
+		}
+
+	case string, []byte:
+		if len(array) > 2 {
+			option = array[2]
+		}
+		packed, err := unpackEvents(second, option)
+		if err != nil {
+			return nil, "", err
+		}
+		events = packed
+
+	default:
+		if len(array) < 3 {
+			return nil, "", fmt.Errorf("%w: message mode without a record", ErrInvalidForward)
+		}
+		events = [][]any{{array[1], array[2]}}
+		if len(array) > 3 {
+			option = array[3]
+		}
+	}
+
+	if len(events) > maxBatchEntries {
+		return nil, "", fmt.Errorf("%w: more than %d entries", ErrInvalidForward, maxBatchEntries)
+	}
+
+	entries := make([]*types.LogEntry, 0, len(events))
+	for _, event := range events {
+		entry, err := fs.entry(tag, event[0], event[1], now)
+		if err != nil {
+			log.Printf("[FORWARD] dropping entry tagged %s: %v", tag, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	var chunk string
+	if options, ok := option.(map[string]any); ok {
+		chunk, _ = textValue(options["chunk"])
+	}
+	return entries, chunk, nil
+}
+
+// unpackEvents decodes the concatenated [time, record] arrays of PackedForward mode,
+// gunzipping them first when the option says compressed: gzip
+func unpackEvents(packed any, option any) ([][]any, error) {
+	var data []byte
+	switch packed := packed.(type) {
+	case string:
+		data = []byte(packed)
+	case []byte:
+		data = packed
+	}
+
+	var reader io.Reader = bytes.NewReader(data)
+	if options, ok := option.(map[string]any); ok {
+		switch compressed, _ := textValue(options["compressed"]); compressed {
+		case "", "text":
+		case "gzip":
+			gzipReader, err := gzip.NewReader(reader)
+			if err != nil {
+				return nil, fmt.Errorf("%w: gzip: %v", ErrInvalidForward, err)
+			}
+			// a chunk may be several gzip members back to back, the reader reads them all
+			reader = &limitChecked{reader: gzipReader}
+		default:
+			return nil, fmt.Errorf("%w: unsupported compression %q", ErrInvalidForward, compressed)
+		}
+	}
+
+	var events [][]any
+	decoder := msgpack.NewDecoder(reader)
+	for {
+		event, err := decoder.Decode()
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: packed entries: %v", ErrInvalidForward, err)
+		}
+		pair, ok := event.([]any)
+		if !ok || len(pair) < 2 {
+			return nil, fmt.Errorf("%w: packed entry is not [time, record]", ErrInvalidForward)
+		}
+		events = append(events, pair)
+		if len(events) > maxBatchEntries {
+			return nil, fmt.Errorf("%w: more than %d entries", ErrInvalidForward, maxBatchEntries)
+		}
+	}
+}
+
+// entry maps one event onto a LogEntry
+func (fs *ForwardServer) entry(tag string, eventTime any, record any, now time.Time) (*types.LogEntry, error) {
+	fields, ok := textValues(record).(map[string]any)
+	if !ok {
+		return nil, errors.New("record is not a map")
+	}
+
+	entry, err := fs.fields.mapFields(fields, now)
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp, err := forwardTime(eventTime)
+	if err != nil {
+		return nil, err
+	}
+	if timestamp > 0 {
+		entry.Timestamp = timestamp
+	}
+	if entry.Service == "" {
+		entry.Service = tag
+	}
+	entry.SetProperty("tag", tag)
+	return entry, nil
+}
+
+// forwardTime reads an event time in milliseconds: integer (or float) seconds, or
+// EventTime, extension type 0 holding big endian seconds and nanoseconds
+func forwardTime(value any) (int64, error) {
+	switch value := value.(type) {
+	case int64:
+		return value * 1000, nil
+	case uint64:
+		return int64(value) * 1000, nil
+	case float64:
+		return int64(value * 1000), nil
+	case msgpack.Ext:
+		if value.Type == 0 && len(value.Data) == 8 {
+			seconds := int64(binary.BigEndian.Uint32(value.Data[:4]))
+			nanos := int64(binary.BigEndian.Uint32(value.Data[4:]))
+			return seconds*1000 + nanos/int64(time.Millisecond), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid event time %v", value)
+}
+
+// textValue reads a msgpack str, or a bin as older Fluentd versions send strings
+func textValue(value any) (string, bool) {
+	switch value := value.(type) {
+	case string:
+		return value, true
+	case []byte:
+		return string(value), true
+	}
+	return "", false
+}
+
+// textValues turns the bins of a record into strings, at any depth
+func textValues(value any) any {
+	switch value := value.(type) {
+	case []byte:
+		return string(value)
+	case []any:
+		for i, element := range value {
+			value[i] = textValues(element)
+		}
+	case map[string]any:
+		for key, element := range value {
+			value[key] = textValues(element)
+		}
+	}
+	return value
+}
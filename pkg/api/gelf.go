@@ -0,0 +1,128 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+// maxGELFMessage bounds a decompressed or reassembled message
+const maxGELFMessage = 8 << 20
+
+// ErrInvalidGELF means a payload isn't a GELF message
+var ErrInvalidGELF = errors.New("invalid GELF message")
+
+// additional fields naming the service, by precedence
+var gelfServiceFields = []string{"_service", "_app", "_container_name"}
+
+// ParseGELF maps a GELF 1.1 JSON message onto a LogEntry: host, short_message,
+// full_message (as StackTrace), level (syslog severity, INFO when missing) and
+// timestamp (seconds). Additional fields lose their "_" and become properties, the
+// first of _service, _app or _container_name the Service instead; file, line and
+// facility are kept as properties too.
+func ParseGELF(data []byte) (*types.LogEntry, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidGELF, err)
+	}
+	if fields == nil {
+		return nil, fmt.Errorf("%w: not an object", ErrInvalidGELF)
+	}
+
+	entry := &types.LogEntry{Properties: map[string]interface{}{}}
+
+	for key, value := range fields {
+		switch key {
+		case "version":
+		case "host":
+			entry.Host = toText(value)
+		case "short_message":
+			entry.Message = toText(value)
+		case "full_message":
+			entry.StackTrace = toText(value)
+		case "timestamp":
+			seconds, ok := value.(float64)
+			if !ok {
+				return nil, fmt.Errorf("%w: timestamp is not a number", ErrInvalidGELF)
+			}
+			entry.Timestamp = int64(math.Round(seconds * 1000))
+		case "level":
+			level, err := gelfLevel(value)
+			if err != nil {
+				return nil, err
+			}
+			entry.Level = level
+		default:
+			// the spec reserves "_id", Graylog rejects it as well
+			if name, additional := strings.CutPrefix(key, "_"); additional && name != "id" && name != "" {
+				entry.Properties[name] = value
+			} else if !additional {
+				entry.Properties[key] = value // file, line, facility and anything non-standard
+			}
+		}
+	}
+
+	for _, field := range gelfServiceFields {
+		name := field[1:]
+		if value, ok := entry.Properties[name]; ok {
+			entry.Service = toText(value)
+			delete(entry.Properties, name)
+			break
+		}
+	}
+
+	return entry, nil
+}
+
+// gelfLevel maps a syslog severity number (0 emergency ... 7 debug) onto a level;
+// a level name is accepted too as some clients send one
+func gelfLevel(value any) (types.LogLevel, error) {
+	switch value := value.(type) {
+	case float64:
+		if value >= 0 && value <= 7 && value == math.Trunc(value) {
+			return syslogLevels[int(value)], nil
+		}
+	case string:
+		if level, ok := types.ParseLogLevel(value); ok {
+			return level, nil
+		}
+	}
+	return "", fmt.Errorf("%w: level %v", ErrInvalidGELF, value)
+}
+
+// gelfPayload undoes the compression of a UDP payload, told apart by its first bytes:
+// gzip (1f 8b), zlib (78 xx) or plain JSON
+func gelfPayload(data []byte) ([]byte, error) {
+	var reader io.ReadCloser
+	var err error
+
+	switch {
+	case len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b:
+		reader, err = gzip.NewReader(bytes.NewReader(data))
+	case len(data) >= 2 && data[0] == 0x78 && (uint16(data[0])<<8|uint16(data[1]))%31 == 0:
+		reader, err = zlib.NewReader(bytes.NewReader(data))
+	default:
+		return data, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidGELF, err)
+	}
+	defer reader.Close()
+
+	payload, err := io.ReadAll(io.LimitReader(reader, maxGELFMessage+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidGELF, err)
+	}
+	if len(payload) > maxGELFMessage {
+		return nil, fmt.Errorf("%w: larger than %d bytes", ErrInvalidGELF, maxGELFMessage)
+	}
+	return payload, nil
+}
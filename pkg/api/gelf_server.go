@@ -0,0 +1,316 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/ingest"
+)
+
+const (
+	maxGELFDatagram = 64 << 10
+	maxGELFChunks   = 128 // per message, from the spec
+	gelfChunkHeader = 12  // magic 1e 0f, 8 byte message id, sequence number, sequence count
+)
+
+// GELFOptions bound the reassembly of chunked UDP messages
+type GELFOptions struct {
+	ChunkTimeout       time.Duration // an incomplete message is dropped this long after its first chunk
+	MaxPendingMessages int           // incomplete messages held at once, the oldest is dropped beyond
+	MaxPendingBytes    int           // chunk bytes held at once, the oldest messages are dropped beyond
+}
+
+func DefaultGELFOptions() GELFOptions {
+	return GELFOptions{
+		ChunkTimeout:       5 * time.Second,
+		MaxPendingMessages: 1000,
+		MaxPendingBytes:    32 << 20,
+	}
+}
+
+// GELFServer receives GELF (Graylog Extended Log Format, e.g. Docker's gelf logging
+// driver) over UDP, chunked or not and gzip, zlib or uncompressed, and over TCP as
+// null byte terminated JSON, and writes it through the IngestManager. Invalid
+// messages are logged and dropped.
+type GELFServer struct {
+	ingestManager *ingest.IngestManager
+	options       GELFOptions
+	udp           net.PacketConn
+	tcp           *tcpListener
+	waitGroup     sync.WaitGroup // UDP reader
+}
+
+func NewGELFServer(ingestManager *ingest.IngestManager) *GELFServer {
+	return NewGELFServerWithOptions(ingestManager, DefaultGELFOptions())
+}
+
+// NewGELFServerWithOptions creates a server; zero option fields take their defaults
+func NewGELFServerWithOptions(ingestManager *ingest.IngestManager, options GELFOptions) *GELFServer {
+	defaults := DefaultGELFOptions()
+	if options.ChunkTimeout <= 0 {
+		options.ChunkTimeout = defaults.ChunkTimeout
+	}
+	if options.MaxPendingMessages <= 0 {
+		options.MaxPendingMessages = defaults.MaxPendingMessages
+	}
+	if options.MaxPendingBytes <= 0 {
+		options.MaxPendingBytes = defaults.MaxPendingBytes
+	}
+	return &GELFServer{ingestManager: ingestManager, options: options}
+}
+
+// Start listens on the UDP and TCP addresses, an empty one is skipped, and serves
+// in the background
+func (gs *GELFServer) Start(udpAddr, tcpAddr string) error {
+	if udpAddr != "" {
+		udp, err := net.ListenPacket("udp", udpAddr)
+		if err != nil {
+			return err
+		}
+		gs.udp = udp
+		gs.waitGroup.Add(1)
+		go gs.serveUDP()
+	}
+
+	if tcpAddr != "" {
+		tcp, err := listenTCP(tcpAddr, "GELF", gs.serveConn)
+		if err != nil {
+			gs.Stop()
+			return err
+		}
+		gs.tcp = tcp
+	}
+
+	return nil
+}
+
+// UDPAddr is the address the UDP listener is bound to, nil without one
+func (gs *GELFServer) UDPAddr() net.Addr {
+	if gs.udp == nil {
+		return nil
+	}
+	return gs.udp.LocalAddr()
+}
+
+// TCPAddr is the address the TCP listener is bound to, nil without one
+func (gs *GELFServer) TCPAddr() net.Addr {
+	if gs.tcp == nil {
+		return nil
+	}
+	return gs.tcp.Addr()
+}
+
+// Stop closes the listeners and open connections and waits until they are done
+func (gs *GELFServer) Stop() {
+	if gs.udp != nil {
+		gs.udp.Close()
+	}
+	if gs.tcp != nil {
+		gs.tcp.Stop()
+	}
+	gs.waitGroup.Wait()
+}
+
+func (gs *GELFServer) serveUDP() {
+	defer gs.waitGroup.Done()
+
+	chunks := newGELFChunks(gs.options)
+	buf := make([]byte, maxGELFDatagram)
+
+	for {
+		// the deadline wakes the reader up to expire chunks when nothing arrives
+		gs.udp.SetReadDeadline(time.Now().Add(gs.options.ChunkTimeout))
+		n, addr, err := gs.udp.ReadFrom(buf)
+		now := time.Now()
+		chunks.expire(now)
+
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				log.Printf("[GELF] udp read failed: %v", err)
+			}
+			continue
+		}
+
+		datagram := buf[:n]
+		if n >= 2 && datagram[0] == 0x1e && datagram[1] == 0x0f {
+			message, err := chunks.add(datagram, now)
+			if err != nil {
+				log.Printf("[GELF] dropping chunk from %s: %v", addr, err)
+				continue
+			}
+			if message == nil {
+				continue
+			}
+			datagram = message
+		}
+
+		payload, err := gelfPayload(datagram)
+		if err != nil {
+			log.Printf("[GELF] dropping message from %s: %v", addr, err)
+			continue
+		}
+		gs.ingest(payload, addr)
+	}
+}
+
+func (gs *GELFServer) serveConn(conn net.Conn) {
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxGELFMessage)
+	scanner.Split(scanNullTerminated)
+
+	for scanner.Scan() {
+		if message := bytes.TrimSpace(scanner.Bytes()); len(message) > 0 {
+			gs.ingest(message, conn.RemoteAddr())
+		}
+	}
+	if err := scanner.Err(); !closedError(err) {
+		log.Printf("[GELF] closing connection from %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// scanNullTerminated splits a stream into the frames ended by a null byte
+func scanNullTerminated(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// ingest parses one message and writes it
+func (gs *GELFServer) ingest(message []byte, from net.Addr) {
+	entry, err := ParseGELF(message)
+	if err == nil {
+		err = entry.Normalize(time.Now())
+	}
+	if err != nil {
+		log.Printf("[GELF] dropping message from %s: %v", from, err)
+		return
+	}
+	if err := gs.ingestManager.AppendLog(entry); err != nil {
+		log.Printf("[GELF] writing message failed: %v", err)
+	}
+}
+
+// gelfChunks reassembles chunked messages; only the UDP reader uses it
+type gelfChunks struct {
+	options GELFOptions
+	pending map[[8]byte]*gelfChunkSet
+	bytes   int
+	expired time.Time // last expire pass
+}
+
+type gelfChunkSet struct {
+	chunks   [][]byte // by sequence number
+	received int
+	bytes    int
+	started  time.Time
+}
+
+func newGELFChunks(options GELFOptions) *gelfChunks {
+	return &gelfChunks{options: options, pending: make(map[[8]byte]*gelfChunkSet)}
+}
+
+// add stores one chunk and returns the whole message once all chunks arrived,
+// nil while some are missing
+func (chunks *gelfChunks) add(datagram []byte, now time.Time) ([]byte, error) {
+	if len(datagram) <= gelfChunkHeader {
+		return nil, fmt.Errorf("%w: chunk of %d bytes", ErrInvalidGELF, len(datagram))
+	}
+	id := [8]byte(datagram[2:10])
+	sequence, count := int(datagram[10]), int(datagram[11])
+	if count == 0 || count > maxGELFChunks || sequence >= count {
+		return nil, fmt.Errorf("%w: chunk %d of %d", ErrInvalidGELF, sequence, count)
+	}
+	data := datagram[gelfChunkHeader:]
+
+	set, ok := chunks.pending[id]
+	if !ok {
+		if len(chunks.pending) >= chunks.options.MaxPendingMessages {
+			chunks.dropOldest("too many incomplete messages")
+		}
+		set = &gelfChunkSet{chunks: make([][]byte, count), started: now}
+		chunks.pending[id] = set
+	}
+
+	if len(set.chunks) != count {
+		chunks.remove(id)
+		return nil, fmt.Errorf("%w: message %x sent with %d and %d chunks", ErrInvalidGELF, id, len(set.chunks), count)
+	}
+	if set.chunks[sequence] != nil {
+		return nil, nil // resent
+	}
+	if set.bytes+len(data) > maxGELFMessage {
+		chunks.remove(id)
+		return nil, fmt.Errorf("%w: message %x larger than %d bytes", ErrInvalidGELF, id, maxGELFMessage)
+	}
+
+	for chunks.bytes+len(data) > chunks.options.MaxPendingBytes && chunks.pending[id] == set {
+		chunks.dropOldest("incomplete messages over the byte limit")
+	}
+	if chunks.pending[id] != set {
+		return nil, fmt.Errorf("message %x doesn't fit in %d pending bytes", id, chunks.options.MaxPendingBytes)
+	}
+
+	set.chunks[sequence] = bytes.Clone(data)
+	set.received++
+	set.bytes += len(data)
+	chunks.bytes += len(data)
+
+	if set.received < count {
+		return nil, nil
+	}
+	chunks.remove(id)
+	return bytes.Join(set.chunks, nil), nil
+}
+
+// expire drops the messages still incomplete after the timeout
+func (chunks *gelfChunks) expire(now time.Time) {
+	if now.Sub(chunks.expired) < chunks.options.ChunkTimeout/10 {
+		return
+	}
+	chunks.expired = now
+
+	for id, set := range chunks.pending {
+		if now.Sub(set.started) >= chunks.options.ChunkTimeout {
+			chunks.drop(id, fmt.Sprintf("%d of %d chunks after %s", set.received, len(set.chunks), chunks.options.ChunkTimeout))
+		}
+	}
+}
+
+func (chunks *gelfChunks) dropOldest(reason string) {
+	var oldest [8]byte
+	var started time.Time
+	for id, set := range chunks.pending {
+		if started.IsZero() || set.started.Before(started) {
+			oldest, started = id, set.started
+		}
+	}
+	if !started.IsZero() {
+		chunks.drop(oldest, reason)
+	}
+}
+
+func (chunks *gelfChunks) drop(id [8]byte, reason string) {
+	chunks.remove(id)
+	log.Printf("[GELF] dropping incomplete message %x: %s", id, reason)
+}
+
+func (chunks *gelfChunks) remove(id [8]byte) {
+	if set, ok := chunks.pending[id]; ok {
+		delete(chunks.pending, id)
+		chunks.bytes -= set.bytes
+	}
+}
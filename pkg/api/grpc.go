@@ -0,0 +1,457 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/ingest"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/query"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+const (
+	maxGRPCMessage = 16 << 20
+	grpcQueryPage  = 100 // entries per QueryResponse
+	grpcService    = "/timberlog.v1.TimberLog/"
+)
+
+// gRPC status codes
+const (
+	grpcOK                = 0
+	grpcCanceled          = 1
+	grpcInvalidArgument   = 3
+	grpcDeadlineExceeded  = 4
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+	grpcUnavailable       = 14
+)
+
+// grpcStatus ends a call with a code other than OK
+type grpcStatus struct {
+	code    int
+	message string
+}
+
+func (status *grpcStatus) Error() string {
+	return status.message
+}
+
+func grpcErrorf(code int, format string, args ...any) error {
+	return &grpcStatus{code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// GRPCServer serves the TimberLog gRPC service of timberlog.proto over cleartext
+// HTTP/2 (h2c, what gRPC clients use without TLS), speaking the gRPC wire protocol
+// itself: length-prefixed messages, optionally gzip compressed, and the status in
+// the grpc-status and grpc-message trailers.
+type GRPCServer struct {
+	ingestManager *ingest.IngestManager
+	queryEngine   *query.QueryEngine
+	tailHub       *query.TailHub // nil answers Tail with UNIMPLEMENTED
+	server        *http.Server
+	listener      net.Listener
+}
+
+func NewGRPCServer(ingestManager *ingest.IngestManager, queryEngine *query.QueryEngine, tailHub *query.TailHub) *GRPCServer {
+	return &GRPCServer{ingestManager: ingestManager, queryEngine: queryEngine, tailHub: tailHub}
+}
+
+// Handler serves the service methods, it needs an HTTP/2 server
+func (gs *GRPCServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+grpcService+"Write", gs.method(gs.write))
+	mux.HandleFunc("POST "+grpcService+"Query", gs.method(gs.query))
+	mux.HandleFunc("POST "+grpcService+"Tail", gs.method(gs.tail))
+	mux.HandleFunc("POST "+grpcService+"Stats", gs.method(gs.stats))
+	return mux
+}
+
+// Start listens on addr and serves in the background
+func (gs *GRPCServer) Start(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	gs.server = &http.Server{Handler: gs.Handler(), Protocols: &protocols}
+	gs.listener = listener
+
+	go func() {
+		if err := gs.server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("[GRPC] serving stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Addr is the address the listener is bound to
+func (gs *GRPCServer) Addr() net.Addr {
+	return gs.listener.Addr()
+}
+
+// Stop closes the listener and all connections, ending open streams
+func (gs *GRPCServer) Stop() {
+	gs.server.Close()
+}
+
+// method adapts a service method to HTTP: it checks the request, sends the response
+// headers and ends the call with the status of the error handle returns
+func (gs *GRPCServer) method(handle func(stream *grpcStream) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			http.Error(w, "expected Content-Type application/grpc", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Accept-Encoding", "gzip")
+		w.WriteHeader(http.StatusOK)
+
+		ctx := r.Context()
+		var err error
+		switch encoding := r.Header.Get("Grpc-Encoding"); encoding {
+		case "", "identity", "gzip":
+		default:
+			err = grpcErrorf(grpcUnimplemented, "unsupported grpc-encoding %q", encoding)
+		}
+		if timeout := r.Header.Get("Grpc-Timeout"); err == nil && timeout != "" {
+			if duration, ok := parseGRPCTimeout(timeout); ok {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, duration)
+				defer cancel()
+			} else {
+				err = grpcErrorf(grpcInvalidArgument, "invalid grpc-timeout %q", timeout)
+			}
+		}
+
+		if err == nil {
+			controller := http.NewResponseController(w)
+			controller.EnableFullDuplex() // HTTP/2 always is, HTTP/1 only on request
+			controller.Flush()
+
+			err = handle(&grpcStream{
+				ctx:        ctx,
+				body:       r.Body,
+				writer:     w,
+				controller: controller,
+				gzip:       r.Header.Get("Grpc-Encoding") == "gzip",
+			})
+		}
+
+		code, message := grpcCode(ctx, err)
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+		if message != "" {
+			w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcEscape(message))
+		}
+	}
+}
+
+// grpcCode maps the error a method returned onto a status; errors that aren't a
+// grpcStatus are INTERNAL unless the call was cancelled or timed out
+func grpcCode(ctx context.Context, err error) (int, string) {
+	var status *grpcStatus
+	switch {
+	case err == nil:
+		return grpcOK, ""
+	case errors.As(err, &status):
+		return status.code, status.message
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return grpcDeadlineExceeded, "deadline exceeded"
+	case ctx.Err() != nil:
+		return grpcCanceled, "cancelled"
+	}
+	return grpcInternal, err.Error()
+}
+
+// grpcStream reads request messages and sends response messages of one call
+type grpcStream struct {
+	ctx        context.Context
+	body       io.Reader
+	writer     http.ResponseWriter
+	controller *http.ResponseController
+	gzip       bool // compressed messages are gzip
+}
+
+// Recv reads the next message, io.EOF once the client closed its side
+func (stream *grpcStream) Recv() ([]byte, error) {
+	var prefix [5]byte // compressed flag, big endian length
+	if _, err := io.ReadFull(stream.body, prefix[:]); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(prefix[1:])
+	if length > maxGRPCMessage {
+		return nil, grpcErrorf(grpcResourceExhausted, "message of %d bytes, the limit is %d", length, maxGRPCMessage)
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(stream.body, message); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	switch {
+	case prefix[0] == 0:
+		return message, nil
+	case prefix[0] == 1 && !stream.gzip:
+		return nil, grpcErrorf(grpcInternal, "compressed message without grpc-encoding")
+	case prefix[0] == 1:
+		reader, err := gzip.NewReader(bytes.NewReader(message))
+		if err != nil {
+			return nil, grpcErrorf(grpcInternal, "gzip: %v", err)
+		}
+		message, err = io.ReadAll(io.LimitReader(reader, maxGRPCMessage+1))
+		if err != nil {
+			return nil, grpcErrorf(grpcInternal, "gzip: %v", err)
+		}
+		if len(message) > maxGRPCMessage {
+			return nil, grpcErrorf(grpcResourceExhausted, "message larger than %d bytes", maxGRPCMessage)
+		}
+		return message, nil
+	}
+	return nil, grpcErrorf(grpcInternal, "invalid compressed flag %d", prefix[0])
+}
+
+// RecvRequest reads the single request message of a unary or server streaming call
+func (stream *grpcStream) RecvRequest() ([]byte, error) {
+	message, err := stream.Recv()
+	if err == io.EOF {
+		return nil, grpcErrorf(grpcInvalidArgument, "missing request message")
+	}
+	return message, err
+}
+
+// Send writes a message and flushes it to the client
+func (stream *grpcStream) Send(message []byte) error {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	if _, err := stream.writer.Write(append(frame, message...)); err != nil {
+		return err
+	}
+	return stream.controller.Flush()
+}
+
+// write acknowledges every batch once its valid entries are durable in the WAL
+func (gs *GRPCServer) write(stream *grpcStream) error {
+	for batch := uint64(1); ; batch++ {
+		message, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		entries, err := decodeWriteRequest(message)
+		if err != nil {
+			return grpcErrorf(grpcInvalidArgument, "batch %d: %v", batch, err)
+		}
+
+		now := time.Now()
+		ack := writeAck{batch: batch}
+		valid := make([]*types.LogEntry, 0, len(entries))
+		for i, entry := range entries {
+			if err := entry.Normalize(now); err != nil {
+				ack.rejected = append(ack.rejected, rejectedEntry{index: i, err: err.Error()})
+				continue
+			}
+			valid = append(valid, entry)
+		}
+
+		if len(valid) > 0 {
+			if err := gs.ingestManager.AppendLogs(valid); err != nil {
+				return grpcErrorf(grpcUnavailable, "writing batch %d failed: %v", batch, err)
+			}
+			if err := gs.ingestManager.Sync(); err != nil {
+				return grpcErrorf(grpcUnavailable, "syncing batch %d failed: %v", batch, err)
+			}
+		}
+		ack.accepted = len(valid)
+
+		if err := stream.Send(ack.encode()); err != nil {
+			return err
+		}
+	}
+}
+
+// query streams the matches in pages, the stats follow the last one
+func (gs *GRPCServer) query(stream *grpcStream) error {
+	message, err := stream.RecvRequest()
+	if err != nil {
+		return err
+	}
+	q, err := decodeQueryRequest(message)
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+
+	page := make([]types.LogEntry, 0, grpcQueryPage)
+	stats, err := gs.queryEngine.Stream(q, func(entry types.LogEntry) error {
+		if err := stream.ctx.Err(); err != nil {
+			return err
+		}
+		page = append(page, entry)
+		if len(page) < grpcQueryPage {
+			return nil
+		}
+		err := stream.Send(encodeQueryResponse(page, nil))
+		page = page[:0]
+		return err
+	})
+	if err != nil {
+		return queryStatus(err)
+	}
+	return stream.Send(encodeQueryResponse(page, stats))
+}
+
+// tail sends the most recent stored matches, oldest first, then follows new ones
+// like TailHandler does
+func (gs *GRPCServer) tail(stream *grpcStream) error {
+	if gs.tailHub == nil {
+		return grpcErrorf(grpcUnimplemented, "tail is not enabled")
+	}
+
+	message, err := stream.RecvRequest()
+	if err != nil {
+		return err
+	}
+	request, err := decodeTailRequest(message)
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+
+	var subscription *query.Subscription
+	switch request.onFull {
+	case 0:
+		subscription, err = gs.tailHub.Subscribe(request.expression)
+	case 1:
+		subscription, err = gs.tailHub.SubscribeWithPolicy(request.expression, query.DropEntries)
+	case 2:
+		subscription, err = gs.tailHub.SubscribeWithPolicy(request.expression, query.Disconnect)
+	default:
+		return grpcErrorf(grpcInvalidArgument, "unknown on_full %d", request.onFull)
+	}
+	if err != nil {
+		return queryStatus(err)
+	}
+	defer subscription.Close()
+
+	recent, err := tailBackfill(gs.queryEngine, subscription, request.expression, int(min(request.backfill, maxTailBackfill)))
+	if err != nil {
+		return queryStatus(err)
+	}
+
+	sent := make(map[string]bool, len(recent))
+	for i := range recent {
+		sent[entryKey(recent[i])] = true
+		if err := stream.Send(encodeTailResponse(&recent[i], 0)); err != nil {
+			return err
+		}
+	}
+
+	heartbeat := time.NewTicker(tailHeartbeat)
+	defer heartbeat.Stop()
+
+	var reported int64
+	for {
+		select {
+		case <-stream.ctx.Done():
+			return stream.ctx.Err()
+
+		case entry, ok := <-subscription.Entries:
+			if !ok {
+				if err := subscription.Err(); err != nil {
+					return grpcErrorf(grpcResourceExhausted, "%v", err)
+				}
+				return nil
+			}
+
+			if len(sent) > 0 {
+				key := entryKey(entry)
+				if sent[key] {
+					delete(sent, key)
+					continue
+				}
+			}
+
+			reported = subscription.Dropped()
+			if err := stream.Send(encodeTailResponse(&entry, reported)); err != nil {
+				return err
+			}
+
+		case <-heartbeat.C:
+			if dropped := subscription.Dropped(); dropped != reported {
+				reported = dropped
+				if err := stream.Send(encodeTailResponse(nil, dropped)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func (gs *GRPCServer) stats(stream *grpcStream) error {
+	if _, err := stream.RecvRequest(); err != nil {
+		return err
+	}
+
+	subscribers := 0
+	if gs.tailHub != nil {
+		subscribers = gs.tailHub.Subscribers()
+	}
+	return stream.Send(encodeStatsResponse(gs.queryEngine.Stats(), gs.ingestManager.Buffered(), subscribers))
+}
+
+// queryStatus is INVALID_ARGUMENT for mistakes in the query, like queryError's 400
+func queryStatus(err error) error {
+	if invalidQuery(err) {
+		return grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+	return err
+}
+
+// parseGRPCTimeout reads a grpc-timeout header: up to 8 digits and a unit
+func parseGRPCTimeout(value string) (time.Duration, bool) {
+	if len(value) < 2 || len(value) > 9 {
+		return 0, false
+	}
+	amount, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || amount < 0 {
+		return 0, false
+	}
+
+	units := map[byte]time.Duration{
+		'H': time.Hour, 'M': time.Minute, 'S': time.Second,
+		'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond,
+	}
+	unit, ok := units[value[len(value)-1]]
+	return time.Duration(amount) * unit, ok
+}
+
+// grpcEscape percent-encodes a grpc-message: bytes outside printable ASCII and '%'
+func grpcEscape(message string) string {
+	var builder strings.Builder
+	for i := 0; i < len(message); i++ {
+		if c := message[i]; c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&builder, "%%%02X", c)
+		} else {
+			builder.WriteByte(c)
+		}
+	}
+	return builder.String()
+}
@@ -0,0 +1,363 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/proto"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/query"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+// Encoding of the messages in timberlog.proto, field numbers follow the schema
+
+type writeAck struct {
+	batch    uint64
+	accepted int
+	rejected []rejectedEntry
+}
+
+type rejectedEntry struct {
+	index int
+	err   string
+}
+
+type tailRequest struct {
+	expression string
+	backfill   int64
+	onFull     int64 // TailRequest.OnFull
+}
+
+func (ack writeAck) encode() []byte {
+	var writer proto.Writer
+	writer.Varint(1, ack.batch)
+	writer.Varint(2, uint64(ack.accepted))
+	for _, rejected := range ack.rejected {
+		writer.Message(3, func(message *proto.Writer) {
+			message.Varint(1, uint64(rejected.index))
+			message.String(2, rejected.err)
+		})
+	}
+	return writer.Bytes()
+}
+
+// decodeWriteRequest reads the entries of a WriteRequest
+func decodeWriteRequest(data []byte) ([]*types.LogEntry, error) {
+	var entries []*types.LogEntry
+	err := proto.Walk(data, func(reader *proto.Reader, field int, wireType proto.WireType) (bool, error) {
+		if field != 1 || wireType != proto.Bytes {
+			return false, nil
+		}
+		message, err := reader.Bytes()
+		if err != nil {
+			return true, err
+		}
+		if len(entries) == maxBatchEntries {
+			return true, fmt.Errorf("more than %d entries", maxBatchEntries)
+		}
+		entry, err := decodeLogEntry(message)
+		entries = append(entries, entry)
+		return true, err
+	})
+	return entries, err
+}
+
+// decodeQueryRequest reads a QueryRequest
+func decodeQueryRequest(data []byte) (*query.Query, error) {
+	q := &query.Query{}
+	err := proto.Walk(data, func(reader *proto.Reader, field int, wireType proto.WireType) (bool, error) {
+		var err error
+		var number uint64
+		switch {
+		case field == 1 && wireType == proto.Bytes:
+			q.Expression, err = reader.String()
+		case field == 6 && wireType == proto.Bytes:
+			q.Cursor, err = reader.String()
+		case field >= 2 && field <= 5 && wireType == proto.Varint:
+			number, err = reader.Varint()
+			switch field {
+			case 2:
+				q.StartTime = int64(number)
+			case 3:
+				q.EndTime = int64(number)
+			case 4:
+				q.Limit = int(int32(number))
+			case 5:
+				q.SortAsc = number != 0
+			}
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+	return q, err
+}
+
+func encodeQueryResponse(entries []types.LogEntry, stats *query.QueryStats) []byte {
+	var writer proto.Writer
+	for i := range entries {
+		writer.Message(1, func(message *proto.Writer) { encodeLogEntry(message, &entries[i]) })
+	}
+	if stats != nil {
+		writer.Message(2, func(message *proto.Writer) {
+			message.Varint(1, uint64(stats.Count))
+			message.Varint(2, uint64(stats.SegmentsRead))
+			message.Varint(3, uint64(stats.TookMillis))
+			if stats.NextCursor != "" {
+				message.String(4, stats.NextCursor)
+			}
+		})
+	}
+	return writer.Bytes()
+}
+
+func decodeTailRequest(data []byte) (tailRequest, error) {
+	var request tailRequest
+	err := proto.Walk(data, func(reader *proto.Reader, field int, wireType proto.WireType) (bool, error) {
+		var err error
+		var number uint64
+		switch {
+		case field == 1 && wireType == proto.Bytes:
+			request.expression, err = reader.String()
+		case (field == 2 || field == 3) && wireType == proto.Varint:
+			number, err = reader.Varint()
+			if field == 2 {
+				request.backfill = int64(int32(number))
+			} else {
+				request.onFull = int64(number)
+			}
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+	return request, err
+}
+
+// encodeTailResponse writes a TailResponse, without an entry when entry is nil
+func encodeTailResponse(entry *types.LogEntry, dropped int64) []byte {
+	var writer proto.Writer
+	if entry != nil {
+		writer.Message(1, func(message *proto.Writer) { encodeLogEntry(message, entry) })
+	}
+	if dropped > 0 {
+		writer.Varint(2, uint64(dropped))
+	}
+	return writer.Bytes()
+}
+
+func encodeStatsResponse(stats query.StorageStats, buffered, subscribers int) []byte {
+	var writer proto.Writer
+	writer.Varint(1, uint64(stats.Segments))
+	writer.Varint(2, uint64(stats.Bytes))
+	writer.Varint(3, uint64(stats.OldestTimestamp))
+	writer.Varint(4, uint64(stats.NewestTimestamp))
+	for _, service := range stats.Services {
+		writer.String(5, service)
+	}
+	writer.Varint(6, uint64(buffered))
+	writer.Varint(7, uint64(subscribers))
+	return writer.Bytes()
+}
+
+func encodeLogEntry(writer *proto.Writer, entry *types.LogEntry) {
+	writer.Varint(1, uint64(entry.Timestamp))
+	writer.String(2, string(entry.Level))
+	writer.String(3, entry.Service)
+	writer.String(4, entry.Host)
+	writer.String(5, entry.Message)
+	writer.String(6, entry.StackTrace)
+	if len(entry.Properties) > 0 {
+		writer.Message(7, func(message *proto.Writer) { encodeStruct(message, entry.Properties) })
+	}
+}
+
+func decodeLogEntry(data []byte) (*types.LogEntry, error) {
+	entry := &types.LogEntry{}
+	err := proto.Walk(data, func(reader *proto.Reader, field int, wireType proto.WireType) (bool, error) {
+		if field == 1 && wireType == proto.Varint {
+			timestamp, err := reader.Varint()
+			entry.Timestamp = int64(timestamp)
+			return true, err
+		}
+		if wireType != proto.Bytes {
+			return false, nil
+		}
+
+		var err error
+		switch field {
+		case 2:
+			var level string
+			level, err = reader.String()
+			entry.Level = types.LogLevel(level)
+		case 3:
+			entry.Service, err = reader.String()
+		case 4:
+			entry.Host, err = reader.String()
+		case 5:
+			entry.Message, err = reader.String()
+		case 6:
+			entry.StackTrace, err = reader.String()
+		case 7:
+			var message []byte
+			if message, err = reader.Bytes(); err == nil {
+				entry.Properties, err = decodeStruct(message, 0)
+			}
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+	return entry, err
+}
+
+// google.protobuf.Struct holds its fields as map entries (1), each a key (1) and a
+// Value (2); a Value is one of null (1), number (2), string (3), bool (4), Struct (5)
+// or ListValue (6), the list holding Values (1).
+
+// maxValueDepth bounds the nesting of decoded properties
+const maxValueDepth = 100
+
+func encodeStruct(writer *proto.Writer, fields map[string]interface{}) {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		writer.Message(1, func(entry *proto.Writer) {
+			entry.String(1, key)
+			entry.Message(2, func(value *proto.Writer) { encodeValue(value, fields[key]) })
+		})
+	}
+}
+
+func encodeValue(writer *proto.Writer, value any) {
+	switch value := value.(type) {
+	case nil:
+		writer.Varint(1, 0)
+	case float64:
+		writer.Double(2, value)
+	case float32:
+		writer.Double(2, float64(value))
+	case int:
+		writer.Double(2, float64(value))
+	case int64:
+		writer.Double(2, float64(value))
+	case uint64:
+		writer.Double(2, float64(value))
+	case json.Number:
+		number, _ := value.Float64()
+		writer.Double(2, number)
+	case string:
+		writer.String(3, value)
+	case bool:
+		writer.Bool(4, value)
+	case map[string]interface{}:
+		writer.Message(5, func(message *proto.Writer) { encodeStruct(message, value) })
+	case []interface{}:
+		writer.Message(6, func(list *proto.Writer) {
+			for _, element := range value {
+				list.Message(1, func(message *proto.Writer) { encodeValue(message, element) })
+			}
+		})
+	default:
+		writer.String(3, toText(value))
+	}
+}
+
+func decodeStruct(data []byte, depth int) (map[string]interface{}, error) {
+	if depth > maxValueDepth {
+		return nil, fmt.Errorf("%w: properties nested deeper than %d", proto.ErrMalformed, maxValueDepth)
+	}
+	fields := map[string]interface{}{}
+	err := proto.Walk(data, func(reader *proto.Reader, field int, wireType proto.WireType) (bool, error) {
+		if field != 1 || wireType != proto.Bytes {
+			return false, nil
+		}
+		entry, err := reader.Bytes()
+		if err != nil {
+			return true, err
+		}
+
+		var key string
+		var value any
+		err = proto.Walk(entry, func(reader *proto.Reader, field int, wireType proto.WireType) (bool, error) {
+			if wireType != proto.Bytes {
+				return false, nil
+			}
+			var err error
+			switch field {
+			case 1:
+				key, err = reader.String()
+			case 2:
+				var message []byte
+				if message, err = reader.Bytes(); err == nil {
+					value, err = decodeValue(message, depth)
+				}
+			default:
+				return false, nil
+			}
+			return true, err
+		})
+		fields[key] = value
+		return true, err
+	})
+	return fields, err
+}
+
+func decodeValue(data []byte, depth int) (any, error) {
+	var value any
+	err := proto.Walk(data, func(reader *proto.Reader, field int, wireType proto.WireType) (bool, error) {
+		var err error
+		switch {
+		case field == 1 && wireType == proto.Varint:
+			_, err = reader.Varint()
+			value = nil
+		case field == 2 && wireType == proto.Fixed64:
+			value, err = reader.Double()
+		case field == 3 && wireType == proto.Bytes:
+			value, err = reader.String()
+		case field == 4 && wireType == proto.Varint:
+			var flag uint64
+			flag, err = reader.Varint()
+			value = flag != 0
+		case field == 5 && wireType == proto.Bytes:
+			var message []byte
+			if message, err = reader.Bytes(); err == nil {
+				value, err = decodeStruct(message, depth+1)
+			}
+		case field == 6 && wireType == proto.Bytes:
+			var message []byte
+			if message, err = reader.Bytes(); err == nil {
+				value, err = decodeList(message, depth+1)
+			}
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+	return value, err
+}
+
+func decodeList(data []byte, depth int) ([]interface{}, error) {
+	if depth > maxValueDepth {
+		return nil, fmt.Errorf("%w: properties nested deeper than %d", proto.ErrMalformed, maxValueDepth)
+	}
+	values := []interface{}{}
+	err := proto.Walk(data, func(reader *proto.Reader, field int, wireType proto.WireType) (bool, error) {
+		if field != 1 || wireType != proto.Bytes {
+			return false, nil
+		}
+		message, err := reader.Bytes()
+		if err != nil {
+			return true, err
+		}
+		value, err := decodeValue(message, depth)
+		values = append(values, value)
+		return true, err
+	})
+	return values, err
+}
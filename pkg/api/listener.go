@@ -0,0 +1,89 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+)
+
+// tcpListener accepts connections and serves each on its own goroutine until Stop
+type tcpListener struct {
+	listener    net.Listener
+	tag         string // log prefix, e.g. SYSLOG
+	connections map[net.Conn]struct{}
+	mutex       sync.Mutex
+	waitGroup   sync.WaitGroup
+}
+
+// listenTCP starts accepting on addr; serve owns the connection, it is closed once
+// serve returns
+func listenTCP(addr, tag string, serve func(net.Conn)) (*tcpListener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tcp := &tcpListener{
+		listener:    listener,
+		tag:         tag,
+		connections: make(map[net.Conn]struct{}),
+	}
+	tcp.waitGroup.Add(1)
+	go tcp.accept(serve)
+	return tcp, nil
+}
+
+func (tcp *tcpListener) accept(serve func(net.Conn)) {
+	defer tcp.waitGroup.Done()
+
+	for {
+		conn, err := tcp.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("[%s] accept failed: %v", tcp.tag, err)
+			}
+			return
+		}
+
+		tcp.mutex.Lock()
+		tcp.connections[conn] = struct{}{}
+		tcp.mutex.Unlock()
+
+		tcp.waitGroup.Add(1)
+		go func() {
+			defer tcp.waitGroup.Done()
+			defer func() {
+				tcp.mutex.Lock()
+				delete(tcp.connections, conn)
+				tcp.mutex.Unlock()
+				conn.Close()
+			}()
+			serve(conn)
+		}()
+	}
+}
+
+// Addr is the address the listener is bound to
+func (tcp *tcpListener) Addr() net.Addr {
+	return tcp.listener.Addr()
+}
+
+// Stop closes the listener and open connections and waits until they are served
+func (tcp *tcpListener) Stop() {
+	tcp.listener.Close()
+
+	tcp.mutex.Lock()
+	for conn := range tcp.connections {
+		conn.Close()
+	}
+	tcp.mutex.Unlock()
+
+	tcp.waitGroup.Wait()
+}
+
+// closedError tells whether a read failed only because the peer or Stop closed the connection
+func closedError(err error) bool {
+	return err == nil || errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF)
+}
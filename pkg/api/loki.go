@@ -0,0 +1,375 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/compress"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/proto"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+// Stream labels that fill the fixed LogEntry fields, the first one present wins.
+// A level label TimberLog doesn't know stays a property.
+var (
+	lokiServiceLabels = []string{"service_name", "service", "app", "job"}
+	lokiHostLabels    = []string{"host", "hostname", "node"}
+	lokiLevelLabels   = []string{"level", "detected_level", "severity"}
+)
+
+// lokiStream is one stream of a push request
+type lokiStream struct {
+	labels  map[string]string
+	entries []lokiEntry
+}
+
+type lokiEntry struct {
+	timestamp int64 // unix nanoseconds
+	line      string
+	metadata  map[string]string // structured metadata
+}
+
+// LokiPushHandler is the Loki push API (POST /loki/api/v1/push) as Promtail and the
+// Grafana Agent speak it: a snappy compressed protobuf PushRequest, or JSON with
+// Content-Type: application/json. Every line becomes an entry labelled with its
+// stream. Like Loki it answers 204, 400 when entries were rejected (the valid ones
+// are still written) and 500 when the write failed, which clients retry.
+func (ws *WriteServer) LokiPushHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := requestBody(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(&limitChecked{reader: body})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var streams []lokiStream
+	if contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); contentType == "application/json" {
+		streams, err = decodeLokiJSON(data)
+	} else {
+		streams, err = decodeLokiProto(data)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid push request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	var entries []*types.LogEntry
+	rejected, firstError := 0, ""
+	for _, stream := range streams {
+		for _, line := range stream.entries {
+			entry := stream.entry(line)
+			if err := entry.Normalize(now); err != nil {
+				if rejected == 0 {
+					firstError = err.Error()
+				}
+				rejected++
+				continue
+			}
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries)+rejected > maxBatchEntries {
+		http.Error(w, fmt.Sprintf("more than %d entries", maxBatchEntries), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if len(entries) > 0 {
+		if err := ws.ingestManager.AppendLogs(entries); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if rejected > 0 {
+		http.Error(w, fmt.Sprintf("%d entries rejected, first: %s", rejected, firstError), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// entry maps one line of the stream onto a LogEntry; labels that aren't Service,
+// Host or Level become properties, then the line's structured metadata
+func (stream lokiStream) entry(line lokiEntry) *types.LogEntry {
+	entry := &types.LogEntry{
+		Timestamp:  line.timestamp / int64(time.Millisecond),
+		Message:    line.line,
+		Properties: make(map[string]interface{}, len(stream.labels)+len(line.metadata)),
+	}
+
+	taken := map[string]bool{}
+	if name, ok := firstLabel(stream.labels, lokiServiceLabels); ok {
+		entry.Service, taken[name] = stream.labels[name], true
+	}
+	if name, ok := firstLabel(stream.labels, lokiHostLabels); ok {
+		entry.Host, taken[name] = stream.labels[name], true
+	}
+	if name, ok := firstLabel(stream.labels, lokiLevelLabels); ok {
+		if level, known := types.ParseLogLevel(stream.labels[name]); known {
+			entry.Level, taken[name] = level, true
+		}
+	}
+
+	for name, value := range stream.labels {
+		if !taken[name] {
+			entry.Properties[name] = value
+		}
+	}
+	for name, value := range line.metadata {
+		entry.Properties[name] = value
+	}
+	return entry
+}
+
+func firstLabel(labels map[string]string, names []string) (string, bool) {
+	for _, name := range names {
+		if _, ok := labels[name]; ok {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// decodeLokiProto decodes a snappy compressed logproto.PushRequest:
+//
+//	PushRequest  { repeated Stream streams = 1; }
+//	Stream       { string labels = 1; repeated Entry entries = 2; }
+//	Entry        { Timestamp timestamp = 1; string line = 2; repeated LabelPair structuredMetadata = 3; }
+//	Timestamp    { int64 seconds = 1; int32 nanos = 2; }
+//	LabelPair    { string name = 1; string value = 2; }
+func decodeLokiProto(data []byte) ([]lokiStream, error) {
+	size, err := compress.DecodedLen(data)
+	if err != nil {
+		return nil, fmt.Errorf("snappy: %w", err)
+	}
+	if size > maxBatchBytes {
+		return nil, fmt.Errorf("request body larger than %d bytes", maxBatchBytes)
+	}
+	if data, err = compress.Decode(data); err != nil {
+		return nil, fmt.Errorf("snappy: %w", err)
+	}
+
+	var streams []lokiStream
+	err = proto.Walk(data, func(reader *proto.Reader, field int, wireType proto.WireType) (bool, error) {
+		if field != 1 || wireType != proto.Bytes {
+			return false, nil
+		}
+		message, err := reader.Bytes()
+		if err != nil {
+			return true, err
+		}
+		stream, err := decodeLokiStream(message)
+		streams = append(streams, stream)
+		return true, err
+	})
+	return streams, err
+}
+
+func decodeLokiStream(data []byte) (lokiStream, error) {
+	var stream lokiStream
+
+	err := proto.Walk(data, func(reader *proto.Reader, field int, wireType proto.WireType) (bool, error) {
+		if wireType != proto.Bytes {
+			return false, nil
+		}
+
+		switch field {
+		case 1:
+			text, err := reader.String()
+			if err != nil {
+				return true, err
+			}
+			stream.labels, err = parseLokiLabels(text)
+			return true, err
+
+		case 2:
+			message, err := reader.Bytes()
+			if err != nil {
+				return true, err
+			}
+			entry := lokiEntry{}
+			err = proto.Walk(message, func(reader *proto.Reader, field int, wireType proto.WireType) (bool, error) {
+				if wireType != proto.Bytes {
+					return false, nil
+				}
+				var err error
+				switch field {
+				case 1:
+					var timestamp []byte
+					if timestamp, err = reader.Bytes(); err == nil {
+						entry.timestamp, err = decodeProtoTimestamp(timestamp)
+					}
+				case 2:
+					entry.line, err = reader.String()
+				case 3:
+					var pair []byte
+					if pair, err = reader.Bytes(); err == nil {
+						err = decodeLabelPair(pair, &entry.metadata)
+					}
+				default:
+					return false, nil
+				}
+				return true, err
+			})
+			stream.entries = append(stream.entries, entry)
+			return true, err
+		}
+		return false, nil
+	})
+
+	return stream, err
+}
+
+// decodeProtoTimestamp reads a google.protobuf.Timestamp as unix nanoseconds
+func decodeProtoTimestamp(data []byte) (int64, error) {
+	var seconds, nanos int64
+	err := proto.Walk(data, func(reader *proto.Reader, field int, wireType proto.WireType) (bool, error) {
+		if wireType != proto.Varint || (field != 1 && field != 2) {
+			return false, nil
+		}
+		value, err := reader.Varint()
+		if field == 1 {
+			seconds = int64(value)
+		} else {
+			nanos = int64(int32(value))
+		}
+		return true, err
+	})
+	return seconds*int64(time.Second) + nanos, err
+}
+
+func decodeLabelPair(data []byte, labels *map[string]string) error {
+	var name, value string
+	err := proto.Walk(data, func(reader *proto.Reader, field int, wireType proto.WireType) (bool, error) {
+		if wireType != proto.Bytes || (field != 1 && field != 2) {
+			return false, nil
+		}
+		text, err := reader.String()
+		if field == 1 {
+			name = text
+		} else {
+			value = text
+		}
+		return true, err
+	})
+
+	if err == nil && name != "" {
+		if *labels == nil {
+			*labels = map[string]string{}
+		}
+		(*labels)[name] = value
+	}
+	return err
+}
+
+// parseLokiLabels parses a label set as Prometheus writes it: {name="value", ...}
+// with Go string escapes in the values
+func parseLokiLabels(text string) (map[string]string, error) {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "{") || !strings.HasSuffix(text, "}") {
+		return nil, fmt.Errorf("labels %q are not in braces", text)
+	}
+	rest := text[1 : len(text)-1]
+	labels := map[string]string{}
+
+	for {
+		rest = strings.TrimLeft(rest, " ,")
+		if rest == "" {
+			return labels, nil
+		}
+
+		name, value, ok := strings.Cut(rest, "=")
+		name = strings.TrimSpace(name)
+		value = strings.TrimLeft(value, " ")
+		if !ok || name == "" || !strings.HasPrefix(value, `"`) {
+			return nil, fmt.Errorf("malformed labels %q", text)
+		}
+
+		// the closing quote is the first one not escaped
+		end := 1
+		for end < len(value) && value[end] != '"' {
+			if value[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(value) {
+			return nil, fmt.Errorf("unterminated label value in %q", text)
+		}
+		unquoted, err := strconv.Unquote(value[:end+1])
+		if err != nil {
+			return nil, fmt.Errorf("label %s: %w", name, err)
+		}
+
+		labels[name] = unquoted
+		rest = value[end+1:]
+	}
+}
+
+// Loki's JSON push body:
+//
+//	{"streams": [{"stream": {"label": "value"}, "values": [["<unix ns>", "<line>", {<metadata>}]]}]}
+type lokiJSONRequest struct {
+	Streams []struct {
+		Stream map[string]string   `json:"stream"`
+		Values [][]json.RawMessage `json:"values"`
+	} `json:"streams"`
+}
+
+func decodeLokiJSON(data []byte) ([]lokiStream, error) {
+	var request lokiJSONRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		return nil, err
+	}
+
+	streams := make([]lokiStream, 0, len(request.Streams))
+	for _, jsonStream := range request.Streams {
+		stream := lokiStream{labels: jsonStream.Stream}
+
+		for _, value := range jsonStream.Values {
+			if len(value) < 2 || len(value) > 3 {
+				return nil, errors.New("a value must be [timestamp, line] or [timestamp, line, metadata]")
+			}
+
+			var timestamp string
+			var entry lokiEntry
+			if err := json.Unmarshal(value[0], &timestamp); err != nil {
+				return nil, fmt.Errorf("timestamp must be a string of unix nanoseconds: %s", value[0])
+			}
+			nanos, err := strconv.ParseInt(timestamp, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("timestamp must be a string of unix nanoseconds: %s", value[0])
+			}
+			entry.timestamp = nanos
+			if err := json.Unmarshal(value[1], &entry.line); err != nil {
+				return nil, fmt.Errorf("line must be a string: %s", value[1])
+			}
+			if len(value) == 3 {
+				if err := json.Unmarshal(value[2], &entry.metadata); err != nil {
+					return nil, fmt.Errorf("structured metadata must map strings to strings: %s", value[2])
+				}
+			}
+			stream.entries = append(stream.entries, entry)
+		}
+		streams = append(streams, stream)
+	}
+	return streams, nil
+}
@@ -0,0 +1,198 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/proto"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+// OTLPLogsHandler is the OTLP/HTTP logs endpoint (POST /v1/logs). It takes an
+// ExportLogsServiceRequest as application/x-protobuf or application/json, optionally
+// gzipped, and answers in the same encoding. Records that don't make a valid entry
+// are reported as a partial success; a failed write is a 503 so exporters retry.
+func (ws *WriteServer) OTLPLogsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var decode func([]byte) ([]otlpResourceLogs, error)
+	switch contentType {
+	case "application/x-protobuf":
+		decode = decodeOTLPProto
+	case "application/json":
+		decode = decodeOTLPJSON
+	default:
+		http.Error(w, "use application/x-protobuf or application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := requestBody(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(&limitChecked{reader: body})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resources, err := decode(data)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid ExportLogsServiceRequest: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	entries, rejected, firstError := otlpEntries(resources, time.Now())
+	if len(entries)+rejected > maxBatchEntries {
+		http.Error(w, fmt.Sprintf("more than %d log records", maxBatchEntries), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if len(entries) > 0 {
+		if err := ws.ingestManager.AppendLogs(entries); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	writeOTLPResponse(w, contentType, rejected, firstError)
+}
+
+// otlpEntries maps every record onto a LogEntry, counting the ones that are invalid
+func otlpEntries(resources []otlpResourceLogs, now time.Time) ([]*types.LogEntry, int, string) {
+	var entries []*types.LogEntry
+	rejected, firstError := 0, ""
+
+	for _, resource := range resources {
+		for _, record := range resource.records {
+			entry := record.entry(resource.attributes)
+			if err := entry.Normalize(now); err != nil {
+				if rejected == 0 {
+					firstError = err.Error()
+				}
+				rejected++
+				continue
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, rejected, firstError
+}
+
+// entry maps the record: service.name and host.name of the resource become Service
+// and Host, the other resource attributes and the record's own attributes (which win)
+// Properties, along with trace_id and span_id
+func (record otlpLogRecord) entry(resource map[string]any) *types.LogEntry {
+	entry := &types.LogEntry{
+		Level:      otlpLevel(record.severityNumber, record.severityText),
+		Properties: make(map[string]interface{}, len(resource)+len(record.attributes)+2),
+	}
+
+	switch {
+	case record.timeUnixNano > 0:
+		entry.Timestamp = record.timeUnixNano / int64(time.Millisecond)
+	case record.observedTimeUnixNano > 0:
+		entry.Timestamp = record.observedTimeUnixNano / int64(time.Millisecond)
+	}
+
+	for key, value := range resource {
+		switch key {
+		case "service.name":
+			entry.Service = toText(value)
+		case "host.name":
+			entry.Host = toText(value)
+		default:
+			entry.Properties[key] = value
+		}
+	}
+	for key, value := range record.attributes {
+		entry.Properties[key] = value
+	}
+	if record.traceID != "" {
+		entry.Properties["trace_id"] = record.traceID
+	}
+	if record.spanID != "" {
+		entry.Properties["span_id"] = record.spanID
+	}
+
+	switch body := record.body.(type) {
+	case nil:
+	case string:
+		entry.Message = body
+	default:
+		// structured bodies are kept as their JSON text
+		data, _ := json.Marshal(body)
+		entry.Message = string(data)
+	}
+
+	return entry
+}
+
+// otlpLevel maps a SeverityNumber range (TRACE 1-4 ... FATAL 21-24) onto a level,
+// falling back to the severity text and then INFO when the number is unspecified
+func otlpLevel(number int64, text string) types.LogLevel {
+	switch {
+	case number >= 21:
+		return types.Fatal
+	case number >= 17:
+		return types.Error
+	case number >= 13:
+		return types.Warn
+	case number >= 9:
+		return types.Info
+	case number >= 1:
+		return types.Debug
+	}
+
+	if level, ok := types.ParseLogLevel(text); ok {
+		return level
+	}
+	return types.Info
+}
+
+func toText(value any) string {
+	if text, ok := value.(string); ok {
+		return text
+	}
+	return fmt.Sprint(value)
+}
+
+// writeOTLPResponse writes an ExportLogsServiceResponse, with partial_success
+// (rejected_log_records = 1, error_message = 2) when records were rejected
+func writeOTLPResponse(w http.ResponseWriter, contentType string, rejected int, message string) {
+	w.Header().Set("Content-Type", contentType)
+
+	if contentType == "application/json" {
+		response := map[string]any{}
+		if rejected > 0 {
+			response["partialSuccess"] = map[string]string{
+				"rejectedLogRecords": strconv.Itoa(rejected),
+				"errorMessage":       message,
+			}
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	var writer proto.Writer
+	if rejected > 0 {
+		writer.Message(1, func(partial *proto.Writer) {
+			partial.Varint(1, uint64(rejected))
+			partial.String(2, message)
+		})
+	}
+	w.Write(writer.Bytes())
+}
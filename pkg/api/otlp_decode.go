@@ -0,0 +1,410 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/proto"
+)
+
+// Decoding of opentelemetry/proto/collector/logs/v1 ExportLogsServiceRequest, in the
+// protobuf and the OTLP JSON encoding, into the few parts TimberLog keeps. Scopes are
+// flattened into their resource.
+
+// otlpResourceLogs are the records sent for one resource
+type otlpResourceLogs struct {
+	attributes map[string]any
+	records    []otlpLogRecord
+}
+
+// otlpLogRecord is one LogRecord
+type otlpLogRecord struct {
+	timeUnixNano         int64
+	observedTimeUnixNano int64
+	severityNumber       int64
+	severityText         string
+	body                 any // nil when unset
+	attributes           map[string]any
+	traceID              string // hex, empty when unset
+	spanID               string
+}
+
+// decodeOTLPProto decodes a protobuf ExportLogsServiceRequest
+func decodeOTLPProto(data []byte) ([]otlpResourceLogs, error) {
+	var resources []otlpResourceLogs
+
+	err := proto.Walk(data, func(reader *proto.Reader, field int, wireType proto.WireType) (bool, error) {
+		if field != 1 || wireType != proto.Bytes {
+			return false, nil
+		}
+		message, err := reader.Bytes()
+		if err != nil {
+			return true, err
+		}
+		resource, err := decodeResourceLogs(message)
+		if err != nil {
+			return true, fmt.Errorf("resource_logs: %w", err)
+		}
+		resources = append(resources, resource)
+		return true, nil
+	})
+
+	return resources, err
+}
+
+// ResourceLogs: resource = 1, scope_logs = 2, and the deprecated
+// instrumentation_library_logs = 1000 which has the same layout as scope_logs
+func decodeResourceLogs(data []byte) (otlpResourceLogs, error) {
+	resource := otlpResourceLogs{attributes: map[string]any{}}
+
+	err := proto.Walk(data, func(reader *proto.Reader, field int, wireType proto.WireType) (bool, error) {
+		if wireType != proto.Bytes {
+			return false, nil
+		}
+
+		switch field {
+		case 1: // Resource: attributes = 1
+			message, err := reader.Bytes()
+			if err != nil {
+				return true, err
+			}
+			return true, decodeAttributes(message, 1, resource.attributes, 0)
+
+		case 2, 1000: // ScopeLogs: log_records = 2
+			message, err := reader.Bytes()
+			if err != nil {
+				return true, err
+			}
+			return true, proto.Walk(message, func(reader *proto.Reader, field int, wireType proto.WireType) (bool, error) {
+				if field != 2 || wireType != proto.Bytes {
+					return false, nil
+				}
+				message, err := reader.Bytes()
+				if err != nil {
+					return true, err
+				}
+				record, err := decodeLogRecord(message)
+				if err != nil {
+					return true, fmt.Errorf("log_record: %w", err)
+				}
+				resource.records = append(resource.records, record)
+				return true, nil
+			})
+		}
+		return false, nil
+	})
+
+	return resource, err
+}
+
+func decodeLogRecord(data []byte) (otlpLogRecord, error) {
+	record := otlpLogRecord{attributes: map[string]any{}}
+
+	err := proto.Walk(data, func(reader *proto.Reader, field int, wireType proto.WireType) (bool, error) {
+		var err error
+
+		switch {
+		case field == 1 && wireType == proto.Fixed64:
+			var nanos uint64
+			nanos, err = reader.Fixed64()
+			record.timeUnixNano = int64(nanos)
+		case field == 11 && wireType == proto.Fixed64:
+			var nanos uint64
+			nanos, err = reader.Fixed64()
+			record.observedTimeUnixNano = int64(nanos)
+		case field == 2 && wireType == proto.Varint:
+			var number uint64
+			number, err = reader.Varint()
+			record.severityNumber = int64(number)
+		case field == 3 && wireType == proto.Bytes:
+			record.severityText, err = reader.String()
+		case field == 5 && wireType == proto.Bytes:
+			var message []byte
+			if message, err = reader.Bytes(); err == nil {
+				record.body, err = decodeAnyValue(message, 0)
+			}
+		case field == 6 && wireType == proto.Bytes:
+			var message []byte
+			if message, err = reader.Bytes(); err == nil {
+				err = decodeKeyValue(message, record.attributes, 0)
+			}
+		case field == 9 && wireType == proto.Bytes:
+			var id []byte
+			id, err = reader.Bytes()
+			record.traceID = otlpID(id)
+		case field == 10 && wireType == proto.Bytes:
+			var id []byte
+			id, err = reader.Bytes()
+			record.spanID = otlpID(id)
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+
+	return record, err
+}
+
+// decodeAttributes adds the KeyValue messages found in field of data to attributes,
+// depth is the nesting of the values they sit in
+func decodeAttributes(data []byte, field int, attributes map[string]any, depth int) error {
+	return proto.Walk(data, func(reader *proto.Reader, number int, wireType proto.WireType) (bool, error) {
+		if number != field || wireType != proto.Bytes {
+			return false, nil
+		}
+		message, err := reader.Bytes()
+		if err != nil {
+			return true, err
+		}
+		return true, decodeKeyValue(message, attributes, depth)
+	})
+}
+
+// KeyValue: key = 1, value = 2
+func decodeKeyValue(data []byte, attributes map[string]any, depth int) error {
+	var key string
+	var value any
+
+	err := proto.Walk(data, func(reader *proto.Reader, field int, wireType proto.WireType) (bool, error) {
+		if wireType != proto.Bytes {
+			return false, nil
+		}
+		var err error
+		switch field {
+		case 1:
+			key, err = reader.String()
+		case 2:
+			var message []byte
+			if message, err = reader.Bytes(); err == nil {
+				value, err = decodeAnyValue(message, depth)
+			}
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+
+	if err == nil && key != "" {
+		attributes[key] = value
+	}
+	return err
+}
+
+// AnyValue is a oneof: string = 1, bool = 2, int64 = 3, double = 4, ArrayValue = 5,
+// KeyValueList = 6, bytes = 7. Arrays and lists hold their elements in field 1.
+func decodeAnyValue(data []byte, depth int) (any, error) {
+	if depth > maxValueDepth {
+		return nil, fmt.Errorf("%w: values nested deeper than %d", proto.ErrMalformed, maxValueDepth)
+	}
+	var value any
+
+	err := proto.Walk(data, func(reader *proto.Reader, field int, wireType proto.WireType) (bool, error) {
+		var err error
+
+		switch {
+		case field == 1 && wireType == proto.Bytes:
+			value, err = reader.String()
+		case field == 2 && wireType == proto.Varint:
+			var flag uint64
+			flag, err = reader.Varint()
+			value = flag != 0
+		case field == 3 && wireType == proto.Varint:
+			var number uint64
+			number, err = reader.Varint()
+			value = int64(number)
+		case field == 4 && wireType == proto.Fixed64:
+			value, err = reader.Double()
+		case field == 5 && wireType == proto.Bytes:
+			var message []byte
+			if message, err = reader.Bytes(); err != nil {
+				break
+			}
+			values := []any{}
+			err = proto.Walk(message, func(reader *proto.Reader, field int, wireType proto.WireType) (bool, error) {
+				if field != 1 || wireType != proto.Bytes {
+					return false, nil
+				}
+				element, err := reader.Bytes()
+				if err != nil {
+					return true, err
+				}
+				decoded, err := decodeAnyValue(element, depth+1)
+				values = append(values, decoded)
+				return true, err
+			})
+			value = values
+		case field == 6 && wireType == proto.Bytes:
+			var message []byte
+			if message, err = reader.Bytes(); err != nil {
+				break
+			}
+			values := map[string]any{}
+			err = decodeAttributes(message, 1, values, depth+1)
+			value = values
+		case field == 7 && wireType == proto.Bytes:
+			var raw []byte
+			raw, err = reader.Bytes()
+			value = base64.StdEncoding.EncodeToString(raw)
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+
+	return value, err
+}
+
+// otlpID is a trace or span id as hex, empty for a missing or all-zero (invalid) id
+func otlpID(id []byte) string {
+	for _, b := range id {
+		if b != 0 {
+			return hex.EncodeToString(id)
+		}
+	}
+	return ""
+}
+
+// OTLP JSON follows the protobuf JSON mapping with two exceptions: field names are
+// lowerCamelCase only and trace/span ids are hex instead of base64. 64-bit integers
+// may be sent as strings.
+
+type otlpJSONRequest struct {
+	ResourceLogs []struct {
+		Resource struct {
+			Attributes []otlpJSONKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeLogs []otlpJSONScopeLogs `json:"scopeLogs"`
+	} `json:"resourceLogs"`
+}
+
+type otlpJSONScopeLogs struct {
+	LogRecords []otlpJSONLogRecord `json:"logRecords"`
+}
+
+type otlpJSONLogRecord struct {
+	TimeUnixNano         otlpJSONInt        `json:"timeUnixNano"`
+	ObservedTimeUnixNano otlpJSONInt        `json:"observedTimeUnixNano"`
+	SeverityNumber       otlpJSONInt        `json:"severityNumber"`
+	SeverityText         string             `json:"severityText"`
+	Body                 *otlpJSONAnyValue  `json:"body"`
+	Attributes           []otlpJSONKeyValue `json:"attributes"`
+	TraceID              string             `json:"traceId"`
+	SpanID               string             `json:"spanId"`
+}
+
+type otlpJSONKeyValue struct {
+	Key   string           `json:"key"`
+	Value otlpJSONAnyValue `json:"value"`
+}
+
+type otlpJSONAnyValue struct {
+	StringValue *string      `json:"stringValue"`
+	BoolValue   *bool        `json:"boolValue"`
+	IntValue    *otlpJSONInt `json:"intValue"`
+	DoubleValue *float64     `json:"doubleValue"`
+	ArrayValue  *struct {
+		Values []otlpJSONAnyValue `json:"values"`
+	} `json:"arrayValue"`
+	KvlistValue *struct {
+		Values []otlpJSONKeyValue `json:"values"`
+	} `json:"kvlistValue"`
+	BytesValue *string `json:"bytesValue"` // base64
+}
+
+// otlpJSONInt is an integer sent as a JSON number or a decimal string
+type otlpJSONInt int64
+
+func (number *otlpJSONInt) UnmarshalJSON(data []byte) error {
+	text := strings.Trim(string(data), `"`)
+	if text == "" || text == "null" {
+		return nil
+	}
+	value, err := strconv.ParseInt(text, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid integer %s", data)
+	}
+	*number = otlpJSONInt(value)
+	return nil
+}
+
+// decodeOTLPJSON decodes a JSON ExportLogsServiceRequest
+func decodeOTLPJSON(data []byte) ([]otlpResourceLogs, error) {
+	var request otlpJSONRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		return nil, err
+	}
+
+	resources := make([]otlpResourceLogs, 0, len(request.ResourceLogs))
+	for _, resourceLogs := range request.ResourceLogs {
+		resource := otlpResourceLogs{attributes: jsonAttributes(resourceLogs.Resource.Attributes)}
+
+		for _, scope := range resourceLogs.ScopeLogs {
+			for _, logRecord := range scope.LogRecords {
+				record := otlpLogRecord{
+					timeUnixNano:         int64(logRecord.TimeUnixNano),
+					observedTimeUnixNano: int64(logRecord.ObservedTimeUnixNano),
+					severityNumber:       int64(logRecord.SeverityNumber),
+					severityText:         logRecord.SeverityText,
+					attributes:           jsonAttributes(logRecord.Attributes),
+				}
+				if logRecord.Body != nil {
+					record.body = logRecord.Body.value()
+				}
+
+				traceID, err := hex.DecodeString(logRecord.TraceID)
+				if err != nil {
+					return nil, fmt.Errorf("traceId: %w", err)
+				}
+				spanID, err := hex.DecodeString(logRecord.SpanID)
+				if err != nil {
+					return nil, fmt.Errorf("spanId: %w", err)
+				}
+				record.traceID, record.spanID = otlpID(traceID), otlpID(spanID)
+
+				resource.records = append(resource.records, record)
+			}
+		}
+		resources = append(resources, resource)
+	}
+
+	return resources, nil
+}
+
+func jsonAttributes(keyValues []otlpJSONKeyValue) map[string]any {
+	attributes := make(map[string]any, len(keyValues))
+	for _, keyValue := range keyValues {
+		if keyValue.Key != "" {
+			attributes[keyValue.Key] = keyValue.Value.value()
+		}
+	}
+	return attributes
+}
+
+// value returns the set member of the oneof, bytes stay base64
+func (anyValue *otlpJSONAnyValue) value() any {
+	switch {
+	case anyValue.StringValue != nil:
+		return *anyValue.StringValue
+	case anyValue.BoolValue != nil:
+		return *anyValue.BoolValue
+	case anyValue.IntValue != nil:
+		return int64(*anyValue.IntValue)
+	case anyValue.DoubleValue != nil:
+		return *anyValue.DoubleValue
+	case anyValue.ArrayValue != nil:
+		values := make([]any, 0, len(anyValue.ArrayValue.Values))
+		for _, element := range anyValue.ArrayValue.Values {
+			values = append(values, element.value())
+		}
+		return values
+	case anyValue.KvlistValue != nil:
+		return jsonAttributes(anyValue.KvlistValue.Values)
+	case anyValue.BytesValue != nil:
+		return *anyValue.BytesValue
+	}
+	return nil
+}
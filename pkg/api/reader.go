@@ -2,31 +2,67 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
+	"mime"
 	"net/http"
+	"strconv"
 
 	"github.com/mrsridharpadmanaben/TimberLog/pkg/query"
 )
 
 type QueryServer struct {
 	queryEngine *query.QueryEngine
+	tailHub     *query.TailHub // nil disables /tail
 }
 
 func NewQueryServer(queryEngine *query.QueryEngine) *QueryServer {
 	return &QueryServer{queryEngine: queryEngine}
 }
 
+// NewQueryServerWithTail also serves /tail, following the entries published to tailHub
+func NewQueryServerWithTail(queryEngine *query.QueryEngine, tailHub *query.TailHub) *QueryServer {
+	return &QueryServer{queryEngine: queryEngine, tailHub: tailHub}
+}
+
 // HTTP handler
 func (qs *QueryServer) QueryHandler(w http.ResponseWriter, r *http.Request) {
-	var query query.Query
-	if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+	q, err := decodeQuery(r)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	results, err := qs.queryEngine.Execute(&query)
+	if format := streamFormat(r); format != "" {
+		qs.streamQuery(w, r, q, format)
+		return
+	}
+
+	page, err := qs.queryEngine.ExecutePage(q)
+	if err != nil {
+		queryError(w, err)
+		return
+	}
+
+	// the body stays a plain array; pass the cursor back as "Cursor" or cursor= for the next page
+	if page.NextCursor != "" {
+		w.Header().Set("X-Next-Cursor", page.NextCursor)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page.Entries)
+}
+
+// AggregateHandler takes a query whose Aggregations are computed over all matches
+func (qs *QueryServer) AggregateHandler(w http.ResponseWriter, r *http.Request) {
+	q, err := decodeQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
+	results, err := qs.queryEngine.Aggregate(q)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		queryError(w, err)
 		return
 	}
 
@@ -34,9 +70,89 @@ func (qs *QueryServer) QueryHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(results)
 }
 
+// queryError answers 400 for mistakes in the query and 500 for everything else
+func queryError(w http.ResponseWriter, err error) {
+	if invalidQuery(err) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// invalidQuery tells whether a query failed because of the query itself
+func invalidQuery(err error) bool {
+	var parseError *query.ParseError
+	return errors.As(err, &parseError) || errors.Is(err, query.ErrInvalidFilter) || errors.Is(err, query.ErrInvalidAggregation) ||
+		errors.Is(err, query.ErrInvalidCursor)
+}
+
+// decodeQuery reads a query as JSON (query.Query), as a query string in a text/plain body,
+// or from the URL: q=<query string>&start=&end=&limit=&asc=&cursor=
+func decodeQuery(r *http.Request) (*query.Query, error) {
+	params := r.URL.Query()
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	if r.Method == http.MethodGet || params.Has("q") || mediaType == "text/plain" {
+		q := &query.Query{Expression: params.Get("q")}
+
+		if mediaType == "text/plain" {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				return nil, err
+			}
+			q.Expression = string(body)
+		}
+
+		var err error
+		if q.StartTime, err = intParam(params, "start"); err != nil {
+			return nil, err
+		}
+		if q.EndTime, err = intParam(params, "end"); err != nil {
+			return nil, err
+		}
+		limit, err := intParam(params, "limit")
+		if err != nil {
+			return nil, err
+		}
+		q.Limit = int(limit)
+		q.SortAsc = params.Get("asc") == "true"
+		q.Cursor = params.Get("cursor")
+		return q, nil
+	}
+
+	var q query.Query
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+// intParam parses an optional integer URL parameter
+func intParam(params map[string][]string, name string) (int64, error) {
+	values := params[name]
+	if len(values) == 0 || values[0] == "" {
+		return 0, nil
+	}
+
+	value, err := strconv.ParseInt(values[0], 10, 64)
+	if err != nil {
+		return 0, errors.New("invalid " + name + ": " + values[0])
+	}
+	return value, nil
+}
+
+// Handler routes the query endpoints, on a mux of their own so no other server exposes them
+func (qs *QueryServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/query", qs.QueryHandler)
+	mux.HandleFunc("/aggregate", qs.AggregateHandler)
+	if qs.tailHub != nil {
+		mux.HandleFunc("/tail", qs.TailHandler)
+	}
+	return mux
+}
+
 // Start server
 func (qs *QueryServer) Start(addr string) error {
-	http.HandleFunc("/query", qs.QueryHandler)
-
-	return http.ListenAndServe(addr, nil)
+	return http.ListenAndServe(addr, qs.Handler())
 }
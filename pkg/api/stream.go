@@ -0,0 +1,126 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/query"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+const (
+	mediaNDJSON = "application/x-ndjson"
+	mediaSSE    = "text/event-stream"
+)
+
+// streamTrailer ends a stream: stats when the query completed, the error when it didn't
+type streamTrailer struct {
+	Count        int    `json:"count"`
+	SegmentsRead int    `json:"segments_read"`
+	TookMillis   int64  `json:"took_ms"`
+	NextCursor   string `json:"next_cursor,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// streamFormat picks a streaming media type from the Accept header, "" for a JSON array
+func streamFormat(r *http.Request) string {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := mime.ParseMediaType(strings.TrimSpace(accepted))
+		switch mediaType {
+		case mediaNDJSON, "application/jsonl":
+			return mediaNDJSON
+		case mediaSSE:
+			return mediaSSE
+		}
+	}
+	return ""
+}
+
+// streamQuery writes results as they are read, one JSON object per line for NDJSON or
+// one "data:" event each for SSE, then a trailer: a {"trailer": {...}} line, or an
+// event named "trailer". Query errors found before the first row still get a 4xx/5xx.
+func (qs *QueryServer) streamQuery(w http.ResponseWriter, r *http.Request, q *query.Query, format string) {
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	started := false
+
+	start := func() {
+		if started {
+			return
+		}
+		started = true
+		w.Header().Set("Content-Type", format)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(http.StatusOK)
+	}
+
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	stats, err := qs.queryEngine.Stream(q, func(entry types.LogEntry) error {
+		// stop reading segments for a client that went away
+		if err := r.Context().Err(); err != nil {
+			return err
+		}
+		start()
+
+		var err error
+		if format == mediaSSE {
+			err = writeEvent(w, "", entry)
+		} else {
+			err = encoder.Encode(entry)
+		}
+		flush()
+		return err
+	})
+
+	if err != nil && !started {
+		queryError(w, err)
+		return
+	}
+	start()
+
+	trailer := streamTrailer{}
+	if stats != nil {
+		trailer.Count = stats.Count
+		trailer.SegmentsRead = stats.SegmentsRead
+		trailer.TookMillis = stats.TookMillis
+		trailer.NextCursor = stats.NextCursor
+	}
+	if err != nil {
+		trailer.Error = err.Error()
+	}
+
+	if format == mediaSSE {
+		writeEvent(w, "trailer", trailer)
+	} else {
+		encoder.Encode(map[string]streamTrailer{"trailer": trailer})
+	}
+	flush()
+}
+
+// writeEvent writes one server-sent event carrying v as JSON; an empty name is a plain message
+func writeEvent(w io.Writer, name string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	var event []byte
+	if name != "" {
+		event = append(event, "event: "+name+"\n"...)
+	}
+	event = append(event, "data: "...)
+	event = append(event, data...)
+	event = append(event, "\n\n"...)
+
+	_, err = w.Write(event)
+	return err
+}
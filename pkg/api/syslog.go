@@ -0,0 +1,253 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+// ErrInvalidSyslog means a message has no valid PRI or a malformed RFC 5424 header
+var ErrInvalidSyslog = errors.New("invalid syslog message")
+
+var syslogFacilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+var syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// syslogLevels maps a severity (0 emerg ... 7 debug) onto a level
+var syslogLevels = []types.LogLevel{
+	types.Fatal, types.Fatal, types.Fatal, types.Error, types.Warn, types.Info, types.Info, types.Debug,
+}
+
+// ParseSyslog parses one RFC 5424 or RFC 3164 (BSD) message. APP-NAME or the tag
+// becomes Service and HOSTNAME Host; facility, severity, PROCID and MSGID are kept as
+// properties and each SD-ELEMENT becomes a property holding its params. now fills in
+// the year RFC 3164 timestamps lack.
+func ParseSyslog(message []byte, now time.Time) (*types.LogEntry, error) {
+	message = bytes.TrimRight(message, "\r\n\x00")
+
+	priority, rest, err := syslogPriority(message)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &types.LogEntry{
+		Level: syslogLevels[priority%8],
+		Properties: map[string]interface{}{
+			"facility": syslogFacilities[priority/8],
+			"severity": syslogSeverities[priority%8],
+		},
+	}
+
+	if len(rest) >= 2 && rest[0] >= '1' && rest[0] <= '9' && rest[1] == ' ' {
+		err = parseRFC5424(entry, string(rest[2:]))
+	} else {
+		parseRFC3164(entry, string(rest), now)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// syslogPriority reads "<PRI>"; a message without one is user.notice as RFC 3164 says
+func syslogPriority(message []byte) (int, []byte, error) {
+	if len(message) == 0 || message[0] != '<' {
+		return 13, message, nil
+	}
+
+	end := bytes.IndexByte(message, '>')
+	if end < 2 || end > 4 {
+		return 0, nil, fmt.Errorf("%w: bad PRI", ErrInvalidSyslog)
+	}
+	priority, err := strconv.Atoi(string(message[1:end]))
+	if err != nil || priority < 0 || priority > 191 {
+		return 0, nil, fmt.Errorf("%w: bad PRI %q", ErrInvalidSyslog, message[1:end])
+	}
+	return priority, message[end+1:], nil
+}
+
+// parseRFC5424 parses what follows "<PRI>VERSION ":
+// TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG], "-" for nil values
+func parseRFC5424(entry *types.LogEntry, rest string) error {
+	var fields [5]string
+	for i := range fields {
+		var ok bool
+		fields[i], rest, ok = strings.Cut(rest, " ")
+		if !ok || fields[i] == "" {
+			return fmt.Errorf("%w: truncated header", ErrInvalidSyslog)
+		}
+	}
+	timestamp, hostname, appName, procID, msgID := fields[0], fields[1], fields[2], fields[3], fields[4]
+
+	if timestamp != "-" {
+		parsed, err := time.Parse(time.RFC3339Nano, timestamp)
+		if err != nil {
+			return fmt.Errorf("%w: bad timestamp %q", ErrInvalidSyslog, timestamp)
+		}
+		entry.Timestamp = parsed.UnixMilli()
+	}
+	entry.Host = nilValue(hostname)
+	entry.Service = nilValue(appName)
+	if procID != "-" {
+		entry.Properties["proc_id"] = procID
+	}
+	if msgID != "-" {
+		entry.Properties["msg_id"] = msgID
+	}
+
+	rest, err := parseStructuredData(entry.Properties, rest)
+	if err != nil {
+		return err
+	}
+
+	rest = strings.TrimPrefix(rest, " ")
+	entry.Message = strings.TrimPrefix(rest, "\ufeff") // UTF-8 BOM
+	return nil
+}
+
+func nilValue(field string) string {
+	if field == "-" {
+		return ""
+	}
+	return field
+}
+
+// parseStructuredData reads "-" or [SD-ID PARAM="VALUE" ...]... into properties and
+// returns what follows. A param given twice in an element becomes a list.
+func parseStructuredData(properties map[string]interface{}, rest string) (string, error) {
+	if strings.HasPrefix(rest, "-") {
+		return rest[1:], nil
+	}
+	if !strings.HasPrefix(rest, "[") {
+		return "", fmt.Errorf("%w: bad structured data", ErrInvalidSyslog)
+	}
+
+	for strings.HasPrefix(rest, "[") {
+		end := strings.IndexAny(rest, " ]")
+		if end < 2 {
+			return "", fmt.Errorf("%w: bad SD-ID", ErrInvalidSyslog)
+		}
+		id := rest[1:end]
+		rest = rest[end:]
+		params := map[string]interface{}{}
+
+		for {
+			rest = strings.TrimLeft(rest, " ")
+			if strings.HasPrefix(rest, "]") {
+				rest = rest[1:]
+				break
+			}
+
+			name, value, ok := strings.Cut(rest, `="`)
+			if !ok || name == "" || strings.ContainsAny(name, " ]") {
+				return "", fmt.Errorf("%w: bad SD-PARAM in [%s]", ErrInvalidSyslog, id)
+			}
+			text, remaining, err := sdValue(value)
+			if err != nil {
+				return "", fmt.Errorf("%w in [%s]", err, id)
+			}
+			rest = remaining
+
+			switch previous := params[name].(type) {
+			case nil:
+				params[name] = text
+			case []interface{}:
+				params[name] = append(previous, text)
+			default:
+				params[name] = []interface{}{previous, text}
+			}
+		}
+
+		properties[id] = params
+	}
+
+	return rest, nil
+}
+
+// sdValue reads a PARAM-VALUE up to its closing quote, undoing \" \\ and \] escapes
+func sdValue(value string) (string, string, error) {
+	var text strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			if i+1 < len(value) && strings.IndexByte(`"\]`, value[i+1]) >= 0 {
+				i++
+			}
+			text.WriteByte(value[i])
+		case '"':
+			return text.String(), value[i+1:], nil
+		default:
+			text.WriteByte(value[i])
+		}
+	}
+	return "", "", fmt.Errorf("%w: unterminated SD-PARAM value", ErrInvalidSyslog)
+}
+
+// parseRFC3164 parses what follows "<PRI>": "Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG".
+// BSD syslog is loosely followed, so nothing here fails: without a recognizable
+// timestamp the whole rest is the message.
+func parseRFC3164(entry *types.LogEntry, rest string, now time.Time) {
+	timestamp, rest, ok := bsdTimestamp(rest, now)
+	if !ok {
+		entry.Message = rest
+		return
+	}
+	entry.Timestamp = timestamp
+
+	if hostname, remaining, ok := strings.Cut(rest, " "); ok && hostname != "" && !strings.HasSuffix(hostname, ":") {
+		entry.Host = hostname
+		rest = remaining
+	}
+
+	// TAG: up to 32 characters ending at '[', ':' or a space
+	end := strings.IndexAny(rest, "[: ")
+	if end > 0 && end <= 32 {
+		tag, remaining, procID := rest[:end], rest[end:], ""
+		if strings.HasPrefix(remaining, "[") {
+			if closing := strings.Index(remaining, "]"); closing > 0 {
+				procID, remaining = remaining[1:closing], remaining[closing+1:]
+			}
+		}
+		if strings.HasPrefix(remaining, ":") {
+			entry.Service = tag
+			if procID != "" {
+				entry.Properties["proc_id"] = procID
+			}
+			rest = strings.TrimPrefix(remaining[1:], " ")
+		}
+	}
+
+	entry.Message = rest
+}
+
+// bsdTimestamp reads "Mmm dd hh:mm:ss " (the day space padded) in now's location and
+// year, or last year if that would put it in the future; or an RFC 3339 timestamp as
+// some senders use instead
+func bsdTimestamp(rest string, now time.Time) (int64, string, bool) {
+	if len(rest) >= 16 && rest[15] == ' ' {
+		if parsed, err := time.ParseInLocation(time.Stamp, rest[:15], now.Location()); err == nil {
+			parsed = time.Date(now.Year(), parsed.Month(), parsed.Day(),
+				parsed.Hour(), parsed.Minute(), parsed.Second(), 0, now.Location())
+			if parsed.Sub(now) > 24*time.Hour { // December's messages read in January
+				parsed = parsed.AddDate(-1, 0, 0)
+			}
+			return parsed.UnixMilli(), rest[16:], true
+		}
+	}
+
+	if field, remaining, ok := strings.Cut(rest, " "); ok {
+		if parsed, err := time.Parse(time.RFC3339Nano, field); err == nil {
+			return parsed.UnixMilli(), remaining, true
+		}
+	}
+	return 0, rest, false
+}
@@ -0,0 +1,192 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/ingest"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+const (
+	maxSyslogMessage = 64 << 10
+	maxSyslogBatch   = 1000 // messages already buffered on a connection written together
+)
+
+// SyslogServer receives syslog over UDP, one message per datagram, and TCP, framed by
+// octet counting or newlines (RFC 6587, detected per message), and writes it through
+// the IngestManager. Unparsable messages are logged and dropped.
+type SyslogServer struct {
+	ingestManager *ingest.IngestManager
+	udp           net.PacketConn
+	tcp           *tcpListener
+	waitGroup     sync.WaitGroup // UDP reader
+}
+
+func NewSyslogServer(ingestManager *ingest.IngestManager) *SyslogServer {
+	return &SyslogServer{ingestManager: ingestManager}
+}
+
+// Start listens on the UDP and TCP addresses, an empty one is skipped, and serves
+// in the background
+func (ss *SyslogServer) Start(udpAddr, tcpAddr string) error {
+	if udpAddr != "" {
+		udp, err := net.ListenPacket("udp", udpAddr)
+		if err != nil {
+			return err
+		}
+		ss.udp = udp
+		ss.waitGroup.Add(1)
+		go ss.serveUDP()
+	}
+
+	if tcpAddr != "" {
+		tcp, err := listenTCP(tcpAddr, "SYSLOG", ss.serveConn)
+		if err != nil {
+			ss.Stop()
+			return err
+		}
+		ss.tcp = tcp
+	}
+
+	return nil
+}
+
+// UDPAddr is the address the UDP listener is bound to, nil without one
+func (ss *SyslogServer) UDPAddr() net.Addr {
+	if ss.udp == nil {
+		return nil
+	}
+	return ss.udp.LocalAddr()
+}
+
+// TCPAddr is the address the TCP listener is bound to, nil without one
+func (ss *SyslogServer) TCPAddr() net.Addr {
+	if ss.tcp == nil {
+		return nil
+	}
+	return ss.tcp.Addr()
+}
+
+// Stop closes the listeners and open connections and waits until they are done
+func (ss *SyslogServer) Stop() {
+	if ss.udp != nil {
+		ss.udp.Close()
+	}
+	if ss.tcp != nil {
+		ss.tcp.Stop()
+	}
+	ss.waitGroup.Wait()
+}
+
+func (ss *SyslogServer) serveUDP() {
+	defer ss.waitGroup.Done()
+
+	buf := make([]byte, maxSyslogMessage)
+	for {
+		n, addr, err := ss.udp.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("[SYSLOG] udp read failed: %v", err)
+			continue
+		}
+		ss.ingest([][]byte{buf[:n]}, addr)
+	}
+}
+
+func (ss *SyslogServer) serveConn(conn net.Conn) {
+	reader := bufio.NewReaderSize(conn, maxSyslogMessage)
+	for {
+		var batch [][]byte
+		var err error
+
+		// whatever has already arrived goes in one write
+		for len(batch) == 0 || (reader.Buffered() > 0 && len(batch) < maxSyslogBatch) {
+			var frame []byte
+			if frame, err = readSyslogFrame(reader); err != nil {
+				break
+			}
+			if len(frame) > 0 {
+				batch = append(batch, frame)
+			}
+		}
+
+		ss.ingest(batch, conn.RemoteAddr())
+
+		if err != nil {
+			if !closedError(err) {
+				log.Printf("[SYSLOG] closing connection from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+	}
+}
+
+// readSyslogFrame reads one message: "LENGTH SP MESSAGE" when it starts with a digit,
+// otherwise up to the next newline. Blank lines come back as empty frames.
+func readSyslogFrame(reader *bufio.Reader) ([]byte, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if first[0] >= '0' && first[0] <= '9' {
+		header, err := reader.ReadSlice(' ')
+		if err != nil {
+			return nil, fmt.Errorf("bad octet count: %w", err)
+		}
+		length, err := strconv.Atoi(string(header[:len(header)-1]))
+		if err != nil || length > maxSyslogMessage {
+			return nil, fmt.Errorf("bad octet count %q", header[:len(header)-1])
+		}
+		frame := make([]byte, length)
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			return nil, err
+		}
+		return frame, nil
+	}
+
+	line, err := reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, fmt.Errorf("message longer than %d bytes", maxSyslogMessage)
+	}
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return nil, err
+	}
+	return bytes.Clone(bytes.TrimRight(line, "\r\n")), nil
+}
+
+// ingest parses the messages and writes the valid ones
+func (ss *SyslogServer) ingest(messages [][]byte, from net.Addr) {
+	now := time.Now()
+	entries := make([]*types.LogEntry, 0, len(messages))
+
+	for _, message := range messages {
+		entry, err := ParseSyslog(message, now)
+		if err == nil {
+			err = entry.Normalize(now)
+		}
+		if err != nil {
+			log.Printf("[SYSLOG] dropping message from %s: %v", from, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(entries) == 0 {
+		return
+	}
+	if err := ss.ingestManager.AppendLogs(entries); err != nil {
+		log.Printf("[SYSLOG] writing %d message(s) failed: %v", len(entries), err)
+	}
+}
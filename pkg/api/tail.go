@@ -0,0 +1,192 @@
+package api
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/query"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+const (
+	defaultTailBackfill = 20
+	maxTailBackfill     = 1000
+	tailHeartbeat       = 15 * time.Second
+)
+
+// TailHandler follows new entries as server-sent events: GET /tail?q=<query string>
+// &backfill=<n>&on_full=drop|disconnect. The n most recent stored matches come first,
+// oldest first, then every matching entry as it is written. A "dropped" event reports
+// how many entries a slow client missed so far; with on_full=disconnect an "error"
+// event ends the stream instead.
+func (qs *QueryServer) TailHandler(w http.ResponseWriter, r *http.Request) {
+	if qs.tailHub == nil {
+		http.Error(w, "tail is not enabled", http.StatusNotFound)
+		return
+	}
+
+	params := r.URL.Query()
+	expression := params.Get("q")
+
+	backfill, err := intParam(params, "backfill")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !params.Has("backfill") {
+		backfill = defaultTailBackfill
+	}
+	backfill = min(max(backfill, 0), maxTailBackfill)
+
+	subscribe := qs.tailHub.Subscribe
+	switch params.Get("on_full") {
+	case "":
+	case "drop":
+		subscribe = func(expression string) (*query.Subscription, error) {
+			return qs.tailHub.SubscribeWithPolicy(expression, query.DropEntries)
+		}
+	case "disconnect":
+		subscribe = func(expression string) (*query.Subscription, error) {
+			return qs.tailHub.SubscribeWithPolicy(expression, query.Disconnect)
+		}
+	default:
+		http.Error(w, "on_full must be drop or disconnect", http.StatusBadRequest)
+		return
+	}
+
+	// subscribe before reading the backfill so nothing written in between is missed
+	subscription, err := subscribe(expression)
+	if err != nil {
+		queryError(w, err)
+		return
+	}
+	defer subscription.Close()
+
+	recent, err := tailBackfill(qs.queryEngine, subscription, expression, int(backfill))
+	if err != nil {
+		queryError(w, err)
+		return
+	}
+
+	// entries written after subscribing can be in the backfill too, send them once
+	sent := make(map[string]bool, len(recent))
+	for _, entry := range recent {
+		sent[entryKey(entry)] = true
+	}
+
+	flusher, _ := w.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	w.Header().Set("Content-Type", mediaSSE)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	for _, entry := range recent {
+		if err := writeEvent(w, "", entry); err != nil {
+			return
+		}
+	}
+	flush()
+
+	heartbeat := time.NewTicker(tailHeartbeat)
+	defer heartbeat.Stop()
+
+	var reported int64
+	reportDropped := func() error {
+		dropped := subscription.Dropped()
+		if dropped == reported {
+			return nil
+		}
+		reported = dropped
+		return writeEvent(w, "dropped", map[string]int64{"dropped": dropped})
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case entry, ok := <-subscription.Entries:
+			if !ok {
+				if err := subscription.Err(); err != nil {
+					writeEvent(w, "error", map[string]string{"error": err.Error()})
+					flush()
+				}
+				return
+			}
+
+			if len(sent) > 0 {
+				key := entryKey(entry)
+				if sent[key] {
+					delete(sent, key)
+					continue
+				}
+			}
+
+			if err := reportDropped(); err != nil {
+				return
+			}
+			if err := writeEvent(w, "", entry); err != nil {
+				return
+			}
+			flush()
+
+		case <-heartbeat.C:
+			if subscription.Dropped() != reported {
+				err = reportDropped()
+			} else {
+				// comment line, keeps proxies from closing an idle stream
+				_, err = w.Write([]byte(": keep-alive\n\n"))
+			}
+			if err != nil {
+				return
+			}
+			flush()
+		}
+	}
+}
+
+// tailBackfill returns the n most recent matches, oldest first: stored ones and those the
+// subscription sees waiting to be stored. Pending entries are read before the store, so
+// one stored in between shows up in the query, and it is only returned once.
+func tailBackfill(queryEngine *query.QueryEngine, subscription *query.Subscription, expression string, n int) ([]types.LogEntry, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+
+	pending := subscription.Pending()
+	page, err := queryEngine.ExecutePage(&query.Query{Expression: expression, Limit: n})
+	if err != nil {
+		return nil, err
+	}
+	recent := page.Entries
+	slices.Reverse(recent)
+
+	stored := make(map[string]bool, len(recent))
+	for _, entry := range recent {
+		stored[entryKey(entry)] = true
+	}
+	for _, entry := range pending {
+		if !stored[entryKey(entry)] {
+			recent = append(recent, entry)
+		}
+	}
+
+	slices.SortStableFunc(recent, func(a, b types.LogEntry) int {
+		return cmp.Compare(a.Timestamp, b.Timestamp)
+	})
+	return recent[max(len(recent)-n, 0):], nil
+}
+
+// entryKey identifies an entry for de-duplication between backfill and live entries
+func entryKey(entry types.LogEntry) string {
+	data, _ := json.Marshal(entry)
+	return string(data)
+}
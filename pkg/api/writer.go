@@ -8,12 +8,45 @@ import (
 	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
 )
 
+// WriteOptions configures a WriteServer
+type WriteOptions struct {
+	Elastic ElasticOptions // where _bulk documents keep the entry fields
+}
+
+func DefaultWriteOptions() WriteOptions {
+	return WriteOptions{
+		Elastic: DefaultElasticOptions(),
+	}
+}
+
 type WriteServer struct {
-	ingestManager *ingest.IngestManager
+	ingestManager  *ingest.IngestManager
+	elasticOptions ElasticOptions
 }
 
 func NewWriteServer(ingestManager *ingest.IngestManager) *WriteServer {
-	return &WriteServer{ingestManager: ingestManager}
+	return NewWriteServerWithOptions(ingestManager, DefaultWriteOptions())
+}
+
+// NewWriteServerWithOptions creates a server; zero option fields take their defaults
+func NewWriteServerWithOptions(ingestManager *ingest.IngestManager, options WriteOptions) *WriteServer {
+	defaults := DefaultWriteOptions()
+	if options.Elastic.TimestampFields == nil {
+		options.Elastic.TimestampFields = defaults.Elastic.TimestampFields
+	}
+	if options.Elastic.LevelFields == nil {
+		options.Elastic.LevelFields = defaults.Elastic.LevelFields
+	}
+	if options.Elastic.ServiceFields == nil {
+		options.Elastic.ServiceFields = defaults.Elastic.ServiceFields
+	}
+	if options.Elastic.HostFields == nil {
+		options.Elastic.HostFields = defaults.Elastic.HostFields
+	}
+	if options.Elastic.MessageFields == nil {
+		options.Elastic.MessageFields = defaults.Elastic.MessageFields
+	}
+	return &WriteServer{ingestManager: ingestManager, elasticOptions: options.Elastic}
 }
 
 // HTTP handler
@@ -42,11 +75,21 @@ func (ws *WriteServer) StopBackgroundFlush(w http.ResponseWriter, r *http.Reques
 	w.Write([]byte("ok"))
 }
 
+// Handler routes the ingest endpoints, on a mux of their own so no other server exposes them
+func (ws *WriteServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/write", ws.WriteHandler)
+	mux.HandleFunc("/write/batch", ws.BatchHandler)
+	mux.HandleFunc("/v1/logs", ws.OTLPLogsHandler)
+	mux.HandleFunc("/loki/api/v1/push", ws.LokiPushHandler)
+	mux.HandleFunc("/_bulk", ws.ElasticBulkHandler)
+	mux.HandleFunc("/{index}/_bulk", ws.ElasticBulkHandler)
+	mux.HandleFunc("GET /{$}", ws.ElasticInfoHandler)
+	mux.HandleFunc("/stop", ws.StopBackgroundFlush)
+	return mux
+}
+
 // Start server
 func (ws *WriteServer) Start(addr string) error {
-
-	http.HandleFunc("/write", ws.WriteHandler)
-	http.HandleFunc("/stop", ws.StopBackgroundFlush)
-
-	return http.ListenAndServe(addr, nil)
+	return http.ListenAndServe(addr, ws.Handler())
 }
@@ -0,0 +1,97 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// Codec identifies a block compression algorithm. The value is stored on disk, never renumber.
+type Codec byte
+
+const (
+	// None stores data as is
+	None Codec = 0
+	// Snappy is fast with a moderate ratio, the default for segments
+	Snappy Codec = 1
+	// Deflate is slower but compresses repetitive logs noticeably better
+	Deflate Codec = 2
+)
+
+func (codec Codec) String() string {
+	switch codec {
+	case None:
+		return "none"
+	case Snappy:
+		return "snappy"
+	case Deflate:
+		return "deflate"
+	}
+	return fmt.Sprintf("codec(%d)", byte(codec))
+}
+
+// ParseCodec returns the codec with the given name
+func ParseCodec(name string) (Codec, error) {
+	switch name {
+	case "none", "":
+		return None, nil
+	case "snappy":
+		return Snappy, nil
+	case "deflate":
+		return Deflate, nil
+	}
+	return None, fmt.Errorf("unknown codec %q", name)
+}
+
+// Encode compresses src
+func (codec Codec) Encode(src []byte) ([]byte, error) {
+	switch codec {
+	case None:
+		return append([]byte(nil), src...), nil
+	case Snappy:
+		return Encode(src), nil
+	case Deflate:
+		var buffer bytes.Buffer
+		writer, err := flate.NewWriter(&buffer, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := writer.Write(src); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unknown codec %d", byte(codec))
+}
+
+// Decode decompresses src, which must expand to exactly size bytes
+func (codec Codec) Decode(src []byte, size int) ([]byte, error) {
+	var out []byte
+	var err error
+
+	switch codec {
+	case None:
+		out = src
+	case Snappy:
+		out, err = Decode(src)
+	case Deflate:
+		reader := flate.NewReader(bytes.NewReader(src))
+		out = make([]byte, size)
+		_, err = io.ReadFull(reader, out)
+		reader.Close()
+	default:
+		return nil, fmt.Errorf("unknown codec %d", byte(codec))
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", codec, err)
+	}
+	if len(out) != size {
+		return nil, fmt.Errorf("%s: decoded %d bytes, expected %d", codec, len(out), size)
+	}
+	return out, nil
+}
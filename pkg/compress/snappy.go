@@ -0,0 +1,193 @@
+package compress
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Snappy block format (https://github.com/google/snappy/blob/main/format_description.txt):
+//
+//	uvarint decoded length, then a sequence of elements
+//	literal: tag 00, length-1 in the upper 6 bits (60..63 = 1..4 extra length bytes follow)
+//	copy1:   tag 01, length 4..11, 11 bit offset
+//	copy2:   tag 10, length 1..64, 16 bit offset
+//	copy4:   tag 11, length 1..64, 32 bit offset
+//
+// The encoder is a plain greedy matcher over a hash table of 4 byte sequences. It does not
+// reach the speed of the reference implementation but its output is readable by any snappy decoder.
+
+const (
+	tagLiteral = 0x00
+	tagCopy1   = 0x01
+	tagCopy2   = 0x02
+	tagCopy4   = 0x03
+
+	minMatch      = 4
+	maxCopyLength = 64
+	hashTableBits = 14
+
+	// refuse to allocate more than this for a single block
+	maxDecodedLen = 1 << 30
+)
+
+var ErrCorrupt = errors.New("snappy: corrupt input")
+
+// Encode returns the snappy encoding of src
+func Encode(src []byte) []byte {
+	dst := binary.AppendUvarint(make([]byte, 0, len(src)/2+16), uint64(len(src)))
+
+	// positions + 1, zero means empty
+	var table [1 << hashTableBits]int32
+
+	literal := 0
+	for i := 0; i+minMatch <= len(src); {
+		sequence := binary.LittleEndian.Uint32(src[i:])
+		hash := (sequence * 0x1e35a7bd) >> (32 - hashTableBits)
+
+		candidate := int(table[hash]) - 1
+		table[hash] = int32(i + 1)
+
+		if candidate < 0 || binary.LittleEndian.Uint32(src[candidate:]) != sequence {
+			i++
+			continue
+		}
+
+		length := minMatch
+		for i+length < len(src) && src[candidate+length] == src[i+length] {
+			length++
+		}
+
+		dst = emitLiteral(dst, src[literal:i])
+		dst = emitCopy(dst, i-candidate, length)
+		i += length
+		literal = i
+	}
+
+	return emitLiteral(dst, src[literal:])
+}
+
+func emitLiteral(dst, literal []byte) []byte {
+	if len(literal) == 0 {
+		return dst
+	}
+
+	n := len(literal) - 1
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2|tagLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|tagLiteral, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2|tagLiteral, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2|tagLiteral, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2|tagLiteral, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, literal...)
+}
+
+func emitCopy(dst []byte, offset, length int) []byte {
+	for length > 0 {
+		n := min(length, maxCopyLength)
+		switch {
+		case n >= 4 && n <= 11 && offset < 1<<11:
+			dst = append(dst, byte(offset>>8)<<5|byte(n-4)<<2|tagCopy1, byte(offset))
+		case offset < 1<<16:
+			dst = append(dst, byte(n-1)<<2|tagCopy2, byte(offset), byte(offset>>8))
+		default:
+			dst = append(dst, byte(n-1)<<2|tagCopy4, byte(offset), byte(offset>>8), byte(offset>>16), byte(offset>>24))
+		}
+		length -= n
+	}
+	return dst
+}
+
+// DecodedLen returns the length src decodes to
+func DecodedLen(src []byte) (int, error) {
+	n, header := binary.Uvarint(src)
+	if header <= 0 || n > maxDecodedLen {
+		return 0, ErrCorrupt
+	}
+	return int(n), nil
+}
+
+// Decode returns the data encoded in src
+func Decode(src []byte) ([]byte, error) {
+	size, err := DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	_, header := binary.Uvarint(src)
+	src = src[header:]
+
+	dst := make([]byte, 0, size)
+	for len(src) > 0 {
+		tag := src[0]
+		var length, offset int
+
+		switch tag & 0x03 {
+		case tagLiteral:
+			length = int(tag >> 2)
+			src = src[1:]
+			if length >= 60 {
+				extra := length - 59
+				if len(src) < extra {
+					return nil, ErrCorrupt
+				}
+				length = 0
+				for k := range extra {
+					length |= int(src[k]) << (8 * k)
+				}
+				src = src[extra:]
+			}
+			length++
+
+			if length > len(src) || len(dst)+length > size {
+				return nil, ErrCorrupt
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+
+		case tagCopy1:
+			if len(src) < 2 {
+				return nil, ErrCorrupt
+			}
+			length = 4 + int(tag>>2)&0x07
+			offset = int(tag>>5)<<8 | int(src[1])
+			src = src[2:]
+
+		case tagCopy2:
+			if len(src) < 3 {
+				return nil, ErrCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+
+		case tagCopy4:
+			if len(src) < 5 {
+				return nil, ErrCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+
+		if offset <= 0 || offset > len(dst) || len(dst)+length > size {
+			return nil, ErrCorrupt
+		}
+
+		// byte by byte, a copy may overlap the bytes it produces
+		start := len(dst) - offset
+		for k := range length {
+			dst = append(dst, dst[start+k])
+		}
+	}
+
+	if len(dst) != size {
+		return nil, ErrCorrupt
+	}
+	return dst, nil
+}
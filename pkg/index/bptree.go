@@ -1,3 +1,802 @@
 package index
 
-// TODO: write own b+ tree implementaion on disk
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// On-disk B+ tree.
+//
+// The file is an array of fixed-size pages. Page 0 holds the tree metadata, every
+// other page is a node. Leaves hold IndexEntry records and are chained through `next`
+// for range iteration; internal nodes hold separator entries and child page ids.
+// Pages are decoded into nodes and cached in a small LRU buffer pool, dirty nodes are
+// written back on eviction and on Flush.
+//
+//	meta page:  magic u32 | version u16 | root u32 | pageCount u32 | count u64
+//	node page:  type u8 | count u16 | next u32 | payload
+//	leaf payload:     entry*
+//	internal payload: child u32 | (entry child u32)*
+
+const (
+	PageSize          = 4096
+	DefaultCachePages = 64
+
+	bptreeMagic   uint32 = 0x54424c50 // "TBLP"
+	bptreeVersion uint16 = 1
+
+	nodeLeaf     byte = 1
+	nodeInternal byte = 2
+
+	nodeHeaderSize = 1 + 2 + 4
+	childSize      = 4
+
+	// every page must be able to hold at least 4 entries so splits always work
+	maxEntrySize = (PageSize - nodeHeaderSize - childSize) / 4
+
+	// bulk loaded pages are left with some room so later inserts don't split right away
+	bulkFillPercent = 90
+)
+
+var (
+	ErrEntryTooLarge = errors.New("index entry too large for a b+ tree page")
+	ErrTreeNotEmpty  = errors.New("bulk load requires an empty b+ tree")
+	ErrUnsortedInput = errors.New("bulk load input is not sorted")
+	ErrCorruptPage   = errors.New("corrupt b+ tree page")
+)
+
+type pageID uint32
+
+// node is the decoded form of a page
+type node struct {
+	id       pageID
+	leaf     bool
+	entries  []IndexEntry // leaf: records, internal: separators
+	children []pageID     // internal only, len(entries)+1
+	next     pageID       // leaf only, right sibling (0 = none)
+	dirty    bool
+	pins     int
+	element  *list.Element
+}
+
+// BPTree is a page-based B+ tree stored in a single file
+type BPTree struct {
+	path      string
+	file      *os.File
+	pool      *bufferPool
+	root      pageID
+	pageCount uint32
+	count     int64
+	mutex     sync.Mutex
+}
+
+// OpenBPTree opens the tree stored at path, creating an empty one if the file does not exist.
+// cachePages bounds how many decoded pages are kept in memory.
+func OpenBPTree(path string, cachePages int) (*BPTree, error) {
+	if cachePages <= 0 {
+		cachePages = DefaultCachePages
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	tree := &BPTree{
+		path: path,
+		file: file,
+		pool: newBufferPool(file, cachePages),
+	}
+
+	if info.Size() == 0 {
+		// fresh tree: meta page + an empty root leaf
+		tree.pageCount = 1
+		root := tree.newNode(true)
+		tree.root = root.id
+		tree.pool.unpin(root)
+
+		if err := tree.flush(); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return tree, nil
+	}
+
+	if err := tree.readMeta(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return tree, nil
+}
+
+// Path returns the file backing the tree
+func (tree *BPTree) Path() string {
+	return tree.path
+}
+
+// Len returns the number of entries in the tree
+func (tree *BPTree) Len() int {
+	tree.mutex.Lock()
+	defer tree.mutex.Unlock()
+	return int(tree.count)
+}
+
+// Set inserts an entry, replacing an equal one if present
+func (tree *BPTree) Set(entry IndexEntry) error {
+	if entrySize(entry) > maxEntrySize {
+		return ErrEntryTooLarge
+	}
+
+	tree.mutex.Lock()
+	defer tree.mutex.Unlock()
+
+	separator, right, replaced, err := tree.insert(tree.root, entry)
+	if err != nil {
+		return err
+	}
+
+	if separator != nil {
+		// root was split: grow the tree by one level
+		root := tree.newNode(false)
+		root.entries = []IndexEntry{*separator}
+		root.children = []pageID{tree.root, right}
+		tree.root = root.id
+		tree.pool.unpin(root)
+	}
+
+	if !replaced {
+		tree.count++
+	}
+
+	return tree.pool.evict()
+}
+
+// insert adds entry below page id. If the page had to be split it returns the
+// separator and the new right sibling for the parent to link.
+func (tree *BPTree) insert(id pageID, entry IndexEntry) (*IndexEntry, pageID, bool, error) {
+	n, err := tree.pool.get(id)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	defer tree.pool.unpin(n)
+
+	if n.leaf {
+		i := lowerBound(n.entries, entry)
+		if i < len(n.entries) && compareEntries(n.entries[i], entry) == 0 {
+			n.entries[i] = entry
+			n.dirty = true
+			return nil, 0, true, nil
+		}
+
+		n.entries = append(n.entries, IndexEntry{})
+		copy(n.entries[i+1:], n.entries[i:])
+		n.entries[i] = entry
+		n.dirty = true
+
+		if n.size() <= PageSize {
+			return nil, 0, false, nil
+		}
+
+		mid := splitPoint(n.entries)
+		right := tree.newNode(true)
+		right.entries = append([]IndexEntry(nil), n.entries[mid:]...)
+		right.next = n.next
+		n.entries = append([]IndexEntry(nil), n.entries[:mid]...)
+		n.next = right.id
+		tree.pool.unpin(right)
+
+		separator := right.entries[0]
+		return &separator, right.id, false, nil
+	}
+
+	i := upperBound(n.entries, entry)
+	separator, rightChild, replaced, err := tree.insert(n.children[i], entry)
+	if err != nil || separator == nil {
+		return nil, 0, replaced, err
+	}
+
+	n.entries = append(n.entries, IndexEntry{})
+	copy(n.entries[i+1:], n.entries[i:])
+	n.entries[i] = *separator
+
+	n.children = append(n.children, 0)
+	copy(n.children[i+2:], n.children[i+1:])
+	n.children[i+1] = rightChild
+	n.dirty = true
+
+	if n.size() <= PageSize {
+		return nil, 0, replaced, nil
+	}
+
+	// the middle separator moves up, it is not kept in either half
+	mid := splitPoint(n.entries)
+	if mid >= len(n.entries) {
+		mid = len(n.entries) - 1
+	}
+	promoted := n.entries[mid]
+
+	right := tree.newNode(false)
+	right.entries = append([]IndexEntry(nil), n.entries[mid+1:]...)
+	right.children = append([]pageID(nil), n.children[mid+1:]...)
+	n.entries = append([]IndexEntry(nil), n.entries[:mid]...)
+	n.children = append([]pageID(nil), n.children[:mid+1]...)
+	tree.pool.unpin(right)
+
+	return &promoted, right.id, replaced, nil
+}
+
+// Delete removes an entry if present. Pages are not merged, empty leaves are
+// simply skipped during iteration.
+func (tree *BPTree) Delete(entry IndexEntry) error {
+	tree.mutex.Lock()
+	defer tree.mutex.Unlock()
+
+	n, err := tree.findLeaf(entry)
+	if err != nil {
+		return err
+	}
+
+	for {
+		i := lowerBound(n.entries, entry)
+		if i < len(n.entries) {
+			if compareEntries(n.entries[i], entry) == 0 {
+				n.entries = append(n.entries[:i], n.entries[i+1:]...)
+				n.dirty = true
+				tree.count--
+			}
+			tree.pool.unpin(n)
+			return tree.pool.evict()
+		}
+
+		// entry might sit in a right sibling if this leaf was emptied before
+		next := n.next
+		tree.pool.unpin(n)
+		if next == 0 {
+			return nil
+		}
+		if n, err = tree.pool.get(next); err != nil {
+			return err
+		}
+	}
+}
+
+// Ascend calls iter for every entry >= pivot in order, until iter returns false.
+// iter must not call back into the tree.
+func (tree *BPTree) Ascend(pivot IndexEntry, iter func(IndexEntry) bool) error {
+	tree.mutex.Lock()
+	defer tree.mutex.Unlock()
+
+	n, err := tree.findLeaf(pivot)
+	if err != nil {
+		return err
+	}
+
+	i := lowerBound(n.entries, pivot)
+	for {
+		for ; i < len(n.entries); i++ {
+			if !iter(n.entries[i]) {
+				tree.pool.unpin(n)
+				return tree.pool.evict()
+			}
+		}
+
+		next := n.next
+		tree.pool.unpin(n)
+		if next == 0 {
+			return tree.pool.evict()
+		}
+
+		if n, err = tree.pool.get(next); err != nil {
+			return err
+		}
+		i = 0
+	}
+}
+
+// Scan calls iter for every entry in order
+func (tree *BPTree) Scan(iter func(IndexEntry) bool) error {
+	return tree.Ascend(minEntry, iter)
+}
+
+// BulkLoad fills an empty tree from entries sorted by compareEntries.
+// Pages are packed bottom-up, which is much faster than inserting one by one.
+func (tree *BPTree) BulkLoad(entries []IndexEntry) error {
+	tree.mutex.Lock()
+	defer tree.mutex.Unlock()
+
+	if tree.count != 0 {
+		return ErrTreeNotEmpty
+	}
+
+	for i, entry := range entries {
+		if entrySize(entry) > maxEntrySize {
+			return ErrEntryTooLarge
+		}
+		if i > 0 && compareEntries(entries[i-1], entry) >= 0 {
+			return ErrUnsortedInput
+		}
+	}
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	type child struct {
+		id    pageID
+		first IndexEntry
+	}
+
+	limit := PageSize * bulkFillPercent / 100
+
+	// leaves: the first one reuses the empty root page
+	var level []child
+	current, err := tree.pool.get(tree.root)
+	if err != nil {
+		return err
+	}
+	if !current.leaf || len(current.entries) != 0 {
+		tree.pool.unpin(current)
+		return ErrTreeNotEmpty
+	}
+	size := nodeHeaderSize
+
+	for _, entry := range entries {
+		entrySize := entrySize(entry)
+		if len(current.entries) > 0 && size+entrySize > limit {
+			next := tree.newNode(true)
+			current.next = next.id
+			level = append(level, child{id: current.id, first: current.entries[0]})
+			tree.pool.unpin(current)
+			if err := tree.pool.evict(); err != nil {
+				return err
+			}
+			current = next
+			size = nodeHeaderSize
+		}
+		current.entries = append(current.entries, entry)
+		current.dirty = true
+		size += entrySize
+	}
+	level = append(level, child{id: current.id, first: current.entries[0]})
+	tree.pool.unpin(current)
+
+	// internal levels until a single root remains
+	for len(level) > 1 {
+		var parents []child
+
+		parent := tree.newNode(false)
+		parent.children = []pageID{level[0].id}
+		first := level[0].first
+		size := nodeHeaderSize + childSize
+
+		for _, c := range level[1:] {
+			entrySize := entrySize(c.first) + childSize
+			if size+entrySize > limit && len(parent.children) > 1 {
+				parents = append(parents, child{id: parent.id, first: first})
+				tree.pool.unpin(parent)
+				if err := tree.pool.evict(); err != nil {
+					return err
+				}
+
+				parent = tree.newNode(false)
+				parent.children = []pageID{c.id}
+				first = c.first
+				size = nodeHeaderSize + childSize
+				continue
+			}
+			parent.entries = append(parent.entries, c.first)
+			parent.children = append(parent.children, c.id)
+			size += entrySize
+		}
+		parents = append(parents, child{id: parent.id, first: first})
+		tree.pool.unpin(parent)
+
+		level = parents
+	}
+
+	tree.root = level[0].id
+	tree.count = int64(len(entries))
+
+	return tree.flush()
+}
+
+// Flush writes all dirty pages and the metadata to disk
+func (tree *BPTree) Flush() error {
+	tree.mutex.Lock()
+	defer tree.mutex.Unlock()
+	return tree.flush()
+}
+
+// Close flushes the tree and closes its file
+func (tree *BPTree) Close() error {
+	tree.mutex.Lock()
+	defer tree.mutex.Unlock()
+
+	if err := tree.flush(); err != nil {
+		tree.file.Close()
+		return err
+	}
+	return tree.file.Close()
+}
+
+func (tree *BPTree) flush() error {
+	if err := tree.pool.flush(); err != nil {
+		return err
+	}
+	if err := tree.writeMeta(); err != nil {
+		return err
+	}
+	return tree.file.Sync()
+}
+
+// findLeaf descends to the leaf that would hold entry. The leaf is returned pinned.
+func (tree *BPTree) findLeaf(entry IndexEntry) (*node, error) {
+	id := tree.root
+	for {
+		n, err := tree.pool.get(id)
+		if err != nil {
+			return nil, err
+		}
+		if n.leaf {
+			return n, nil
+		}
+		id = n.children[upperBound(n.entries, entry)]
+		tree.pool.unpin(n)
+	}
+}
+
+// newNode allocates a page at the end of the file. The node is returned pinned and dirty.
+func (tree *BPTree) newNode(leaf bool) *node {
+	n := &node{
+		id:    pageID(tree.pageCount),
+		leaf:  leaf,
+		dirty: true,
+	}
+	tree.pageCount++
+	tree.pool.add(n)
+	return n
+}
+
+func (tree *BPTree) readMeta() error {
+	page := make([]byte, PageSize)
+	if _, err := tree.file.ReadAt(page, 0); err != nil {
+		return err
+	}
+
+	if binary.LittleEndian.Uint32(page[0:4]) != bptreeMagic {
+		return fmt.Errorf("%s: not a b+ tree file", tree.path)
+	}
+	if version := binary.LittleEndian.Uint16(page[4:6]); version != bptreeVersion {
+		return fmt.Errorf("%s: unsupported b+ tree version %d", tree.path, version)
+	}
+
+	tree.root = pageID(binary.LittleEndian.Uint32(page[6:10]))
+	tree.pageCount = binary.LittleEndian.Uint32(page[10:14])
+	tree.count = int64(binary.LittleEndian.Uint64(page[14:22]))
+
+	if tree.root == 0 || uint32(tree.root) >= tree.pageCount {
+		return fmt.Errorf("%s: %w: root page %d", tree.path, ErrCorruptPage, tree.root)
+	}
+	return nil
+}
+
+func (tree *BPTree) writeMeta() error {
+	page := make([]byte, PageSize)
+	binary.LittleEndian.PutUint32(page[0:4], bptreeMagic)
+	binary.LittleEndian.PutUint16(page[4:6], bptreeVersion)
+	binary.LittleEndian.PutUint32(page[6:10], uint32(tree.root))
+	binary.LittleEndian.PutUint32(page[10:14], tree.pageCount)
+	binary.LittleEndian.PutUint64(page[14:22], uint64(tree.count))
+
+	_, err := tree.file.WriteAt(page, 0)
+	return err
+}
+
+// --- buffer pool ---
+
+// bufferPool caches decoded pages. Pinned nodes are in use by an operation and
+// are never evicted, so the pool can temporarily grow past its capacity.
+type bufferPool struct {
+	file     *os.File
+	capacity int
+	nodes    map[pageID]*node
+	lru      *list.List // front = most recently used
+}
+
+func newBufferPool(file *os.File, capacity int) *bufferPool {
+	return &bufferPool{
+		file:     file,
+		capacity: capacity,
+		nodes:    make(map[pageID]*node),
+		lru:      list.New(),
+	}
+}
+
+// get returns the node of a page, reading it from disk on a miss. The node is pinned.
+func (pool *bufferPool) get(id pageID) (*node, error) {
+	if n, ok := pool.nodes[id]; ok {
+		pool.lru.MoveToFront(n.element)
+		n.pins++
+		return n, nil
+	}
+
+	page := make([]byte, PageSize)
+	if _, err := pool.file.ReadAt(page, int64(id)*PageSize); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: page %d out of range", ErrCorruptPage, id)
+		}
+		return nil, err
+	}
+
+	n, err := decodeNode(id, page)
+	if err != nil {
+		return nil, err
+	}
+
+	pool.add(n)
+	return n, nil
+}
+
+// add caches a node and pins it
+func (pool *bufferPool) add(n *node) {
+	n.pins++
+	n.element = pool.lru.PushFront(n)
+	pool.nodes[n.id] = n
+}
+
+func (pool *bufferPool) unpin(n *node) {
+	n.pins--
+}
+
+// evict writes back and drops least recently used unpinned nodes until the pool fits
+func (pool *bufferPool) evict() error {
+	element := pool.lru.Back()
+	for len(pool.nodes) > pool.capacity && element != nil {
+		prev := element.Prev()
+		n := element.Value.(*node)
+
+		if n.pins == 0 {
+			if n.dirty {
+				if err := pool.write(n); err != nil {
+					return err
+				}
+			}
+			pool.lru.Remove(element)
+			delete(pool.nodes, n.id)
+		}
+
+		element = prev
+	}
+	return nil
+}
+
+// flush writes every dirty node, keeping them cached
+func (pool *bufferPool) flush() error {
+	for _, n := range pool.nodes {
+		if n.dirty {
+			if err := pool.write(n); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (pool *bufferPool) write(n *node) error {
+	page, err := encodeNode(n)
+	if err != nil {
+		return err
+	}
+	if _, err := pool.file.WriteAt(page, int64(n.id)*PageSize); err != nil {
+		return err
+	}
+	n.dirty = false
+	return nil
+}
+
+// --- page encoding ---
+
+func (n *node) size() int {
+	size := nodeHeaderSize
+	if !n.leaf {
+		size += childSize * len(n.children)
+	}
+	for _, entry := range n.entries {
+		size += entrySize(entry)
+	}
+	return size
+}
+
+func encodeNode(n *node) ([]byte, error) {
+	if n.size() > PageSize {
+		return nil, fmt.Errorf("%w: page %d overflows", ErrCorruptPage, n.id)
+	}
+
+	buf := make([]byte, nodeHeaderSize, PageSize)
+	if n.leaf {
+		buf[0] = nodeLeaf
+	} else {
+		buf[0] = nodeInternal
+	}
+	binary.LittleEndian.PutUint16(buf[1:3], uint16(len(n.entries)))
+	binary.LittleEndian.PutUint32(buf[3:7], uint32(n.next))
+
+	if n.leaf {
+		for _, entry := range n.entries {
+			buf = appendEntry(buf, entry)
+		}
+	} else {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(n.children[0]))
+		for i, entry := range n.entries {
+			buf = appendEntry(buf, entry)
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(n.children[i+1]))
+		}
+	}
+
+	return buf[:PageSize], nil
+}
+
+func decodeNode(id pageID, page []byte) (*node, error) {
+	n := &node{id: id}
+
+	switch page[0] {
+	case nodeLeaf:
+		n.leaf = true
+	case nodeInternal:
+	default:
+		return nil, fmt.Errorf("%w: page %d has type %d", ErrCorruptPage, id, page[0])
+	}
+
+	count := int(binary.LittleEndian.Uint16(page[1:3]))
+	n.next = pageID(binary.LittleEndian.Uint32(page[3:7]))
+	n.entries = make([]IndexEntry, 0, count)
+
+	pos := nodeHeaderSize
+	if !n.leaf {
+		n.children = make([]pageID, 0, count+1)
+		n.children = append(n.children, pageID(binary.LittleEndian.Uint32(page[pos:])))
+		pos += childSize
+	}
+
+	for i := 0; i < count; i++ {
+		entry, read, err := readEntry(page[pos:])
+		if err != nil {
+			return nil, fmt.Errorf("%w: page %d: %v", ErrCorruptPage, id, err)
+		}
+		pos += read
+		n.entries = append(n.entries, entry)
+
+		if !n.leaf {
+			if pos+childSize > len(page) {
+				return nil, fmt.Errorf("%w: page %d truncated", ErrCorruptPage, id)
+			}
+			n.children = append(n.children, pageID(binary.LittleEndian.Uint32(page[pos:])))
+			pos += childSize
+		}
+	}
+
+	return n, nil
+}
+
+// entry: keyLen uvarint | key | fileLen uvarint | file | offset varint | timestamp varint
+func appendEntry(buf []byte, entry IndexEntry) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(entry.Key)))
+	buf = append(buf, entry.Key...)
+	buf = binary.AppendUvarint(buf, uint64(len(entry.FileName)))
+	buf = append(buf, entry.FileName...)
+	buf = binary.AppendVarint(buf, entry.Offset)
+	buf = binary.AppendVarint(buf, entry.Timestamp)
+	return buf
+}
+
+func readEntry(buf []byte) (IndexEntry, int, error) {
+	var entry IndexEntry
+	pos := 0
+
+	readString := func() (string, error) {
+		length, n := binary.Uvarint(buf[pos:])
+		if n <= 0 || uint64(len(buf)-pos-n) < length {
+			return "", errors.New("bad string")
+		}
+		pos += n
+		s := string(buf[pos : pos+int(length)])
+		pos += int(length)
+		return s, nil
+	}
+
+	readVarint := func() (int64, error) {
+		value, n := binary.Varint(buf[pos:])
+		if n <= 0 {
+			return 0, errors.New("bad varint")
+		}
+		pos += n
+		return value, nil
+	}
+
+	var err error
+	if entry.Key, err = readString(); err != nil {
+		return entry, 0, err
+	}
+	if entry.FileName, err = readString(); err != nil {
+		return entry, 0, err
+	}
+	if entry.Offset, err = readVarint(); err != nil {
+		return entry, 0, err
+	}
+	if entry.Timestamp, err = readVarint(); err != nil {
+		return entry, 0, err
+	}
+
+	return entry, pos, nil
+}
+
+func entrySize(entry IndexEntry) int {
+	return uvarintLen(uint64(len(entry.Key))) + len(entry.Key) +
+		uvarintLen(uint64(len(entry.FileName))) + len(entry.FileName) +
+		varintLen(entry.Offset) + varintLen(entry.Timestamp)
+}
+
+func uvarintLen(x uint64) int {
+	n := 1
+	for x >= 0x80 {
+		x >>= 7
+		n++
+	}
+	return n
+}
+
+func varintLen(x int64) int {
+	// zig-zag, same as binary.PutVarint
+	ux := uint64(x) << 1
+	if x < 0 {
+		ux = ^ux
+	}
+	return uvarintLen(ux)
+}
+
+// lowerBound returns the first position whose entry is >= entry
+func lowerBound(entries []IndexEntry, entry IndexEntry) int {
+	return sort.Search(len(entries), func(i int) bool {
+		return compareEntries(entries[i], entry) >= 0
+	})
+}
+
+// upperBound returns the first position whose entry is > entry
+func upperBound(entries []IndexEntry, entry IndexEntry) int {
+	return sort.Search(len(entries), func(i int) bool {
+		return compareEntries(entries[i], entry) > 0
+	})
+}
+
+// splitPoint picks the index where the encoded size of entries crosses half
+func splitPoint(entries []IndexEntry) int {
+	total := 0
+	for _, entry := range entries {
+		total += entrySize(entry)
+	}
+
+	half, size := total/2, 0
+	for i, entry := range entries {
+		size += entrySize(entry)
+		if size >= half {
+			if i+1 >= len(entries) {
+				return len(entries) - 1
+			}
+			return i + 1
+		}
+	}
+	return len(entries) / 2
+}
@@ -1,12 +1,14 @@
 package index
 
 import (
+	"container/list"
 	"fmt"
+	"log"
 	"math"
+	"slices"
 	"sync"
 
 	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
-	"github.com/tidwall/btree"
 )
 
 // IndexEntry represents a pointer from an index to an actual log record.
@@ -24,48 +26,101 @@ type LessFunc func(a, b IndexEntry) bool
 type Index struct {
 	Name      string
 	Extractor func(*types.LogEntry) string // extracts key from a log entry
-	Tree      *btree.BTreeG[IndexEntry]
+	Tree      Tree                         // entries of the active segment
+	Sealed    map[string]Tree              // sealed segment -> its sidecar tree
+	live      map[string]bool              // segment in Tree -> holds all of its entries
 }
 
 // IndexManager manages multiple user-defined indexes.
 type IndexManager struct {
-	indexes map[string]*Index
-	mutex   sync.RWMutex
+	indexes  map[string]*Index
+	segments map[string]*list.Element // sealed segments whose sidecar indexes are open -> their place in recent
+	recent   *list.List               // open sealed segments, front = most recently used
+	maxOpen  int                      // open sealed segments before the least recently used is closed, 0 = unlimited
+	inserted map[string]bool          // segments that received entries in this process
+	backend  Backend
+	mutex    sync.RWMutex
+	lruMutex sync.Mutex // guards recent for LoadSegment under a read lock
 }
 
-// NewIndexManager creates a new empty index manager with default timestamp index.
+const (
+	timestampIndex = "timestamp"
+
+	// digits of the largest uint64, every timestamp key is padded to this width
+	timestampKeyWidth = 20
+
+	// DefaultMaxOpenSegments bounds the sealed segments whose sidecars stay open
+	DefaultMaxOpenSegments = 256
+)
+
+// TimestampKey is the key of a timestamp in the default timestamp index. The timestamp
+// is offset by 2^63 so negative ones sort first, and zero padded so string order is
+// numeric order and range walks can seek.
+func TimestampKey(timestamp int64) string {
+	return fmt.Sprintf("%0*d", timestampKeyWidth, uint64(timestamp)^(1<<63))
+}
+
+// NewIndexManager creates a new empty in-memory index manager with default timestamp index.
 func NewIndexManager() *IndexManager {
+	// the memory backend never fails
+	indexManager, _ := NewIndexManagerWithBackend(MemoryBackend())
+	return indexManager
+}
+
+// NewIndexManagerWithBackend creates an index manager whose indexes live in the given backend
+func NewIndexManagerWithBackend(backend Backend) (*IndexManager, error) {
 	indexManager := &IndexManager{
-		indexes: make(map[string]*Index),
+		indexes:  make(map[string]*Index),
+		segments: make(map[string]*list.Element),
+		recent:   list.New(),
+		maxOpen:  DefaultMaxOpenSegments,
+		inserted: make(map[string]bool),
+		backend:  backend,
 	}
 
 	// Default timestamp index
-	indexManager.CreateIndex("timestamp", func(logEntry *types.LogEntry) string {
-		// pad timestamp so string comparison is numeric
-		return fmt.Sprintf("%d", logEntry.Timestamp)
+	err := indexManager.CreateIndex(timestampIndex, func(logEntry *types.LogEntry) string {
+		return TimestampKey(logEntry.Timestamp)
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	return indexManager
+	return indexManager, nil
+}
+
+// SetMaxOpenSegments sets how many sealed segments keep their sidecars open (0 = unlimited).
+// Past it the least recently used segment is closed; LoadSegment opens it again when needed.
+func (indexManager *IndexManager) SetMaxOpenSegments(limit int) {
+	indexManager.mutex.Lock()
+	defer indexManager.mutex.Unlock()
+	indexManager.maxOpen = limit
+	indexManager.evictSegments()
 }
 
 // CreateIndex defines a new index with a name and extractor function
-func (indexManager *IndexManager) CreateIndex(name string, extractor func(*types.LogEntry) string) {
+func (indexManager *IndexManager) CreateIndex(name string, extractor func(*types.LogEntry) string) error {
 	indexManager.mutex.Lock()
 	defer indexManager.mutex.Unlock()
 
-	// comparator: sort by Key first, then Timestamp for uniqueness
-	comparator := func(a, b IndexEntry) bool {
-		if a.Key == b.Key {
-			return a.Timestamp < b.Timestamp
-		}
-		return a.Key < b.Key
+	tree, err := indexManager.backend(name)
+	if err != nil {
+		return err
+	}
+
+	// replacing an index: release the old trees
+	if old, exists := indexManager.indexes[name]; exists {
+		old.close()
 	}
 
 	indexManager.indexes[name] = &Index{
 		Name:      name,
 		Extractor: extractor,
-		Tree:      btree.NewBTreeG(comparator),
+		Tree:      tree,
+		Sealed:    make(map[string]Tree),
+		live:      make(map[string]bool),
 	}
+	return nil
 }
 
 // DropIndex removes an index.
@@ -73,32 +128,74 @@ func (indexManager *IndexManager) DropIndex(name string) error {
 	indexManager.mutex.Lock()
 	defer indexManager.mutex.Unlock()
 
-	if _, exists := indexManager.indexes[name]; !exists {
+	idx, exists := indexManager.indexes[name]
+	if !exists {
 		return fmt.Errorf("index %s not found", name)
 	}
 
+	idx.close()
 	delete(indexManager.indexes, name)
 	return nil
 }
 
+// Close releases every tree of every index
+func (indexManager *IndexManager) Close() error {
+	indexManager.mutex.Lock()
+	defer indexManager.mutex.Unlock()
+
+	var firstErr error
+	for _, idx := range indexManager.indexes {
+		if err := idx.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
 // Insert inserts a log into all indexes
-func (indexManager *IndexManager) Insert(entry *types.LogEntry, fileName string, offset int64) {
-	indexManager.mutex.RLock()
-	defer indexManager.mutex.RUnlock()
+func (indexManager *IndexManager) Insert(entry *types.LogEntry, fileName string, offset int64) error {
+	indexManager.mutex.Lock()
+	defer indexManager.mutex.Unlock()
+
+	seen := indexManager.inserted[fileName]
+	indexManager.inserted[fileName] = true
 
 	for _, idx := range indexManager.indexes {
+		// an index created after the segment got its first entries only covers part of it
+		if _, ok := idx.live[fileName]; !ok {
+			idx.live[fileName] = !seen
+		}
+
 		key := idx.Extractor(entry)
 
 		if key == "" {
 			continue
 		}
 
-		idx.Tree.Set(IndexEntry{
+		err := idx.Tree.Set(IndexEntry{
 			Key:       key,
 			FileName:  fileName,
 			Offset:    offset,
 			Timestamp: entry.Timestamp,
 		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MarkIncomplete records that an entry of a segment could not be indexed, so no index
+// covers the segment any more and queries scan it instead
+func (indexManager *IndexManager) MarkIncomplete(fileName string) {
+	indexManager.mutex.Lock()
+	defer indexManager.mutex.Unlock()
+
+	for _, idx := range indexManager.indexes {
+		if _, sealed := idx.Sealed[fileName]; !sealed {
+			idx.live[fileName] = false
+		}
 	}
 }
 
@@ -115,9 +212,9 @@ func (indexManager *IndexManager) Search(indexName, key string) []IndexEntry {
 	results := []IndexEntry{}
 
 	// pivot search starts at (key, timestamp=min value)
-	pivot := IndexEntry{Key: key, Timestamp: math.MinInt64}
+	pivot := IndexEntry{Key: key, Timestamp: math.MinInt64, Offset: math.MinInt64}
 
-	idx.Tree.Ascend(pivot, func(item IndexEntry) bool {
+	idx.ascend(nil, pivot, func(item IndexEntry) bool {
 		if item.Key != key {
 			return false // stop once keys don't match
 		}
@@ -139,14 +236,12 @@ func (indexManager *IndexManager) RangeSearch(indexName string, start, end int64
 	}
 
 	results := []IndexEntry{}
-	idx.Tree.Ascend(IndexEntry{}, func(item IndexEntry) bool {
+	pivot, ordered := idx.rangePivot(start)
+	idx.ascend(nil, pivot, func(item IndexEntry) bool {
 		if item.Timestamp >= start && item.Timestamp <= end {
 			results = append(results, item)
 		}
-		if item.Timestamp > end {
-			return false
-		}
-		return true
+		return !ordered || item.Timestamp <= end
 	})
 
 	return results
@@ -159,25 +254,187 @@ func (indexManager *IndexManager) HasIndex(field string) bool {
 	return ok
 }
 
-func (im *IndexManager) Lookup(indexName string, start, end int64, key string) []int64 {
-	im.mutex.RLock()
-	defer im.mutex.RUnlock()
+// Lookup returns the offsets of entries within [start, end] matching key (any key if empty),
+// grouped by the segment file they live in. Offsets are sorted per segment.
+// A zero start or end leaves that side of the range open.
+func (indexManager *IndexManager) Lookup(indexName string, start, end int64, key string) map[string][]int64 {
+	offsets, _ := indexManager.LookupSegments(indexName, nil, start, end, key)
+	return offsets
+}
 
-	idx, ok := im.indexes[indexName]
+// LookupSegments is Lookup limited to the given segments (nil for every open one), e.g. those
+// whose time range overlaps the query, so the sidecars of the others aren't walked.
+// covered holds the segments the index covered in full during the lookup: only their
+// offsets are complete, the others have to be scanned.
+func (indexManager *IndexManager) LookupSegments(indexName string, segments []string, start, end int64, key string) (offsets map[string][]int64, covered map[string]bool) {
+	indexManager.mutex.RLock()
+	defer indexManager.mutex.RUnlock()
+
+	idx, ok := indexManager.indexes[indexName]
 	if !ok {
-		return nil
+		return nil, nil
+	}
+
+	covered = make(map[string]bool)
+	if segments == nil {
+		for segment := range idx.Sealed {
+			covered[segment] = true
+		}
+		for segment, complete := range idx.live {
+			covered[segment] = covered[segment] || complete
+		}
+	} else {
+		for _, segment := range segments {
+			_, sealed := idx.Sealed[segment]
+			covered[segment] = sealed || idx.live[segment]
+		}
 	}
 
-	results := []int64{}
-	idx.Tree.Ascend(IndexEntry{}, func(item IndexEntry) bool {
-		if item.Timestamp > end {
-			return false
+	inRange := func(timestamp int64) bool {
+		return (start == 0 || timestamp >= start) && (end == 0 || timestamp <= end)
+	}
+	wanted := func(fileName string) bool {
+		_, ok := covered[fileName]
+		return segments == nil || ok
+	}
+
+	offsets = make(map[string][]int64)
+
+	if key != "" {
+		// entries of one key are ordered by timestamp: jump to the start of the range
+		pivot := IndexEntry{Key: key, Timestamp: start, Offset: math.MinInt64}
+		if start == 0 {
+			pivot.Timestamp = math.MinInt64
 		}
-		if item.Timestamp >= start && (key == "" || item.Key == key) {
-			results = append(results, item.Offset)
+
+		idx.ascend(segments, pivot, func(item IndexEntry) bool {
+			if item.Key != key || (end != 0 && item.Timestamp > end) {
+				return false
+			}
+			if wanted(item.FileName) {
+				offsets[item.FileName] = append(offsets[item.FileName], item.Offset)
+			}
+			return true
+		})
+	} else {
+		pivot, ordered := idx.rangePivot(start)
+		idx.ascend(segments, pivot, func(item IndexEntry) bool {
+			if inRange(item.Timestamp) {
+				if wanted(item.FileName) {
+					offsets[item.FileName] = append(offsets[item.FileName], item.Offset)
+				}
+				return true
+			}
+			// in time order nothing after the first entry past end matches
+			return !ordered || end == 0 || item.Timestamp <= end
+		})
+	}
+
+	for fileName, segmentOffsets := range offsets {
+		slices.Sort(segmentOffsets)
+		offsets[fileName] = slices.Compact(segmentOffsets)
+	}
+
+	return offsets, covered
+}
+
+// HasSegmentIndex reports whether every entry of a segment is covered by the index:
+// either its sidecar is open or all of its entries were inserted by this process.
+func (indexManager *IndexManager) HasSegmentIndex(indexName, segmentFile string) bool {
+	indexManager.mutex.RLock()
+	defer indexManager.mutex.RUnlock()
+
+	idx, ok := indexManager.indexes[indexName]
+	if !ok {
+		return false
+	}
+	if _, ok := idx.Sealed[segmentFile]; ok {
+		return true
+	}
+	return idx.live[segmentFile]
+}
+
+// SegmentEntries returns the entries of one segment within [start, end] (zero leaves
+// a side open). ok is false when the index doesn't cover every entry of the segment.
+func (indexManager *IndexManager) SegmentEntries(indexName, segmentFile string, start, end int64) (entries []IndexEntry, ok bool) {
+	indexManager.mutex.RLock()
+	defer indexManager.mutex.RUnlock()
+
+	idx, found := indexManager.indexes[indexName]
+	if !found {
+		return nil, false
+	}
+
+	tree, sealed := idx.Sealed[segmentFile]
+	if !sealed {
+		if !idx.live[segmentFile] {
+			return nil, false
+		}
+		tree = idx.Tree
+	}
+
+	err := tree.Scan(func(item IndexEntry) bool {
+		if item.FileName == segmentFile &&
+			(start == 0 || item.Timestamp >= start) && (end == 0 || item.Timestamp <= end) {
+			entries = append(entries, item)
 		}
 		return true
 	})
+	if err != nil {
+		log.Printf("[INDEX] %s/%s: %v", indexName, segmentFile, err)
+		return nil, false
+	}
 
-	return results
+	return entries, true
+}
+
+// ascend walks the active tree and then the sealed trees of segments, every sealed tree
+// if segments is nil. Order is only guaranteed within a tree; iter returning false
+// stops the current tree.
+func (idx *Index) ascend(segments []string, pivot IndexEntry, iter func(IndexEntry) bool) {
+	if err := idx.Tree.Ascend(pivot, iter); err != nil {
+		log.Printf("[INDEX] %s: %v", idx.Name, err)
+	}
+
+	walk := func(segment string, tree Tree) {
+		if err := tree.Ascend(pivot, iter); err != nil {
+			log.Printf("[INDEX] %s/%s: %v", idx.Name, segment, err)
+		}
+	}
+	if segments == nil {
+		for segment, tree := range idx.Sealed {
+			walk(segment, tree)
+		}
+		return
+	}
+	for _, segment := range segments {
+		if tree, ok := idx.Sealed[segment]; ok {
+			walk(segment, tree)
+		}
+	}
+}
+
+// rangePivot is where a walk over timestamps from start on begins. ordered reports
+// that the keys follow timestamps, so the walk can stop at the first entry past the range.
+func (idx *Index) rangePivot(start int64) (pivot IndexEntry, ordered bool) {
+	if idx.Name != timestampIndex {
+		return minEntry, false
+	}
+	if start == 0 {
+		return minEntry, true
+	}
+	return IndexEntry{Key: TimestampKey(start), Timestamp: start, Offset: math.MinInt64}, true
+}
+
+func (idx *Index) close() error {
+	var firstErr error
+	if err := idx.Tree.Close(); err != nil {
+		firstErr = err
+	}
+	for _, tree := range idx.Sealed {
+		if err := tree.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
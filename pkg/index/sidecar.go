@@ -0,0 +1,270 @@
+package index
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+const (
+	sidecarExtension = ".idx"
+
+	// sealed segments are many and mostly cold, keep their page caches small
+	sealedCachePages = 8
+)
+
+// SidecarPath returns the index file written next to a sealed segment,
+// e.g. segment_123.log + "timestamp" -> segment_123.timestamp.idx
+func SidecarPath(dir, segmentFile, indexName string) string {
+	base := strings.TrimSuffix(filepath.Base(segmentFile), filepath.Ext(segmentFile))
+	return filepath.Join(dir, base+"."+indexName+sidecarExtension)
+}
+
+// PersistSegment moves the entries of a sealed segment out of the active trees into
+// one bulk loaded B+ tree sidecar per index that holds all of them. The sidecars never
+// change afterwards.
+func (indexManager *IndexManager) PersistSegment(dir, segmentFile string) error {
+	indexManager.mutex.Lock()
+	defer indexManager.mutex.Unlock()
+
+	for name, idx := range indexManager.indexes {
+		// Scan is ordered, so entries come out ready for bulk loading
+		entries := []IndexEntry{}
+		err := idx.Tree.Scan(func(item IndexEntry) bool {
+			if item.FileName == segmentFile {
+				entries = append(entries, item)
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if err := idx.Tree.Delete(entry); err != nil {
+				return err
+			}
+		}
+
+		// an index missing entries of the segment gets no sidecar, the segment is scanned
+		complete := idx.live[segmentFile]
+		delete(idx.live, segmentFile)
+		if !complete {
+			continue
+		}
+
+		path := SidecarPath(dir, segmentFile, name)
+		if err := writeSidecar(path, entries); err != nil {
+			return err
+		}
+
+		tree, err := OpenBPTree(path, sealedCachePages)
+		if err != nil {
+			return err
+		}
+		if old, ok := idx.Sealed[segmentFile]; ok {
+			old.Close()
+		}
+		idx.Sealed[segmentFile] = tree
+	}
+
+	indexManager.openedSegment(segmentFile)
+	delete(indexManager.inserted, segmentFile)
+	return nil
+}
+
+// BuildSegment writes the sidecars of a segment created outside the ingest path
+// (e.g. by compaction) from its entries and their offsets, and opens them
+func (indexManager *IndexManager) BuildSegment(dir, segmentFile string, entries []*types.LogEntry, offsets []int64) error {
+	indexManager.mutex.Lock()
+	defer indexManager.mutex.Unlock()
+
+	for name, idx := range indexManager.indexes {
+		items := make([]IndexEntry, 0, len(entries))
+		for i, entry := range entries {
+			key := idx.Extractor(entry)
+			if key == "" {
+				continue
+			}
+			items = append(items, IndexEntry{
+				Key:       key,
+				FileName:  segmentFile,
+				Offset:    offsets[i],
+				Timestamp: entry.Timestamp,
+			})
+		}
+		slices.SortFunc(items, compareEntries)
+
+		path := SidecarPath(dir, segmentFile, name)
+		if err := writeSidecar(path, items); err != nil {
+			return err
+		}
+
+		tree, err := OpenBPTree(path, sealedCachePages)
+		if err != nil {
+			return err
+		}
+		if old, ok := idx.Sealed[segmentFile]; ok {
+			old.Close()
+		}
+		idx.Sealed[segmentFile] = tree
+	}
+
+	indexManager.openedSegment(segmentFile)
+	return nil
+}
+
+// LoadSegment lazily opens the sidecar files of a sealed segment.
+// Segments already open (or persisted by this process) are only marked as recently used.
+// Missing sidecars are not an error: the segment is simply not indexed and gets scanned.
+func (indexManager *IndexManager) LoadSegment(dir, segmentFile string) error {
+	indexManager.mutex.RLock()
+	element, loaded := indexManager.segments[segmentFile]
+	if loaded {
+		indexManager.lruMutex.Lock()
+		indexManager.recent.MoveToFront(element)
+		indexManager.lruMutex.Unlock()
+	}
+	indexManager.mutex.RUnlock()
+
+	if loaded {
+		return nil
+	}
+
+	indexManager.mutex.Lock()
+	defer indexManager.mutex.Unlock()
+
+	// another query might have loaded it meanwhile
+	if _, loaded := indexManager.segments[segmentFile]; loaded {
+		return nil
+	}
+
+	for name, idx := range indexManager.indexes {
+		path := SidecarPath(dir, segmentFile, name)
+		if _, err := os.Stat(path); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+
+		tree, err := OpenBPTree(path, sealedCachePages)
+		if err != nil {
+			indexManager.closeSegment(segmentFile)
+			return err
+		}
+		if name == timestampIndex {
+			current, err := currentTimestampKeys(tree)
+			if err != nil {
+				tree.Close()
+				indexManager.closeSegment(segmentFile)
+				return err
+			}
+			if !current {
+				// written before timestamp keys were padded and offset, range walks would misplace it
+				tree.Close()
+				log.Printf("[INDEX] ignoring %s with outdated timestamp keys, the segment gets scanned", path)
+				continue
+			}
+		}
+		idx.Sealed[segmentFile] = tree
+	}
+
+	indexManager.openedSegment(segmentFile)
+	return nil
+}
+
+// currentTimestampKeys reports whether a timestamp sidecar uses TimestampKey keys
+func currentTimestampKeys(tree Tree) (bool, error) {
+	current := true
+	err := tree.Ascend(minEntry, func(item IndexEntry) bool {
+		current = len(item.Key) == timestampKeyWidth
+		return false
+	})
+	return current, err
+}
+
+// openedSegment marks the sidecars of a sealed segment open and most recently used,
+// then closes the least recently used segments past the limit. Callers hold the write lock.
+func (indexManager *IndexManager) openedSegment(segmentFile string) {
+	if element, ok := indexManager.segments[segmentFile]; ok {
+		indexManager.recent.MoveToFront(element)
+	} else {
+		indexManager.segments[segmentFile] = indexManager.recent.PushFront(segmentFile)
+	}
+	indexManager.evictSegments()
+}
+
+// evictSegments closes the least recently used sealed segments until at most maxOpen stay open
+func (indexManager *IndexManager) evictSegments() {
+	for indexManager.maxOpen > 0 && indexManager.recent.Len() > indexManager.maxOpen {
+		indexManager.closeSegment(indexManager.recent.Back().Value.(string))
+	}
+}
+
+// closeSegment closes the sidecar trees of a sealed segment, leaving their files for LoadSegment
+func (indexManager *IndexManager) closeSegment(segmentFile string) {
+	for _, idx := range indexManager.indexes {
+		if tree, ok := idx.Sealed[segmentFile]; ok {
+			tree.Close()
+			delete(idx.Sealed, segmentFile)
+		}
+	}
+	if element, ok := indexManager.segments[segmentFile]; ok {
+		indexManager.recent.Remove(element)
+		delete(indexManager.segments, segmentFile)
+	}
+}
+
+// DropSegment closes the sidecar trees of a deleted segment and removes their files,
+// including sidecars of indexes that no longer exist
+func (indexManager *IndexManager) DropSegment(dir, segmentFile string) error {
+	indexManager.mutex.Lock()
+	defer indexManager.mutex.Unlock()
+
+	indexManager.closeSegment(segmentFile)
+	for _, idx := range indexManager.indexes {
+		delete(idx.live, segmentFile)
+	}
+	delete(indexManager.inserted, segmentFile)
+
+	base := strings.TrimSuffix(filepath.Base(segmentFile), filepath.Ext(segmentFile))
+	paths, err := filepath.Glob(filepath.Join(dir, base+".*"+sidecarExtension))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSidecar bulk loads entries into a new tree file atomically (write tmp -> rename)
+func writeSidecar(path string, entries []IndexEntry) error {
+	tmp := path + ".tmp"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	tree, err := OpenBPTree(tmp, sealedCachePages)
+	if err != nil {
+		return err
+	}
+
+	if err := tree.BulkLoad(entries); err != nil {
+		tree.Close()
+		return err
+	}
+
+	if err := tree.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,116 @@
+package index
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tidwall/btree"
+)
+
+// Tree stores the entries of an index ordered by compareEntries
+type Tree interface {
+	Set(entry IndexEntry) error
+	Delete(entry IndexEntry) error
+	Ascend(pivot IndexEntry, iter func(IndexEntry) bool) error
+	Scan(iter func(IndexEntry) bool) error
+	Len() int
+	Close() error
+}
+
+// Backend creates the tree behind a named index
+type Backend func(indexName string) (Tree, error)
+
+// minEntry sorts before every real entry (keys are never empty)
+var minEntry = IndexEntry{Timestamp: math.MinInt64, Offset: math.MinInt64}
+
+// compareEntries orders by Key, then Timestamp, then position in the segments.
+// Every field takes part so entries with the same key and timestamp don't overwrite each other.
+func compareEntries(a, b IndexEntry) int {
+	if c := strings.Compare(a.Key, b.Key); c != 0 {
+		return c
+	}
+	if a.Timestamp != b.Timestamp {
+		if a.Timestamp < b.Timestamp {
+			return -1
+		}
+		return 1
+	}
+	if c := strings.Compare(a.FileName, b.FileName); c != 0 {
+		return c
+	}
+	if a.Offset != b.Offset {
+		if a.Offset < b.Offset {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+// MemoryBackend keeps indexes in an in-memory tidwall btree
+func MemoryBackend() Backend {
+	return func(indexName string) (Tree, error) {
+		return newMemoryTree(), nil
+	}
+}
+
+// DiskBackend keeps indexes in on-disk B+ trees (<dir>/<index>.bpt), so their size is
+// bounded by disk instead of memory. The trees only hold entries of the active segment,
+// which are rebuilt from the WAL on startup, so existing files are started over.
+func DiskBackend(dir string, cachePages int) Backend {
+	return func(indexName string) (Tree, error) {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+
+		path := filepath.Join(dir, indexName+".bpt")
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		return OpenBPTree(path, cachePages)
+	}
+}
+
+// memoryTree adapts tidwall btree to the Tree interface
+type memoryTree struct {
+	tree *btree.BTreeG[IndexEntry]
+}
+
+func newMemoryTree() *memoryTree {
+	return &memoryTree{
+		tree: btree.NewBTreeG(func(a, b IndexEntry) bool {
+			return compareEntries(a, b) < 0
+		}),
+	}
+}
+
+func (memoryTree *memoryTree) Set(entry IndexEntry) error {
+	memoryTree.tree.Set(entry)
+	return nil
+}
+
+func (memoryTree *memoryTree) Delete(entry IndexEntry) error {
+	memoryTree.tree.Delete(entry)
+	return nil
+}
+
+func (memoryTree *memoryTree) Ascend(pivot IndexEntry, iter func(IndexEntry) bool) error {
+	memoryTree.tree.Ascend(pivot, iter)
+	return nil
+}
+
+func (memoryTree *memoryTree) Scan(iter func(IndexEntry) bool) error {
+	memoryTree.tree.Scan(iter)
+	return nil
+}
+
+func (memoryTree *memoryTree) Len() int {
+	return memoryTree.tree.Len()
+}
+
+func (memoryTree *memoryTree) Close() error {
+	return nil
+}
@@ -3,13 +3,15 @@ package ingest
 import (
 	"sync"
 
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/storage"
 	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
 )
 
 type MemoryBuffer struct {
-	buffer  []*types.LogEntry
-	maxSize int
-	mutex   sync.Mutex
+	buffer    []*types.LogEntry
+	positions []storage.WALPosition // WAL record of each entry, zero when unknown
+	maxSize   int
+	mutex     sync.Mutex
 	// b+ tree - inmemory index for recent log retrieval
 }
 
@@ -22,21 +24,55 @@ func NewMemoryBuffer(maxSize int) *MemoryBuffer {
 
 // Append a log entry to the buffer
 func (memoryBuffer *MemoryBuffer) Append(entry *types.LogEntry) {
+	memoryBuffer.AppendAt(entry, storage.WALPosition{})
+}
+
+// AppendAt appends a log entry together with the position of its WAL record
+func (memoryBuffer *MemoryBuffer) AppendAt(entry *types.LogEntry, position storage.WALPosition) {
 	memoryBuffer.mutex.Lock()
 	defer memoryBuffer.mutex.Unlock()
 	memoryBuffer.buffer = append(memoryBuffer.buffer, entry)
+	memoryBuffer.positions = append(memoryBuffer.positions, position)
 }
 
 // Flush returns all entries and resets the buffer
 func (memoryBuffer *MemoryBuffer) Flush() []*types.LogEntry {
+	logEntries, _ := memoryBuffer.Drain()
+	return logEntries
+}
+
+// Drain returns all entries with their WAL positions and resets the buffer
+func (memoryBuffer *MemoryBuffer) Drain() ([]*types.LogEntry, []storage.WALPosition) {
 	memoryBuffer.mutex.Lock()
 	defer memoryBuffer.mutex.Unlock()
 
-	logEntries := memoryBuffer.buffer
+	logEntries, positions := memoryBuffer.buffer, memoryBuffer.positions
 
 	memoryBuffer.buffer = []*types.LogEntry{}
+	memoryBuffer.positions = nil
 
-	return logEntries
+	return logEntries, positions
+}
+
+// Requeue puts entries taken by Drain back in front of the buffer, e.g. when writing them failed
+func (memoryBuffer *MemoryBuffer) Requeue(entries []*types.LogEntry, positions []storage.WALPosition) {
+	memoryBuffer.mutex.Lock()
+	defer memoryBuffer.mutex.Unlock()
+
+	memoryBuffer.buffer = append(entries[:len(entries):len(entries)], memoryBuffer.buffer...)
+	memoryBuffer.positions = append(positions[:len(positions):len(positions)], memoryBuffer.positions...)
+}
+
+// Snapshot returns a copy of the buffered entries, oldest first, leaving them buffered
+func (memoryBuffer *MemoryBuffer) Snapshot() []types.LogEntry {
+	memoryBuffer.mutex.Lock()
+	defer memoryBuffer.mutex.Unlock()
+
+	entries := make([]types.LogEntry, len(memoryBuffer.buffer))
+	for i, entry := range memoryBuffer.buffer {
+		entries[i] = *entry
+	}
+	return entries
 }
 
 // length
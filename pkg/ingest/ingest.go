@@ -1,6 +1,7 @@
 package ingest
 
 import (
+	"log"
 	"sync"
 	"time"
 
@@ -17,9 +18,19 @@ type IngestManager struct {
 	indexManager   *index.IndexManager
 	flushInterval  time.Duration
 	stopChannel    chan struct{}
-	mutex          sync.Mutex
+	stopOnce       sync.Once
+	mutex          sync.RWMutex // appends share it, Flush takes it exclusively
+
+	// earliest WAL record written to the active segment; everything before it is in sealed segments
+	activeStart *storage.WALPosition
+
+	onAppend AppendHook
 }
 
+// AppendHook is called with every entry AppendLog accepted, once it is durable in the WAL.
+// It runs on the appending goroutine and must not block.
+type AppendHook func(entry *types.LogEntry)
+
 // NewIngestManager initializes the IngestManager
 func NewIngestManager(
 	buffer *MemoryBuffer,
@@ -29,6 +40,12 @@ func NewIngestManager(
 	indexManager *index.IndexManager,
 	flushInterval time.Duration,
 ) *IngestManager {
+	// persist the indexes of every sealed segment next to it, so they survive restarts
+	dir := segmentManager.Dir()
+	segmentManager.OnRotate(func(meta storage.SegmentMeta) error {
+		return indexManager.PersistSegment(dir, meta.FileName)
+	})
+
 	return &IngestManager{
 		buffer:         buffer,
 		walManager:     walManager,
@@ -40,65 +57,144 @@ func NewIngestManager(
 	}
 }
 
-// AppendLog appends a log entry to memory buffer and WAL
+// AppendLog appends a log entry to memory buffer and WAL.
+// Concurrent calls run in parallel so the WAL can group their fsyncs; a Flush waits
+// for appends in progress, so everything durable in the WAL is in the buffer it drains.
 func (ingestManager *IngestManager) AppendLog(entry *types.LogEntry) error {
-	ingestManager.mutex.Lock()
-	defer ingestManager.mutex.Unlock()
+	ingestManager.mutex.RLock()
+	defer ingestManager.mutex.RUnlock()
 
 	// 1. Persist immediately to WAL
-	if err := ingestManager.walManager.Append(entry); err != nil {
+	position, err := ingestManager.walManager.AppendPosition(entry)
+	if err != nil {
 		return err
 	}
 
 	// 2. Append to memory buffer
-	ingestManager.buffer.Append(entry)
+	ingestManager.buffer.AppendAt(entry, position)
+
+	if ingestManager.onAppend != nil {
+		ingestManager.onAppend(entry)
+	}
+
+	return nil
+}
+
+// AppendLogs appends entries with a single WAL write, so a batch shares one group
+// commit. On error none of them is buffered.
+func (ingestManager *IngestManager) AppendLogs(entries []*types.LogEntry) error {
+	ingestManager.mutex.RLock()
+	defer ingestManager.mutex.RUnlock()
+
+	positions, err := ingestManager.walManager.AppendBatchPositions(entries)
+	if err != nil {
+		return err
+	}
+
+	for i, entry := range entries {
+		ingestManager.buffer.AppendAt(entry, positions[i])
+		if ingestManager.onAppend != nil {
+			ingestManager.onAppend(entry)
+		}
+	}
 
 	return nil
 }
 
-// Flush writes all buffered logs to the segment and updates manifest
+// Sync waits until every entry appended so far is durable in the WAL, whatever the
+// WAL's durability mode; receivers call it before acknowledging entries
+func (ingestManager *IngestManager) Sync() error {
+	return ingestManager.walManager.Sync()
+}
+
+// Buffered returns how many appended entries wait for the next Flush
+func (ingestManager *IngestManager) Buffered() int {
+	return ingestManager.buffer.Length()
+}
+
+// Pending returns the appended entries waiting for the next Flush, oldest first.
+// A Flush in progress is waited for, so an entry is either pending or already stored.
+func (ingestManager *IngestManager) Pending() []types.LogEntry {
+	ingestManager.mutex.RLock()
+	defer ingestManager.mutex.RUnlock()
+	return ingestManager.buffer.Snapshot()
+}
+
+// OnAppend registers a hook that sees every accepted entry, e.g. to feed live tails
+func (ingestManager *IngestManager) OnAppend(hook AppendHook) {
+	ingestManager.mutex.Lock()
+	defer ingestManager.mutex.Unlock()
+	ingestManager.onAppend = hook
+}
+
+// Flush writes all buffered logs to the segment and updates manifest.
+// It also rotates the WAL once it is big or old enough and deletes WAL files
+// whose entries all sit in sealed segments.
 func (ingestManager *IngestManager) Flush() error {
 
 	ingestManager.mutex.Lock()
 	defer ingestManager.mutex.Unlock()
 
-	// 1. Get logs from memory buffer
-	logs := ingestManager.buffer.Flush()
-	if len(logs) == 0 {
+	// 1. Get logs from memory buffer; with appends locked out they are everything up to the WAL position
+	logs, positions := ingestManager.buffer.Drain()
+	rotated := false
+	if ingestManager.walManager.ShouldRotate() {
+		if err := ingestManager.walManager.Rotate(); err != nil {
+			return err
+		}
+		rotated = true
+	}
+	end := ingestManager.walManager.Position()
+
+	if len(logs) == 0 && !rotated {
 		return nil
 	}
 
 	// 2. Write logs to SegmentManager
-	for _, entry := range logs {
+	for i, entry := range logs {
+		segment := ingestManager.segmentManager.CurrFileName()
 		offset, err := ingestManager.segmentManager.Append(entry)
 		if err != nil {
+			// keep what wasn't written for the next flush; the WAL isn't released past it
+			ingestManager.buffer.Requeue(logs[i:], positions[i:])
 			return err
 		}
 
-		ingestManager.indexManager.Insert(entry, ingestManager.segmentManager.CurrFileName(), offset)
-	}
+		fileName := ingestManager.segmentManager.CurrFileName()
+		if fileName != segment {
+			ingestManager.activeStart = nil // previous segment sealed
+		}
+		// concurrent appends can reach the buffer out of WAL order, keep the earliest
+		if ingestManager.activeStart == nil || positions[i].Before(*ingestManager.activeStart) {
+			position := positions[i]
+			ingestManager.activeStart = &position
+		}
 
-	if ingestManager.segmentManager.IsSegmentRotated() {
-		meta := storage.SegmentMeta{
-			FileName:     ingestManager.segmentManager.LastRotatedFileName(),
-			Size:         ingestManager.segmentManager.LastRotatedFileSize(),
-			MinTimestamp: ingestManager.segmentManager.LastRotatedMinTimestamp(),
-			MaxTimestamp: ingestManager.segmentManager.LastRotatedMaxTimestamp(),
+		if err := ingestManager.indexManager.Insert(entry, fileName, offset); err != nil {
+			// the entry is stored but not indexed: queries have to scan its segment
+			ingestManager.indexManager.MarkIncomplete(fileName)
+			ingestManager.buffer.Requeue(logs[i+1:], positions[i+1:])
+			return err
 		}
+	}
+
+	// every segment sealed during this flush goes into the manifest, then gets compressed
+	for _, meta := range ingestManager.segmentManager.RotatedSegments() {
 		if err := ingestManager.manifest.AddSegment(meta); err != nil {
 			return err
 		}
-		ingestManager.segmentManager.ResetRotationInfo()
+		ingestManager.segmentManager.CompressSealed(ingestManager.manifest, meta)
 	}
+	ingestManager.segmentManager.ResetRotationInfo()
 
-	// 3. after segment persisted, mark WAL seq flushed
-	currSeq := ingestManager.walManager.Meta.CurrentSeq
-	// everything before the active WAL file is persisted; safe to delete
-	if err := ingestManager.walManager.MarkFlushed(currSeq - 1); err != nil {
-		return err
+	// 3. release the WAL up to the first record still held only by the active segment.
+	// A zero position (entry replayed from the WAL) never releases anything past the
+	// current mark, so replayed entries stay in the WAL until their segment is sealed.
+	release := end
+	if ingestManager.activeStart != nil {
+		release = *ingestManager.activeStart
 	}
-
-	return nil
+	return ingestManager.walManager.MarkFlushedPosition(release)
 }
 
 // StartBackgroundFlush starts periodic flushes in a separate goroutine
@@ -119,13 +215,44 @@ func (ingestManager *IngestManager) StartBackgroundFlush() {
 
 // StopBackgroundFlush stops the periodic flush goroutine
 func (ingestManager *IngestManager) StopBackgroundFlush() {
-	close(ingestManager.stopChannel)
+	ingestManager.stopOnce.Do(func() {
+		close(ingestManager.stopChannel)
+	})
 }
 
+// Close stops the periodic flush, flushes what is buffered, waits for sealed segments
+// being compressed and closes the segment manager and the WAL
+func (ingestManager *IngestManager) Close() error {
+	ingestManager.StopBackgroundFlush()
+
+	err := ingestManager.Flush()
+	if closeErr := ingestManager.segmentManager.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := ingestManager.walManager.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// RecoverFromWAL replays unflushed WAL entries into segments, failing on WAL
+// corruption other than a torn final record
 func (ingestManager *IngestManager) RecoverFromWAL() error {
-	entries, err := ingestManager.walManager.ReplayAllUnflushed()
+	_, err := ingestManager.RecoverFromWALWithMode(storage.RecoverStrict)
+	return err
+}
+
+// RecoverFromWALWithMode replays unflushed WAL entries into segments and reports
+// how many records and bytes had to be discarded
+func (ingestManager *IngestManager) RecoverFromWALWithMode(mode storage.RecoveryMode) (*storage.RecoveryReport, error) {
+	entries, report, err := ingestManager.walManager.Recover(mode)
 	if err != nil {
-		return err
+		return report, err
+	}
+
+	if report.DiscardedRecords > 0 {
+		log.Printf("[RECOVERY] discarded %d record(s), %d byte(s) from %v",
+			report.DiscardedRecords, report.DiscardedBytes, report.TruncatedFiles)
 	}
 
 	for _, e := range entries {
@@ -134,8 +261,8 @@ func (ingestManager *IngestManager) RecoverFromWAL() error {
 
 	// --- Flush recovered logs to segments ---
 	if err := ingestManager.Flush(); err != nil {
-		return err
+		return report, err
 	}
 
-	return nil
+	return report, nil
 }
@@ -0,0 +1,345 @@
+package msgpack
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// Minimal MessagePack (https://github.com/msgpack/msgpack/blob/master/spec.md), what
+// the Fluent Forward protocol needs. Values decode to
+//
+//	nil, bool, int64 (uint64 above MaxInt64), float64, string, []byte (bin),
+//	[]any, map[string]any (other key types are formatted as strings), Ext
+
+// Ext is an extension value, e.g. Fluentd's EventTime (type 0)
+type Ext struct {
+	Type int8
+	Data []byte
+}
+
+const (
+	maxDepth = 100
+	// MaxBytes bounds a single str, bin or ext value
+	MaxBytes = 64 << 20
+)
+
+// ErrMalformed means the input is not valid MessagePack
+var ErrMalformed = errors.New("malformed msgpack")
+
+// Decoder reads consecutive values from a stream
+type Decoder struct {
+	reader *bufio.Reader
+}
+
+func NewDecoder(reader io.Reader) *Decoder {
+	if buffered, ok := reader.(*bufio.Reader); ok {
+		return &Decoder{reader: buffered}
+	}
+	return &Decoder{reader: bufio.NewReader(reader)}
+}
+
+// Decode reads the next value; io.EOF when the stream ends between values,
+// io.ErrUnexpectedEOF when it ends inside one
+func (decoder *Decoder) Decode() (any, error) {
+	if _, err := decoder.reader.Peek(1); err != nil {
+		return nil, err
+	}
+	value, err := decoder.value(0)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return value, err
+}
+
+// Unmarshal decodes the single value in data
+func Unmarshal(data []byte) (any, error) {
+	decoder := NewDecoder(bytes.NewReader(data))
+	value, err := decoder.Decode()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return value, err
+}
+
+func (decoder *Decoder) value(depth int) (any, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("%w: nested deeper than %d", ErrMalformed, maxDepth)
+	}
+
+	code, err := decoder.reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case code <= 0x7f:
+		return int64(code), nil
+	case code >= 0xe0:
+		return int64(int8(code)), nil
+	case code&0xf0 == 0x80:
+		return decoder.mapValue(int(code&0x0f), depth)
+	case code&0xf0 == 0x90:
+		return decoder.array(int(code&0x0f), depth)
+	case code&0xe0 == 0xa0:
+		return decoder.text(int(code & 0x1f))
+	}
+
+	switch code {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+
+	case 0xc4, 0xc5, 0xc6:
+		length, err := decoder.length(code - 0xc4)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.bytes(length)
+
+	case 0xc7, 0xc8, 0xc9:
+		length, err := decoder.length(code - 0xc7)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.ext(length)
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return decoder.ext(1 << (code - 0xd4))
+
+	case 0xca:
+		bits, err := decoder.uint(4)
+		return float64(math.Float32frombits(uint32(bits))), err
+	case 0xcb:
+		bits, err := decoder.uint(8)
+		return math.Float64frombits(bits), err
+
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		number, err := decoder.uint(1 << (code - 0xcc))
+		if number > math.MaxInt64 {
+			return number, err
+		}
+		return int64(number), err
+	case 0xd0:
+		number, err := decoder.uint(1)
+		return int64(int8(number)), err
+	case 0xd1:
+		number, err := decoder.uint(2)
+		return int64(int16(number)), err
+	case 0xd2:
+		number, err := decoder.uint(4)
+		return int64(int32(number)), err
+	case 0xd3:
+		number, err := decoder.uint(8)
+		return int64(number), err
+
+	case 0xd9, 0xda, 0xdb:
+		length, err := decoder.length(code - 0xd9)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.text(length)
+
+	case 0xdc, 0xdd:
+		length, err := decoder.length(code - 0xdc + 1)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.array(length, depth)
+	case 0xde, 0xdf:
+		length, err := decoder.length(code - 0xde + 1)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.mapValue(length, depth)
+	}
+
+	return nil, fmt.Errorf("%w: unknown type byte 0x%02x", ErrMalformed, code)
+}
+
+// length reads a big endian length of 1, 2 or 4 bytes (size 0, 1, 2)
+func (decoder *Decoder) length(size byte) (int, error) {
+	length, err := decoder.uint(1 << size)
+	return int(length), err
+}
+
+func (decoder *Decoder) uint(size int) (uint64, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(decoder.reader, buf[8-size:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buf[:]), nil
+}
+
+func (decoder *Decoder) bytes(length int) ([]byte, error) {
+	if length > MaxBytes {
+		return nil, fmt.Errorf("%w: value of %d bytes", ErrMalformed, length)
+	}
+	data := make([]byte, length)
+	_, err := io.ReadFull(decoder.reader, data)
+	return data, err
+}
+
+func (decoder *Decoder) text(length int) (string, error) {
+	data, err := decoder.bytes(length)
+	return string(data), err
+}
+
+func (decoder *Decoder) ext(length int) (Ext, error) {
+	extType, err := decoder.reader.ReadByte()
+	if err != nil {
+		return Ext{}, err
+	}
+	data, err := decoder.bytes(length)
+	return Ext{Type: int8(extType), Data: data}, err
+}
+
+// array and mapValue don't trust the declared length for their allocation, every
+// element takes at least a byte of input
+func (decoder *Decoder) array(length int, depth int) ([]any, error) {
+	values := make([]any, 0, min(length, 1024))
+	for range length {
+		value, err := decoder.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func (decoder *Decoder) mapValue(length int, depth int) (map[string]any, error) {
+	values := make(map[string]any, min(length, 1024))
+	for range length {
+		key, err := decoder.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		value, err := decoder.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		switch key := key.(type) {
+		case string:
+			values[key] = value
+		case []byte:
+			values[string(key)] = value
+		default:
+			values[fmt.Sprint(key)] = value
+		}
+	}
+	return values, nil
+}
+
+// Marshal encodes nil, bool, ints, floats, string, []byte, Ext, []any and
+// map[string]any, the latter with sorted keys
+func Marshal(value any) ([]byte, error) {
+	return appendValue(nil, value)
+}
+
+func appendValue(dst []byte, value any) ([]byte, error) {
+	switch value := value.(type) {
+	case nil:
+		return append(dst, 0xc0), nil
+	case bool:
+		if value {
+			return append(dst, 0xc3), nil
+		}
+		return append(dst, 0xc2), nil
+	case int:
+		return appendInt(dst, int64(value)), nil
+	case int64:
+		return appendInt(dst, value), nil
+	case uint64:
+		if value > math.MaxInt64 {
+			return binary.BigEndian.AppendUint64(append(dst, 0xcf), value), nil
+		}
+		return appendInt(dst, int64(value)), nil
+	case float64:
+		return binary.BigEndian.AppendUint64(append(dst, 0xcb), math.Float64bits(value)), nil
+	case string:
+		dst = appendLength(dst, len(value), 0xa0, 31, 0xd9, 0xda, 0xdb)
+		return append(dst, value...), nil
+	case []byte:
+		dst = appendLength(dst, len(value), 0, -1, 0xc4, 0xc5, 0xc6)
+		return append(dst, value...), nil
+	case Ext:
+		switch len(value.Data) {
+		case 1, 2, 4, 8, 16:
+			dst = append(dst, 0xd4+byte(bitsLen(len(value.Data))))
+		default:
+			dst = appendLength(dst, len(value.Data), 0, -1, 0xc7, 0xc8, 0xc9)
+		}
+		dst = append(dst, byte(value.Type))
+		return append(dst, value.Data...), nil
+	case []any:
+		dst = appendLength(dst, len(value), 0x90, 15, 0, 0xdc, 0xdd)
+		for _, element := range value {
+			var err error
+			if dst, err = appendValue(dst, element); err != nil {
+				return nil, err
+			}
+		}
+		return dst, nil
+	case map[string]any:
+		dst = appendLength(dst, len(value), 0x80, 15, 0, 0xde, 0xdf)
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			var err error
+			dst, _ = appendValue(dst, key)
+			if dst, err = appendValue(dst, value[key]); err != nil {
+				return nil, err
+			}
+		}
+		return dst, nil
+	}
+	return nil, fmt.Errorf("msgpack: cannot encode %T", value)
+}
+
+func appendInt(dst []byte, value int64) []byte {
+	switch {
+	case value >= 0 && value <= 0x7f:
+		return append(dst, byte(value))
+	case value >= -32 && value < 0:
+		return append(dst, byte(int8(value)))
+	case value >= math.MinInt32 && value <= math.MaxInt32:
+		return binary.BigEndian.AppendUint32(append(dst, 0xd2), uint32(int32(value)))
+	}
+	return binary.BigEndian.AppendUint64(append(dst, 0xd3), uint64(value))
+}
+
+// appendLength writes a length after code8, code16 or code32 by its size, or as
+// fix|length when it fits in fixMax (fixMax < 0 for types without a fix form)
+func appendLength(dst []byte, length int, fix byte, fixMax int, code8, code16, code32 byte) []byte {
+	switch {
+	case length <= fixMax:
+		return append(dst, fix|byte(length))
+	case length <= math.MaxUint8 && code8 != 0:
+		return append(dst, code8, byte(length))
+	case length <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(dst, code16), uint16(length))
+	}
+	return binary.BigEndian.AppendUint32(append(dst, code32), uint32(length))
+}
+
+// bitsLen is log2 of a fixext size
+func bitsLen(size int) int {
+	n := 0
+	for size > 1 {
+		size >>= 1
+		n++
+	}
+	return n
+}
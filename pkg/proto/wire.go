@@ -0,0 +1,222 @@
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Minimal protocol buffers wire format, enough to read and write the few message
+// types TimberLog speaks (OTLP logs, Loki push, the gRPC service) without generated code.
+//
+//	tag    = varint(field << 3 | wire type)
+//	varint   wire type 0, 7 bits per byte, low bits first
+//	fixed64  wire type 1, little endian
+//	bytes    wire type 2, varint length then the bytes (strings, messages, packed)
+//	fixed32  wire type 5, little endian
+
+// WireType is the encoding of a field value
+type WireType int
+
+const (
+	Varint  WireType = 0
+	Fixed64 WireType = 1
+	Bytes   WireType = 2
+	Fixed32 WireType = 5
+)
+
+// ErrMalformed means the input is not a valid protobuf encoding
+var ErrMalformed = errors.New("malformed protobuf")
+
+// Reader walks the fields of one encoded message
+type Reader struct {
+	buf []byte
+	pos int
+}
+
+// NewReader reads the message encoded in buf
+func NewReader(buf []byte) *Reader {
+	return &Reader{buf: buf}
+}
+
+// Next returns the number and wire type of the next field, io.EOF after the last one.
+// The value has to be read (or skipped) before calling Next again.
+func (reader *Reader) Next() (int, WireType, error) {
+	if reader.pos >= len(reader.buf) {
+		return 0, 0, io.EOF
+	}
+
+	tag, err := reader.Varint()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	field, wireType := tag>>3, WireType(tag&7)
+	if field == 0 || field > math.MaxInt32 {
+		return 0, 0, fmt.Errorf("%w: field number %d", ErrMalformed, field)
+	}
+	return int(field), wireType, nil
+}
+
+// Varint reads a varint value
+func (reader *Reader) Varint() (uint64, error) {
+	value, n := binary.Uvarint(reader.buf[reader.pos:])
+	if n <= 0 {
+		return 0, fmt.Errorf("%w: bad varint at %d", ErrMalformed, reader.pos)
+	}
+	reader.pos += n
+	return value, nil
+}
+
+// Fixed64 reads a fixed64, sfixed64 or double value
+func (reader *Reader) Fixed64() (uint64, error) {
+	if len(reader.buf)-reader.pos < 8 {
+		return 0, fmt.Errorf("%w: fixed64 cut short", ErrMalformed)
+	}
+	value := binary.LittleEndian.Uint64(reader.buf[reader.pos:])
+	reader.pos += 8
+	return value, nil
+}
+
+// Fixed32 reads a fixed32, sfixed32 or float value
+func (reader *Reader) Fixed32() (uint32, error) {
+	if len(reader.buf)-reader.pos < 4 {
+		return 0, fmt.Errorf("%w: fixed32 cut short", ErrMalformed)
+	}
+	value := binary.LittleEndian.Uint32(reader.buf[reader.pos:])
+	reader.pos += 4
+	return value, nil
+}
+
+// Bytes reads a length-delimited value. The slice shares memory with the input.
+func (reader *Reader) Bytes() ([]byte, error) {
+	length, err := reader.Varint()
+	if err != nil {
+		return nil, err
+	}
+	if length > uint64(len(reader.buf)-reader.pos) {
+		return nil, fmt.Errorf("%w: length %d past end of message", ErrMalformed, length)
+	}
+
+	value := reader.buf[reader.pos : reader.pos+int(length)]
+	reader.pos += int(length)
+	return value, nil
+}
+
+// String reads a length-delimited value as a string
+func (reader *Reader) String() (string, error) {
+	value, err := reader.Bytes()
+	return string(value), err
+}
+
+// Double reads a double field
+func (reader *Reader) Double() (float64, error) {
+	bits, err := reader.Fixed64()
+	return math.Float64frombits(bits), err
+}
+
+// Skip reads past a value of an unknown field
+func (reader *Reader) Skip(wireType WireType) error {
+	var err error
+	switch wireType {
+	case Varint:
+		_, err = reader.Varint()
+	case Fixed64:
+		_, err = reader.Fixed64()
+	case Bytes:
+		_, err = reader.Bytes()
+	case Fixed32:
+		_, err = reader.Fixed32()
+	default:
+		err = fmt.Errorf("%w: unsupported wire type %d", ErrMalformed, wireType)
+	}
+	return err
+}
+
+// Writer builds an encoded message
+type Writer struct {
+	buf []byte
+}
+
+// Bytes returns the encoded message
+func (writer *Writer) Bytes() []byte {
+	return writer.buf
+}
+
+func (writer *Writer) tag(field int, wireType WireType) {
+	writer.buf = binary.AppendUvarint(writer.buf, uint64(field)<<3|uint64(wireType))
+}
+
+// Varint writes a varint field (int32, int64, uint32, uint64, enums)
+func (writer *Writer) Varint(field int, value uint64) {
+	writer.tag(field, Varint)
+	writer.buf = binary.AppendUvarint(writer.buf, value)
+}
+
+// Bool writes a bool field
+func (writer *Writer) Bool(field int, value bool) {
+	if value {
+		writer.Varint(field, 1)
+	} else {
+		writer.Varint(field, 0)
+	}
+}
+
+// Fixed64 writes a fixed64 field
+func (writer *Writer) Fixed64(field int, value uint64) {
+	writer.tag(field, Fixed64)
+	writer.buf = binary.LittleEndian.AppendUint64(writer.buf, value)
+}
+
+// Double writes a double field
+func (writer *Writer) Double(field int, value float64) {
+	writer.Fixed64(field, math.Float64bits(value))
+}
+
+// BytesField writes a length-delimited field
+func (writer *Writer) BytesField(field int, value []byte) {
+	writer.tag(field, Bytes)
+	writer.buf = binary.AppendUvarint(writer.buf, uint64(len(value)))
+	writer.buf = append(writer.buf, value...)
+}
+
+// String writes a string field
+func (writer *Writer) String(field int, value string) {
+	writer.tag(field, Bytes)
+	writer.buf = binary.AppendUvarint(writer.buf, uint64(len(value)))
+	writer.buf = append(writer.buf, value...)
+}
+
+// Message writes an embedded message built by encode
+func (writer *Writer) Message(field int, encode func(*Writer)) {
+	var nested Writer
+	encode(&nested)
+	writer.BytesField(field, nested.buf)
+}
+
+// Walk calls visit for every field of the message in data. visit reads the value
+// from reader and returns true, or returns false to have the field skipped.
+func Walk(data []byte, visit func(reader *Reader, field int, wireType WireType) (bool, error)) error {
+	reader := NewReader(data)
+	for {
+		field, wireType, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		handled, err := visit(reader, field, wireType)
+		if err != nil {
+			return err
+		}
+		if !handled {
+			if err := reader.Skip(wireType); err != nil {
+				return err
+			}
+		}
+	}
+}
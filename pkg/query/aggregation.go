@@ -0,0 +1,281 @@
+package query
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+// AggregationType names what an Aggregation computes
+type AggregationType string
+
+const (
+	AggCount         AggregationType = "count"          // matching entries, or entries that have Field
+	AggTerms         AggregationType = "terms"          // entries per distinct value of Field, top Size
+	AggMin           AggregationType = "min"            // over numeric values of Field
+	AggMax           AggregationType = "max"            //
+	AggSum           AggregationType = "sum"            //
+	AggAvg           AggregationType = "avg"            //
+	AggPercentiles   AggregationType = "percentiles"    // Percents of the numeric values of Field
+	AggDateHistogram AggregationType = "date_histogram" // entries per Interval of Timestamp
+)
+
+// maxHistogramBuckets bounds a date histogram, gaps included
+const maxHistogramBuckets = 10000
+
+// ErrInvalidAggregation means an aggregation is missing a field or has a bad parameter
+var ErrInvalidAggregation = errors.New("invalid aggregation")
+
+// Aggregation is one statistic computed over every entry matching a query
+type Aggregation struct {
+	Name     string // key in the result, defaults to type_field
+	Type     AggregationType
+	Field    string    // fixed field or property, nested by dotted name
+	Size     int       // terms: keep the Size most frequent values, 0 keeps all
+	Percents []float64 // percentiles: defaults to 50, 95, 99
+	Interval int64     // date_histogram: bucket width in milliseconds
+}
+
+// AggregationResult holds the outcome of one Aggregation
+type AggregationResult struct {
+	Type        AggregationType
+	Count       int64              // entries (count, terms, date_histogram) or numeric values seen
+	Value       *float64           // min, max, sum, avg; nil without numeric values
+	Percentiles map[string]float64 // percent -> value, e.g. "95"
+	Buckets     []Bucket           // terms by count, date_histogram by time
+	OtherCount  int64              // terms: entries in values cut off by Size
+}
+
+// Bucket is one group of a terms or date_histogram aggregation
+type Bucket struct {
+	Key   string // the value, or the bucket start in milliseconds
+	Start int64  // date_histogram: bucket start in milliseconds
+	Count int64
+}
+
+// fieldLookup returns the value of a field of the entry being aggregated
+type fieldLookup func(field string) (any, bool)
+
+// aggregator accumulates one Aggregation entry by entry
+type aggregator struct {
+	aggregation Aggregation
+	count       int64
+	values      []float64        // percentiles
+	sum         float64          // sum, avg
+	extreme     float64          // min, max
+	terms       map[string]int64 // terms
+	buckets     map[int64]int64  // date_histogram
+}
+
+// aggregationName is the result key of an aggregation
+func aggregationName(aggregation Aggregation) string {
+	if aggregation.Name != "" {
+		return aggregation.Name
+	}
+	if aggregation.Field == "" {
+		return string(aggregation.Type)
+	}
+	return string(aggregation.Type) + "_" + aggregation.Field
+}
+
+// newAggregators validates the aggregations and prepares one aggregator per name
+func newAggregators(aggregations []Aggregation) (map[string]*aggregator, error) {
+	aggregators := make(map[string]*aggregator, len(aggregations))
+
+	for _, aggregation := range aggregations {
+		name := aggregationName(aggregation)
+		if _, duplicate := aggregators[name]; duplicate {
+			return nil, fmt.Errorf("%w: duplicate name %q", ErrInvalidAggregation, name)
+		}
+
+		switch aggregation.Type {
+		case AggCount:
+		case AggTerms, AggMin, AggMax, AggSum, AggAvg:
+			if aggregation.Field == "" {
+				return nil, fmt.Errorf("%w: %s needs a field", ErrInvalidAggregation, aggregation.Type)
+			}
+		case AggPercentiles:
+			if aggregation.Field == "" {
+				return nil, fmt.Errorf("%w: percentiles needs a field", ErrInvalidAggregation)
+			}
+			if len(aggregation.Percents) == 0 {
+				aggregation.Percents = []float64{50, 95, 99}
+			}
+			for _, percent := range aggregation.Percents {
+				if percent < 0 || percent > 100 {
+					return nil, fmt.Errorf("%w: percent %v out of range", ErrInvalidAggregation, percent)
+				}
+			}
+		case AggDateHistogram:
+			if aggregation.Interval <= 0 {
+				return nil, fmt.Errorf("%w: date_histogram needs a positive interval", ErrInvalidAggregation)
+			}
+		default:
+			return nil, fmt.Errorf("%w: unknown type %q", ErrInvalidAggregation, aggregation.Type)
+		}
+
+		aggregators[name] = &aggregator{
+			aggregation: aggregation,
+			terms:       make(map[string]int64),
+			buckets:     make(map[int64]int64),
+		}
+	}
+
+	return aggregators, nil
+}
+
+// entryLookup reads fields of a decoded entry
+func entryLookup(entry types.LogEntry) fieldLookup {
+	return func(field string) (any, bool) {
+		return fieldValue(entry, field)
+	}
+}
+
+// add accumulates one matching entry
+func (agg *aggregator) add(lookup fieldLookup) {
+	aggregation := agg.aggregation
+
+	switch aggregation.Type {
+	case AggCount:
+		if aggregation.Field == "" {
+			agg.count++
+		} else if _, ok := lookup(aggregation.Field); ok {
+			agg.count++
+		}
+
+	case AggTerms:
+		if value, ok := lookup(aggregation.Field); ok {
+			agg.terms[toString(value)]++
+			agg.count++
+		}
+
+	case AggDateHistogram:
+		value, _ := lookup("timestamp")
+		timestamp, _ := numericValue(value)
+		start := int64(math.Floor(timestamp/float64(aggregation.Interval))) * aggregation.Interval
+		agg.buckets[start]++
+		agg.count++
+
+	default:
+		value, ok := lookup(aggregation.Field)
+		if !ok {
+			return
+		}
+		number, ok := numericValue(value)
+		if !ok {
+			return
+		}
+
+		switch {
+		case agg.count == 0:
+			agg.extreme = number
+		case aggregation.Type == AggMin:
+			agg.extreme = min(agg.extreme, number)
+		case aggregation.Type == AggMax:
+			agg.extreme = max(agg.extreme, number)
+		}
+		if aggregation.Type == AggPercentiles {
+			agg.values = append(agg.values, number)
+		}
+		agg.sum += number
+		agg.count++
+	}
+}
+
+// result turns the accumulated state into an AggregationResult
+func (agg *aggregator) result() (*AggregationResult, error) {
+	aggregation := agg.aggregation
+	result := &AggregationResult{Type: aggregation.Type, Count: agg.count}
+
+	switch aggregation.Type {
+	case AggTerms:
+		for key, count := range agg.terms {
+			result.Buckets = append(result.Buckets, Bucket{Key: key, Count: count})
+		}
+		slices.SortFunc(result.Buckets, func(a, b Bucket) int {
+			if a.Count != b.Count {
+				return cmp.Compare(b.Count, a.Count)
+			}
+			return strings.Compare(a.Key, b.Key)
+		})
+		if aggregation.Size > 0 && len(result.Buckets) > aggregation.Size {
+			for _, bucket := range result.Buckets[aggregation.Size:] {
+				result.OtherCount += bucket.Count
+			}
+			result.Buckets = result.Buckets[:aggregation.Size]
+		}
+
+	case AggDateHistogram:
+		if len(agg.buckets) == 0 {
+			break
+		}
+		first, last := int64(math.MaxInt64), int64(math.MinInt64)
+		for start := range agg.buckets {
+			first, last = min(first, start), max(last, start)
+		}
+		if (last-first)/aggregation.Interval >= maxHistogramBuckets {
+			return nil, fmt.Errorf("%w: date_histogram would need more than %d buckets, use a larger interval",
+				ErrInvalidAggregation, maxHistogramBuckets)
+		}
+		// empty buckets in between are kept so the histogram has no holes
+		for start := first; start <= last; start += aggregation.Interval {
+			result.Buckets = append(result.Buckets, Bucket{
+				Key:   strconv.FormatInt(start, 10),
+				Start: start,
+				Count: agg.buckets[start],
+			})
+		}
+
+	case AggMin, AggMax:
+		if agg.count > 0 {
+			result.Value = &agg.extreme
+		}
+	case AggSum:
+		if agg.count > 0 {
+			result.Value = &agg.sum
+		}
+	case AggAvg:
+		if agg.count > 0 {
+			avg := agg.sum / float64(agg.count)
+			result.Value = &avg
+		}
+
+	case AggPercentiles:
+		if len(agg.values) == 0 {
+			break
+		}
+		slices.Sort(agg.values)
+		result.Percentiles = make(map[string]float64, len(aggregation.Percents))
+		for _, percent := range aggregation.Percents {
+			result.Percentiles[strconv.FormatFloat(percent, 'f', -1, 64)] = percentile(agg.values, percent)
+		}
+	}
+
+	return result, nil
+}
+
+// percentile interpolates linearly between the closest ranks of sorted values
+func percentile(sorted []float64, percent float64) float64 {
+	rank := percent / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+// numericValue is toNumber that also accepts numeric strings, e.g. index keys
+func numericValue(value any) (float64, bool) {
+	if number, ok := toNumber(value); ok {
+		return number, true
+	}
+	if text, ok := value.(string); ok {
+		number, err := strconv.ParseFloat(text, 64)
+		return number, err == nil
+	}
+	return 0, false
+}
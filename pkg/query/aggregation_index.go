@@ -0,0 +1,137 @@
+package query
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/index"
+)
+
+// indexAggregation describes how to answer aggregations from index entries alone
+type indexAggregation struct {
+	start, end int64
+	keys       map[string]string // equality filters: index -> key every match has
+	fields     []string          // indexes the aggregations read values from
+}
+
+// planIndexAggregation checks whether the filter and every aggregation only need the
+// timestamp and other indexes. ok is false if some entry would have to be decoded.
+func planIndexAggregation(query *Query, filter Filter, aggregations []Aggregation, indexManager *index.IndexManager) (*indexAggregation, bool) {
+	if !indexManager.HasIndex("timestamp") {
+		return nil, false
+	}
+
+	plan := &indexAggregation{start: query.StartTime, end: query.EndTime, keys: make(map[string]string)}
+
+	for _, conjunct := range conjuncts(filter) {
+		switch f := conjunct.(type) {
+		case *TimestampFilter:
+			// the query range, applied by every index scan
+		case *FieldFilter:
+			if f.Op != OpMatch && f.Op != OpEq {
+				return nil, false
+			}
+			switch strings.ToLower(f.Field) {
+			case "timestamp", "level", "message", "stacktrace":
+				return nil, false
+			}
+			if !indexManager.HasIndex(f.Field) {
+				return nil, false
+			}
+			if key, seen := plan.keys[f.Field]; seen && key != f.Value {
+				return nil, false
+			}
+			plan.keys[f.Field] = f.Value
+		default:
+			return nil, false
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, aggregation := range aggregations {
+		field := aggregation.Field
+		if aggregation.Type == AggDateHistogram || field == "" || strings.EqualFold(field, "timestamp") {
+			continue
+		}
+		if !indexManager.HasIndex(field) {
+			return nil, false
+		}
+		if !seen[field] {
+			seen[field] = true
+			plan.fields = append(plan.fields, field)
+		}
+	}
+
+	return plan, true
+}
+
+// aggregateIndexes feeds the aggregators from the index entries of every segment.
+// ok is false, with nothing aggregated, when an index doesn't cover one of them.
+func (plan *indexAggregation) aggregateIndexes(segments []string, indexManager *index.IndexManager, aggregators map[string]*aggregator) bool {
+	type segmentValues struct {
+		timestamps map[int64]int64             // offset -> timestamp of the entries in range
+		values     map[string]map[int64]string // field -> offset -> key
+	}
+
+	collected := make([]segmentValues, 0, len(segments))
+
+	for _, segPath := range segments {
+		fileName := filepath.Base(segPath)
+
+		entries, ok := indexManager.SegmentEntries("timestamp", fileName, plan.start, plan.end)
+		if !ok {
+			return false
+		}
+		timestamps := make(map[int64]int64, len(entries))
+		for _, entry := range entries {
+			timestamps[entry.Offset] = entry.Timestamp
+		}
+
+		for indexName, key := range plan.keys {
+			entries, ok := indexManager.SegmentEntries(indexName, fileName, plan.start, plan.end)
+			if !ok {
+				return false
+			}
+			matching := make(map[int64]int64, len(entries))
+			for _, entry := range entries {
+				if timestamp, ok := timestamps[entry.Offset]; ok && entry.Key == key {
+					matching[entry.Offset] = timestamp
+				}
+			}
+			timestamps = matching
+		}
+
+		values := make(map[string]map[int64]string, len(plan.fields))
+		for _, field := range plan.fields {
+			entries, ok := indexManager.SegmentEntries(field, fileName, plan.start, plan.end)
+			if !ok {
+				return false
+			}
+			keys := make(map[int64]string, len(entries))
+			for _, entry := range entries {
+				keys[entry.Offset] = entry.Key
+			}
+			values[field] = keys
+		}
+
+		collected = append(collected, segmentValues{timestamps: timestamps, values: values})
+	}
+
+	// only aggregate once every segment turned out to be covered
+	for _, segment := range collected {
+		for offset, timestamp := range segment.timestamps {
+			lookup := func(field string) (any, bool) {
+				if strings.EqualFold(field, "timestamp") {
+					return timestamp, true
+				}
+				key, ok := segment.values[field][offset]
+				return key, ok
+			}
+			for _, agg := range aggregators {
+				agg.add(lookup)
+			}
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,70 @@
+package query
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// ErrInvalidCursor means a cursor wasn't produced by a previous query
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor is where a page ended. Results are ordered by timestamp, then segment file
+// and offset, so every entry has a distinct position and the next page starts right
+// after the cursor however many entries share its timestamp. Appends to the active
+// segment land after the last position, they don't shift pages already read.
+// Compaction moves entries to new positions; only entries sharing the cursor's
+// timestamp can then show up twice or be skipped.
+type Cursor struct {
+	Timestamp int64  `json:"t"`
+	Segment   string `json:"s"`
+	Offset    int64  `json:"o"`
+}
+
+// Encode turns the cursor into an opaque URL-safe string
+func (cursor Cursor) Encode() string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeCursor parses a string returned by Encode
+func DecodeCursor(encoded string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var cursor Cursor
+	if err := json.Unmarshal(data, &cursor); err != nil || cursor.Segment == "" {
+		return nil, ErrInvalidCursor
+	}
+	return &cursor, nil
+}
+
+// position of an entry in the result order
+type position struct {
+	timestamp int64
+	segment   string
+	offset    int64
+}
+
+func (cursor *Cursor) position() position {
+	return position{timestamp: cursor.Timestamp, segment: cursor.Segment, offset: cursor.Offset}
+}
+
+func (p position) cursor() Cursor {
+	return Cursor{Timestamp: p.timestamp, Segment: p.segment, Offset: p.offset}
+}
+
+// comparePositions orders positions ascending
+func comparePositions(a, b position) int {
+	if c := cmp.Compare(a.timestamp, b.timestamp); c != 0 {
+		return c
+	}
+	if c := strings.Compare(a.segment, b.segment); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.offset, b.offset)
+}
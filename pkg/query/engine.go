@@ -1,6 +1,9 @@
 package query
 
 import (
+	"fmt"
+	"slices"
+
 	"github.com/mrsridharpadmanaben/TimberLog/pkg/index"
 	"github.com/mrsridharpadmanaben/TimberLog/pkg/storage"
 	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
@@ -22,7 +25,106 @@ func NewQueryEngine(indexManager *index.IndexManager, manifest *storage.Manifest
 }
 
 // Execute runs a query and returns results.
+// The manifest snapshot keeps compaction and retention from deleting the segments it reads.
 func (queryEngine *QueryEngine) Execute(query *Query) ([]types.LogEntry, error) {
-	plan := PlanQuery(query, queryEngine.indexManager, queryEngine.manifest, queryEngine.segmentManager)
+	snapshot := queryEngine.manifest.Acquire()
+	defer snapshot.Release()
+
+	plan, err := PlanQuery(query, queryEngine.indexManager, snapshot.Segments, queryEngine.segmentManager)
+	if err != nil {
+		return nil, err
+	}
 	return ExecutePlan(plan, queryEngine.segmentManager)
 }
+
+// ExecutePage runs a query and returns one page of results; pass its NextCursor as
+// Query.Cursor to get the next one
+func (queryEngine *QueryEngine) ExecutePage(query *Query) (*ResultSet, error) {
+	snapshot := queryEngine.manifest.Acquire()
+	defer snapshot.Release()
+
+	plan, err := PlanQuery(query, queryEngine.indexManager, snapshot.Segments, queryEngine.segmentManager)
+	if err != nil {
+		return nil, err
+	}
+	return ExecutePage(plan, queryEngine.segmentManager)
+}
+
+// Stream runs a query and passes each result to emit as soon as it is read.
+// Errors in the query itself are returned before emit is first called.
+func (queryEngine *QueryEngine) Stream(query *Query, emit func(types.LogEntry) error) (*QueryStats, error) {
+	snapshot := queryEngine.manifest.Acquire()
+	defer snapshot.Release()
+
+	plan, err := PlanQuery(query, queryEngine.indexManager, snapshot.Segments, queryEngine.segmentManager)
+	if err != nil {
+		return nil, err
+	}
+	return StreamPlan(plan, queryEngine.segmentManager, emit)
+}
+
+// Aggregate computes query.Aggregations over all matching entries. Without a
+// filter, or with only equality filters on indexed fields, and with aggregations over
+// the timestamp or indexed fields, the index entries are enough and no entry is decoded.
+func (queryEngine *QueryEngine) Aggregate(query *Query) (map[string]*AggregationResult, error) {
+	aggregations := query.Aggregations
+	if len(aggregations) == 0 {
+		return nil, fmt.Errorf("%w: no aggregations", ErrInvalidAggregation)
+	}
+	// a cursor would leave out what earlier pages returned, aggregations count everything
+	if query.Cursor != "" {
+		return nil, fmt.Errorf("%w: a cursor only pages results", ErrInvalidAggregation)
+	}
+
+	snapshot := queryEngine.manifest.Acquire()
+	defer snapshot.Release()
+
+	plan, err := PlanQuery(query, queryEngine.indexManager, snapshot.Segments, queryEngine.segmentManager)
+	if err != nil {
+		return nil, err
+	}
+
+	if indexPlan, ok := planIndexAggregation(query, plan.Filter, aggregations, queryEngine.indexManager); ok {
+		aggregators, err := newAggregators(aggregations)
+		if err != nil {
+			return nil, err
+		}
+		if indexPlan.aggregateIndexes(plan.Segments, queryEngine.indexManager, aggregators) {
+			return aggregationResults(aggregators)
+		}
+	}
+
+	return AggregatePlan(plan, queryEngine.segmentManager, aggregations)
+}
+
+// StorageStats summarizes the segments, sealed and active
+type StorageStats struct {
+	Segments        int
+	Bytes           int64
+	OldestTimestamp int64 // 0 without segments
+	NewestTimestamp int64
+	Services        []string // sorted
+}
+
+// Stats summarizes the segments from their metadata, none is read
+func (queryEngine *QueryEngine) Stats() StorageStats {
+	segments := queryEngine.manifest.GetSegments()
+	if active, ok := queryEngine.segmentManager.ActiveSegment(); ok {
+		segments = append(segments, active)
+	}
+
+	var stats StorageStats
+	for _, segment := range segments {
+		if stats.Segments == 0 || segment.MinTimestamp < stats.OldestTimestamp {
+			stats.OldestTimestamp = segment.MinTimestamp
+		}
+		stats.NewestTimestamp = max(stats.NewestTimestamp, segment.MaxTimestamp)
+		stats.Segments++
+		stats.Bytes += segment.Size
+		stats.Services = append(stats.Services, segment.Services...)
+	}
+
+	slices.Sort(stats.Services)
+	stats.Services = slices.Compact(stats.Services)
+	return stats
+}
@@ -1,7 +1,7 @@
 package query
 
 import (
-	"sort"
+	"time"
 
 	"github.com/mrsridharpadmanaben/TimberLog/pkg/storage"
 	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
@@ -9,47 +9,114 @@ import (
 
 // ExecutePlan runs the query plan against segment files
 func ExecutePlan(plan *QueryPlan, segmentManager *storage.SegmentManager) ([]types.LogEntry, error) {
-	var results []types.LogEntry
+	page, err := ExecutePage(plan, segmentManager)
+	if err != nil {
+		return nil, err
+	}
+	return page.Entries, nil
+}
 
-	for _, segPath := range plan.Segments {
-		offsets := plan.Offsets[segPath]
+// ExecutePage returns up to Limit matches following the plan's cursor in result order,
+// and a cursor for the next page when more matches remain. A negative Limit returns all.
+func ExecutePage(plan *QueryPlan, segmentManager *storage.SegmentManager) (*ResultSet, error) {
+	page := &ResultSet{Entries: []types.LogEntry{}}
 
-		// Read only matching offsets
-		entries, err := segmentManager.ReadSegment(segPath, offsets)
-		if err != nil {
-			return nil, err
-		}
+	stats, err := StreamPlan(plan, segmentManager, func(entry types.LogEntry) error {
+		page.Entries = append(page.Entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		// Apply remaining filters (non-indexed or safety check)
-		for _, e := range entries {
-			if ApplyFilters(e, plan.Filter) {
-				results = append(results, e)
+	page.Count = len(page.Entries)
+	page.NextCursor = stats.NextCursor
+	return page, nil
+}
 
-				if len(results) >= plan.Query.Limit {
-					break
-				}
-			}
+// QueryStats describes a finished query
+type QueryStats struct {
+	Count        int    // entries returned
+	SegmentsRead int    // segments read, the merge skips those past the last result
+	TookMillis   int64  // time spent reading and merging segments
+	NextCursor   string // continues after the last entry when Limit cut the results short
+}
+
+// StreamPlan passes matches to emit in result order as the segments are merged, so
+// the results never have to be held at once. An error from emit stops the query.
+func StreamPlan(plan *QueryPlan, segmentManager *storage.SegmentManager, emit func(types.LogEntry) error) (*QueryStats, error) {
+	started := time.Now()
+	stats := &QueryStats{}
+	limit := plan.Query.Limit
+
+	var last position
+	read, err := mergeSegments(plan, segmentManager, func(m match) (bool, error) {
+		// one match beyond the limit only tells there is a next page
+		if limit > 0 && stats.Count == limit {
+			stats.NextCursor = last.cursor().Encode()
+			return false, nil
 		}
 
-		if len(results) >= plan.Query.Limit {
-			break
+		if err := emit(m.entry); err != nil {
+			return false, err
 		}
+		stats.Count++
+		last = m.position
+		return true, nil
+	})
+
+	stats.SegmentsRead = read
+	stats.TookMillis = time.Since(started).Milliseconds()
+	return stats, err
+}
+
+// afterCursor reports whether a position comes after the cursor in result order
+func (plan *QueryPlan) afterCursor(pos position) bool {
+	if plan.Cursor == nil {
+		return true
+	}
+	c := comparePositions(pos, plan.Cursor.position())
+	if plan.Query.SortAsc {
+		return c > 0
 	}
+	return c < 0
+}
+
+// AggregatePlan computes aggregations over every entry the plan matches; Limit doesn't apply
+func AggregatePlan(plan *QueryPlan, segmentManager *storage.SegmentManager, aggregations []Aggregation) (map[string]*AggregationResult, error) {
+	aggregators, err := newAggregators(aggregations)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, segPath := range plan.Segments {
+		entries, err := segmentManager.ReadSegment(segPath, plan.Offsets[segPath])
+		if err != nil {
+			return nil, err
+		}
 
-	// Sort by timestamp
-	if len(results) > 1 {
-		sort.Slice(results, func(i, j int) bool {
-			if plan.Query.SortAsc {
-				return results[i].Timestamp < results[j].Timestamp
+		for _, e := range entries {
+			if !ApplyFilters(e, plan.Filter) {
+				continue
+			}
+			lookup := entryLookup(e)
+			for _, agg := range aggregators {
+				agg.add(lookup)
 			}
-			return results[i].Timestamp < results[j].Timestamp
-		})
+		}
 	}
 
-	// // Apply limit
-	// if plan.Query.Limit > 0 && len(results) > plan.Query.Limit {
-	// 	results = results[:plan.Query.Limit]
-	// }
+	return aggregationResults(aggregators)
+}
 
+func aggregationResults(aggregators map[string]*aggregator) (map[string]*AggregationResult, error) {
+	results := make(map[string]*AggregationResult, len(aggregators))
+	for name, agg := range aggregators {
+		result, err := agg.result()
+		if err != nil {
+			return nil, err
+		}
+		results[name] = result
+	}
 	return results, nil
 }
@@ -1,7 +1,13 @@
 package query
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
 )
@@ -10,28 +16,297 @@ type Filter interface {
 	Apply(entry types.LogEntry) bool
 }
 
-// FieldFilter checks fixed fields or dynamic Properties
+// FieldOp says how a FieldFilter compares a field with its value
+type FieldOp string
+
+const (
+	OpMatch     FieldOp = ""           // equal; substring for message and stacktrace
+	OpEq        FieldOp = "eq"         // equal, numerically when both sides are numbers
+	OpNe        FieldOp = "ne"         // present and not equal
+	OpLt        FieldOp = "lt"         // less than; numbers, timestamps, otherwise strings
+	OpLe        FieldOp = "le"         // less than or equal
+	OpGt        FieldOp = "gt"         // greater than
+	OpGe        FieldOp = "ge"         // greater than or equal
+	OpRegex     FieldOp = "regex"      // RE2 regular expression, unanchored
+	OpPrefix    FieldOp = "prefix"     // starts with
+	OpGlob      FieldOp = "glob"       // * matches any run of characters, ? a single one
+	OpExists    FieldOp = "exists"     // field is set, Value is ignored
+	OpNotExists FieldOp = "not_exists" // field is not set
+	OpIn        FieldOp = "in"         // equal to one of Values
+)
+
+// ErrInvalidFilter means a filter can't be evaluated, e.g. a bad regex or a missing value
+var ErrInvalidFilter = errors.New("invalid filter")
+
+// FieldFilter checks fixed fields or dynamic Properties. Properties are looked up by
+// exact key first, then a dotted name walks nested objects ("http.status").
 type FieldFilter struct {
-	Field string
-	Value string
+	Field  string
+	Value  string
+	Values []string // OpIn
+	Op     FieldOp
+
+	regex *regexp.Regexp // compiled OpRegex pattern
+}
+
+// Compile validates the filter and prepares it for Apply
+func (f *FieldFilter) Compile() error {
+	switch f.Op {
+	case OpMatch, OpEq, OpNe, OpPrefix, OpGlob, OpExists, OpNotExists:
+		return nil
+	case OpLt, OpLe, OpGt, OpGe:
+		if f.Value == "" {
+			return fmt.Errorf("%w: %s needs a value", ErrInvalidFilter, f.Op)
+		}
+		return nil
+	case OpRegex:
+		regex, err := regexp.Compile(f.Value)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidFilter, err)
+		}
+		f.regex = regex
+		return nil
+	case OpIn:
+		if len(f.Values) == 0 {
+			return fmt.Errorf("%w: in needs at least one value", ErrInvalidFilter)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: unknown operator %q", ErrInvalidFilter, f.Op)
 }
 
 func (f *FieldFilter) Apply(entry types.LogEntry) bool {
-	switch strings.ToLower(f.Field) {
+	value, ok := fieldValue(entry, f.Field)
+
+	switch f.Op {
+	case OpExists:
+		return ok
+	case OpNotExists:
+		return !ok
+	}
+	if !ok {
+		return false
+	}
+
+	switch f.Op {
+	case OpMatch:
+		switch strings.ToLower(f.Field) {
+		case "message", "stacktrace":
+			return strings.Contains(toString(value), f.Value)
+		}
+		return f.equal(value, f.Value)
+	case OpEq:
+		return f.equal(value, f.Value)
+	case OpNe:
+		return !f.equal(value, f.Value)
+	case OpIn:
+		for _, candidate := range f.Values {
+			if f.equal(value, candidate) {
+				return true
+			}
+		}
+		return false
+	case OpLt:
+		c, ok := f.compare(value)
+		return ok && c < 0
+	case OpLe:
+		c, ok := f.compare(value)
+		return ok && c <= 0
+	case OpGt:
+		c, ok := f.compare(value)
+		return ok && c > 0
+	case OpGe:
+		c, ok := f.compare(value)
+		return ok && c >= 0
+	case OpRegex:
+		regex := f.regex
+		if regex == nil {
+			var err error
+			if regex, err = regexp.Compile(f.Value); err != nil {
+				return false
+			}
+		}
+		return regex.MatchString(toString(value))
+	case OpPrefix:
+		return strings.HasPrefix(toString(value), f.Value)
+	case OpGlob:
+		return globMatch(f.Value, toString(value))
+	}
+	return false
+}
+
+// equal compares numerically when both sides are numbers; levels ignore case
+func (f *FieldFilter) equal(value any, want string) bool {
+	if number, ok := toNumber(value); ok {
+		if wantNumber, err := strconv.ParseFloat(want, 64); err == nil {
+			return number == wantNumber
+		}
+	}
+
+	if strings.EqualFold(f.Field, "level") {
+		return strings.EqualFold(toString(value), want)
+	}
+	return toString(value) == want
+}
+
+// compare orders value against f.Value: as numbers if both are numeric, as times if
+// both are RFC 3339 (or the field is the millisecond timestamp), otherwise as strings
+func (f *FieldFilter) compare(value any) (int, bool) {
+	if number, ok := toNumber(value); ok {
+		if want, err := strconv.ParseFloat(f.Value, 64); err == nil {
+			return compareFloat(number, want), true
+		}
+		if strings.EqualFold(f.Field, "timestamp") {
+			if want, err := time.Parse(time.RFC3339Nano, f.Value); err == nil {
+				return compareFloat(number, float64(want.UnixMilli())), true
+			}
+		}
+		return 0, false
+	}
+
+	text := toString(value)
+	if number, err := strconv.ParseFloat(text, 64); err == nil {
+		if want, err := strconv.ParseFloat(f.Value, 64); err == nil {
+			return compareFloat(number, want), true
+		}
+	}
+	if at, err := time.Parse(time.RFC3339Nano, text); err == nil {
+		if want, err := time.Parse(time.RFC3339Nano, f.Value); err == nil {
+			return at.Compare(want), true
+		}
+	}
+	return strings.Compare(text, f.Value), true
+}
+
+func compareFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// fieldValue returns the value of a fixed field or property and whether it is set.
+// service and host fall back to a property of the same name when the field is empty.
+func fieldValue(entry types.LogEntry, field string) (any, bool) {
+	switch strings.ToLower(field) {
+	case "timestamp":
+		return entry.Timestamp, true
 	case "level":
-		return string(entry.Level) == f.Value
-	case "service":
-		return entry.Service == f.Value
-	case "host":
-		return entry.Host == f.Value
+		return string(entry.Level), entry.Level != ""
 	case "message":
-		return strings.Contains(entry.Message, f.Value)
+		return entry.Message, entry.Message != ""
 	case "stacktrace":
-		return strings.Contains(entry.StackTrace, f.Value)
-	default:
-		propVal, ok := entry.Properties[f.Field]
-		return ok && propVal == f.Value
+		return entry.StackTrace, entry.StackTrace != ""
+	case "service":
+		if entry.Service != "" {
+			return entry.Service, true
+		}
+	case "host":
+		if entry.Host != "" {
+			return entry.Host, true
+		}
 	}
+
+	return propertyValue(entry.Properties, strings.TrimPrefix(field, "properties."))
+}
+
+// propertyValue resolves a property, walking nested objects along a dotted path
+func propertyValue(properties map[string]interface{}, path string) (any, bool) {
+	if value, ok := properties[path]; ok {
+		return value, value != nil
+	}
+
+	for i := strings.IndexByte(path, '.'); i >= 0; {
+		if nested, ok := properties[path[:i]].(map[string]interface{}); ok {
+			if value, ok := propertyValue(nested, path[i+1:]); ok {
+				return value, true
+			}
+		}
+		next := strings.IndexByte(path[i+1:], '.')
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return nil, false
+}
+
+// toNumber converts numeric property values, as decoded from JSON or set in code
+func toNumber(value any) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func toString(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+		return ""
+	}
+
+	if number, ok := toNumber(value); ok {
+		return strconv.FormatFloat(number, 'f', -1, 64)
+	}
+	if _, nested := value.(map[string]interface{}); nested {
+		encoded, _ := json.Marshal(value)
+		return string(encoded)
+	}
+	return fmt.Sprint(value)
+}
+
+// globMatch matches s against a pattern of literal runes, * and ?
+func globMatch(pattern, s string) bool {
+	p, t := []rune(pattern), []rune(s)
+	pi, ti := 0, 0
+	star, mark := -1, 0
+
+	for ti < len(t) {
+		switch {
+		case pi < len(p) && p[pi] == '*':
+			star, mark = pi, ti
+			pi++
+		case pi < len(p) && (p[pi] == '?' || p[pi] == t[ti]):
+			pi++
+			ti++
+		case star >= 0:
+			// let the last * swallow one more rune
+			mark++
+			pi, ti = star+1, mark
+		default:
+			return false
+		}
+	}
+
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
 }
 
 // TimestampFilter for range queries
@@ -78,6 +353,15 @@ func (o *OrFilter) Apply(entry types.LogEntry) bool {
 	return false
 }
 
+// NotFilter negates a filter
+type NotFilter struct {
+	Filter Filter
+}
+
+func (n *NotFilter) Apply(entry types.LogEntry) bool {
+	return !n.Filter.Apply(entry)
+}
+
 // ApplyFilters helper
 func ApplyFilters(entry types.LogEntry, filter Filter) bool {
 	if filter == nil {
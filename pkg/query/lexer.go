@@ -0,0 +1,160 @@
+package query
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenWord
+	tokenString // quoted, taken literally
+	tokenColon
+	tokenCompare // = != < <= > >= =~
+	tokenComma
+	tokenLParen
+	tokenRParen
+	tokenAnd
+	tokenOr
+	tokenNot
+)
+
+func (kind tokenKind) String() string {
+	switch kind {
+	case tokenEOF:
+		return "end of query"
+	case tokenWord:
+		return "word"
+	case tokenString:
+		return "quoted string"
+	case tokenColon:
+		return "':'"
+	case tokenCompare:
+		return "operator"
+	case tokenComma:
+		return "','"
+	case tokenLParen:
+		return "'('"
+	case tokenRParen:
+		return "')'"
+	case tokenAnd:
+		return "AND"
+	case tokenOr:
+		return "OR"
+	case tokenNot:
+		return "NOT"
+	}
+	return "token"
+}
+
+type token struct {
+	kind   tokenKind
+	text   string
+	column int // 1-based, in runes
+}
+
+// lex splits a query into tokens. Keywords (AND, OR, NOT) are case-insensitive;
+// quote a value to use one literally.
+func lex(input string) ([]token, error) {
+	var tokens []token
+
+	column := func(offset int) int {
+		return utf8.RuneCountInString(input[:offset]) + 1
+	}
+
+	for i := 0; i < len(input); {
+		r, size := utf8.DecodeRuneInString(input[i:])
+
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+
+		case r == ':':
+			tokens = append(tokens, token{kind: tokenColon, text: ":", column: column(i)})
+			i++
+
+		case r == ',':
+			tokens = append(tokens, token{kind: tokenComma, text: ",", column: column(i)})
+			i++
+
+		case isCompareStart(input[i:]):
+			operator := input[i : i+1]
+			if i+1 < len(input) && (input[i+1] == '=' || input[i:i+2] == "=~") {
+				operator = input[i : i+2]
+			}
+			tokens = append(tokens, token{kind: tokenCompare, text: operator, column: column(i)})
+			i += len(operator)
+
+		case r == '(':
+			tokens = append(tokens, token{kind: tokenLParen, text: "(", column: column(i)})
+			i++
+
+		case r == ')':
+			tokens = append(tokens, token{kind: tokenRParen, text: ")", column: column(i)})
+			i++
+
+		case r == '"':
+			start := i
+			var text strings.Builder
+			i++
+			closed := false
+			for i < len(input) {
+				c := input[i]
+				if c == '\\' && i+1 < len(input) {
+					text.WriteByte(input[i+1])
+					i += 2
+					continue
+				}
+				if c == '"' {
+					closed = true
+					i++
+					break
+				}
+				text.WriteByte(c)
+				i++
+			}
+			if !closed {
+				return nil, &ParseError{Query: input, Column: column(start), Message: "unterminated quoted string"}
+			}
+			tokens = append(tokens, token{kind: tokenString, text: text.String(), column: column(start)})
+
+		default:
+			start := i
+			for i < len(input) {
+				r, size := utf8.DecodeRuneInString(input[i:])
+				if unicode.IsSpace(r) || strings.ContainsRune(`:(),"`, r) || isCompareStart(input[i:]) {
+					break
+				}
+				i += size
+			}
+
+			word := input[start:i]
+			kind := tokenWord
+			switch strings.ToUpper(word) {
+			case "AND":
+				kind = tokenAnd
+			case "OR":
+				kind = tokenOr
+			case "NOT":
+				kind = tokenNot
+			}
+			tokens = append(tokens, token{kind: kind, text: word, column: column(start)})
+		}
+	}
+
+	return append(tokens, token{kind: tokenEOF, column: column(len(input))}), nil
+}
+
+// isCompareStart reports whether a comparison operator starts at s; a lone ! stays part of a word
+func isCompareStart(s string) bool {
+	switch s[0] {
+	case '=', '<', '>':
+		return true
+	case '!':
+		return len(s) > 1 && s[1] == '='
+	}
+	return false
+}
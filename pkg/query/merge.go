@@ -0,0 +1,144 @@
+package query
+
+import (
+	"container/heap"
+	"math"
+	"path/filepath"
+	"slices"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/storage"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+// match is an entry that passed the filter and its place in the result order
+type match struct {
+	position position
+	entry    types.LogEntry
+}
+
+// segmentSource yields the matches of one segment in result order. It is read on
+// first use; until then its bound stands in for it, which no match of it precedes.
+type segmentSource struct {
+	path    string
+	bound   position
+	opened  bool
+	matches []match
+	next    int
+}
+
+func (source *segmentSource) head() position {
+	if !source.opened {
+		return source.bound
+	}
+	return source.matches[source.next].position
+}
+
+// open reads the segment and sorts its matches
+func (source *segmentSource) open(plan *QueryPlan, segmentManager *storage.SegmentManager) error {
+	records, err := segmentManager.ReadSegmentRecords(source.path, plan.Offsets[source.path])
+	if err != nil {
+		return err
+	}
+
+	segment := filepath.Base(source.path)
+	for _, record := range records {
+		// Apply remaining filters (non-indexed or safety check)
+		if !ApplyFilters(record.Entry, plan.Filter) {
+			continue
+		}
+
+		pos := position{timestamp: record.Entry.Timestamp, segment: segment, offset: record.Offset}
+		if plan.afterCursor(pos) {
+			source.matches = append(source.matches, match{position: pos, entry: record.Entry})
+		}
+	}
+
+	// segments are mostly in time order already, but entries can arrive late
+	slices.SortFunc(source.matches, func(a, b match) int {
+		return plan.compare(a.position, b.position)
+	})
+	source.opened = true
+	return nil
+}
+
+// mergeHeap orders segment sources by their next match, or their bound if unread
+type mergeHeap struct {
+	plan    *QueryPlan
+	sources []*segmentSource
+}
+
+func (h *mergeHeap) Len() int { return len(h.sources) }
+func (h *mergeHeap) Less(i, j int) bool {
+	return h.plan.compare(h.sources[i].head(), h.sources[j].head()) < 0
+}
+func (h *mergeHeap) Swap(i, j int) { h.sources[i], h.sources[j] = h.sources[j], h.sources[i] }
+func (h *mergeHeap) Push(x any)    { h.sources = append(h.sources, x.(*segmentSource)) }
+func (h *mergeHeap) Pop() any {
+	last := h.sources[len(h.sources)-1]
+	h.sources = h.sources[:len(h.sources)-1]
+	return last
+}
+
+// mergeSegments passes the matches of every planned segment to emit in result order,
+// until emit returns false or an error. A sealed segment is only read once the merge
+// reaches the earliest (latest, descending) timestamp it holds, so a top-N query leaves
+// the segments beyond its last result unread. It returns how many segments were read.
+func mergeSegments(plan *QueryPlan, segmentManager *storage.SegmentManager, emit func(match) (bool, error)) (int, error) {
+	h := &mergeHeap{plan: plan}
+
+	for _, path := range plan.Segments {
+		source := &segmentSource{path: path}
+		segment := filepath.Base(path)
+
+		// the active segment is still growing, read it right away
+		meta, sealed := plan.Sealed[path]
+		switch {
+		case !sealed && plan.Query.SortAsc:
+			source.bound = position{timestamp: math.MinInt64, segment: segment, offset: math.MinInt64}
+		case !sealed:
+			source.bound = position{timestamp: math.MaxInt64, segment: segment, offset: math.MaxInt64}
+		case plan.Query.SortAsc:
+			source.bound = position{timestamp: meta.MinTimestamp, segment: segment, offset: math.MinInt64}
+		default:
+			source.bound = position{timestamp: meta.MaxTimestamp, segment: segment, offset: math.MaxInt64}
+		}
+		h.sources = append(h.sources, source)
+	}
+	heap.Init(h)
+
+	read := 0
+	for h.Len() > 0 {
+		source := h.sources[0]
+
+		if !source.opened {
+			if err := source.open(plan, segmentManager); err != nil {
+				return read, err
+			}
+			read++
+		} else {
+			more, err := emit(source.matches[source.next])
+			if err != nil || !more {
+				return read, err
+			}
+			// emitted matches aren't needed anymore
+			source.matches[source.next] = match{}
+			source.next++
+		}
+
+		if source.next == len(source.matches) {
+			heap.Pop(h)
+		} else {
+			heap.Fix(h, 0)
+		}
+	}
+
+	return read, nil
+}
+
+// compare orders positions the way the query returns them
+func (plan *QueryPlan) compare(a, b position) int {
+	if plan.Query.SortAsc {
+		return comparePositions(a, b)
+	}
+	return comparePositions(b, a)
+}
@@ -0,0 +1,299 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Query language, lowest precedence first:
+//
+//	expr    = or
+//	or      = and { OR and }
+//	and     = not { [AND] not }        terms next to each other are ANDed
+//	not     = NOT not | primary
+//	primary = "(" expr ")" | term
+//	term    = field ":" value           match; substring for message and stacktrace
+//	        | field ":" "*"             field exists, NOT field:* that it doesn't
+//	        | field ":" "(" value { ["," | OR] value } ")"   any of the values
+//	        | field op value            op is = != < <= > >= or =~ (regex)
+//	        | value                     a bare value searches the message
+//	value   = word | "quoted string"    in an unquoted word a trailing * is a prefix,
+//	                                    other * and ? make it a glob
+//
+// Fields are fixed fields or properties, nested properties by dotted name.
+// e.g. level:ERROR AND (service:auth OR service:billing) AND NOT host:canary-*
+//
+//	status_code >= 500 AND http.method:(POST, PUT) AND user_id:*
+
+// ParseError reports where a query could not be parsed
+type ParseError struct {
+	Query   string
+	Column  int // 1-based
+	Message string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parse error at column %d: %s", e.Column, e.Message)
+}
+
+type parser struct {
+	input  string
+	tokens []token
+	pos    int
+}
+
+// ParseFilter compiles a query string into a Filter tree
+func ParseFilter(input string) (Filter, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{input: input, tokens: tokens}
+	if p.peek().kind == tokenEOF {
+		return nil, p.errorf(p.peek(), "empty query")
+	}
+
+	filter, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if next := p.peek(); next.kind != tokenEOF {
+		return nil, p.errorf(next, "unexpected %s", describe(next))
+	}
+	return filter, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) errorf(tok token, format string, args ...any) *ParseError {
+	return &ParseError{Query: p.input, Column: tok.column, Message: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) parseOr() (Filter, error) {
+	first, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	filters := []Filter{first}
+	for p.peek().kind == tokenOr {
+		p.next()
+		filter, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+	}
+
+	if len(filters) == 1 {
+		return first, nil
+	}
+	return &OrFilter{Filters: flatten(filters, func(f Filter) []Filter {
+		if or, ok := f.(*OrFilter); ok {
+			return or.Filters
+		}
+		return nil
+	})}, nil
+}
+
+func (p *parser) parseAnd() (Filter, error) {
+	first, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	filters := []Filter{first}
+	for {
+		switch p.peek().kind {
+		case tokenAnd:
+			p.next()
+		case tokenWord, tokenString, tokenLParen, tokenNot:
+			// implicit AND
+		default:
+			if len(filters) == 1 {
+				return first, nil
+			}
+			return &AndFilter{Filters: flatten(filters, func(f Filter) []Filter {
+				if and, ok := f.(*AndFilter); ok {
+					return and.Filters
+				}
+				return nil
+			})}, nil
+		}
+
+		filter, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+	}
+}
+
+func (p *parser) parseNot() (Filter, error) {
+	if p.peek().kind != tokenNot {
+		return p.parsePrimary()
+	}
+
+	p.next()
+	filter, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	if fieldFilter, ok := filter.(*FieldFilter); ok && fieldFilter.Op == OpExists {
+		return &FieldFilter{Field: fieldFilter.Field, Op: OpNotExists}, nil
+	}
+	return &NotFilter{Filter: filter}, nil
+}
+
+func (p *parser) parsePrimary() (Filter, error) {
+	tok := p.next()
+
+	switch tok.kind {
+	case tokenLParen:
+		filter, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokenRParen {
+			return nil, p.errorf(closing, "expected ')' to close '(' at column %d, found %s", tok.column, describe(closing))
+		}
+		return filter, nil
+
+	case tokenWord, tokenString:
+		next := p.peek()
+		if next.kind != tokenColon && next.kind != tokenCompare {
+			return valueFilter("message", tok), nil
+		}
+		if tok.kind == tokenString {
+			return nil, p.errorf(tok, "field name can't be quoted")
+		}
+
+		p.next() // ':' or operator
+		if next.kind == tokenCompare {
+			return p.parseComparison(tok.text, next)
+		}
+		if p.peek().kind == tokenLParen {
+			return p.parseIn(tok.text)
+		}
+
+		value, err := p.expectValue(tok.text + ":")
+		if err != nil {
+			return nil, err
+		}
+		if value.kind == tokenWord && value.text == "*" {
+			return &FieldFilter{Field: tok.text, Op: OpExists}, nil
+		}
+		return valueFilter(tok.text, value), nil
+	}
+
+	return nil, p.errorf(tok, "expected a field, value or '(', found %s", describe(tok))
+}
+
+var compareOps = map[string]FieldOp{
+	"=":  OpEq,
+	"==": OpEq,
+	"!=": OpNe,
+	"<":  OpLt,
+	"<=": OpLe,
+	">":  OpGt,
+	">=": OpGe,
+	"=~": OpRegex,
+}
+
+// parseComparison parses the value after field and a comparison operator
+func (p *parser) parseComparison(field string, operator token) (Filter, error) {
+	op, ok := compareOps[operator.text]
+	if !ok {
+		return nil, p.errorf(operator, "unknown operator %q", operator.text)
+	}
+
+	value, err := p.expectValue(field + " " + operator.text)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := &FieldFilter{Field: field, Value: value.text, Op: op}
+	if err := filter.Compile(); err != nil {
+		return nil, p.errorf(value, "%v", err)
+	}
+	return filter, nil
+}
+
+// parseIn parses the value list of field:(a, b OR c)
+func (p *parser) parseIn(field string) (Filter, error) {
+	open := p.next() // '('
+
+	filter := &FieldFilter{Field: field, Op: OpIn}
+	for {
+		value, err := p.expectValue(field + ":(")
+		if err != nil {
+			return nil, err
+		}
+		filter.Values = append(filter.Values, value.text)
+
+		switch separator := p.next(); separator.kind {
+		case tokenComma, tokenOr:
+		case tokenRParen:
+			return filter, nil
+		default:
+			return nil, p.errorf(separator, "expected ',' or ')' to close '(' at column %d, found %s", open.column, describe(separator))
+		}
+	}
+}
+
+// expectValue takes the next token, which has to be a value following context
+func (p *parser) expectValue(context string) (token, error) {
+	value := p.next()
+	if value.kind != tokenWord && value.kind != tokenString {
+		return value, p.errorf(value, "expected a value after '%s', found %s", context, describe(value))
+	}
+	return value, nil
+}
+
+// valueFilter matches field against a value token. In an unquoted word a single
+// trailing * makes it a prefix match, any other wildcard a glob.
+func valueFilter(field string, value token) Filter {
+	filter := &FieldFilter{Field: field, Value: value.text}
+	if value.kind != tokenWord || !strings.ContainsAny(value.text, "*?") {
+		return filter
+	}
+
+	if body := strings.TrimSuffix(value.text, "*"); !strings.ContainsAny(body, "*?") {
+		filter.Op, filter.Value = OpPrefix, body
+	} else {
+		filter.Op = OpGlob
+	}
+	return filter
+}
+
+// flatten merges nested filters of the same kind, children returns nil for other kinds
+func flatten(filters []Filter, children func(Filter) []Filter) []Filter {
+	var flat []Filter
+	for _, filter := range filters {
+		if nested := children(filter); nested != nil {
+			flat = append(flat, nested...)
+		} else {
+			flat = append(flat, filter)
+		}
+	}
+	return flat
+}
+
+func describe(tok token) string {
+	if tok.kind == tokenWord {
+		return fmt.Sprintf("%q", tok.text)
+	}
+	return tok.kind.String()
+}
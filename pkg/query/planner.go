@@ -1,7 +1,10 @@
 package query
 
 import (
+	"fmt"
+	"log"
 	"path/filepath"
+	"strings"
 
 	"github.com/mrsridharpadmanaben/TimberLog/pkg/index"
 	"github.com/mrsridharpadmanaben/TimberLog/pkg/storage"
@@ -18,16 +21,22 @@ const (
 type FilterExpression struct {
 	Field    string
 	Value    string
+	Values   []string            // for Op "in"
+	Op       FieldOp             // comparison, empty matches like field:value
 	Operator OperatorLogicalType // "AND" or "OR"
 }
 
 // Query represents the high-level user request.
 type Query struct {
-	StartTime int64
-	EndTime   int64
-	Filters   []FilterExpression // flexible AND/OR filters
-	Limit     int
-	SortAsc   bool
+	StartTime  int64
+	EndTime    int64
+	Filters    []FilterExpression // flexible AND/OR filters
+	Expression string             // query language, see ParseFilter; ANDed with Filters
+	Limit      int
+	SortAsc    bool
+	Cursor     string // NextCursor of the previous page, see Cursor
+
+	Aggregations []Aggregation // see QueryEngine.Aggregate
 }
 
 // QueryPlan describes which segments and offsets to read
@@ -36,21 +45,86 @@ type QueryPlan struct {
 	Offsets  map[string][]int64
 	Query    *Query
 	Filter   Filter
+	Cursor   *Cursor                        // results start after it, nil for the first page
+	Sealed   map[string]storage.SegmentMeta // sealed segments by path, their time range orders the reads
 }
 
-// PlanQuery decides which segments and offsets to use
-func PlanQuery(query *Query, indexManager *index.IndexManager, manifest *storage.Manifest, activeSegment *storage.SegmentManager) *QueryPlan {
+// PlanQuery decides which segments and offsets to use. segments are the sealed segments
+// to consider, usually a manifest snapshot that stays acquired until the plan is executed.
+// An Expression that doesn't parse returns a *ParseError, a bad Cursor ErrInvalidCursor.
+func PlanQuery(query *Query, indexManager *index.IndexManager, segments []storage.SegmentMeta, activeSegment *storage.SegmentManager) (*QueryPlan, error) {
 	plan := &QueryPlan{
 		Segments: []string{},
 		Offsets:  make(map[string][]int64),
 		Query:    query,
+		Sealed:   make(map[string]storage.SegmentMeta),
 	}
 
 	if plan.Query.Limit == 0 {
 		plan.Query.Limit = 100
 	}
 
-	// --- Build filter tree dynamically ---
+	filter, err := buildFilter(query)
+	if err != nil {
+		return nil, err
+	}
+	plan.Filter = filter
+
+	if query.Cursor != "" {
+		if plan.Cursor, err = DecodeCursor(query.Cursor); err != nil {
+			return nil, err
+		}
+	}
+
+	dir := activeSegment.Dir()
+
+	// --- Select segments from manifest ---
+	var sealed []string
+	for _, seg := range segments {
+		if (query.StartTime == 0 || seg.MaxTimestamp >= query.StartTime) &&
+			(query.EndTime == 0 || seg.MinTimestamp <= query.EndTime) && !plan.beforeCursor(seg) {
+
+			// sealed segment indexes live in sidecar files until first needed;
+			// without them the segment is just scanned in full
+			if err := indexManager.LoadSegment(dir, seg.FileName); err != nil {
+				log.Printf("[INDEX] failed to load index of %s: %v", seg.FileName, err)
+			}
+			sealed = append(sealed, seg.FileName)
+			plan.Sealed[filepath.Join(dir, seg.FileName)] = seg
+		}
+	}
+
+	// --- Active segment ---
+	selected := sealed
+	activeMeta := activeSegment.ActiveSegmentMeta()
+	if (query.StartTime == 0 || activeMeta.MaxTimestamp >= query.StartTime) &&
+		(query.EndTime == 0 || activeMeta.MinTimestamp <= query.EndTime) {
+		selected = append(selected, activeMeta.FileName)
+	}
+
+	// --- Index lookups over the selected segments only, offsets grouped per segment ---
+	lookups := lookupIndexes(query, plan.Filter, indexManager, selected)
+
+	for _, fileName := range selected {
+		planSegment(plan, dir, fileName, lookups)
+	}
+
+	return plan, nil
+}
+
+// beforeCursor reports whether a segment only holds entries earlier pages returned
+func (plan *QueryPlan) beforeCursor(segment storage.SegmentMeta) bool {
+	if plan.Cursor == nil {
+		return false
+	}
+	if plan.Query.SortAsc {
+		return segment.MaxTimestamp < plan.Cursor.Timestamp
+	}
+	return segment.MinTimestamp > plan.Cursor.Timestamp
+}
+
+// buildFilter combines time range, Filters and Expression into one filter tree
+func buildFilter(query *Query) (Filter, error) {
 	var filterStack []Filter
 
 	// timestamp filter
@@ -63,7 +137,10 @@ func PlanQuery(query *Query, indexManager *index.IndexManager, manifest *storage
 
 	// field filters
 	for _, f := range query.Filters {
-		newFilter := &FieldFilter{Field: f.Field, Value: f.Value}
+		newFilter := &FieldFilter{Field: f.Field, Value: f.Value, Values: f.Values, Op: f.Op}
+		if err := newFilter.Compile(); err != nil {
+			return nil, fmt.Errorf("filter on %s: %w", f.Field, err)
+		}
 		if f.Operator == OperatorOR && len(filterStack) > 0 {
 			// combine last filter with OR
 			last := filterStack[len(filterStack)-1]
@@ -74,74 +151,128 @@ func PlanQuery(query *Query, indexManager *index.IndexManager, manifest *storage
 		}
 	}
 
+	// query language
+	if strings.TrimSpace(query.Expression) != "" {
+		parsed, err := ParseFilter(query.Expression)
+		if err != nil {
+			return nil, err
+		}
+		filterStack = append(filterStack, parsed)
+	}
+
 	// finalize filter
-	if len(filterStack) == 1 {
-		plan.Filter = filterStack[0]
-	} else if len(filterStack) > 1 {
-		plan.Filter = &AndFilter{Filters: filterStack}
+	switch len(filterStack) {
+	case 0:
+		return nil, nil
+	case 1:
+		return filterStack[0], nil
 	}
+	return &AndFilter{Filters: filterStack}, nil
+}
 
-	// --- Select segments from manifest ---
-	for _, seg := range manifest.GetSegments() {
-		if (query.StartTime == 0 || seg.MaxTimestamp >= query.StartTime) &&
-			(query.EndTime == 0 || seg.MinTimestamp <= query.EndTime) {
+// indexLookup holds the result of one index lookup, offsets grouped by segment file
+type indexLookup struct {
+	indexName string
+	offsets   map[string][]int64
+	covered   map[string]bool // segments the index covered in full during the lookup
+}
 
-			path := filepath.Join(activeSegment.Dir(), seg.FileName)
-			plan.Segments = append(plan.Segments, path)
+// lookupIndexes runs every index lookup that can narrow down the query over segments
+func lookupIndexes(query *Query, filter Filter, indexManager *index.IndexManager, segments []string) []indexLookup {
+	var lookups []indexLookup
+	lookup := func(indexName, key string) {
+		offsets, covered := indexManager.LookupSegments(indexName, segments, query.StartTime, query.EndTime, key)
+		lookups = append(lookups, indexLookup{indexName: indexName, offsets: offsets, covered: covered})
+	}
 
-			offsets := getOffsetsForSegment(query, indexManager)
-			plan.Offsets[path] = offsets
-		}
+	// timestamp index only helps when there is a range to narrow down to
+	if query.StartTime != 0 || query.EndTime != 0 {
+		lookup("timestamp", "")
 	}
 
-	// --- Active segment ---
-	activeMeta := activeSegment.ActiveSegmentMeta()
-	if (query.StartTime == 0 || activeMeta.MaxTimestamp >= query.StartTime) &&
-		(query.EndTime == 0 || activeMeta.MinTimestamp <= query.EndTime) {
+	// only filters every match has to pass can narrow down; anything under OR or NOT widens the result
+	for _, conjunct := range conjuncts(filter) {
+		fieldFilter, ok := conjunct.(*FieldFilter)
+		if !ok || (fieldFilter.Op != OpMatch && fieldFilter.Op != OpEq) {
+			continue
+		}
 
-		path := filepath.Join(activeSegment.Dir(), activeMeta.FileName)
-		plan.Segments = append(plan.Segments, path)
+		switch strings.ToLower(fieldFilter.Field) {
+		case "timestamp", "message", "stacktrace":
+			continue // message and stacktrace match substrings, not index keys
+		case "level":
+			continue // levels match case-insensitively, index keys are exact
+		}
+		if !indexManager.HasIndex(fieldFilter.Field) {
+			continue
+		}
 
-		offsets := getOffsetsForSegment(query, indexManager)
-		plan.Offsets[path] = offsets
+		lookup(fieldFilter.Field, fieldFilter.Value)
 	}
 
-	return plan
+	return lookups
 }
 
-// Helper to get offsets from indexes for a segment
-func getOffsetsForSegment(query *Query, indexManager *index.IndexManager) []int64 {
-	var offsets []int64
+// conjuncts returns the filters that are ANDed at the top of a filter tree
+func conjuncts(filter Filter) []Filter {
+	and, ok := filter.(*AndFilter)
+	if !ok {
+		if filter == nil {
+			return nil
+		}
+		return []Filter{filter}
+	}
 
-	// Try timestamp-only index first
-	if idxOffsets := indexManager.Lookup("timestamp", query.StartTime, query.EndTime, ""); len(idxOffsets) > 0 {
-		offsets = append(offsets, idxOffsets...)
+	var result []Filter
+	for _, child := range and.Filters {
+		result = append(result, conjuncts(child)...)
 	}
+	return result
+}
 
-	// Apply other indexed filters (intersection)
-	for _, filter := range query.Filters {
-		if idxOffsets := indexManager.Lookup(filter.Field, query.StartTime, query.EndTime, filter.Value); len(idxOffsets) > 0 {
-			if len(offsets) == 0 {
-				offsets = idxOffsets
-			} else {
-				offsets = intersect(offsets, idxOffsets)
-			}
+// planSegment adds a segment to the plan with only its own offsets.
+// Lookups of indexes not covering the segment are ignored; if none applies the
+// segment is scanned in full, if they leave no offsets the segment is skipped.
+func planSegment(plan *QueryPlan, dir, fileName string, lookups []indexLookup) {
+	var offsets []int64
+	indexed := false
+
+	for _, lookup := range lookups {
+		if !lookup.covered[fileName] {
+			continue
+		}
+
+		segmentOffsets := lookup.offsets[fileName]
+		if !indexed {
+			offsets = segmentOffsets
+			indexed = true
+		} else {
+			offsets = intersect(offsets, segmentOffsets)
 		}
 	}
 
-	return offsets
+	if indexed && len(offsets) == 0 {
+		return
+	}
+
+	path := filepath.Join(dir, fileName)
+	plan.Segments = append(plan.Segments, path)
+	plan.Offsets[path] = offsets
 }
 
-// Simple slice intersection
+// intersect two sorted offset slices
 func intersect(a, b []int64) []int64 {
-	m := make(map[int64]struct{}, len(a))
-	for _, v := range a {
-		m[v] = struct{}{}
-	}
 	var res []int64
-	for _, v := range b {
-		if _, ok := m[v]; ok {
-			res = append(res, v)
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			res = append(res, a[i])
+			i++
+			j++
 		}
 	}
 	return res
@@ -4,7 +4,9 @@ import (
 	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
 )
 
+// ResultSet is one page of query results
 type ResultSet struct {
-	Entries []types.LogEntry
-	Count   int
+	Entries    []types.LogEntry
+	Count      int
+	NextCursor string // continues after the last entry, empty when there are no more
 }
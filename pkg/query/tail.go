@@ -0,0 +1,203 @@
+package query
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+// SlowConsumerPolicy decides what happens to a subscriber whose buffer is full
+type SlowConsumerPolicy int
+
+const (
+	// DropEntries skips entries the subscriber has no room for and counts them
+	DropEntries SlowConsumerPolicy = iota
+	// Disconnect ends the subscription with ErrSlowConsumer
+	Disconnect
+)
+
+// ErrSlowConsumer ends a Disconnect subscription that fell behind
+var ErrSlowConsumer = errors.New("subscriber too slow, buffer full")
+
+// TailOptions configures a TailHub
+type TailOptions struct {
+	BufferSize int // entries buffered per subscriber
+	Policy     SlowConsumerPolicy
+}
+
+// DefaultTailOptions buffers 256 entries per subscriber and drops beyond that
+func DefaultTailOptions() TailOptions {
+	return TailOptions{
+		BufferSize: 256,
+		Policy:     DropEntries,
+	}
+}
+
+// TailHub fans new entries out to live subscribers whose filter they match
+type TailHub struct {
+	options     TailOptions
+	subscribers map[*Subscription]struct{}
+	pending     PendingSource
+	mutex       sync.RWMutex
+}
+
+// PendingSource returns the entries published but not stored yet, in the order they
+// were published. It must not miss an entry that is being stored meanwhile.
+type PendingSource func() []types.LogEntry
+
+// Subscription receives matching entries on Entries until it is closed. Entries is
+// closed when the subscription ends; Err then tells whether the hub disconnected it.
+type Subscription struct {
+	Entries <-chan types.LogEntry
+
+	entries chan types.LogEntry
+	filter  Filter
+	policy  SlowConsumerPolicy
+	dropped atomic.Int64
+	err     error
+	hub     *TailHub
+}
+
+// NewTailHub creates a hub with the default options
+func NewTailHub() *TailHub {
+	return NewTailHubWithOptions(DefaultTailOptions())
+}
+
+// NewTailHubWithOptions creates a hub; zero option fields take their defaults
+func NewTailHubWithOptions(options TailOptions) *TailHub {
+	if options.BufferSize <= 0 {
+		options.BufferSize = DefaultTailOptions().BufferSize
+	}
+	return &TailHub{
+		options:     options,
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscribe follows entries matching a query language expression, all for an empty one
+func (hub *TailHub) Subscribe(expression string) (*Subscription, error) {
+	return hub.SubscribeWithPolicy(expression, hub.options.Policy)
+}
+
+// SubscribeWithPolicy is Subscribe with its own slow consumer policy
+func (hub *TailHub) SubscribeWithPolicy(expression string, policy SlowConsumerPolicy) (*Subscription, error) {
+	var filter Filter
+	if strings.TrimSpace(expression) != "" {
+		var err error
+		if filter, err = ParseFilter(expression); err != nil {
+			return nil, err
+		}
+	}
+
+	entries := make(chan types.LogEntry, hub.options.BufferSize)
+	subscription := &Subscription{
+		Entries: entries,
+		entries: entries,
+		filter:  filter,
+		policy:  policy,
+		hub:     hub,
+	}
+
+	hub.mutex.Lock()
+	hub.subscribers[subscription] = struct{}{}
+	hub.mutex.Unlock()
+
+	return subscription, nil
+}
+
+// Publish hands an entry to every subscriber it matches without waiting for any of them
+func (hub *TailHub) Publish(entry types.LogEntry) {
+	var slow []*Subscription
+
+	hub.mutex.RLock()
+	for subscription := range hub.subscribers {
+		if !ApplyFilters(entry, subscription.filter) {
+			continue
+		}
+
+		select {
+		case subscription.entries <- entry:
+		default:
+			if subscription.policy == Disconnect {
+				slow = append(slow, subscription)
+			} else {
+				subscription.dropped.Add(1)
+			}
+		}
+	}
+	hub.mutex.RUnlock()
+
+	for _, subscription := range slow {
+		hub.remove(subscription, ErrSlowConsumer)
+	}
+}
+
+// SetPending registers where entries waiting to be stored come from, e.g. the ingest
+// buffer, so subscribers can backfill them too
+func (hub *TailHub) SetPending(source PendingSource) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	hub.pending = source
+}
+
+// Subscribers returns the number of live subscriptions
+func (hub *TailHub) Subscribers() int {
+	hub.mutex.RLock()
+	defer hub.mutex.RUnlock()
+	return len(hub.subscribers)
+}
+
+// remove ends a subscription; the channel is closed under the write lock so no
+// Publish can be sending to it
+func (hub *TailHub) remove(subscription *Subscription, err error) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	if _, ok := hub.subscribers[subscription]; !ok {
+		return
+	}
+	delete(hub.subscribers, subscription)
+	subscription.err = err
+	close(subscription.entries)
+}
+
+// Close ends the subscription
+func (subscription *Subscription) Close() {
+	subscription.hub.remove(subscription, nil)
+}
+
+// Pending returns the entries waiting to be stored that match the subscription, in the
+// order they were published. Read it before querying stored entries, so an entry
+// stored in between is found by the query instead of missed.
+func (subscription *Subscription) Pending() []types.LogEntry {
+	subscription.hub.mutex.RLock()
+	source := subscription.hub.pending
+	subscription.hub.mutex.RUnlock()
+
+	if source == nil {
+		return nil
+	}
+	var matching []types.LogEntry
+	for _, entry := range source() {
+		if ApplyFilters(entry, subscription.filter) {
+			matching = append(matching, entry)
+		}
+	}
+	return matching
+}
+
+// Dropped returns how many matching entries were skipped because the buffer was full
+func (subscription *Subscription) Dropped() int64 {
+	return subscription.dropped.Load()
+}
+
+// Err returns ErrSlowConsumer once the hub disconnected the subscription, read it
+// after Entries is closed
+func (subscription *Subscription) Err() error {
+	subscription.hub.mutex.RLock()
+	defer subscription.hub.mutex.RUnlock()
+	return subscription.err
+}
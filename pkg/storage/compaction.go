@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/compress"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+// SegmentIndexer maintains the per segment indexes of segments the compactor writes and retires
+type SegmentIndexer interface {
+	BuildSegment(dir, segmentFile string, entries []*types.LogEntry, offsets []int64) error
+	DropSegment(dir, segmentFile string) error
+}
+
+// CompactionOptions decides which segments get merged
+type CompactionOptions struct {
+	SmallSegmentSize int64         // sealed segments smaller than this (on disk) are merged
+	TargetSize       int64         // a merged segment takes inputs up to this total size
+	Interval         time.Duration // how often the background compactor runs
+}
+
+// DefaultCompactionOptions merges segments under 256 KB into segments of up to 4 MB every minute
+func DefaultCompactionOptions() CompactionOptions {
+	return CompactionOptions{
+		SmallSegmentSize: 256 << 10,
+		TargetSize:       4 << 20,
+		Interval:         time.Minute,
+	}
+}
+
+// Compactor merges runs of adjacent small sealed segments into larger time sorted ones
+type Compactor struct {
+	segmentManager *SegmentManager
+	manifest       *Manifest
+	indexer        SegmentIndexer
+	options        CompactionOptions
+	stopChannel    chan struct{}
+	mutex          sync.Mutex // one compaction at a time
+}
+
+// NewCompactor creates a compactor for the sealed segments of manifest
+func NewCompactor(segmentManager *SegmentManager, manifest *Manifest, indexer SegmentIndexer, options CompactionOptions) *Compactor {
+	defaults := DefaultCompactionOptions()
+	if options.SmallSegmentSize <= 0 {
+		options.SmallSegmentSize = defaults.SmallSegmentSize
+	}
+	if options.TargetSize <= 0 {
+		options.TargetSize = defaults.TargetSize
+	}
+	if options.Interval <= 0 {
+		options.Interval = defaults.Interval
+	}
+
+	return &Compactor{
+		segmentManager: segmentManager,
+		manifest:       manifest,
+		indexer:        indexer,
+		options:        options,
+		stopChannel:    make(chan struct{}),
+	}
+}
+
+// Compact merges every run of small segments and returns the merged segments
+func (compactor *Compactor) Compact() ([]SegmentMeta, error) {
+	compactor.mutex.Lock()
+	defer compactor.mutex.Unlock()
+
+	// the snapshot keeps retention from deleting inputs while they are read
+	snapshot := compactor.manifest.Acquire()
+	defer snapshot.Release()
+
+	var merged []SegmentMeta
+	for _, run := range compactor.pickRuns(snapshot.Segments) {
+		meta, err := compactor.merge(run)
+		if err == ErrSegmentsChanged {
+			continue // an input was deleted meanwhile, the next run picks up the rest
+		}
+		if err != nil {
+			return merged, err
+		}
+		merged = append(merged, meta)
+	}
+
+	if len(merged) > 0 {
+		log.Printf("[COMPACTION] merged small segments into %d segment(s)", len(merged))
+	}
+	return merged, nil
+}
+
+// pickRuns groups adjacent small segments (in manifest order) up to TargetSize
+func (compactor *Compactor) pickRuns(segments []SegmentMeta) [][]SegmentMeta {
+	var runs [][]SegmentMeta
+	var run []SegmentMeta
+	var runSize int64
+
+	closeRun := func() {
+		if len(run) > 1 {
+			runs = append(runs, run)
+		}
+		run, runSize = nil, 0
+	}
+
+	for _, segment := range segments {
+		if segment.Size >= compactor.options.SmallSegmentSize {
+			closeRun()
+			continue
+		}
+		if runSize+segment.Size > compactor.options.TargetSize {
+			closeRun()
+		}
+		run = append(run, segment)
+		runSize += segment.Size
+	}
+	closeRun()
+
+	return runs
+}
+
+// merge writes the entries of run, sorted by timestamp, into a new segment, indexes it,
+// swaps it into the manifest and retires the inputs
+func (compactor *Compactor) merge(run []SegmentMeta) (SegmentMeta, error) {
+	dir := compactor.segmentManager.Dir()
+
+	var entries []*types.LogEntry
+	services := make(map[string]bool)
+	for _, segment := range run {
+		logs, err := compactor.segmentManager.ReadSegment(filepath.Join(dir, segment.FileName), nil)
+		if err != nil {
+			return SegmentMeta{}, err
+		}
+		for i := range logs {
+			entries = append(entries, &logs[i])
+		}
+		for _, service := range segment.Services {
+			services[service] = true
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Timestamp < entries[j].Timestamp })
+
+	fileName := compactor.segmentManager.reserveFileName()
+	path := filepath.Join(dir, fileName)
+
+	meta, offsets, err := compactor.writeSegment(path, entries)
+	if err == nil {
+		meta.FileName = fileName
+		for service := range services {
+			meta.Services = append(meta.Services, service)
+		}
+		sort.Strings(meta.Services)
+		err = compactor.indexer.BuildSegment(dir, fileName, entries, offsets)
+	}
+
+	fileNames := make([]string, 0, len(run))
+	for _, segment := range run {
+		fileNames = append(fileNames, segment.FileName)
+	}
+	if err == nil {
+		err = compactor.manifest.ReplaceSegments(fileNames, meta)
+	}
+
+	if err != nil {
+		// the new segment never became visible
+		compactor.indexer.DropSegment(dir, fileName)
+		os.Remove(path)
+		return SegmentMeta{}, err
+	}
+
+	compactor.manifest.Retire(func() {
+		for _, name := range fileNames {
+			if err := compactor.indexer.DropSegment(dir, name); err != nil {
+				log.Printf("[COMPACTION] dropping indexes of %s failed: %v", name, err)
+			}
+			if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+				log.Printf("[COMPACTION] deleting %s failed: %v", name, err)
+			}
+		}
+	})
+
+	return meta, nil
+}
+
+// writeSegment writes entries as a sealed segment, compressed with the segment manager's codec
+func (compactor *Compactor) writeSegment(path string, entries []*types.LogEntry) (SegmentMeta, []int64, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return SegmentMeta{}, nil, err
+	}
+
+	data := fileHeader(segmentMagic)
+	offsets := make([]int64, 0, len(entries))
+	meta := SegmentMeta{}
+
+	for i, entry := range entries {
+		payload, err := json.Marshal(entry)
+		if err != nil {
+			file.Close()
+			return SegmentMeta{}, nil, err
+		}
+		offsets = append(offsets, int64(len(data)))
+		data = append(data, encodeRecord(RecordTypeEntry, payload)...)
+
+		if i == 0 || entry.Timestamp < meta.MinTimestamp {
+			meta.MinTimestamp = entry.Timestamp
+		}
+		if i == 0 || entry.Timestamp > meta.MaxTimestamp {
+			meta.MaxTimestamp = entry.Timestamp
+		}
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return SegmentMeta{}, nil, err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return SegmentMeta{}, nil, err
+	}
+	if err := file.Close(); err != nil {
+		return SegmentMeta{}, nil, err
+	}
+	meta.Size = int64(len(data))
+
+	codec := compactor.segmentManager.options.Codec
+	if codec != compress.None {
+		size, err := compressSegment(path, codec, compactor.segmentManager.options.BlockSize)
+		if err != nil {
+			return SegmentMeta{}, nil, fmt.Errorf("compress %s: %w", path, err)
+		}
+		meta.Size = size
+		meta.Codec = codec.String()
+	}
+
+	return meta, offsets, nil
+}
+
+// Start runs compaction every interval in a separate goroutine
+func (compactor *Compactor) Start() {
+	go func() {
+		ticker := time.NewTicker(compactor.options.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := compactor.Compact(); err != nil {
+					log.Printf("[COMPACTION] %v", err)
+				}
+			case <-compactor.stopChannel:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the compaction goroutine
+func (compactor *Compactor) Stop() {
+	close(compactor.stopChannel)
+}
@@ -2,24 +2,48 @@ package storage
 
 import (
 	"encoding/json"
+	"errors"
 	"os"
 	"path/filepath"
+	"slices"
 	"sync"
 )
 
 type SegmentMeta struct {
-	FileName     string `json:"file_name"`
-	Size         int64  `json:"size"`
-	MinTimestamp int64  `json:"min_timestamp"`
-	MaxTimestamp int64  `json:"max_timestamp"`
+	FileName     string   `json:"file_name"`
+	Size         int64    `json:"size"`
+	MinTimestamp int64    `json:"min_timestamp"`
+	MaxTimestamp int64    `json:"max_timestamp"`
+	Codec        string   `json:"codec,omitempty"`    // block codec of a compressed segment, empty when stored plain
+	Services     []string `json:"services,omitempty"` // distinct services of the entries (Service or the "service" property), sorted
 }
 
 type Manifest struct {
-	Segments []SegmentMeta `json:"segments"`
-	path     string
-	mutex    sync.Mutex
+	Segments   []SegmentMeta `json:"segments"`
+	path       string
+	generation int64          // bumped by Retire, snapshots remember the one they were taken in
+	readers    map[int64]int  // open snapshots per generation
+	retired    []retiredFiles // cleanups waiting for older snapshots to be released
+	mutex      sync.Mutex
 }
 
+// ManifestSnapshot is a consistent list of segments. Files of segments removed from
+// the manifest after the snapshot was taken stay on disk until it is released.
+type ManifestSnapshot struct {
+	Segments   []SegmentMeta
+	manifest   *Manifest
+	generation int64
+	once       sync.Once
+}
+
+type retiredFiles struct {
+	generation int64
+	cleanup    func()
+}
+
+// ErrSegmentsChanged means segments a change was based on are no longer in the manifest
+var ErrSegmentsChanged = errors.New("manifest segments changed")
+
 // NewManifest loads or creates manifest file
 func NewManifest(path string) (*Manifest, error) {
 
@@ -32,6 +56,7 @@ func NewManifest(path string) (*Manifest, error) {
 	manifest := &Manifest{
 		Segments: []SegmentMeta{},
 		path:     path,
+		readers:  make(map[int64]int),
 	}
 
 	// Ensure manifest directory exists
@@ -71,6 +96,153 @@ func (manifest *Manifest) AddSegment(meta SegmentMeta) error {
 	return manifest.save()
 }
 
+// RemoveSegments drops the named segments and saves manifest
+func (manifest *Manifest) RemoveSegments(fileNames []string) error {
+	manifest.mutex.Lock()
+	defer manifest.mutex.Unlock()
+
+	remove := make(map[string]bool, len(fileNames))
+	for _, fileName := range fileNames {
+		remove[fileName] = true
+	}
+
+	segments := make([]SegmentMeta, 0, len(manifest.Segments))
+	for _, segment := range manifest.Segments {
+		if !remove[segment.FileName] {
+			segments = append(segments, segment)
+		}
+	}
+
+	manifest.Segments = segments
+	return manifest.save()
+}
+
+// ReplaceSegments swaps the named segments for one merged segment, which takes the
+// place of the first of them, and saves manifest. Nothing changes if any of them is gone.
+func (manifest *Manifest) ReplaceSegments(fileNames []string, merged SegmentMeta) error {
+	manifest.mutex.Lock()
+	defer manifest.mutex.Unlock()
+
+	replace := make(map[string]bool, len(fileNames))
+	for _, fileName := range fileNames {
+		replace[fileName] = true
+	}
+
+	segments := make([]SegmentMeta, 0, len(manifest.Segments))
+	found := 0
+	for _, segment := range manifest.Segments {
+		if !replace[segment.FileName] {
+			segments = append(segments, segment)
+			continue
+		}
+		if found == 0 {
+			segments = append(segments, merged)
+		}
+		found++
+	}
+	if found != len(replace) {
+		return ErrSegmentsChanged
+	}
+
+	manifest.Segments = segments
+	return manifest.save()
+}
+
+// SwapSegment runs swap, e.g. replacing the segment's file, and puts meta in place of the
+// entry with the same file name, all under the manifest lock. Without that entry swap
+// doesn't run and ErrSegmentsChanged is returned.
+func (manifest *Manifest) SwapSegment(meta SegmentMeta, swap func() error) error {
+	manifest.mutex.Lock()
+	defer manifest.mutex.Unlock()
+
+	i := slices.IndexFunc(manifest.Segments, func(segment SegmentMeta) bool {
+		return segment.FileName == meta.FileName
+	})
+	if i < 0 {
+		return ErrSegmentsChanged
+	}
+	if err := swap(); err != nil {
+		return err
+	}
+
+	manifest.Segments[i] = meta
+	return manifest.save()
+}
+
+// Acquire takes a snapshot of the segments, Release it once done reading them
+func (manifest *Manifest) Acquire() *ManifestSnapshot {
+	manifest.mutex.Lock()
+	defer manifest.mutex.Unlock()
+
+	segments := make([]SegmentMeta, len(manifest.Segments))
+	copy(segments, manifest.Segments)
+
+	manifest.readers[manifest.generation]++
+	return &ManifestSnapshot{
+		Segments:   segments,
+		manifest:   manifest,
+		generation: manifest.generation,
+	}
+}
+
+// Release ends the snapshot and runs cleanups that were only waiting for it
+func (snapshot *ManifestSnapshot) Release() {
+	snapshot.once.Do(func() {
+		manifest := snapshot.manifest
+
+		manifest.mutex.Lock()
+		manifest.readers[snapshot.generation]--
+		if manifest.readers[snapshot.generation] == 0 {
+			delete(manifest.readers, snapshot.generation)
+		}
+		ready := manifest.takeRetired()
+		manifest.mutex.Unlock()
+
+		for _, cleanup := range ready {
+			cleanup()
+		}
+	})
+}
+
+// Retire runs cleanup, typically deleting the files of segments just removed from the
+// manifest, once every snapshot taken so far has been released
+func (manifest *Manifest) Retire(cleanup func()) {
+	manifest.mutex.Lock()
+	manifest.retired = append(manifest.retired, retiredFiles{generation: manifest.generation, cleanup: cleanup})
+	manifest.generation++
+	ready := manifest.takeRetired()
+	manifest.mutex.Unlock()
+
+	for _, cleanup := range ready {
+		cleanup()
+	}
+}
+
+// takeRetired removes the cleanups no open snapshot waits for, caller holds the mutex
+func (manifest *Manifest) takeRetired() []func() {
+	var ready []func()
+	remaining := manifest.retired[:0]
+
+	for _, retired := range manifest.retired {
+		blocked := false
+		for generation := range manifest.readers {
+			if generation <= retired.generation {
+				blocked = true
+				break
+			}
+		}
+
+		if blocked {
+			remaining = append(remaining, retired)
+		} else {
+			ready = append(ready, retired.cleanup)
+		}
+	}
+
+	manifest.retired = remaining
+	return ready
+}
+
 // save writes the manifest to disk atomically
 func (manifest *Manifest) save() error {
 	tempPath := manifest.path + ".tmp"
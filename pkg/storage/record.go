@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Binary record framing used by segment files.
+//
+//	file header: magic u32 | version u16 | reserved u16
+//	record:      length u32 | crc32c u32 | type u8 | payload
+//
+// length is the payload length, the checksum covers type + payload.
+// All integers are little endian.
+
+const (
+	segmentMagic  uint32 = 0x47534c54 // "TLSG"
+	FormatVersion uint16 = 1
+
+	fileHeaderSize   = 8
+	recordHeaderSize = 4 + 4 + 1
+
+	// RecordTypeEntry holds a JSON encoded types.LogEntry
+	RecordTypeEntry byte = 1
+
+	// anything bigger is treated as a damaged length field
+	maxRecordSize = 64 << 20
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	// ErrTornRecord means a record stops before its declared length, typically a write cut short by a crash
+	ErrTornRecord = errors.New("torn record")
+	// ErrCorruptRecord means a record is complete but its content is damaged
+	ErrCorruptRecord = errors.New("corrupt record")
+)
+
+// CorruptionError reports where a file is damaged
+type CorruptionError struct {
+	File   string
+	Offset int64
+	Err    error // ErrTornRecord or ErrCorruptRecord
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("%s: %v at offset %d: %s", e.File, e.Err, e.Offset, e.Reason)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
+
+// fileHeader returns the header written at the start of a framed file
+func fileHeader(magic uint32) []byte {
+	header := make([]byte, fileHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:4], magic)
+	binary.LittleEndian.PutUint16(header[4:6], FormatVersion)
+	return header
+}
+
+// parseFileHeader checks whether header starts a framed file with the given magic.
+// ok is false for files in an older (unframed) format.
+func parseFileHeader(header []byte, magic uint32) (bool, error) {
+	if len(header) < fileHeaderSize || binary.LittleEndian.Uint32(header[0:4]) != magic {
+		return false, nil
+	}
+
+	if version := binary.LittleEndian.Uint16(header[4:6]); version > FormatVersion {
+		return false, fmt.Errorf("unsupported format version %d", version)
+	}
+
+	return true, nil
+}
+
+// encodeRecord frames a payload
+func encodeRecord(recordType byte, payload []byte) []byte {
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	record[8] = recordType
+	record = append(record, payload...)
+
+	binary.LittleEndian.PutUint32(record[4:8], crc32.Checksum(record[8:], castagnoli))
+	return record
+}
+
+// readRecord reads the next record. It returns io.EOF only on a clean record boundary,
+// ErrTornRecord when the input ends inside a record and ErrCorruptRecord on a bad length or checksum.
+// size is the number of bytes the record occupies, also when it is damaged but complete.
+func readRecord(reader *bufio.Reader) (recordType byte, payload []byte, size int, err error) {
+	header := make([]byte, recordHeaderSize)
+
+	n, err := io.ReadFull(reader, header)
+	if err == io.EOF {
+		return 0, nil, 0, io.EOF
+	}
+	if err == io.ErrUnexpectedEOF {
+		return 0, nil, n, fmt.Errorf("%w: header cut after %d bytes", ErrTornRecord, n)
+	}
+	if err != nil {
+		return 0, nil, 0, err
+	}
+
+	length := binary.LittleEndian.Uint32(header[0:4])
+	checksum := binary.LittleEndian.Uint32(header[4:8])
+	recordType = header[8]
+
+	if length > maxRecordSize {
+		return 0, nil, recordHeaderSize, fmt.Errorf("%w: length %d out of range", ErrCorruptRecord, length)
+	}
+
+	payload = make([]byte, length)
+	n, err = io.ReadFull(reader, payload)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, nil, recordHeaderSize + n, fmt.Errorf("%w: payload cut at %d of %d bytes", ErrTornRecord, n, length)
+	}
+	if err != nil {
+		return 0, nil, 0, err
+	}
+
+	size = recordHeaderSize + int(length)
+
+	digest := crc32.Update(crc32.Checksum(header[8:9], castagnoli), castagnoli, payload)
+	if digest != checksum {
+		return 0, nil, size, fmt.Errorf("%w: checksum mismatch", ErrCorruptRecord)
+	}
+
+	return recordType, payload, size, nil
+}
+
+// recordFollows reports whether a well formed entry record starts anywhere in data
+func recordFollows(data []byte) bool {
+	for i := 0; i+recordHeaderSize < len(data); i++ {
+		// entry payloads are JSON objects, which rules out most positions cheaply
+		if data[i+8] != RecordTypeEntry || data[i+recordHeaderSize] != '{' {
+			continue
+		}
+		end := i + recordHeaderSize + int(binary.LittleEndian.Uint32(data[i:i+4]))
+		if end > len(data) || end < i+recordHeaderSize {
+			continue
+		}
+		if crc32.Checksum(data[i+8:end], castagnoli) == binary.LittleEndian.Uint32(data[i+4:i+8]) {
+			return true
+		}
+	}
+	return false
+}
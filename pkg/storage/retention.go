@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RetentionPolicy decides which sealed segments are deleted
+type RetentionPolicy struct {
+	MaxAge        time.Duration            // delete segments whose newest entry is older (0 = keep forever)
+	MaxTotalBytes int64                    // delete the oldest segments until the rest fit (0 = unlimited)
+	ServiceMaxAge map[string]time.Duration // MaxAge override per service (0 = keep forever), see expiredByAge
+}
+
+// DeleteHook is called for every segment retention deletes, after the manifest
+// dropped it and before its file is removed
+type DeleteHook func(meta SegmentMeta) error
+
+// RetentionManager periodically deletes sealed segments according to a policy
+type RetentionManager struct {
+	dir         string
+	manifest    *Manifest
+	policy      RetentionPolicy
+	interval    time.Duration
+	onDelete    DeleteHook
+	stopChannel chan struct{}
+	mutex       sync.Mutex // one enforcement at a time
+}
+
+// NewRetentionManager creates a retention manager for the segments of manifest stored in dir
+func NewRetentionManager(dir string, manifest *Manifest, policy RetentionPolicy, interval time.Duration) *RetentionManager {
+	return &RetentionManager{
+		dir:         dir,
+		manifest:    manifest,
+		policy:      policy,
+		interval:    interval,
+		stopChannel: make(chan struct{}),
+	}
+}
+
+// OnDelete registers a hook that runs for every deleted segment, e.g. to drop its indexes
+func (retentionManager *RetentionManager) OnDelete(hook DeleteHook) {
+	retentionManager.mutex.Lock()
+	defer retentionManager.mutex.Unlock()
+	retentionManager.onDelete = hook
+}
+
+// Expired returns the segments the policy deletes at time now, oldest first
+func (policy RetentionPolicy) Expired(segments []SegmentMeta, now time.Time) []SegmentMeta {
+	// oldest first, that is also the order the size limit gives segments up in
+	sorted := make([]SegmentMeta, len(segments))
+	copy(sorted, segments)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].MaxTimestamp < sorted[j].MaxTimestamp })
+
+	var expired, kept []SegmentMeta
+	var keptBytes int64
+	for _, segment := range sorted {
+		if policy.expiredByAge(segment, now) {
+			expired = append(expired, segment)
+			continue
+		}
+		kept = append(kept, segment)
+		keptBytes += segment.Size
+	}
+
+	if policy.MaxTotalBytes > 0 {
+		for len(kept) > 0 && keptBytes > policy.MaxTotalBytes {
+			expired = append(expired, kept[0])
+			keptBytes -= kept[0].Size
+			kept = kept[1:]
+		}
+	}
+
+	return expired
+}
+
+// expiredByAge reports whether every service in the segment is past its max age.
+// A segment is shared by all services written at the time, so the longest retention among them wins:
+// an override shorter than MaxAge only applies to segments holding nothing but that service.
+func (policy RetentionPolicy) expiredByAge(segment SegmentMeta, now time.Time) bool {
+	maxAge := policy.MaxAge
+	if len(segment.Services) > 0 {
+		maxAge = -1
+		for _, service := range segment.Services {
+			serviceMaxAge, ok := policy.ServiceMaxAge[service]
+			if !ok {
+				serviceMaxAge = policy.MaxAge
+			}
+			if serviceMaxAge == 0 {
+				return false
+			}
+			maxAge = max(maxAge, serviceMaxAge)
+		}
+	}
+
+	if maxAge <= 0 {
+		return false
+	}
+	return segment.MaxTimestamp < now.Add(-maxAge).UnixMilli()
+}
+
+// Enforce deletes every segment the policy expires right now and returns them.
+// The manifest is updated first, so a crash can leave an orphaned file but never
+// a manifest entry pointing at a deleted one. Files go once running queries are done with them.
+func (retentionManager *RetentionManager) Enforce() ([]SegmentMeta, error) {
+	retentionManager.mutex.Lock()
+	defer retentionManager.mutex.Unlock()
+
+	expired := retentionManager.policy.Expired(retentionManager.manifest.GetSegments(), time.Now())
+	if len(expired) == 0 {
+		return nil, nil
+	}
+
+	fileNames := make([]string, 0, len(expired))
+	for _, segment := range expired {
+		fileNames = append(fileNames, segment.FileName)
+	}
+	if err := retentionManager.manifest.RemoveSegments(fileNames); err != nil {
+		return nil, err
+	}
+
+	onDelete := retentionManager.onDelete
+	retentionManager.manifest.Retire(func() {
+		for _, segment := range expired {
+			if onDelete != nil {
+				if err := onDelete(segment); err != nil {
+					log.Printf("[RETENTION] dropping indexes of %s failed: %v", segment.FileName, err)
+				}
+			}
+
+			path := filepath.Join(retentionManager.dir, segment.FileName)
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				log.Printf("[RETENTION] deleting %s failed: %v", path, err)
+			}
+		}
+	})
+
+	log.Printf("[RETENTION] deleted %d segment(s)", len(expired))
+	return expired, nil
+}
+
+// Start enforces the policy every interval in a separate goroutine
+func (retentionManager *RetentionManager) Start() {
+	go func() {
+		ticker := time.NewTicker(retentionManager.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := retentionManager.Enforce(); err != nil {
+					log.Printf("[RETENTION] %v", err)
+				}
+			case <-retentionManager.stopChannel:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the retention goroutine
+func (retentionManager *RetentionManager) Stop() {
+	close(retentionManager.stopChannel)
+}
@@ -3,13 +3,17 @@ package storage
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/compress"
 	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
 )
 
@@ -21,24 +25,65 @@ type SegmentManager struct {
 	currFile            *os.File
 	lastTimestamp       int64 // last segment timestamp
 	counter             int
-	rotated             bool
-	rotatedMeta         SegmentMeta
+	rotatedSegments     []SegmentMeta // sealed since the last ResetRotationInfo
 	minTimestampSegment int64
 	maxTimestampSegment int64
+	services            map[string]bool // services seen in the current segment
+	onRotate            RotateHook
+	options             SegmentOptions
+	compressions        sync.WaitGroup // CompressSealed in progress
 	mutex               sync.Mutex
 }
 
-// NewSegmentManager initializes segment manager
+// SegmentOptions configures how sealed segments are stored
+type SegmentOptions struct {
+	Codec     compress.Codec // sealed segments are rewritten into blocks of this codec, compress.None keeps them plain
+	BlockSize int            // uncompressed bytes per block
+}
+
+// DefaultSegmentOptions compresses sealed segments with snappy in 64 KB blocks
+func DefaultSegmentOptions() SegmentOptions {
+	return SegmentOptions{
+		Codec:     compress.Snappy,
+		BlockSize: 64 << 10,
+	}
+}
+
+// RotateHook is called with the metadata of a segment once it has been sealed.
+// It runs while the segment manager lock is held, so it must not call back into
+// the segment manager. Its error is returned by the Append that sealed the segment,
+// which stays sealed, the next segment already open.
+type RotateHook func(meta SegmentMeta) error
+
+// NewSegmentManager initializes segment manager with the default options
 func NewSegmentManager(dir string, maxSize int64) (*SegmentManager, error) {
+	return NewSegmentManagerWithOptions(dir, maxSize, DefaultSegmentOptions())
+}
+
+// NewSegmentManagerWithOptions initializes segment manager
+func NewSegmentManagerWithOptions(dir string, maxSize int64, options SegmentOptions) (*SegmentManager, error) {
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return nil, err
 	}
 
+	if options.BlockSize <= 0 {
+		options.BlockSize = DefaultSegmentOptions().BlockSize
+	}
+
 	segmentManager := &SegmentManager{
 		dir:           dir,
 		maxSize:       maxSize,
 		lastTimestamp: 0,
 		counter:       0,
+		options:       options,
+	}
+
+	// compressions cut short by an exit leave their tmp file behind, the plain segment is intact
+	stale, _ := filepath.Glob(filepath.Join(dir, "segment_*.log.tmp"))
+	for _, path := range stale {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
 	}
 
 	if err := segmentManager.newSegment(); err != nil {
@@ -52,20 +97,32 @@ func (segmentManager *SegmentManager) Append(entry *types.LogEntry) (int64, erro
 	segmentManager.mutex.Lock()
 	defer segmentManager.mutex.Unlock()
 
+	// Rotate segment if the previous append filled it up. Rotating before the
+	// write (instead of after) lets callers index the last entry of a segment
+	// under its own file name before the segment is sealed.
+	if segmentManager.currSize >= segmentManager.maxSize {
+		if err := segmentManager.rotateSegment(); err != nil {
+			return 0, err
+		}
+	}
+
 	if segmentManager.currFile == nil {
 		if err := segmentManager.newSegment(); err != nil {
 			return 0, err
 		}
+	}
+
+	if segmentManager.currSize == fileHeaderSize {
 		segmentManager.minTimestampSegment = entry.Timestamp
 		segmentManager.maxTimestampSegment = entry.Timestamp
 	}
 
-	data, err := json.Marshal(entry)
+	payload, err := json.Marshal(entry)
 	if err != nil {
 		return 0, err
 	}
 
-	data = append(data, '\n')
+	data := encodeRecord(RecordTypeEntry, payload)
 
 	offset, err := segmentManager.currFile.Seek(0, io.SeekCurrent)
 	if err != nil {
@@ -88,11 +145,10 @@ func (segmentManager *SegmentManager) Append(entry *types.LogEntry) (int64, erro
 		segmentManager.maxTimestampSegment = entry.Timestamp
 	}
 
-	// Rotate segment if exceeds maxsize
-	if segmentManager.currSize >= segmentManager.maxSize {
-		if err := segmentManager.rotateSegment(); err != nil {
-			return 0, err
-		}
+	if entry.Service != "" {
+		segmentManager.services[entry.Service] = true
+	} else if service, ok := entry.Properties["service"].(string); ok {
+		segmentManager.services[service] = true
 	}
 
 	return offset, nil
@@ -105,20 +161,32 @@ func (segmentManager *SegmentManager) newSegment() error {
 	fileName := fmt.Sprintf("segment_%d.log", segmentID)
 	path := filepath.Join(segmentManager.dir, fileName)
 
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
 
+	if _, err := file.Write(fileHeader(segmentMagic)); err != nil {
+		file.Close()
+		return err
+	}
+
 	segmentManager.currFile = file
-	segmentManager.currSize = 0
+	segmentManager.currSize = fileHeaderSize
 	segmentManager.currName = fileName
 	segmentManager.minTimestampSegment = 0
 	segmentManager.maxTimestampSegment = 0
-	segmentManager.rotated = false
+	segmentManager.services = make(map[string]bool)
 	return nil
 }
 
+// reserveFileName returns a segment file name no other segment uses
+func (segmentManager *SegmentManager) reserveFileName() string {
+	segmentManager.mutex.Lock()
+	defer segmentManager.mutex.Unlock()
+	return fmt.Sprintf("segment_%d.log", segmentManager.nextSegmentID())
+}
+
 // nextSegmentID generates unique segment ID using timestamp + counter
 func (segmentManager *SegmentManager) nextSegmentID() int64 {
 	now := time.Now().UnixNano() / int64(time.Millisecond)
@@ -136,18 +204,114 @@ func (segmentManager *SegmentManager) nextSegmentID() int64 {
 // rotateSegment closes current file and starts new segment
 func (segmentManager *SegmentManager) rotateSegment() error {
 	if segmentManager.currFile != nil {
+		if err := segmentManager.currFile.Sync(); err != nil {
+			return err
+		}
 		segmentManager.currFile.Close()
+		segmentManager.currFile = nil // a failed rotation is retried by the next Append
 	}
-	// Save rotated metadata
-	segmentManager.rotatedMeta = SegmentMeta{
+	// Save rotated metadata, a single flush can rotate several times
+	rotatedMeta := SegmentMeta{
 		FileName:     segmentManager.currName,
 		Size:         segmentManager.currSize,
 		MinTimestamp: segmentManager.minTimestampSegment,
 		MaxTimestamp: segmentManager.maxTimestampSegment,
+		Services:     segmentManager.serviceNames(),
+	}
+
+	// the next segment is open before the hook runs, so appends go on even if it fails
+	if err := segmentManager.newSegment(); err != nil {
+		return err
 	}
-	segmentManager.rotated = true
+	segmentManager.rotatedSegments = append(segmentManager.rotatedSegments, rotatedMeta)
 
-	return segmentManager.newSegment()
+	if segmentManager.onRotate != nil {
+		return segmentManager.onRotate(rotatedMeta)
+	}
+	return nil
+}
+
+// CompressSealed rewrites a sealed segment, already in the manifest, into compressed
+// blocks in the background and swaps its manifest entry once done. Offsets stay valid
+// and the file is replaced by a rename, so readers aren't disturbed. A segment that
+// fails to compress stays plain, which readers handle just as well.
+func (segmentManager *SegmentManager) CompressSealed(manifest *Manifest, meta SegmentMeta) {
+	if segmentManager.options.Codec == compress.None {
+		return
+	}
+
+	segmentManager.compressions.Add(1)
+	go func() {
+		defer segmentManager.compressions.Done()
+		if err := segmentManager.compressSealed(manifest, meta); err != nil {
+			log.Printf("[SEGMENT] compressing %s failed, keeping it uncompressed: %v", meta.FileName, err)
+		}
+	}()
+}
+
+// WaitCompressed waits until the segments handed to CompressSealed are compressed
+func (segmentManager *SegmentManager) WaitCompressed() {
+	segmentManager.compressions.Wait()
+}
+
+// Close waits for pending compressions and syncs and closes the active segment
+func (segmentManager *SegmentManager) Close() error {
+	segmentManager.WaitCompressed()
+
+	segmentManager.mutex.Lock()
+	defer segmentManager.mutex.Unlock()
+	if segmentManager.currFile == nil {
+		return nil
+	}
+	err := segmentManager.currFile.Sync()
+	if closeErr := segmentManager.currFile.Close(); err == nil {
+		err = closeErr
+	}
+	segmentManager.currFile = nil
+	return err
+}
+
+func (segmentManager *SegmentManager) compressSealed(manifest *Manifest, meta SegmentMeta) error {
+	codec := segmentManager.options.Codec
+	path := filepath.Join(segmentManager.dir, meta.FileName)
+	tmp := path + ".tmp"
+	defer os.Remove(tmp) // no-op after the rename
+
+	// retention or compaction may remove the segment meanwhile, its file must stay gone
+	size, err := writeCompressedSegment(path, tmp, codec, segmentManager.options.BlockSize)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	meta.Size = size
+	meta.Codec = codec.String()
+
+	err = manifest.SwapSegment(meta, func() error {
+		return os.Rename(tmp, path)
+	})
+	if errors.Is(err, ErrSegmentsChanged) {
+		return nil
+	}
+	return err
+}
+
+// serviceNames returns the services of the current segment sorted
+func (segmentManager *SegmentManager) serviceNames() []string {
+	services := make([]string, 0, len(segmentManager.services))
+	for service := range segmentManager.services {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	return services
+}
+
+// OnRotate registers a hook that runs every time a segment is sealed
+func (segmentManager *SegmentManager) OnRotate(hook RotateHook) {
+	segmentManager.mutex.Lock()
+	defer segmentManager.mutex.Unlock()
+	segmentManager.onRotate = hook
 }
 
 // Flush syncs current segment to disk
@@ -176,28 +340,51 @@ func (segmentManager *SegmentManager) CurrFileSize() int64 {
 
 // Rotation info for ingest manager
 func (segmentManager *SegmentManager) IsSegmentRotated() bool {
-	return segmentManager.rotated
+	segmentManager.mutex.Lock()
+	defer segmentManager.mutex.Unlock()
+	return len(segmentManager.rotatedSegments) > 0
+}
+
+// RotatedSegments returns every segment sealed since the last ResetRotationInfo, oldest first
+func (segmentManager *SegmentManager) RotatedSegments() []SegmentMeta {
+	segmentManager.mutex.Lock()
+	defer segmentManager.mutex.Unlock()
+
+	segments := make([]SegmentMeta, len(segmentManager.rotatedSegments))
+	copy(segments, segmentManager.rotatedSegments)
+	return segments
+}
+
+func (segmentManager *SegmentManager) lastRotated() SegmentMeta {
+	segmentManager.mutex.Lock()
+	defer segmentManager.mutex.Unlock()
+
+	if len(segmentManager.rotatedSegments) == 0 {
+		return SegmentMeta{}
+	}
+	return segmentManager.rotatedSegments[len(segmentManager.rotatedSegments)-1]
 }
 
 func (segmentManager *SegmentManager) LastRotatedFileName() string {
-	return segmentManager.rotatedMeta.FileName
+	return segmentManager.lastRotated().FileName
 }
 
 func (segmentManager *SegmentManager) LastRotatedFileSize() int64 {
-	return segmentManager.rotatedMeta.Size
+	return segmentManager.lastRotated().Size
 }
 
 func (segmentManager *SegmentManager) LastRotatedMinTimestamp() int64 {
-	return segmentManager.rotatedMeta.MinTimestamp
+	return segmentManager.lastRotated().MinTimestamp
 }
 
 func (segmentManager *SegmentManager) LastRotatedMaxTimestamp() int64 {
-	return segmentManager.rotatedMeta.MaxTimestamp
+	return segmentManager.lastRotated().MaxTimestamp
 }
 
 func (segmentManager *SegmentManager) ResetRotationInfo() {
-	segmentManager.rotated = false
-	segmentManager.rotatedMeta = SegmentMeta{}
+	segmentManager.mutex.Lock()
+	defer segmentManager.mutex.Unlock()
+	segmentManager.rotatedSegments = nil
 }
 
 // CurrFileName returns the current segment file name
@@ -210,18 +397,53 @@ func (segmentManager *SegmentManager) Dir() string {
 func (segmentManager *SegmentManager) ActiveSegmentMeta() SegmentMeta {
 	segmentManager.mutex.Lock()
 	defer segmentManager.mutex.Unlock()
+	return segmentManager.activeSegmentMeta()
+}
 
+// ActiveSegment returns the meta of the active segment and whether it holds any entry
+// yet, both read at once so a rotation can't come in between
+func (segmentManager *SegmentManager) ActiveSegment() (SegmentMeta, bool) {
+	segmentManager.mutex.Lock()
+	defer segmentManager.mutex.Unlock()
+	return segmentManager.activeSegmentMeta(), segmentManager.currSize > fileHeaderSize
+}
+
+func (segmentManager *SegmentManager) activeSegmentMeta() SegmentMeta {
 	return SegmentMeta{
 		FileName:     segmentManager.currName,
 		Size:         segmentManager.currSize,
 		MinTimestamp: segmentManager.minTimestampSegment,
 		MaxTimestamp: segmentManager.maxTimestampSegment,
+		Services:     segmentManager.serviceNames(),
 	}
 }
 
+// SegmentRecord is a log entry and the offset it is stored at in its segment
+type SegmentRecord struct {
+	Offset int64
+	Entry  types.LogEntry
+}
+
 // ReadSegment reads logs from a segment file at given offsets.
 // If offsets is empty, read the whole file.
+// Damaged records are reported as *CorruptionError, segments written before the
+// binary format (newline-delimited JSON) are still readable. Compressed segments
+// only decompress the blocks holding the requested offsets.
 func (segmentManager *SegmentManager) ReadSegment(fileName string, offsets []int64) ([]types.LogEntry, error) {
+	records, err := segmentManager.ReadSegmentRecords(fileName, offsets)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]types.LogEntry, len(records))
+	for i, record := range records {
+		entries[i] = record.Entry
+	}
+	return entries, nil
+}
+
+// ReadSegmentRecords is ReadSegment keeping the offset of every entry
+func (segmentManager *SegmentManager) ReadSegmentRecords(fileName string, offsets []int64) ([]SegmentRecord, error) {
 
 	segmentManager.mutex.Lock()
 	defer segmentManager.mutex.Unlock()
@@ -233,16 +455,118 @@ func (segmentManager *SegmentManager) ReadSegment(fileName string, offsets []int
 
 	defer file.Close()
 
-	var results []types.LogEntry
+	header := make([]byte, fileHeaderSize)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+
+	framed, err := parseFileHeader(header[:n], segmentMagic)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+
+	if !framed {
+		compressed, err := parseFileHeader(header[:n], compressedSegmentMagic)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fileName, err)
+		}
+		if compressed {
+			return readCompressedSegment(file, fileName, offsets)
+		}
+		return readJSONSegment(file, offsets)
+	}
+
+	var results []SegmentRecord
+
+	if len(offsets) == 0 {
+		// full scan
+		reader := bufio.NewReader(file)
+		offset := int64(fileHeaderSize)
+
+		for {
+			entry, size, err := readEntryRecord(reader)
+			if err == io.EOF {
+				return results, nil
+			}
+			if err != nil {
+				return nil, corruption(fileName, offset, err)
+			}
+
+			results = append(results, SegmentRecord{Offset: offset, Entry: entry})
+			offset += int64(size)
+		}
+	}
+
+	// read only specific offsets
+	for _, off := range offsets {
+		if _, err := file.Seek(off, io.SeekStart); err != nil {
+			return nil, err
+		}
+
+		entry, _, err := readEntryRecord(bufio.NewReader(file))
+		if err == io.EOF {
+			err = fmt.Errorf("%w: offset past end of segment", ErrTornRecord)
+		}
+		if err != nil {
+			return nil, corruption(fileName, off, err)
+		}
+
+		results = append(results, SegmentRecord{Offset: off, Entry: entry})
+	}
+
+	return results, nil
+}
+
+// readEntryRecord reads the next record and decodes it as a log entry
+func readEntryRecord(reader *bufio.Reader) (types.LogEntry, int, error) {
+	var entry types.LogEntry
+
+	recordType, payload, size, err := readRecord(reader)
+	if err != nil {
+		return entry, size, err
+	}
+
+	if recordType != RecordTypeEntry {
+		return entry, size, fmt.Errorf("%w: unknown record type %d", ErrCorruptRecord, recordType)
+	}
+
+	if err := json.Unmarshal(payload, &entry); err != nil {
+		return entry, size, fmt.Errorf("%w: %v", ErrCorruptRecord, err)
+	}
+
+	return entry, size, nil
+}
+
+// corruption wraps a record error with the file and offset it happened at
+func corruption(fileName string, offset int64, err error) error {
+	switch {
+	case errors.Is(err, ErrTornRecord):
+		return &CorruptionError{File: fileName, Offset: offset, Err: ErrTornRecord, Reason: err.Error()}
+	case errors.Is(err, ErrCorruptRecord):
+		return &CorruptionError{File: fileName, Offset: offset, Err: ErrCorruptRecord, Reason: err.Error()}
+	}
+	return err
+}
+
+// readJSONSegment reads segments in the original newline-delimited JSON format
+func readJSONSegment(file *os.File, offsets []int64) ([]SegmentRecord, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	var results []SegmentRecord
 
 	if len(offsets) == 0 {
 		// full scan
 		scanner := bufio.NewScanner(file)
+		offset := int64(0)
 		for scanner.Scan() {
 			var entry types.LogEntry
 			if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
-				results = append(results, entry)
+				results = append(results, SegmentRecord{Offset: offset, Entry: entry})
 			}
+			offset += int64(len(scanner.Bytes())) + 1
 		}
 
 		return results, scanner.Err()
@@ -261,7 +585,7 @@ func (segmentManager *SegmentManager) ReadSegment(fileName string, offsets []int
 
 		var entry types.LogEntry
 		if err := json.Unmarshal(line, &entry); err == nil {
-			results = append(results, entry)
+			results = append(results, SegmentRecord{Offset: off, Entry: entry})
 		}
 	}
 
@@ -0,0 +1,309 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/compress"
+)
+
+// Compressed segment layout. Sealed segments are rewritten into it, the records
+// themselves stay byte for byte what the plain segment held.
+//
+//	file header: magic "TLSC" | version u16 | reserved u16
+//	blocks:      record(RecordTypeBlock, codec u8 | compressed records)
+//	block index: record(RecordTypeBlockIndex, count, then start, raw size, file offset per block, all uvarint)
+//	footer:      block index offset u64 | magic u32
+//
+// A block starts and ends on a record boundary. Offsets keep pointing into the plain
+// layout (start is the offset of the first record of a block), so index entries taken
+// while the segment was active stay valid and a read only decompresses the blocks it needs.
+
+const (
+	compressedSegmentMagic uint32 = 0x43534c54 // "TLSC"
+
+	// RecordTypeBlock holds a codec byte followed by a compressed run of records
+	RecordTypeBlock byte = 2
+	// RecordTypeBlockIndex holds the block index of a compressed segment
+	RecordTypeBlockIndex byte = 3
+
+	segmentFooterSize = 8 + 4
+)
+
+type segmentBlock struct {
+	start      int64 // offset of the first record in the plain layout
+	rawSize    int64
+	fileOffset int64 // offset of the block record in the compressed file
+}
+
+// compressSegment rewrites a sealed plain segment into compressed blocks (write tmp -> rename)
+// and returns the new file size. Blocks that don't shrink are stored uncompressed.
+func compressSegment(path string, codec compress.Codec, blockSize int) (int64, error) {
+	tmp := path + ".tmp"
+	defer os.Remove(tmp) // no-op after the rename
+
+	size, err := writeCompressedSegment(path, tmp, codec, blockSize)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// writeCompressedSegment writes the compressed blocks of the plain segment at path into tmp
+// and returns its size
+func writeCompressedSegment(path, tmp string, codec compress.Codec, blockSize int) (int64, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	reader := bufio.NewReader(src)
+	header := make([]byte, fileHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, err
+	}
+	if framed, err := parseFileHeader(header, segmentMagic); err != nil || !framed {
+		return 0, fmt.Errorf("%s: not a plain segment", path)
+	}
+
+	out, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+
+	writer := bufio.NewWriter(out)
+	fileOffset := int64(fileHeaderSize)
+	start := int64(fileHeaderSize)
+	var blocks []segmentBlock
+	var raw []byte
+
+	writeBlock := func() error {
+		if len(raw) == 0 {
+			return nil
+		}
+
+		blockCodec := codec
+		data, err := codec.Encode(raw)
+		if err != nil {
+			return err
+		}
+		if len(data) >= len(raw) {
+			blockCodec, data = compress.None, raw
+		}
+
+		record := encodeRecord(RecordTypeBlock, append([]byte{byte(blockCodec)}, data...))
+		if _, err := writer.Write(record); err != nil {
+			return err
+		}
+
+		blocks = append(blocks, segmentBlock{start: start, rawSize: int64(len(raw)), fileOffset: fileOffset})
+		fileOffset += int64(len(record))
+		start += int64(len(raw))
+		raw = raw[:0]
+		return nil
+	}
+
+	err = func() error {
+		if _, err := writer.Write(fileHeader(compressedSegmentMagic)); err != nil {
+			return err
+		}
+
+		for {
+			recordType, payload, _, err := readRecord(reader)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return corruption(path, start+int64(len(raw)), err)
+			}
+
+			raw = append(raw, encodeRecord(recordType, payload)...)
+			if len(raw) >= blockSize {
+				if err := writeBlock(); err != nil {
+					return err
+				}
+			}
+		}
+		if err := writeBlock(); err != nil {
+			return err
+		}
+
+		index := binary.AppendUvarint(nil, uint64(len(blocks)))
+		for _, block := range blocks {
+			index = binary.AppendUvarint(index, uint64(block.start))
+			index = binary.AppendUvarint(index, uint64(block.rawSize))
+			index = binary.AppendUvarint(index, uint64(block.fileOffset))
+		}
+		record := encodeRecord(RecordTypeBlockIndex, index)
+		if _, err := writer.Write(record); err != nil {
+			return err
+		}
+
+		footer := make([]byte, segmentFooterSize)
+		binary.LittleEndian.PutUint64(footer[0:8], uint64(fileOffset))
+		binary.LittleEndian.PutUint32(footer[8:12], compressedSegmentMagic)
+		if _, err := writer.Write(footer); err != nil {
+			return err
+		}
+		fileOffset += int64(len(record)) + segmentFooterSize
+
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+		return out.Sync()
+	}()
+	out.Close()
+	if err != nil {
+		return 0, err
+	}
+	return fileOffset, nil
+}
+
+// readBlockIndex reads the block index through the footer of a compressed segment
+func readBlockIndex(file *os.File, fileName string) ([]segmentBlock, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < fileHeaderSize+segmentFooterSize {
+		return nil, &CorruptionError{File: fileName, Offset: info.Size(), Err: ErrTornRecord, Reason: "missing footer"}
+	}
+
+	footer := make([]byte, segmentFooterSize)
+	if _, err := file.ReadAt(footer, info.Size()-segmentFooterSize); err != nil {
+		return nil, err
+	}
+	indexOffset := int64(binary.LittleEndian.Uint64(footer[0:8]))
+	if binary.LittleEndian.Uint32(footer[8:12]) != compressedSegmentMagic || indexOffset >= info.Size() {
+		return nil, &CorruptionError{File: fileName, Offset: info.Size() - segmentFooterSize, Err: ErrCorruptRecord, Reason: "bad footer"}
+	}
+
+	section := io.NewSectionReader(file, indexOffset, info.Size()-segmentFooterSize-indexOffset)
+	recordType, payload, _, err := readRecord(bufio.NewReader(section))
+	if err == nil && recordType != RecordTypeBlockIndex {
+		err = fmt.Errorf("%w: expected block index, found record type %d", ErrCorruptRecord, recordType)
+	}
+	if err == io.EOF {
+		err = fmt.Errorf("%w: block index missing", ErrTornRecord)
+	}
+	if err != nil {
+		return nil, corruption(fileName, indexOffset, err)
+	}
+
+	count, n := binary.Uvarint(payload)
+	payload = payload[max(n, 0):]
+	if n <= 0 || count > uint64(len(payload)) {
+		return nil, corruption(fileName, indexOffset, fmt.Errorf("%w: bad block count", ErrCorruptRecord))
+	}
+
+	blocks := make([]segmentBlock, 0, count)
+	for range count {
+		var fields [3]int64
+		for i := range fields {
+			value, n := binary.Uvarint(payload)
+			if n <= 0 {
+				return nil, corruption(fileName, indexOffset, fmt.Errorf("%w: block index cut short", ErrCorruptRecord))
+			}
+			fields[i] = int64(value)
+			payload = payload[n:]
+		}
+		blocks = append(blocks, segmentBlock{start: fields[0], rawSize: fields[1], fileOffset: fields[2]})
+	}
+
+	return blocks, nil
+}
+
+// readBlock reads and decompresses one block
+func readBlock(file *os.File, fileName string, block segmentBlock) ([]byte, error) {
+	section := io.NewSectionReader(file, block.fileOffset, recordHeaderSize+maxRecordSize)
+	recordType, payload, _, err := readRecord(bufio.NewReader(section))
+	if err == nil && (recordType != RecordTypeBlock || len(payload) == 0) {
+		err = fmt.Errorf("%w: expected block, found record type %d", ErrCorruptRecord, recordType)
+	}
+	if err == io.EOF {
+		err = fmt.Errorf("%w: block past end of segment", ErrTornRecord)
+	}
+	if err != nil {
+		return nil, corruption(fileName, block.fileOffset, err)
+	}
+
+	raw, err := compress.Codec(payload[0]).Decode(payload[1:], int(block.rawSize))
+	if err != nil {
+		return nil, corruption(fileName, block.fileOffset, fmt.Errorf("%w: %v", ErrCorruptRecord, err))
+	}
+	return raw, nil
+}
+
+// readCompressedSegment is ReadSegmentRecords for compressed segments
+func readCompressedSegment(file *os.File, fileName string, offsets []int64) ([]SegmentRecord, error) {
+	blocks, err := readBlockIndex(file, fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []SegmentRecord
+
+	if len(offsets) == 0 {
+		// full scan
+		for _, block := range blocks {
+			raw, err := readBlock(file, fileName, block)
+			if err != nil {
+				return nil, err
+			}
+
+			reader := bufio.NewReader(bytes.NewReader(raw))
+			offset := block.start
+			for {
+				entry, size, err := readEntryRecord(reader)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return nil, corruption(fileName, offset, err)
+				}
+
+				results = append(results, SegmentRecord{Offset: offset, Entry: entry})
+				offset += int64(size)
+			}
+		}
+		return results, nil
+	}
+
+	// read only specific offsets, decompressing each block once for a run of offsets in it
+	current := -1
+	var raw []byte
+	for _, off := range offsets {
+		i := sort.Search(len(blocks), func(i int) bool { return blocks[i].start+blocks[i].rawSize > off })
+		if i == len(blocks) || off < blocks[i].start {
+			return nil, corruption(fileName, off, fmt.Errorf("%w: offset past end of segment", ErrTornRecord))
+		}
+
+		if i != current {
+			if raw, err = readBlock(file, fileName, blocks[i]); err != nil {
+				return nil, err
+			}
+			current = i
+		}
+
+		entry, _, err := readEntryRecord(bufio.NewReader(bytes.NewReader(raw[off-blocks[i].start:])))
+		if err == io.EOF {
+			err = fmt.Errorf("%w: offset past end of block", ErrTornRecord)
+		}
+		if err != nil {
+			return nil, corruption(fileName, off, err)
+		}
+
+		results = append(results, SegmentRecord{Offset: off, Entry: entry})
+	}
+
+	return results, nil
+}
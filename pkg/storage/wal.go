@@ -5,25 +5,68 @@ package storage
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
 )
 
-const walFilePattern = "wal_%08d.wal"
+const (
+	walFilePattern = "wal_%08d.wal"
+
+	walMagic uint32 = 0x4c574c54 // "TLWL"
+)
+
+// RecoveryMode decides what replay does with damaged WAL records
+type RecoveryMode int
+
+const (
+	// RecoverStrict truncates a torn final record but fails on damage in the middle of a file
+	RecoverStrict RecoveryMode = iota
+	// RecoverRepair also truncates a file at a damaged record in the middle, dropping everything after it
+	RecoverRepair
+)
+
+// RecoveryReport describes what a WAL replay found and discarded
+type RecoveryReport struct {
+	FilesReplayed    int      `json:"files_replayed"`
+	Records          int      `json:"records"`
+	DiscardedRecords int      `json:"discarded_records"`
+	DiscardedBytes   int64    `json:"discarded_bytes"`
+	TruncatedFiles   []string `json:"truncated_files"`
+}
 
 type WalMeta struct {
 	LastFlushedSeq int64 `json:"last_flushed_seq"`
+	FlushedOffset  int64 `json:"flushed_offset"` // records before this offset in file LastFlushedSeq+1 are flushed too
 	CurrentSeq     int64 `json:"current_seq"`
 	LastOffset     int64 `json:"last_offset"`
 }
 
+// WALPosition points between two records: file Seq, byte Offset.
+// The zero value lies before every record.
+type WALPosition struct {
+	Seq    int64
+	Offset int64
+}
+
+// Before reports whether position comes earlier in the WAL than other
+func (position WALPosition) Before(other WALPosition) bool {
+	if position.Seq != other.Seq {
+		return position.Seq < other.Seq
+	}
+	return position.Offset < other.Offset
+}
+
 type WALManager struct {
 	dir        string
 	walFile    *os.File
@@ -31,12 +74,23 @@ type WALManager struct {
 	metaFile   *os.File
 	metaPath   string
 	lastOffset int64
+	openedAt   time.Time // when the current file was opened, for age based rotation
+	options    WALOptions
+	commits    chan *commitRequest // group commit queue (SyncBatch)
+	closing    chan struct{}
+	background sync.WaitGroup
+	closeOnce  sync.Once
 	mutex      sync.Mutex
 	Meta       WalMeta
 }
 
-// opens and create WAL files
+// opens and create WAL files with the default options (group commit)
 func NewWALManager(walPath, metaPath string) (*WALManager, error) {
+	return NewWALManagerWithOptions(walPath, metaPath, DefaultWALOptions())
+}
+
+// NewWALManagerWithOptions opens and create WAL files with the given durability settings
+func NewWALManagerWithOptions(walPath, metaPath string, options WALOptions) (*WALManager, error) {
 	dir := walPath
 	// if walPath is a file (ends with .wal or contains a file name), use dir of it
 	if !strings.HasSuffix(walPath, string(os.PathSeparator)) && filepath.Ext(walPath) != "" {
@@ -49,6 +103,21 @@ func NewWALManager(walPath, metaPath string) (*WALManager, error) {
 	walManager := &WALManager{
 		dir:      dir,
 		metaPath: metaPath,
+		options:  options.withDefaults(),
+		commits:  make(chan *commitRequest),
+		closing:  make(chan struct{}),
+	}
+
+	metaFile, err := os.OpenFile(metaPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	walManager.metaFile = metaFile
+
+	// load existing meta (if any) first, it tells which wal file is current
+	if err := walManager.loadWalMeta(); err != nil {
+		metaFile.Close()
+		return nil, err
 	}
 
 	// ensure current seq >= 1
@@ -56,197 +125,367 @@ func NewWALManager(walPath, metaPath string) (*WALManager, error) {
 		walManager.Meta.CurrentSeq = 1
 	}
 
-	walPath = filepath.Join(walManager.dir, fmt.Sprintf(walFilePattern, walManager.Meta.CurrentSeq))
-	walFile, err := os.OpenFile(walPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	// a crash during Rotate can leave a newer file than the meta knows about
+	seqs, err := walManager.walFileSeqs()
 	if err != nil {
+		metaFile.Close()
 		return nil, err
 	}
+	if len(seqs) > 0 && seqs[len(seqs)-1] > walManager.Meta.CurrentSeq {
+		walManager.Meta.CurrentSeq = seqs[len(seqs)-1]
+	}
 
-	metaFile, err := os.OpenFile(metaPath, os.O_CREATE|os.O_RDWR, 0644)
-	if err != nil {
-		walFile.Close()
+	if err := walManager.openCurrent(); err != nil {
+		metaFile.Close()
 		return nil, err
 	}
 
-	walManager.walPath = walPath
-	walManager.walFile = walFile
-	walManager.metaFile = metaFile
+	walManager.startBackground()
 
-	// load existing meta (if any)
-	if err := walManager.loadWalMeta(); err != nil {
-		return nil, err
+	return walManager, nil
+}
+
+// openCurrent opens the wal file of Meta.CurrentSeq for appending, writing the file header
+// if it is new. A current file still in the old JSON-lines format is left for replay and
+// appends move on to the next sequence number, so formats never mix within a file.
+func (walManager *WALManager) openCurrent() error {
+	for {
+		walPath := filepath.Join(walManager.dir, fmt.Sprintf(walFilePattern, walManager.Meta.CurrentSeq))
+		walFile, err := os.OpenFile(walPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+
+		info, err := walFile.Stat()
+		if err != nil {
+			walFile.Close()
+			return err
+		}
+
+		if info.Size() < fileHeaderSize {
+			// new file, or one whose header was cut short by a crash during Rotate
+			if err := walFile.Truncate(0); err != nil {
+				walFile.Close()
+				return err
+			}
+			if _, err := walFile.Write(fileHeader(walMagic)); err != nil {
+				walFile.Close()
+				return err
+			}
+			if err := walFile.Sync(); err != nil {
+				walFile.Close()
+				return err
+			}
+		} else {
+			header := make([]byte, fileHeaderSize)
+			n, _ := walFile.ReadAt(header, 0)
+			framed, err := parseFileHeader(header[:n], walMagic)
+			if err != nil {
+				walFile.Close()
+				return fmt.Errorf("%s: %w", walPath, err)
+			}
+			if !framed {
+				walFile.Close()
+				walManager.Meta.CurrentSeq++
+				continue
+			}
+		}
+
+		walManager.walPath = walPath
+		walManager.walFile = walFile
+		walManager.openedAt = time.Now()
+		walManager.lastOffset = max(info.Size(), fileHeaderSize)
+		walManager.Meta.LastOffset = walManager.lastOffset
+		return walManager.saveWalMeta(&walManager.Meta)
 	}
+}
 
-	walManager.lastOffset = walManager.Meta.LastOffset
+// ReplaySingleFile reads a single WAL file and returns entries (helper).
+// It never modifies the file, any damaged record is returned as an error.
+func (walManager *WALManager) ReplaySingleFile(path string) ([]*types.LogEntry, error) {
+	return replayWALFile(path, RecoverStrict, false, 0, &RecoveryReport{})
+}
 
-	return walManager, nil
+// ReplayAllUnflushed reads WAL files in ascending seq order for seq > LastFlushedSeq
+// and returns entries. It does NOT modify meta or delete files; a torn final record is
+// truncated, any other damage fails the replay (see Recover).
+func (walManager *WALManager) ReplayAllUnflushed() ([]*types.LogEntry, error) {
+	entries, _, err := walManager.Recover(RecoverStrict)
+	return entries, err
 }
 
-// Appends a log entry to WAL
-func (walManager *WALManager) Append(entry *types.LogEntry) error {
+// Recover replays every unflushed WAL file like ReplayAllUnflushed and reports what was
+// discarded. A record cut short by a crash at the end of a file is always truncated away.
+// Damage in the middle of a file returns a *CorruptionError, unless mode is RecoverRepair,
+// in which case the file is truncated at the damaged record.
+func (walManager *WALManager) Recover(mode RecoveryMode) ([]*types.LogEntry, *RecoveryReport, error) {
 	walManager.mutex.Lock()
 	defer walManager.mutex.Unlock()
 
-	data, err := json.Marshal(entry)
+	report := &RecoveryReport{}
+
+	seqs, err := walManager.walFileSeqs()
 	if err != nil {
-		return err
+		return nil, report, err
 	}
 
-	data = append(data, '\n')
+	var entries []*types.LogEntry
+	for _, seq := range seqs {
+		if seq <= walManager.Meta.LastFlushedSeq {
+			continue
+		}
 
-	n, err := walManager.walFile.Write(data)
-	if err != nil {
-		return err
-	}
+		// the first unflushed file can start with records that already reached a sealed segment
+		var skipBefore int64
+		if seq == walManager.Meta.LastFlushedSeq+1 {
+			skipBefore = walManager.Meta.FlushedOffset
+		}
 
-	walManager.lastOffset += int64(n)
-	walManager.Meta.LastOffset = walManager.lastOffset
+		path := filepath.Join(walManager.dir, fmt.Sprintf(walFilePattern, seq))
+		fileEntries, err := replayWALFile(path, mode, true, skipBefore, report)
+		if err != nil {
+			return nil, report, err
+		}
+		entries = append(entries, fileEntries...)
+		report.FilesReplayed++
+	}
 
-	if err := walManager.walFile.Sync(); err != nil {
-		return err
+	// the current file may have been truncated under our append handle
+	if info, err := os.Stat(walManager.walPath); err == nil && walManager.walFile != nil {
+		walManager.lastOffset = info.Size()
+		walManager.Meta.LastOffset = info.Size()
 	}
 
-	// persist meta (atomic)
-	return walManager.saveWalMeta(&walManager.Meta)
+	return entries, report, nil
 }
 
-// ReplaySingleFile reads a single WAL file and returns entries (helper)
-func (walManager *WALManager) ReplaySingleFile(path string) ([]*types.LogEntry, error) {
+// replayWALFile reads the entries of one WAL file, leaving out records before skipBefore.
+// With truncate set, damage is cut off the file according to mode; without it any damage is an error.
+func replayWALFile(path string, mode RecoveryMode, truncate bool, skipBefore int64, report *RecoveryReport) ([]*types.LogEntry, error) {
 	fh, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
 	defer fh.Close()
 
-	var entries []*types.LogEntry
-	scanner := bufio.NewScanner(fh)
-	for scanner.Scan() {
-		var e types.LogEntry
-		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
-			// skip malformed line
-			continue
-		}
-		entries = append(entries, &e)
-	}
-	if err := scanner.Err(); err != nil {
+	info, err := fh.Stat()
+	if err != nil {
 		return nil, err
 	}
-	return entries, nil
-}
+	fileSize := info.Size()
 
-// ReplayAllUnflushed reads WAL files in ascending seq order for seq > LastFlushedSeq
-// and returns entries. It does NOT modify meta or delete files.
-func (walManager *WALManager) ReplayAllUnflushed() ([]*types.LogEntry, error) {
-	walManager.mutex.Lock()
-	defer walManager.mutex.Unlock()
-
-	// load meta to ensure we have latest
-	if err := walManager.loadWalMeta(); err != nil {
+	header := make([]byte, fileHeaderSize)
+	n, err := io.ReadFull(fh, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 		return nil, err
 	}
 
-	files, err := os.ReadDir(walManager.dir)
+	framed, err := parseFileHeader(header[:n], walMagic)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%s: %w", path, err)
 	}
-
-	type walFileInfo struct {
-		path string
-		seq  int64
+	if !framed {
+		if _, err := fh.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return replayJSONLines(fh, report)
 	}
 
-	var toReplay []walFileInfo
-	for _, walFile := range files {
-		if walFile.IsDir() {
-			continue
-		}
-		name := walFile.Name()
-		if !strings.HasPrefix(name, "wal_") || !strings.HasSuffix(name, ".wal") {
-			continue
+	var entries []*types.LogEntry
+	reader := bufio.NewReader(fh)
+	offset := int64(fileHeaderSize)
+
+	for {
+		entry, size, err := readEntryRecord(reader)
+		if err == io.EOF {
+			return entries, nil
 		}
-		seq, err := walSeqFromName(name)
+
 		if err != nil {
-			continue
+			// a torn record, or a damaged one that ends the file, is a write cut short by a crash,
+			// unless whole records follow it: then its length field is damaged
+			tornTail := errors.Is(err, ErrTornRecord) || offset+int64(size) == fileSize
+			if tornTail {
+				data, readErr := os.ReadFile(path)
+				if readErr != nil {
+					return nil, readErr
+				}
+				if recordFollows(data[offset+1:]) {
+					tornTail = false
+					err = fmt.Errorf("%w: length runs over the records that follow", ErrCorruptRecord)
+				}
+			}
+			damage := corruption(path, offset, err)
+
+			if !truncate || (!tornTail && mode != RecoverRepair) {
+				return nil, damage
+			}
+
+			if !tornTail {
+				log.Printf("[WAL REPAIR] %v, dropping the rest of the file", damage)
+			}
+
+			discarded := 1
+			if !tornTail {
+				discarded += countRecords(reader)
+			}
+
+			if err := truncateFile(path, offset); err != nil {
+				return nil, err
+			}
+
+			report.DiscardedRecords += discarded
+			report.DiscardedBytes += fileSize - offset
+			report.TruncatedFiles = append(report.TruncatedFiles, filepath.Base(path))
+			return entries, nil
 		}
-		if seq > walManager.Meta.LastFlushedSeq {
-			toReplay = append(toReplay, walFileInfo{
-				path: filepath.Join(walManager.dir, name),
-				seq:  seq,
-			})
+
+		if offset >= skipBefore {
+			e := entry
+			entries = append(entries, &e)
+			report.Records++
 		}
+		offset += int64(size)
 	}
+}
 
-	sort.Slice(toReplay, func(i, j int) bool { return toReplay[i].seq < toReplay[j].seq })
-
+// replayJSONLines reads WAL files written before records were framed
+func replayJSONLines(fh *os.File, report *RecoveryReport) ([]*types.LogEntry, error) {
 	var entries []*types.LogEntry
-	for _, wf := range toReplay {
-		fh, err := os.Open(wf.path)
-		if err != nil {
-			return nil, err
+
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		var e types.LogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// skip malformed line (likely partial on crash)
+			report.DiscardedRecords++
+			report.DiscardedBytes += int64(len(scanner.Bytes()))
+			continue
 		}
+		entries = append(entries, &e)
+		report.Records++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
 
-		scanner := bufio.NewScanner(fh)
-		for scanner.Scan() {
-			var e types.LogEntry
-			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
-				// skip malformed line (likely partial on crash)
-				continue
-			}
-			entries = append(entries, &e)
+// countRecords counts the records left in reader whose framing is still readable
+func countRecords(reader *bufio.Reader) int {
+	count := 0
+	for {
+		_, _, _, err := readRecord(reader)
+		if err == io.EOF || errors.Is(err, ErrTornRecord) {
+			return count
 		}
-		if err := scanner.Err(); err != nil {
-			fh.Close()
-			return nil, err
+		if err != nil && !errors.Is(err, ErrCorruptRecord) {
+			return count
 		}
-		fh.Close()
+		count++
 	}
+}
 
-	return entries, nil
+// truncateFile cuts a file at size and makes the new length durable
+func truncateFile(path string, size int64) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := file.Truncate(size); err != nil {
+		return err
+	}
+	return file.Sync()
 }
 
 // MarkFlushed updates LastFlushedSeq in meta and deletes wal files up to that seq (inclusive).
 // Call this after you deterministically persisted WALs up to seq `seq`.
 func (walManager *WALManager) MarkFlushed(seq int64) error {
+	return walManager.MarkFlushedPosition(WALPosition{Seq: seq + 1})
+}
+
+// MarkFlushedPosition records that every record before position is persisted elsewhere.
+// Files before position.Seq are deleted; replay skips the flushed prefix of position.Seq.
+// The meta is saved before deleting, so a crash in between only leaves files replay ignores.
+func (walManager *WALManager) MarkFlushedPosition(position WALPosition) error {
 	walManager.mutex.Lock()
 	defer walManager.mutex.Unlock()
 
-	// load meta (defensive)
-	if err := walManager.loadWalMeta(); err != nil {
-		return err
-	}
-
-	if seq <= walManager.Meta.LastFlushedSeq {
+	if !walManager.flushedPosition().Before(position) {
 		return nil
 	}
 
-	walManager.Meta.LastFlushedSeq = seq
+	lastFlushedSeq := position.Seq - 1
+
+	walManager.Meta.LastFlushedSeq = lastFlushedSeq
+	walManager.Meta.FlushedOffset = position.Offset
 	if err := walManager.saveWalMeta(&walManager.Meta); err != nil {
 		return err
 	}
 
 	// delete files
-	files, err := os.ReadDir(walManager.dir)
+	seqs, err := walManager.walFileSeqs()
 	if err != nil {
 		return err
 	}
+	for _, seq := range seqs {
+		if seq <= lastFlushedSeq && seq != walManager.Meta.CurrentSeq {
+			_ = os.Remove(filepath.Join(walManager.dir, fmt.Sprintf(walFilePattern, seq))) // ignore errors
+		}
+	}
+
+	return nil
+}
+
+// flushedPosition is where replay starts, caller holds the mutex
+func (walManager *WALManager) flushedPosition() WALPosition {
+	return WALPosition{Seq: walManager.Meta.LastFlushedSeq + 1, Offset: walManager.Meta.FlushedOffset}
+}
+
+// Position returns the position right after the last appended record
+func (walManager *WALManager) Position() WALPosition {
+	walManager.mutex.Lock()
+	defer walManager.mutex.Unlock()
+	return WALPosition{Seq: walManager.Meta.CurrentSeq, Offset: walManager.lastOffset}
+}
+
+// ShouldRotate reports whether the current file reached the size or age limit of the options
+func (walManager *WALManager) ShouldRotate() bool {
+	walManager.mutex.Lock()
+	defer walManager.mutex.Unlock()
+
+	if walManager.lastOffset <= fileHeaderSize {
+		return false // nothing written yet
+	}
+	if walManager.options.MaxFileSize > 0 && walManager.lastOffset >= walManager.options.MaxFileSize {
+		return true
+	}
+	return walManager.options.MaxFileAge > 0 && time.Since(walManager.openedAt) >= walManager.options.MaxFileAge
+}
+
+// walFileSeqs lists the sequence numbers of the wal files on disk in ascending order
+func (walManager *WALManager) walFileSeqs() ([]int64, error) {
+	files, err := os.ReadDir(walManager.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var seqs []int64
 	for _, walFile := range files {
 		if walFile.IsDir() {
 			continue
 		}
-		name := walFile.Name()
-		if !strings.HasPrefix(name, "wal_") || !strings.HasSuffix(name, ".wal") {
-			continue
-		}
-		seqCandidate, err := walSeqFromName(name)
+		seq, err := walSeqFromName(walFile.Name())
 		if err != nil {
 			continue
 		}
-		if seqCandidate <= seq {
-			_ = os.Remove(filepath.Join(walManager.dir, name)) // ignore errors
-		}
+		seqs = append(seqs, seq)
 	}
 
-	return nil
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
 }
 
 func walSeqFromName(name string) (int64, error) {
@@ -296,9 +535,6 @@ func (walManager *WALManager) loadWalMeta() error {
 	}
 
 	walManager.Meta = walMeta
-
-	// reflect last offset into manager
-	walManager.lastOffset = walMeta.LastOffset
 	return nil
 }
 
@@ -344,8 +580,13 @@ func (walManager *WALManager) Rotate() error {
 	walManager.mutex.Lock()
 	defer walManager.mutex.Unlock()
 
+	// the old file must be durable before replay stops at its end
 	if walManager.walFile != nil {
+		if err := walManager.walFile.Sync(); err != nil {
+			return err
+		}
 		walManager.walFile.Close()
+		walManager.walFile = nil
 	}
 	if walManager.metaFile != nil {
 		walManager.metaFile.Close()
@@ -355,30 +596,26 @@ func (walManager *WALManager) Rotate() error {
 	walManager.Meta.LastOffset = 0
 	walManager.lastOffset = 0
 
-	newWalPath := filepath.Join(walManager.dir, fmt.Sprintf(walFilePattern, walManager.Meta.CurrentSeq))
-	walFile, err := os.OpenFile(newWalPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
-	}
-
-	walManager.walFile = walFile
-	walManager.walPath = newWalPath
-	walManager.lastOffset = 0
-
-	return walManager.saveWalMeta(&walManager.Meta)
+	return walManager.openCurrent()
 }
 
-// Close closes WAL and meta files
+// Close waits for pending commits, syncs and closes WAL and meta files
 func (walManager *WALManager) Close() error {
+	walManager.stopBackground()
+
 	walManager.mutex.Lock()
 	defer walManager.mutex.Unlock()
+
+	var err error
 	if walManager.walFile != nil {
+		err = walManager.walFile.Sync()
 		walManager.walFile.Close()
+		walManager.walFile = nil
 	}
 	if walManager.metaFile != nil {
 		walManager.metaFile.Close()
 	}
-	return nil
+	return err
 }
 
 // Truncate clears current wal file and resets lastOffset. Useful in single-file workflows.
@@ -392,7 +629,7 @@ func (walManager *WALManager) Truncate() error {
 		_ = walManager.walFile.Close()
 	}
 
-	if err := os.WriteFile(walManager.walPath, []byte{}, 0644); err != nil {
+	if err := os.WriteFile(walManager.walPath, fileHeader(walMagic), 0644); err != nil {
 		return err
 	}
 
@@ -402,8 +639,8 @@ func (walManager *WALManager) Truncate() error {
 		return err
 	}
 	walManager.walFile = f
-	walManager.lastOffset = 0
-	walManager.Meta.LastOffset = 0
+	walManager.lastOffset = fileHeaderSize
+	walManager.Meta.LastOffset = fileHeaderSize
 
 	// truncate meta (not strictly necessary) — reset last_offset
 	if err := walManager.saveWalMeta(&walManager.Meta); err != nil {
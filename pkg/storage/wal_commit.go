@@ -0,0 +1,275 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+// DurabilityMode decides when an append is acknowledged
+type DurabilityMode int
+
+const (
+	// SyncEveryWrite writes and fsyncs every append on its own
+	SyncEveryWrite DurabilityMode = iota
+	// SyncBatch groups concurrent appends into one write and one fsync (group commit);
+	// each append returns once its batch is durable
+	SyncBatch
+	// SyncInterval returns as soon as an append is written, fsync runs every SyncInterval.
+	// A crash can lose the appends of the last interval.
+	SyncInterval
+)
+
+var ErrWALClosed = errors.New("wal is closed")
+
+// WALOptions configures WAL durability
+type WALOptions struct {
+	Durability   DurabilityMode
+	SyncInterval time.Duration // fsync period for SyncInterval
+	MaxBatchSize int           // max appends merged into one group commit
+	MaxFileSize  int64         // rotate once the current file is this big (0 = never)
+	MaxFileAge   time.Duration // rotate once the current file is this old (0 = never)
+}
+
+// DefaultWALOptions uses group commit and rotates at 64 MB or after an hour
+func DefaultWALOptions() WALOptions {
+	return WALOptions{
+		Durability:   SyncBatch,
+		SyncInterval: 100 * time.Millisecond,
+		MaxBatchSize: 1024,
+		MaxFileSize:  64 << 20,
+		MaxFileAge:   time.Hour,
+	}
+}
+
+func (options WALOptions) withDefaults() WALOptions {
+	defaults := DefaultWALOptions()
+	if options.SyncInterval <= 0 {
+		options.SyncInterval = defaults.SyncInterval
+	}
+	if options.MaxBatchSize <= 0 {
+		options.MaxBatchSize = defaults.MaxBatchSize
+	}
+	return options
+}
+
+// commitRequest is one caller waiting in the group commit queue
+type commitRequest struct {
+	data     []byte
+	position WALPosition // where data landed, set before done is signalled
+	done     chan error
+}
+
+// Appends a log entry to WAL
+func (walManager *WALManager) Append(entry *types.LogEntry) error {
+	return walManager.AppendBatch([]*types.LogEntry{entry})
+}
+
+// AppendPosition appends a log entry and returns the position its record starts at
+func (walManager *WALManager) AppendPosition(entry *types.LogEntry) (WALPosition, error) {
+	positions, err := walManager.AppendBatchPositions([]*types.LogEntry{entry})
+	if err != nil {
+		return WALPosition{}, err
+	}
+	return positions[0], nil
+}
+
+// AppendBatch appends entries as one contiguous write. It returns once the entries are
+// as durable as the configured DurabilityMode promises.
+func (walManager *WALManager) AppendBatch(entries []*types.LogEntry) error {
+	_, err := walManager.AppendBatchPositions(entries)
+	return err
+}
+
+// AppendBatchPositions is AppendBatch returning the position of every entry's record
+func (walManager *WALManager) AppendBatchPositions(entries []*types.LogEntry) ([]WALPosition, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	var data []byte
+	starts := make([]int64, len(entries)) // record offsets within data
+	for i, entry := range entries {
+		payload, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		starts[i] = int64(len(data))
+		data = append(data, encodeRecord(RecordTypeEntry, payload)...)
+	}
+
+	first, err := walManager.appendData(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// the records are written back to back into one file
+	positions := make([]WALPosition, len(entries))
+	for i, start := range starts {
+		positions[i] = WALPosition{Seq: first.Seq, Offset: first.Offset + start}
+	}
+	return positions, nil
+}
+
+// Sync makes everything appended so far durable. Only SyncInterval needs it, the
+// other modes fsync before an append returns.
+func (walManager *WALManager) Sync() error {
+	if walManager.options.Durability != SyncInterval {
+		return nil
+	}
+
+	walManager.mutex.Lock()
+	defer walManager.mutex.Unlock()
+	if walManager.walFile == nil {
+		return ErrWALClosed
+	}
+	return walManager.walFile.Sync()
+}
+
+// appendData writes encoded records as the durability mode says and returns where they start
+func (walManager *WALManager) appendData(data []byte) (WALPosition, error) {
+
+	switch walManager.options.Durability {
+	case SyncBatch:
+		request := &commitRequest{data: data, done: make(chan error, 1)}
+		select {
+		case walManager.commits <- request:
+			err := <-request.done
+			return request.position, err
+		case <-walManager.closing:
+			return WALPosition{}, ErrWALClosed
+		}
+
+	case SyncInterval:
+		walManager.mutex.Lock()
+		defer walManager.mutex.Unlock()
+		return walManager.write(data, false)
+
+	default:
+		walManager.mutex.Lock()
+		defer walManager.mutex.Unlock()
+		return walManager.write(data, true)
+	}
+}
+
+// write appends data to the current file and returns where it starts, caller holds the mutex
+func (walManager *WALManager) write(data []byte, sync bool) (WALPosition, error) {
+	if walManager.walFile == nil {
+		return WALPosition{}, ErrWALClosed
+	}
+
+	position := WALPosition{Seq: walManager.Meta.CurrentSeq, Offset: walManager.lastOffset}
+
+	n, err := walManager.walFile.Write(data)
+	if err != nil {
+		// cut off a partial frame, later records appended behind it would read as damage
+		if n > 0 {
+			if truncErr := walManager.walFile.Truncate(position.Offset); truncErr != nil {
+				walManager.lastOffset += int64(n)
+				walManager.Meta.LastOffset = walManager.lastOffset
+				return position, fmt.Errorf("%w (removing the partial write failed: %v)", err, truncErr)
+			}
+		}
+		return position, err
+	}
+	walManager.lastOffset += int64(n)
+	walManager.Meta.LastOffset = walManager.lastOffset
+
+	if sync {
+		return position, walManager.walFile.Sync()
+	}
+	return position, nil
+}
+
+// startBackground starts the goroutine the durability mode needs
+func (walManager *WALManager) startBackground() {
+	switch walManager.options.Durability {
+	case SyncBatch:
+		walManager.background.Add(1)
+		go walManager.runCommitter()
+	case SyncInterval:
+		walManager.background.Add(1)
+		go walManager.runSyncer()
+	}
+}
+
+func (walManager *WALManager) stopBackground() {
+	walManager.closeOnce.Do(func() {
+		close(walManager.closing)
+	})
+	walManager.background.Wait()
+}
+
+// runCommitter takes a waiting append, merges everything queued behind it and makes
+// the whole batch durable with one write and one fsync. Appends arriving during the
+// fsync queue up and form the next batch.
+func (walManager *WALManager) runCommitter() {
+	defer walManager.background.Done()
+
+	for {
+		var batch []*commitRequest
+
+		select {
+		case request := <-walManager.commits:
+			batch = append(batch, request)
+		case <-walManager.closing:
+			return
+		}
+
+	drain:
+		for len(batch) < walManager.options.MaxBatchSize {
+			select {
+			case request := <-walManager.commits:
+				batch = append(batch, request)
+			default:
+				break drain
+			}
+		}
+
+		size := 0
+		for _, request := range batch {
+			size += len(request.data)
+		}
+		data := make([]byte, 0, size)
+		for _, request := range batch {
+			data = append(data, request.data...)
+		}
+
+		walManager.mutex.Lock()
+		position, err := walManager.write(data, true)
+		walManager.mutex.Unlock()
+
+		for _, request := range batch {
+			request.position = position
+			position.Offset += int64(len(request.data))
+			request.done <- err
+		}
+	}
+}
+
+// runSyncer fsyncs the current file every SyncInterval
+func (walManager *WALManager) runSyncer() {
+	defer walManager.background.Done()
+
+	ticker := time.NewTicker(walManager.options.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			walManager.mutex.Lock()
+			if walManager.walFile != nil {
+				if err := walManager.walFile.Sync(); err != nil {
+					log.Printf("[WAL] interval sync failed: %v", err)
+				}
+			}
+			walManager.mutex.Unlock()
+		case <-walManager.closing:
+			return
+		}
+	}
+}
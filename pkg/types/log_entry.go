@@ -2,6 +2,8 @@ package types
 
 import (
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 )
 
@@ -12,7 +14,9 @@ type LogLevel string
 const (
 	Debug LogLevel = "DEBUG"
 	Info  LogLevel = "INFO"
+	Warn  LogLevel = "WARN"
 	Error LogLevel = "ERROR"
+	Fatal LogLevel = "FATAL"
 )
 
 // LOG STRUCT
@@ -54,7 +58,7 @@ func IsValidLogLevel(level LogLevel) bool {
 
 	switch level {
 
-	case Debug, Info, Error:
+	case Debug, Info, Warn, Error, Fatal:
 		return true
 
 	}
@@ -62,6 +66,49 @@ func IsValidLogLevel(level LogLevel) bool {
 	return false
 }
 
+// ParseLogLevel maps a level name as other logging systems spell it onto a LogLevel,
+// e.g. "warning" -> WARN, "crit" -> FATAL. TRACE has no level of its own and is DEBUG.
+func ParseLogLevel(name string) (LogLevel, bool) {
+	switch strings.ToUpper(strings.TrimSpace(name)) {
+	case "TRACE", "DEBUG", "DBG":
+		return Debug, true
+	case "INFO", "INFORMATION", "INFORMATIONAL", "NOTICE":
+		return Info, true
+	case "WARN", "WARNING":
+		return Warn, true
+	case "ERROR", "ERR":
+		return Error, true
+	case "FATAL", "CRITICAL", "CRIT", "ALERT", "EMERG", "EMERGENCY", "PANIC":
+		return Fatal, true
+	}
+	return "", false
+}
+
+// Normalize checks an entry received from a client and fills in defaults: the level
+// is upper-cased (INFO when empty) and a missing timestamp becomes now
+func (log *LogEntry) Normalize(now time.Time) error {
+	log.Level = LogLevel(strings.ToUpper(string(log.Level)))
+	if log.Level == "" {
+		log.Level = Info
+	}
+	if !IsValidLogLevel(log.Level) {
+		return fmt.Errorf("invalid log level %q", log.Level)
+	}
+
+	if log.Timestamp < 0 {
+		return errors.New("negative timestamp")
+	}
+	if log.Timestamp == 0 {
+		log.Timestamp = now.UnixMilli()
+	}
+
+	if log.Message == "" && log.StackTrace == "" && len(log.Properties) == 0 {
+		return errors.New("empty log entry")
+	}
+
+	return nil
+}
+
 // Properties helper
 
 // can mutate the log entry
@@ -0,0 +1,97 @@
+package api_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/api"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/index"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/ingest"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/query"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/storage"
+)
+
+func TestBatchWrite(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	walManager, _ := storage.NewWALManager(tmpDir, filepath.Join(tmpDir, "wal.meta"))
+	segmentManager, _ := storage.NewSegmentManager(tmpDir, 1024)
+	t.Cleanup(func() { segmentManager.Close() })
+	manifest, _ := storage.NewManifest(filepath.Join(tmpDir, "manifest.json"))
+	indexManager := index.NewIndexManager()
+	ingestManager := ingest.NewIngestManager(
+		&ingest.MemoryBuffer{}, walManager, segmentManager, manifest, indexManager, 1*time.Second,
+	)
+	server := api.NewWriteServer(ingestManager)
+
+	post := func(body []byte, gzipped bool) (int, api.BatchResponse) {
+		request := httptest.NewRequest(http.MethodPost, "/write/batch", bytes.NewReader(body))
+		if gzipped {
+			request.Header.Set("Content-Encoding", "gzip")
+		}
+		recorder := httptest.NewRecorder()
+		server.BatchHandler(recorder, request)
+
+		var response api.BatchResponse
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+		return recorder.Code, response
+	}
+
+	// NDJSON with a blank line, a malformed line and an invalid level
+	ndjson := strings.Join([]string{
+		`{"Timestamp": 1700000000000, "Level": "INFO", "Service": "auth", "Message": "one"}`,
+		``,
+		`{"Timestamp": 1700000001000, "Level": "info", "Message": "two"}`,
+		`{"Timestamp": "soon", "Message": "three"}`,
+		`{"Timestamp": 1700000003000, "Level": "LOUD", "Message": "four"}`,
+		`{"Timestamp": 1700000004000, "Message": "five"}`,
+	}, "\n")
+
+	code, response := post([]byte(ndjson), false)
+	if code != http.StatusOK || response.Accepted != 3 || response.Rejected != 2 {
+		t.Fatalf("unexpected NDJSON result %d %+v", code, response)
+	}
+	if response.Errors[0].Line != 4 || response.Errors[1].Line != 5 || !strings.Contains(response.Errors[1].Error, "LOUD") {
+		t.Errorf("unexpected rejections %+v", response.Errors)
+	}
+
+	// gzipped JSON array
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte(`[{"Timestamp": 1700000005000, "Message": "six"}, {"Timestamp": 1700000006000, "Message": "seven"}, 42]`))
+	writer.Close()
+
+	code, response = post(compressed.Bytes(), true)
+	if code != http.StatusOK || response.Accepted != 2 || len(response.Errors) != 1 || response.Errors[0].Line != 3 {
+		t.Fatalf("unexpected array result %d %+v", code, response)
+	}
+
+	if code, _ := post([]byte(`[{"Message": "x"}`), false); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a truncated array, got %d", code)
+	}
+	if code, response := post([]byte(`{"Level": "LOUD", "Message": "x"}`), false); code != http.StatusBadRequest || response.Rejected != 1 {
+		t.Errorf("expected 400 when every entry is rejected, got %d %+v", code, response)
+	}
+
+	if err := ingestManager.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	results, err := query.NewQueryEngine(indexManager, manifest, segmentManager).Execute(&query.Query{SortAsc: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var messages []string
+	for _, entry := range results {
+		messages = append(messages, entry.Message)
+	}
+	if got := strings.Join(messages, ","); got != "one,two,five,six,seven" {
+		t.Errorf("unexpected stored entries %s", got)
+	}
+}
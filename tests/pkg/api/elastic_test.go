@@ -0,0 +1,120 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/api"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+func postBulk(t *testing.T, server *api.WriteServer, path, body string) (int, api.ElasticBulkResponse) {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_bulk", server.ElasticBulkHandler)
+	mux.HandleFunc("/{index}/_bulk", server.ElasticBulkHandler)
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+
+	var response api.ElasticBulkResponse
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	return recorder.Code, response
+}
+
+func TestElasticBulk(t *testing.T) {
+	ingestManager, received := receivingIngest(t)
+	server := api.NewWriteServer(ingestManager)
+
+	body := strings.Join([]string{
+		`{"index": {"_index": "filebeat-8", "_id": "a1"}}`,
+		`{"@timestamp": "2023-11-14T22:13:20.123Z", "log": {"level": "warning", "logger": "db"}, "service": {"name": "orders"}, "host": {"name": "web-1", "ip": "10.0.0.1"}, "message": "slow query"}`,
+		`{"create": {}}`,
+		`{"timestamp": 1700000000456, "level": "LOUD", "app": "billing", "msg": "unknown level kept"}`,
+		`{"delete": {"_id": "a1"}}`,
+		`{"index": {}}`,
+		`{"@timestamp": "yesterday", "message": "bad date"}`,
+		`{"update": {"_id": "a1"}}`,
+		`{"doc": {"message": "x"}}`,
+		``,
+	}, "\n")
+
+	code, response := postBulk(t, server, "/logs-default/_bulk", body)
+	if code != http.StatusOK || !response.Errors || len(response.Items) != 5 {
+		t.Fatalf("unexpected response %d %+v", code, response)
+	}
+
+	statuses := []int{}
+	for i, action := range []string{"index", "create", "delete", "index", "update"} {
+		item, ok := response.Items[i][action]
+		if !ok {
+			t.Fatalf("item %d is not a %s result: %+v", i, action, response.Items[i])
+		}
+		statuses = append(statuses, item.Status)
+	}
+	if statuses[0] != 201 || statuses[1] != 201 || statuses[2] != 400 || statuses[3] != 400 || statuses[4] != 400 {
+		t.Errorf("unexpected statuses %v", statuses)
+	}
+	if item := response.Items[0]["index"]; item.ID != "a1" || item.Index != "filebeat-8" || item.Result != "created" {
+		t.Errorf("unexpected first item %+v", item)
+	}
+	if item := response.Items[1]["create"]; item.ID == "" || item.Index != "logs-default" {
+		t.Errorf("expected a generated id and the index from the path, got %+v", item)
+	}
+	if response.Items[3]["index"].Error.Type != "mapper_parsing_exception" {
+		t.Errorf("unexpected error for a bad date %+v", response.Items[3]["index"].Error)
+	}
+
+	entries := received()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 stored entries, got %d", len(entries))
+	}
+
+	first := entries[0]
+	if first.Timestamp != 1_700_000_000_123 || first.Level != types.Warn || first.Service != "orders" ||
+		first.Host != "web-1" || first.Message != "slow query" {
+		t.Errorf("unexpected entry %+v", first)
+	}
+	logFields, _ := first.Properties["log"].(map[string]interface{})
+	hostFields, _ := first.Properties["host"].(map[string]interface{})
+	if logFields["logger"] != "db" || logFields["level"] != nil || hostFields["ip"] != "10.0.0.1" ||
+		first.Properties["service"] != nil || first.Properties["_index"] != "filebeat-8" {
+		t.Errorf("unexpected properties %v", first.Properties)
+	}
+
+	second := entries[1]
+	if second.Level != types.Info || second.Properties["level"] != "LOUD" || second.Service != "billing" ||
+		second.Timestamp != 1_700_000_000_456 {
+		t.Errorf("unexpected entry %+v", second)
+	}
+
+	if code, _ := postBulk(t, server, "/_bulk", "{\"index\": {}}\n{\"message\": \"x\"}\nnot json\n"); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a malformed action line, got %d", code)
+	}
+}
+
+func TestElasticFieldMapping(t *testing.T) {
+	ingestManager, received := receivingIngest(t)
+
+	options := api.DefaultWriteOptions()
+	options.Elastic.ServiceFields = []string{"kubernetes.labels.app"}
+	options.Elastic.LevelFields = []string{"lvl"}
+	server := api.NewWriteServerWithOptions(ingestManager, options)
+
+	body := `{"index": {"_index": "k8s"}}` + "\n" +
+		`{"lvl": "error", "kubernetes": {"labels": {"app": "checkout"}, "pod": "checkout-1"}, "log": "boom"}` + "\n"
+	if code, response := postBulk(t, server, "/_bulk", body); code != http.StatusOK || response.Errors {
+		t.Fatalf("unexpected response %d %+v", code, response)
+	}
+
+	entry := received()[0]
+	kubernetes, _ := entry.Properties["kubernetes"].(map[string]interface{})
+	if entry.Service != "checkout" || entry.Level != types.Error || entry.Message != "boom" ||
+		kubernetes["pod"] != "checkout-1" || kubernetes["labels"] != nil {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+}
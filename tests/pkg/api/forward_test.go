@@ -0,0 +1,161 @@
+package api_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/api"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/msgpack"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+func eventTime(seconds, nanos uint32) msgpack.Ext {
+	data := binary.BigEndian.AppendUint32(nil, seconds)
+	return msgpack.Ext{Type: 0, Data: binary.BigEndian.AppendUint32(data, nanos)}
+}
+
+func TestForwardServer(t *testing.T) {
+	ingestManager, received := receivingIngest(t)
+	server := api.NewForwardServer(ingestManager)
+	if err := server.Start("127.0.0.1:0"); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	decoder := msgpack.NewDecoder(conn)
+
+	send := func(message []any) {
+		data, err := msgpack.Marshal(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write(data)
+	}
+	expectAck := func(chunk string, stored int) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		ack, err := decoder.Decode()
+		if err != nil {
+			t.Fatalf("no ack for %s: %v", chunk, err)
+		}
+		if ack.(map[string]any)["ack"] != chunk {
+			t.Errorf("unexpected ack %v, want %s", ack, chunk)
+		}
+		// acknowledged entries have been written
+		if got := len(received()); got != stored {
+			t.Errorf("ack for %s came with %d entries stored, want %d", chunk, got, stored)
+		}
+	}
+
+	// Message mode, no ack requested
+	send([]any{"app.web", int64(1_700_000_000), map[string]any{"message": "message mode", "level": "error", "status": int64(500)}})
+
+	// Forward mode, a bin string from an old Fluentd and an empty record that is dropped
+	send([]any{"app.worker", []any{
+		[]any{eventTime(1_700_000_001, 250_000_000), map[string]any{"log": []byte("forward one"), "service": "jobs"}},
+		[]any{int64(1_700_000_002), map[string]any{}},
+	}, map[string]any{"chunk": "chunk-1", "size": int64(2)}})
+	expectAck("chunk-1", 2)
+
+	// CompressedPackedForward, two gzip members back to back
+	var packed bytes.Buffer
+	for i, text := range []string{"packed one", "packed two"} {
+		event, _ := msgpack.Marshal([]any{eventTime(uint32(1_700_000_010+i), 0), map[string]any{"message": text}})
+		writer := gzip.NewWriter(&packed)
+		writer.Write(event)
+		writer.Close()
+	}
+	send([]any{"app.batch", packed.Bytes(), map[string]any{"chunk": "chunk-2", "compressed": "gzip"}})
+	expectAck("chunk-2", 4)
+
+	entries := received()
+	byMessage := map[string]types.LogEntry{}
+	for _, entry := range entries {
+		byMessage[entry.Message] = entry
+	}
+
+	first := byMessage["message mode"]
+	if first.Timestamp != 1_700_000_000_000 || first.Level != types.Error || first.Service != "app.web" ||
+		first.Properties["tag"] != "app.web" || first.Properties["status"] != int64(500) {
+		t.Errorf("unexpected message mode entry %+v", first)
+	}
+	second := byMessage["forward one"]
+	if second.Timestamp != 1_700_000_001_250 || second.Service != "jobs" || second.Properties["tag"] != "app.worker" {
+		t.Errorf("unexpected forward mode entry %+v", second)
+	}
+	if byMessage["packed two"].Timestamp != 1_700_000_011_000 || byMessage["packed one"].Service != "app.batch" {
+		t.Errorf("unexpected packed entries %+v", byMessage)
+	}
+
+	// a protocol error closes the connection
+	send([]any{int64(42)})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := decoder.Decode(); err == nil {
+		t.Errorf("expected the connection to be closed after an invalid message")
+	}
+}
+
+func TestForwardServerLimits(t *testing.T) {
+	ingestManager, received := receivingIngest(t)
+	server := api.NewForwardServerWithOptions(ingestManager, api.ForwardOptions{
+		IdleTimeout:     200 * time.Millisecond,
+		MaxMessageBytes: 1 << 20,
+	})
+	if err := server.Start("127.0.0.1:0"); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer server.Stop()
+
+	closed := func(conn net.Conn) bool {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		return err != nil && !errors.Is(err, os.ErrDeadlineExceeded)
+	}
+
+	// an array declaring 4 billion elements, fed 64 KiB bins until the server gives up
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		header := []byte{0x93, 0xa3, 'a', 'p', 'p', 0xdd, 0xff, 0xff, 0xff, 0xff}
+		if _, err := conn.Write(header); err != nil {
+			return
+		}
+		bin := append([]byte{0xc6, 0x00, 0x01, 0x00, 0x00}, make([]byte, 64<<10)...)
+		for range 64 {
+			if _, err := conn.Write(bin); err != nil {
+				return
+			}
+		}
+	}()
+	if !closed(conn) {
+		t.Fatalf("expected a message over the limit to close the connection")
+	}
+
+	// a connection sending nothing is closed once idle
+	idle, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	if !closed(idle) {
+		t.Fatalf("expected an idle connection to be closed")
+	}
+
+	if len(received()) != 0 {
+		t.Fatalf("expected nothing written, got %d entries", len(received()))
+	}
+}
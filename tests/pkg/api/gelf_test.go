@@ -0,0 +1,168 @@
+package api_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/api"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+func TestParseGELF(t *testing.T) {
+	message := `{"version":"1.1","host":"docker01","short_message":"request failed","full_message":"panic: boom\n\tat main.go:12",
+		"timestamp":1700000000.1234,"level":3,"_container_name":"checkout","_image_name":"shop/checkout:1.4","_id":"x",
+		"_status":503,"file":"main.go","line":12}`
+
+	entry, err := api.ParseGELF([]byte(message))
+	if err != nil {
+		t.Fatalf("ParseGELF failed: %v", err)
+	}
+	if entry.Host != "docker01" || entry.Message != "request failed" || entry.StackTrace != "panic: boom\n\tat main.go:12" ||
+		entry.Timestamp != 1_700_000_000_123 || entry.Level != types.Error || entry.Service != "checkout" {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+	if entry.Properties["image_name"] != "shop/checkout:1.4" || entry.Properties["status"] != float64(503) ||
+		entry.Properties["file"] != "main.go" || len(entry.Properties) != 4 {
+		t.Errorf("unexpected properties %v", entry.Properties)
+	}
+
+	// _service wins over _container_name, which then stays a property
+	entry, _ = api.ParseGELF([]byte(`{"short_message":"x","_service":"api","_container_name":"api-1","level":"warning"}`))
+	if entry.Service != "api" || entry.Properties["container_name"] != "api-1" || entry.Level != types.Warn {
+		t.Errorf("unexpected service mapping %+v", entry)
+	}
+
+	for _, bad := range []string{`[1]`, `{"short_message":"x","level":9}`, `{"timestamp":"now"}`, `{`} {
+		if _, err := api.ParseGELF([]byte(bad)); !errors.Is(err, api.ErrInvalidGELF) {
+			t.Errorf("expected ErrInvalidGELF for %s, got %v", bad, err)
+		}
+	}
+}
+
+// gelfChunks splits a payload into chunk datagrams of size bytes of data
+func gelfChunks(id string, payload []byte, size int) [][]byte {
+	count := (len(payload) + size - 1) / size
+	var chunks [][]byte
+	for sequence := 0; sequence < count; sequence++ {
+		chunk := append([]byte{0x1e, 0x0f}, id[:8]...)
+		chunk = append(chunk, byte(sequence), byte(count))
+		chunks = append(chunks, append(chunk, payload[sequence*size:min((sequence+1)*size, len(payload))]...))
+	}
+	return chunks
+}
+
+func waitForMessages(t *testing.T, received func() []types.LogEntry, count int) map[string]types.LogEntry {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(received()) < count && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	messages := map[string]types.LogEntry{}
+	for _, entry := range received() {
+		messages[entry.Message] = entry
+	}
+	return messages
+}
+
+func TestGELFServer(t *testing.T) {
+	ingestManager, received := receivingIngest(t)
+	gelfServer := api.NewGELFServer(ingestManager)
+	if err := gelfServer.Start("127.0.0.1:0", "127.0.0.1:0"); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer gelfServer.Stop()
+
+	udp, err := net.Dial("udp", gelfServer.UDPAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	udp.Write([]byte(`{"version":"1.1","host":"h1","short_message":"plain","level":6}`))
+
+	var gzipped bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzipped)
+	fmt.Fprint(gzipWriter, `{"version":"1.1","host":"h2","short_message":"gzipped","level":4}`)
+	gzipWriter.Close()
+	udp.Write(gzipped.Bytes())
+
+	// a zlib payload in chunks, sent out of order with one resent
+	var zlibbed bytes.Buffer
+	zlibWriter := zlib.NewWriter(&zlibbed)
+	fmt.Fprintf(zlibWriter, `{"version":"1.1","host":"h3","short_message":"chunked","full_message":%q}`, bytes.Repeat([]byte("frame\n"), 200))
+	zlibWriter.Close()
+	chunks := gelfChunks("msgid001", zlibbed.Bytes(), 16)
+	if len(chunks) < 3 {
+		t.Fatalf("expected several chunks, got %d", len(chunks))
+	}
+	for i := len(chunks) - 1; i >= 0; i-- {
+		udp.Write(chunks[i])
+		if i == len(chunks)-1 {
+			udp.Write(chunks[i])
+		}
+	}
+
+	tcp, err := net.Dial("tcp", gelfServer.TCPAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(tcp, `{"version":"1.1","host":"h4","short_message":"over tcp","_app":"web"}`+"\x00")
+	fmt.Fprint(tcp, "not json\x00")
+	fmt.Fprint(tcp, `{"version":"1.1","host":"h4","short_message":"last","level":7}`)
+	tcp.Close()
+
+	messages := waitForMessages(t, received, 5)
+	if len(messages) != 5 {
+		t.Fatalf("expected 5 messages, got %v", messages)
+	}
+	if messages["plain"].Level != types.Info || messages["gzipped"].Level != types.Warn ||
+		messages["chunked"].StackTrace != string(bytes.Repeat([]byte("frame\n"), 200)) ||
+		messages["over tcp"].Service != "web" || messages["last"].Level != types.Debug {
+		t.Errorf("unexpected entries %v", messages)
+	}
+}
+
+func TestGELFChunkExpiry(t *testing.T) {
+	ingestManager, received := receivingIngest(t)
+	gelfServer := api.NewGELFServerWithOptions(ingestManager, api.GELFOptions{
+		ChunkTimeout:       50 * time.Millisecond,
+		MaxPendingMessages: 1,
+	})
+	if err := gelfServer.Start("127.0.0.1:0", ""); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer gelfServer.Stop()
+
+	udp, err := net.Dial("udp", gelfServer.UDPAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+
+	// the first chunk expires before the second arrives, which then waits alone
+	expired := gelfChunks("expired1", []byte(`{"host":"h","short_message":"expired"}`), 20)
+	udp.Write(expired[0])
+	time.Sleep(200 * time.Millisecond)
+	udp.Write(expired[1])
+
+	// with one pending message allowed, starting another drops the first
+	evicted := gelfChunks("evicted1", []byte(`{"host":"h","short_message":"evicted"}`), 20)
+	complete := gelfChunks("complete", []byte(`{"host":"h","short_message":"complete"}`), 20)
+	udp.Write(evicted[0])
+	for _, chunk := range complete {
+		udp.Write(chunk)
+	}
+	udp.Write(evicted[1])
+	udp.Write([]byte(`{"host":"h","short_message":"done"}`))
+
+	messages := waitForMessages(t, received, 2)
+	time.Sleep(50 * time.Millisecond)
+	if len(received()) != 2 || messages["complete"].Host != "h" || messages["done"].Host != "h" {
+		t.Errorf("expected only complete and done, got %v", messages)
+	}
+}
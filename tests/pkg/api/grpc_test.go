@@ -0,0 +1,328 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/api"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/index"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/ingest"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/proto"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/query"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/storage"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+func newGRPCServer(t *testing.T) (*api.GRPCServer, *ingest.IngestManager) {
+	t.Helper()
+	tmpDir := t.TempDir()
+
+	walManager, _ := storage.NewWALManager(tmpDir, filepath.Join(tmpDir, "wal.meta"))
+	segmentManager, _ := storage.NewSegmentManager(tmpDir, 1024)
+	t.Cleanup(func() { segmentManager.Close() })
+	manifest, _ := storage.NewManifest(filepath.Join(tmpDir, "manifest.json"))
+	indexManager := index.NewIndexManager()
+	ingestManager := ingest.NewIngestManager(
+		&ingest.MemoryBuffer{}, walManager, segmentManager, manifest, indexManager, 1*time.Second,
+	)
+
+	hub := query.NewTailHub()
+	ingestManager.OnAppend(func(entry *types.LogEntry) {
+		hub.Publish(*entry)
+	})
+	hub.SetPending(ingestManager.Pending)
+
+	grpcServer := api.NewGRPCServer(ingestManager, query.NewQueryEngine(indexManager, manifest, segmentManager), hub)
+	if err := grpcServer.Start("127.0.0.1:0"); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	t.Cleanup(grpcServer.Stop)
+	return grpcServer, ingestManager
+}
+
+// grpcCall starts a call over h2c; requests are written to the returned pipe
+func grpcCall(t *testing.T, server *api.GRPCServer, method string) (*io.PipeWriter, *http.Response) {
+	t.Helper()
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+
+	body, requests := io.Pipe()
+	request, _ := http.NewRequest(http.MethodPost, "http://"+server.Addr().String()+"/timberlog.v1.TimberLog/"+method, body)
+	request.Header.Set("Content-Type", "application/grpc")
+	request.Header.Set("TE", "trailers")
+
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatalf("%s: %v", method, err)
+	}
+	t.Cleanup(func() { response.Body.Close() })
+	return requests, response
+}
+
+func grpcFrame(message []byte) []byte {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	return append(frame, message...)
+}
+
+// unaryCall sends one request and reads the responses up to the end of the call
+func unaryCall(t *testing.T, server *api.GRPCServer, method string, request []byte) ([][]byte, *http.Response) {
+	t.Helper()
+	requests, response := grpcCall(t, server, method)
+	requests.Write(grpcFrame(request))
+	requests.Close()
+
+	var messages [][]byte
+	for {
+		message, err := readGRPCMessage(response.Body)
+		if err == io.EOF {
+			return messages, response
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		messages = append(messages, message)
+	}
+}
+
+func readGRPCMessage(body io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return nil, err
+	}
+	message := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+	_, err := io.ReadFull(body, message)
+	return message, err
+}
+
+// protoFields collects the values of a message by field number, varints as uint64
+// and length-delimited fields as []byte
+func protoFields(t *testing.T, message []byte) map[int][]any {
+	t.Helper()
+	fields := map[int][]any{}
+	err := proto.Walk(message, func(reader *proto.Reader, field int, wireType proto.WireType) (bool, error) {
+		var value any
+		var err error
+		switch wireType {
+		case proto.Varint:
+			value, err = reader.Varint()
+		case proto.Bytes:
+			value, err = reader.Bytes()
+		default:
+			return false, nil
+		}
+		fields[field] = append(fields[field], value)
+		return true, err
+	})
+	if err != nil {
+		t.Fatalf("decoding %x: %v", message, err)
+	}
+	return fields
+}
+
+// logEntry encodes a LogEntry, properties as a google.protobuf.Struct
+func logEntry(writer *proto.Writer, level, service, message string, properties func(*proto.Writer)) {
+	writer.Message(1, func(entry *proto.Writer) {
+		entry.String(2, level)
+		entry.String(3, service)
+		entry.String(5, message)
+		if properties != nil {
+			entry.Message(7, properties)
+		}
+	})
+}
+
+func structField(writer *proto.Writer, key string, value func(*proto.Writer)) {
+	writer.Message(1, func(entry *proto.Writer) {
+		entry.String(1, key)
+		entry.Message(2, value)
+	})
+}
+
+func TestGRPCWriteQueryStats(t *testing.T) {
+	grpcServer, ingestManager := newGRPCServer(t)
+
+	requests, response := grpcCall(t, grpcServer, "Write")
+
+	var batch proto.Writer
+	logEntry(&batch, "info", "auth", "login ok", func(properties *proto.Writer) {
+		structField(properties, "user", func(value *proto.Writer) { value.String(3, "alice") })
+		structField(properties, "attempt", func(value *proto.Writer) { value.Double(2, 3) })
+		structField(properties, "http", func(value *proto.Writer) {
+			value.Message(5, func(nested *proto.Writer) {
+				structField(nested, "method", func(value *proto.Writer) { value.String(3, "POST") })
+			})
+		})
+	})
+	logEntry(&batch, "", "auth", "login failed", nil)
+	requests.Write(grpcFrame(batch.Bytes()))
+
+	ack, err := readGRPCMessage(response.Body)
+	if err != nil {
+		t.Fatalf("reading first ack: %v", err)
+	}
+	fields := protoFields(t, ack)
+	if fields[1][0] != uint64(1) || fields[2][0] != uint64(2) || len(fields[3]) != 0 {
+		t.Fatalf("unexpected first ack %v", fields)
+	}
+
+	// the first ack came before the stream ended, the second batch has a bad entry
+	batch = proto.Writer{}
+	logEntry(&batch, "warn", "billing", "card declined", nil)
+	logEntry(&batch, "loud", "billing", "bad level", nil)
+	requests.Write(grpcFrame(batch.Bytes()))
+	requests.Close()
+
+	ack, err = readGRPCMessage(response.Body)
+	if err != nil {
+		t.Fatalf("reading second ack: %v", err)
+	}
+	fields = protoFields(t, ack)
+	if fields[1][0] != uint64(2) || fields[2][0] != uint64(1) || len(fields[3]) != 1 {
+		t.Fatalf("unexpected second ack %v", fields)
+	}
+	if rejected := protoFields(t, fields[3][0].([]byte)); rejected[1][0] != uint64(1) {
+		t.Errorf("expected entry 1 rejected, got %v", rejected)
+	}
+
+	if _, err := readGRPCMessage(response.Body); err != io.EOF {
+		t.Fatalf("expected the call to end, got %v", err)
+	}
+	if status := response.Trailer.Get("Grpc-Status"); status != "0" {
+		t.Fatalf("expected status 0, got %q: %s", status, response.Trailer.Get("Grpc-Message"))
+	}
+
+	if err := ingestManager.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	// properties made it through as a Struct: nested, numeric and string fields all match
+	var request proto.Writer
+	request.String(1, "user:alice AND attempt >= 3 AND http.method:POST")
+	messages, response := unaryCall(t, grpcServer, "Query", request.Bytes())
+	if response.Trailer.Get("Grpc-Status") != "0" || len(messages) != 1 {
+		t.Fatalf("unexpected query result %d messages, status %q %s", len(messages), response.Trailer.Get("Grpc-Status"), response.Trailer.Get("Grpc-Message"))
+	}
+	fields = protoFields(t, messages[0])
+	if len(fields[1]) != 1 || len(fields[2]) != 1 {
+		t.Fatalf("expected one entry and stats, got %v", fields)
+	}
+	entry := protoFields(t, fields[1][0].([]byte))
+	if string(entry[5][0].([]byte)) != "login ok" || string(entry[2][0].([]byte)) != "INFO" {
+		t.Errorf("unexpected entry %v", entry)
+	}
+
+	// paging: limit 1 leaves a cursor
+	request = proto.Writer{}
+	request.String(1, "service:auth OR service:billing")
+	request.Varint(4, 1)
+	messages, _ = unaryCall(t, grpcServer, "Query", request.Bytes())
+	stats := protoFields(t, protoFields(t, messages[len(messages)-1])[2][0].([]byte))
+	if stats[1][0] != uint64(1) || len(stats[4]) != 1 {
+		t.Errorf("expected count 1 and a cursor, got %v", stats)
+	}
+
+	request = proto.Writer{}
+	request.String(1, "level:(")
+	messages, response = unaryCall(t, grpcServer, "Query", request.Bytes())
+	if len(messages) != 0 || response.Trailer.Get("Grpc-Status") != "3" || response.Trailer.Get("Grpc-Message") == "" {
+		t.Errorf("expected INVALID_ARGUMENT, got %q %q", response.Trailer.Get("Grpc-Status"), response.Trailer.Get("Grpc-Message"))
+	}
+
+	messages, _ = unaryCall(t, grpcServer, "Stats", nil)
+	fields = protoFields(t, messages[0])
+	if fields[1][0].(uint64) == 0 || fields[2][0].(uint64) == 0 || len(fields[5]) != 2 ||
+		string(fields[5][0].([]byte)) != "auth" || fields[7][0] != uint64(0) {
+		t.Errorf("unexpected stats %v", fields)
+	}
+}
+
+func TestGRPCTail(t *testing.T) {
+	grpcServer, ingestManager := newGRPCServer(t)
+
+	appendLog := func(service, message string) {
+		entry := &types.LogEntry{Level: types.Info, Service: service, Message: message}
+		if err := ingestManager.AppendLog(entry); err != nil {
+			t.Fatalf("AppendLog failed: %v", err)
+		}
+	}
+	appendLog("auth", "stored")
+	if err := ingestManager.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	appendLog("auth", "buffered")
+
+	var request proto.Writer
+	request.String(1, "service:auth")
+	request.Varint(2, 5)
+	requests, response := grpcCall(t, grpcServer, "Tail")
+	requests.Write(grpcFrame(request.Bytes()))
+	requests.Close()
+
+	messages := make(chan []byte)
+	go func() {
+		defer close(messages)
+		for {
+			message, err := readGRPCMessage(response.Body)
+			if err != nil {
+				return
+			}
+			messages <- message
+		}
+	}()
+
+	next := func() string {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				t.Fatalf("tail ended, status %q", response.Trailer.Get("Grpc-Status"))
+			}
+			entry := protoFields(t, protoFields(t, message)[1][0].([]byte))
+			return string(entry[5][0].([]byte))
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for a tailed entry")
+			return ""
+		}
+	}
+
+	for _, want := range []string{"stored", "buffered"} {
+		if got := next(); got != want {
+			t.Fatalf("expected the backfill %q first, got %q", want, got)
+		}
+	}
+	// wait for the subscription before writing live entries
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		stats, _ := unaryCall(t, grpcServer, "Stats", nil)
+		if fields := protoFields(t, stats[0]); len(fields[7]) == 1 && fields[7][0] == uint64(1) {
+			break
+		}
+	}
+	appendLog("billing", "other service")
+	appendLog("auth", "live")
+	if got := next(); got != "live" {
+		t.Fatalf("expected the live entry, got %q", got)
+	}
+}
+
+func TestGRPCRejectsNonGRPC(t *testing.T) {
+	grpcServer, _ := newGRPCServer(t)
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+
+	response, err := client.Post("http://"+grpcServer.Addr().String()+"/timberlog.v1.TimberLog/Stats", "application/json", bytes.NewReader(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("expected 415, got %d", response.StatusCode)
+	}
+}
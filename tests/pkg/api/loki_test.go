@@ -0,0 +1,121 @@
+package api_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/api"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/compress"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/proto"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+func pushLoki(server *api.WriteServer, body []byte, contentType string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/loki/api/v1/push", bytes.NewReader(body))
+	request.Header.Set("Content-Type", contentType)
+	recorder := httptest.NewRecorder()
+	server.LokiPushHandler(recorder, request)
+	return recorder
+}
+
+func TestLokiPushProtobuf(t *testing.T) {
+	ingestManager, received := receivingIngest(t)
+	server := api.NewWriteServer(ingestManager)
+
+	var request proto.Writer
+	request.Message(1, func(stream *proto.Writer) {
+		stream.String(1, `{job="varlogs", host="node-1", level="warn", path="C:\\logs\\app \"x\".log"}`)
+		stream.Message(2, func(entry *proto.Writer) {
+			entry.Message(1, func(timestamp *proto.Writer) {
+				timestamp.Varint(1, 1_700_000_000)
+				timestamp.Varint(2, 123_456_789)
+			})
+			entry.String(2, "disk almost full")
+			entry.Message(3, func(pair *proto.Writer) {
+				pair.String(1, "trace_id")
+				pair.String(2, "abc")
+			})
+		})
+		stream.Message(2, func(entry *proto.Writer) {
+			entry.Message(1, func(timestamp *proto.Writer) { timestamp.Varint(1, 1_700_000_001) })
+			entry.String(2, "second line")
+		})
+	})
+
+	recorder := pushLoki(server, compress.Encode(request.Bytes()), "application/x-protobuf")
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	entries := received()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	first := entries[0]
+	if first.Timestamp != 1_700_000_000_123 || first.Service != "varlogs" || first.Host != "node-1" ||
+		first.Level != types.Warn || first.Message != "disk almost full" {
+		t.Errorf("unexpected entry %+v", first)
+	}
+	if first.Properties["path"] != `C:\logs\app "x".log` || first.Properties["trace_id"] != "abc" || first.Properties["job"] != nil {
+		t.Errorf("unexpected properties %v", first.Properties)
+	}
+	if entries[1].Timestamp != 1_700_000_001_000 || entries[1].Message != "second line" {
+		t.Errorf("unexpected second entry %+v", entries[1])
+	}
+
+	if recorder := pushLoki(server, request.Bytes(), "application/x-protobuf"); recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an uncompressed body, got %d", recorder.Code)
+	}
+}
+
+func TestLokiPushJSON(t *testing.T) {
+	ingestManager, received := receivingIngest(t)
+	server := api.NewWriteServer(ingestManager)
+
+	body := `{"streams": [{
+		"stream": {"service_name": "checkout", "env": "prod", "level": "verbose"},
+		"values": [
+			["1700000000999999999", "order placed", {"order_id": "17"}],
+			["1700000002000000000", "order shipped"]
+		]
+	}]}`
+
+	recorder := pushLoki(server, []byte(body), "application/json")
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	entries := received()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	// an unknown level label stays a property
+	if entries[0].Timestamp != 1_700_000_000_999 || entries[0].Service != "checkout" || entries[0].Level != types.Info ||
+		entries[0].Properties["level"] != "verbose" || entries[0].Properties["env"] != "prod" ||
+		entries[0].Properties["order_id"] != "17" {
+		t.Errorf("unexpected entry %+v", entries[0])
+	}
+
+	for _, bad := range []string{
+		`{"streams": [{"stream": {}, "values": [[1700000000000000000, "numeric timestamp"]]}]}`,
+		`{"streams": [{"stream": {}, "values": [["1700000000000000000"]]}]}`,
+		`not json`,
+	} {
+		if recorder := pushLoki(server, []byte(bad), "application/json"); recorder.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s, got %d", bad, recorder.Code)
+		}
+	}
+
+	// an empty line without labels is rejected, the rest is still written
+	body = `{"streams": [{"values": [["1700000003000000000", ""]]}, {"stream": {"app": "x"}, "values": [["1700000004000000000", "kept"]]}]}`
+	if recorder := pushLoki(server, []byte(body), "application/json"); recorder.Code != http.StatusBadRequest ||
+		!strings.Contains(recorder.Body.String(), "1 entries rejected") {
+		t.Errorf("expected a 400 listing the rejected entry, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	if entries := received(); entries[len(entries)-1].Message != "kept" {
+		t.Errorf("valid entry of a partially rejected push was not written")
+	}
+}
@@ -0,0 +1,230 @@
+package api_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/api"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/index"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/ingest"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/proto"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/storage"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+// receivingIngest is an IngestManager over a temp dir that records every appended entry
+func receivingIngest(t *testing.T) (*ingest.IngestManager, func() []types.LogEntry) {
+	tmpDir := t.TempDir()
+
+	walManager, _ := storage.NewWALManager(tmpDir, filepath.Join(tmpDir, "wal.meta"))
+	segmentManager, _ := storage.NewSegmentManager(tmpDir, 1024)
+	t.Cleanup(func() { segmentManager.Close() })
+	manifest, _ := storage.NewManifest(filepath.Join(tmpDir, "manifest.json"))
+	ingestManager := ingest.NewIngestManager(
+		&ingest.MemoryBuffer{}, walManager, segmentManager, manifest, index.NewIndexManager(), 1*time.Second,
+	)
+
+	var mutex sync.Mutex
+	var received []types.LogEntry
+	ingestManager.OnAppend(func(entry *types.LogEntry) {
+		mutex.Lock()
+		received = append(received, *entry)
+		mutex.Unlock()
+	})
+	return ingestManager, func() []types.LogEntry {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return slices.Clone(received)
+	}
+}
+
+func keyValue(writer *proto.Writer, field int, key string, value func(*proto.Writer)) {
+	writer.Message(field, func(kv *proto.Writer) {
+		kv.String(1, key)
+		kv.Message(2, value)
+	})
+}
+
+func TestOTLPProtobuf(t *testing.T) {
+	ingestManager, received := receivingIngest(t)
+	server := api.NewWriteServer(ingestManager)
+
+	var request proto.Writer
+	request.Message(1, func(resourceLogs *proto.Writer) {
+		resourceLogs.Message(1, func(resource *proto.Writer) {
+			keyValue(resource, 1, "service.name", func(v *proto.Writer) { v.String(1, "checkout") })
+			keyValue(resource, 1, "host.name", func(v *proto.Writer) { v.String(1, "node-1") })
+			keyValue(resource, 1, "deployment.environment", func(v *proto.Writer) { v.String(1, "prod") })
+		})
+		resourceLogs.Message(2, func(scopeLogs *proto.Writer) {
+			scopeLogs.Message(2, func(record *proto.Writer) {
+				record.Fixed64(1, 1_700_000_000_123_456_789)
+				record.Varint(2, 13) // WARN
+				record.Message(5, func(body *proto.Writer) { body.String(1, "payment slow") })
+				keyValue(record, 6, "latency_ms", func(v *proto.Writer) { v.Varint(3, 1500) })
+				keyValue(record, 6, "retry", func(v *proto.Writer) { v.Bool(2, true) })
+				record.BytesField(9, bytes.Repeat([]byte{0xab}, 16))
+				record.BytesField(10, bytes.Repeat([]byte{0xcd}, 8))
+			})
+		})
+	})
+	// a record with nothing to store is rejected as a partial success
+	request.Message(1, func(resourceLogs *proto.Writer) {
+		resourceLogs.Message(2, func(scopeLogs *proto.Writer) {
+			scopeLogs.Message(2, func(record *proto.Writer) {
+				record.Varint(2, 9)
+			})
+		})
+	})
+
+	httpRequest := httptest.NewRequest(http.MethodPost, "/v1/logs", bytes.NewReader(request.Bytes()))
+	httpRequest.Header.Set("Content-Type", "application/x-protobuf")
+	recorder := httptest.NewRecorder()
+	server.OTLPLogsHandler(recorder, httpRequest)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	var rejected uint64
+	proto.Walk(recorder.Body.Bytes(), func(reader *proto.Reader, field int, wireType proto.WireType) (bool, error) {
+		partial, err := reader.Bytes()
+		proto.Walk(partial, func(reader *proto.Reader, field int, wireType proto.WireType) (bool, error) {
+			if field == 1 {
+				rejected, err = reader.Varint()
+				return true, err
+			}
+			return false, nil
+		})
+		return true, err
+	})
+	if rejected != 1 {
+		t.Errorf("expected 1 rejected record in the partial success, got %d", rejected)
+	}
+
+	if len(received()) != 1 {
+		t.Fatalf("expected 1 stored entry, got %d", len(received()))
+	}
+	entry := received()[0]
+	if entry.Timestamp != 1_700_000_000_123 || entry.Level != types.Warn || entry.Service != "checkout" ||
+		entry.Host != "node-1" || entry.Message != "payment slow" {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+	if entry.Properties["latency_ms"] != int64(1500) || entry.Properties["retry"] != true ||
+		entry.Properties["deployment.environment"] != "prod" {
+		t.Errorf("unexpected properties %v", entry.Properties)
+	}
+	if entry.Properties["trace_id"] != strings.Repeat("ab", 16) || entry.Properties["span_id"] != strings.Repeat("cd", 8) {
+		t.Errorf("trace context not kept: %v", entry.Properties)
+	}
+	if _, ok := entry.Properties["service.name"]; ok {
+		t.Errorf("service.name should not be a property")
+	}
+}
+
+func TestOTLPJSON(t *testing.T) {
+	ingestManager, received := receivingIngest(t)
+	server := api.NewWriteServer(ingestManager)
+
+	body := `{"resourceLogs": [{
+		"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "auth"}}]},
+		"scopeLogs": [{"logRecords": [{
+			"timeUnixNano": "1700000000000000000",
+			"severityText": "error",
+			"body": {"kvlistValue": {"values": [{"key": "event", "value": {"stringValue": "login"}}]}},
+			"attributes": [
+				{"key": "user", "value": {"kvlistValue": {"values": [{"key": "id", "value": {"intValue": "42"}}]}}},
+				{"key": "tags", "value": {"arrayValue": {"values": [{"stringValue": "a"}, {"doubleValue": 1.5}]}}}
+			],
+			"traceId": "5b8efff798038103d269b633813fc60c",
+			"spanId": "eee19b7ec3c1b174"
+		}]}]
+	}]}`
+
+	httpRequest := httptest.NewRequest(http.MethodPost, "/v1/logs", strings.NewReader(body))
+	httpRequest.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	server.OTLPLogsHandler(recorder, httpRequest)
+
+	if recorder.Code != http.StatusOK || strings.TrimSpace(recorder.Body.String()) != "{}" {
+		t.Fatalf("unexpected response %d %s", recorder.Code, recorder.Body.String())
+	}
+	if len(received()) != 1 {
+		t.Fatalf("expected 1 stored entry, got %d", len(received()))
+	}
+
+	entry := received()[0]
+	if entry.Timestamp != 1_700_000_000_000 || entry.Level != types.Error || entry.Service != "auth" ||
+		entry.Message != `{"event":"login"}` {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+	user, _ := entry.Properties["user"].(map[string]any)
+	tags, _ := entry.Properties["tags"].([]any)
+	if user["id"] != int64(42) || len(tags) != 2 || tags[1] != 1.5 {
+		t.Errorf("unexpected properties %v", entry.Properties)
+	}
+	if entry.Properties["trace_id"] != "5b8efff798038103d269b633813fc60c" || entry.Properties["span_id"] != "eee19b7ec3c1b174" {
+		t.Errorf("trace context not kept: %v", entry.Properties)
+	}
+
+	// unsupported media type and malformed payloads
+	httpRequest = httptest.NewRequest(http.MethodPost, "/v1/logs", strings.NewReader(body))
+	httpRequest.Header.Set("Content-Type", "text/plain")
+	recorder = httptest.NewRecorder()
+	server.OTLPLogsHandler(recorder, httpRequest)
+	if recorder.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected 415, got %d", recorder.Code)
+	}
+
+	httpRequest = httptest.NewRequest(http.MethodPost, "/v1/logs", bytes.NewReader([]byte{0x0a, 0x10, 0x01}))
+	httpRequest.Header.Set("Content-Type", "application/x-protobuf")
+	recorder = httptest.NewRecorder()
+	server.OTLPLogsHandler(recorder, httpRequest)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a truncated message, got %d", recorder.Code)
+	}
+}
+
+func TestOTLPRejectsDeeplyNestedValues(t *testing.T) {
+	ingestManager, received := receivingIngest(t)
+	server := api.NewWriteServer(ingestManager)
+
+	// a body of arrays nested 1000 deep, each AnyValue holding an ArrayValue holding the next
+	var value proto.Writer
+	value.String(1, "leaf")
+	for range 1000 {
+		inner := value.Bytes()
+		var array proto.Writer
+		array.BytesField(1, inner)
+		value = proto.Writer{}
+		value.BytesField(5, array.Bytes())
+	}
+
+	var request proto.Writer
+	request.Message(1, func(resourceLogs *proto.Writer) {
+		resourceLogs.Message(2, func(scopeLogs *proto.Writer) {
+			scopeLogs.Message(2, func(record *proto.Writer) {
+				record.BytesField(5, value.Bytes())
+			})
+		})
+	})
+
+	httpRequest := httptest.NewRequest(http.MethodPost, "/v1/logs", bytes.NewReader(request.Bytes()))
+	httpRequest.Header.Set("Content-Type", "application/x-protobuf")
+	recorder := httptest.NewRecorder()
+	server.OTLPLogsHandler(recorder, httpRequest)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for values nested too deep, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	if len(received()) != 0 {
+		t.Fatalf("expected nothing written, got %d entries", len(received()))
+	}
+}
@@ -0,0 +1,122 @@
+package api_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/api"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/index"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/ingest"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/query"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/storage"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+func newQueryServer(t *testing.T, logs int) *api.QueryServer {
+	t.Helper()
+	tmpDir := t.TempDir()
+
+	walManager, _ := storage.NewWALManager(tmpDir, filepath.Join(tmpDir, "wal.meta"))
+	segmentManager, _ := storage.NewSegmentManager(tmpDir, 1024)
+	t.Cleanup(func() { segmentManager.Close() })
+	manifest, _ := storage.NewManifest(filepath.Join(tmpDir, "manifest.json"))
+	indexManager := index.NewIndexManager()
+
+	ingestManager := ingest.NewIngestManager(
+		&ingest.MemoryBuffer{}, walManager, segmentManager, manifest, indexManager, 1*time.Second,
+	)
+	for i := range logs {
+		entry := &types.LogEntry{Timestamp: int64(1_700_000_000_000 + i*1000), Level: types.Info, Message: fmt.Sprintf("log %d", i)}
+		if err := ingestManager.AppendLog(entry); err != nil {
+			t.Fatalf("AppendLog failed: %v", err)
+		}
+	}
+	if err := ingestManager.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	return api.NewQueryServer(query.NewQueryEngine(indexManager, manifest, segmentManager))
+}
+
+func TestStreamNDJSON(t *testing.T) {
+	server := newQueryServer(t, 30)
+
+	request := httptest.NewRequest(http.MethodGet, "/query?q=log&limit=-1&asc=true", nil)
+	request.Header.Set("Accept", "application/x-ndjson")
+	recorder := httptest.NewRecorder()
+	server.QueryHandler(recorder, request)
+
+	if got := recorder.Header().Get("Content-Type"); got != "application/x-ndjson" {
+		t.Fatalf("expected NDJSON, got %q", got)
+	}
+
+	lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n")
+	if len(lines) != 31 {
+		t.Fatalf("expected 30 rows and a trailer, got %d lines", len(lines))
+	}
+	for i, line := range lines[:30] {
+		var entry types.LogEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil || entry.Message != fmt.Sprintf("log %d", i) {
+			t.Fatalf("line %d: unexpected %s", i, line)
+		}
+	}
+
+	var trailer struct {
+		Trailer struct {
+			Count int    `json:"count"`
+			Error string `json:"error"`
+		} `json:"trailer"`
+	}
+	if err := json.Unmarshal([]byte(lines[30]), &trailer); err != nil || trailer.Trailer.Count != 30 || trailer.Trailer.Error != "" {
+		t.Errorf("unexpected trailer %s", lines[30])
+	}
+}
+
+func TestStreamSSE(t *testing.T) {
+	server := newQueryServer(t, 10)
+
+	request := httptest.NewRequest(http.MethodGet, "/query?limit=4", nil)
+	request.Header.Set("Accept", "text/event-stream")
+	recorder := httptest.NewRecorder()
+	server.QueryHandler(recorder, request)
+
+	var data []string
+	var events []string
+	scanner := bufio.NewScanner(recorder.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if event, ok := strings.CutPrefix(line, "event: "); ok {
+			events = append(events, event)
+		}
+		if payload, ok := strings.CutPrefix(line, "data: "); ok {
+			data = append(data, payload)
+		}
+	}
+
+	if len(data) != 5 || len(events) != 1 || events[0] != "trailer" {
+		t.Fatalf("expected 4 rows and a trailer event, got %d data lines and events %v", len(data), events)
+	}
+	if !strings.Contains(data[0], `"log 9"`) || !strings.Contains(data[4], `"next_cursor"`) {
+		t.Errorf("unexpected stream %v", data)
+	}
+}
+
+func TestStreamQueryError(t *testing.T) {
+	server := newQueryServer(t, 1)
+
+	request := httptest.NewRequest(http.MethodGet, "/query?q=level:(", nil)
+	request.Header.Set("Accept", "application/x-ndjson")
+	recorder := httptest.NewRecorder()
+	server.QueryHandler(recorder, request)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a bad query, got %d", recorder.Code)
+	}
+}
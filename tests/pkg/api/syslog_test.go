@@ -0,0 +1,123 @@
+package api_test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/api"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+func TestParseSyslogRFC5424(t *testing.T) {
+	message := `<165>1 2023-11-14T22:13:20.123Z fw01.example.com firewall 4242 ID47 ` +
+		`[exampleSDID@32473 iut="3" eventSource="Application" eventID="1011"][origin ip="10.0.0.1" ip="10.0.0.2" note="a \"quoted\" \] value"] ` +
+		"\ufeffpacket dropped"
+
+	entry, err := api.ParseSyslog([]byte(message), time.Now())
+	if err != nil {
+		t.Fatalf("ParseSyslog failed: %v", err)
+	}
+
+	// facility 20 (local4), severity 5 (notice)
+	if entry.Level != types.Info || entry.Service != "firewall" || entry.Host != "fw01.example.com" ||
+		entry.Message != "packet dropped" || entry.Timestamp != 1_700_000_000_123 {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+	if entry.Properties["facility"] != "local4" || entry.Properties["severity"] != "notice" ||
+		entry.Properties["proc_id"] != "4242" || entry.Properties["msg_id"] != "ID47" {
+		t.Errorf("unexpected header properties %v", entry.Properties)
+	}
+
+	sd, _ := entry.Properties["exampleSDID@32473"].(map[string]interface{})
+	origin, _ := entry.Properties["origin"].(map[string]interface{})
+	ips, _ := origin["ip"].([]interface{})
+	if sd["eventID"] != "1011" || len(ips) != 2 || origin["note"] != `a "quoted" ] value` {
+		t.Errorf("unexpected structured data %v", entry.Properties)
+	}
+
+	// nil values everywhere
+	entry, err = api.ParseSyslog([]byte("<11>1 - - - - - -"), time.Now())
+	if err != nil || entry.Level != types.Error || entry.Timestamp != 0 || entry.Service != "" || entry.Message != "" {
+		t.Errorf("unexpected nil-valued entry %+v %v", entry, err)
+	}
+
+	for _, bad := range []string{"<999>1 - - - - - -", "<12>1 2023-11-14T22:13:20Z host", "<12>1 - - - - - [id a=\"open"} {
+		if _, err := api.ParseSyslog([]byte(bad), time.Now()); !errors.Is(err, api.ErrInvalidSyslog) {
+			t.Errorf("expected ErrInvalidSyslog for %q, got %v", bad, err)
+		}
+	}
+}
+
+func TestParseSyslogRFC3164(t *testing.T) {
+	now := time.Date(2024, time.January, 2, 12, 0, 0, 0, time.UTC)
+
+	entry, err := api.ParseSyslog([]byte("<34>Oct 11 22:14:15 mymachine su[123]: 'su root' failed for lonvick on /dev/pts/8\n"), now)
+	if err != nil {
+		t.Fatalf("ParseSyslog failed: %v", err)
+	}
+	// October read in January belongs to last year
+	want := time.Date(2023, time.October, 11, 22, 14, 15, 0, time.UTC).UnixMilli()
+	if entry.Level != types.Fatal || entry.Service != "su" || entry.Host != "mymachine" || entry.Timestamp != want ||
+		entry.Message != "'su root' failed for lonvick on /dev/pts/8" || entry.Properties["proc_id"] != "123" ||
+		entry.Properties["facility"] != "auth" {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+
+	entry, _ = api.ParseSyslog([]byte("<13>Jan  2 11:59:00 cron: job done"), now)
+	if entry.Host != "" || entry.Service != "cron" || entry.Message != "job done" {
+		t.Errorf("unexpected entry without hostname %+v", entry)
+	}
+
+	// no PRI and no timestamp: user.notice, all message
+	entry, _ = api.ParseSyslog([]byte("just some text"), now)
+	if entry.Level != types.Info || entry.Properties["facility"] != "user" || entry.Message != "just some text" {
+		t.Errorf("unexpected bare entry %+v", entry)
+	}
+}
+
+func TestSyslogServer(t *testing.T) {
+	ingestManager, received := receivingIngest(t)
+	syslogServer := api.NewSyslogServer(ingestManager)
+	if err := syslogServer.Start("127.0.0.1:0", "127.0.0.1:0"); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer syslogServer.Stop()
+
+	udp, err := net.Dial("udp", syslogServer.UDPAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp.Write([]byte("<14>1 - host1 app1 - - - over udp"))
+	udp.Close()
+
+	tcp, err := net.Dial("tcp", syslogServer.TCPAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	framed := "<14>1 - host2 app2 - - - octet\ncounted"
+	fmt.Fprintf(tcp, "%d %s", len(framed), framed)
+	fmt.Fprint(tcp, "<11>Mar  3 10:00:00 host3 app3: newline framed\n\n")
+	fmt.Fprint(tcp, "<999>garbage\n")
+	fmt.Fprint(tcp, "<12>Mar  3 10:00:01 host3 app3: last, unterminated")
+	tcp.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(received()) < 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	messages := map[string]types.LogEntry{}
+	for _, entry := range received() {
+		messages[entry.Message] = entry
+	}
+	if len(messages) != 4 {
+		t.Fatalf("expected 4 messages, got %v", messages)
+	}
+	if messages["over udp"].Service != "app1" || messages["octet\ncounted"].Host != "host2" ||
+		messages["newline framed"].Level != types.Error || messages["last, unterminated"].Level != types.Warn {
+		t.Errorf("unexpected entries %v", messages)
+	}
+}
@@ -0,0 +1,99 @@
+package api_test
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/api"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/index"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/ingest"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/query"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/storage"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+func TestTailBackfillThenLive(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	walManager, _ := storage.NewWALManager(tmpDir, filepath.Join(tmpDir, "wal.meta"))
+	segmentManager, _ := storage.NewSegmentManager(tmpDir, 1024)
+	t.Cleanup(func() { segmentManager.Close() })
+	manifest, _ := storage.NewManifest(filepath.Join(tmpDir, "manifest.json"))
+	indexManager := index.NewIndexManager()
+	ingestManager := ingest.NewIngestManager(
+		&ingest.MemoryBuffer{}, walManager, segmentManager, manifest, indexManager, 1*time.Second,
+	)
+
+	hub := query.NewTailHub()
+	ingestManager.OnAppend(func(entry *types.LogEntry) {
+		hub.Publish(*entry)
+	})
+	hub.SetPending(ingestManager.Pending)
+
+	appendLog := func(i int) {
+		entry := &types.LogEntry{Timestamp: int64(1_700_000_000_000 + i*1000), Level: types.Info, Service: "auth", Message: fmt.Sprintf("log %d", i)}
+		if err := ingestManager.AppendLog(entry); err != nil {
+			t.Fatalf("AppendLog failed: %v", err)
+		}
+	}
+	for i := range 9 {
+		appendLog(i)
+	}
+	if err := ingestManager.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	// appended but not flushed yet, the backfill has to find it in the buffer
+	appendLog(9)
+
+	server := api.NewQueryServerWithTail(query.NewQueryEngine(indexManager, manifest, segmentManager), hub)
+	httpServer := httptest.NewServer(http.HandlerFunc(server.TailHandler))
+	defer httpServer.Close()
+
+	response, err := http.Get(httpServer.URL + "/tail?q=service:auth&backfill=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(response.Body)
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				lines <- data
+			}
+		}
+		close(lines)
+	}()
+
+	next := func() string {
+		select {
+		case line := <-lines:
+			return line
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for an event")
+			return ""
+		}
+	}
+
+	for _, want := range []string{"log 7", "log 8", "log 9"} {
+		if line := next(); !strings.Contains(line, `"`+want+`"`) {
+			t.Fatalf("backfill: expected %q, got %s", want, line)
+		}
+	}
+
+	// wait for the subscription before writing
+	for hub.Subscribers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	appendLog(10)
+	if line := next(); !strings.Contains(line, `"log 10"`) {
+		t.Fatalf("live: expected log 10, got %s", line)
+	}
+}
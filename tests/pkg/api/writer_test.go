@@ -0,0 +1,40 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/api"
+)
+
+func TestServersKeepTheirOwnRoutes(t *testing.T) {
+	ingestManager, _ := receivingIngest(t)
+	writeServer := api.NewWriteServer(ingestManager)
+	queryServer := newQueryServer(t, 0)
+
+	status := func(handler http.Handler, method, path string) int {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+		return recorder.Code
+	}
+
+	// the query port must not stop flushes or take writes
+	for _, path := range []string{"/stop", "/write", "/_bulk", "/v1/logs"} {
+		if code := status(queryServer.Handler(), http.MethodPost, path); code != http.StatusNotFound {
+			t.Errorf("query server serves %s with %d, want 404", path, code)
+		}
+	}
+	for _, path := range []string{"/query", "/aggregate"} {
+		if code := status(writeServer.Handler(), http.MethodPost, path); code != http.StatusNotFound {
+			t.Errorf("write server serves %s with %d, want 404", path, code)
+		}
+	}
+
+	if code := status(queryServer.Handler(), http.MethodGet, "/query"); code != http.StatusOK {
+		t.Errorf("expected /query on the query server, got %d", code)
+	}
+	if code := status(writeServer.Handler(), http.MethodGet, "/"); code != http.StatusOK {
+		t.Errorf("expected the Elasticsearch info on the write server, got %d", code)
+	}
+}
@@ -0,0 +1,88 @@
+package compress_test
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/compress"
+)
+
+func TestSnappyRoundTrip(t *testing.T) {
+	random := make([]byte, 5000)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	var logs strings.Builder
+	for i := range 500 {
+		fmt.Fprintf(&logs, `{"timestamp":%d,"level":"INFO","message":"request served","properties":{"service":"api"}}`, 1700000000000+i)
+	}
+
+	inputs := map[string][]byte{
+		"empty":  {},
+		"short":  []byte("abc"),
+		"run":    bytes.Repeat([]byte{'a'}, 1000),
+		"random": random,
+		"logs":   []byte(logs.String()),
+		"long":   bytes.Repeat(random[:300], 400), // copies with offsets past 64 KB literals
+	}
+
+	for name, input := range inputs {
+		t.Run(name, func(t *testing.T) {
+			encoded := compress.Encode(input)
+			decoded, err := compress.Decode(encoded)
+			if err != nil {
+				t.Fatalf("Decode failed: %v", err)
+			}
+			if !bytes.Equal(decoded, input) {
+				t.Fatalf("round trip mismatch")
+			}
+		})
+	}
+
+	if encoded := compress.Encode([]byte(logs.String())); len(encoded)*4 > logs.Len() {
+		t.Fatalf("Expected repetitive logs to shrink at least 4x, got %d -> %d", logs.Len(), len(encoded))
+	}
+}
+
+func TestSnappyDecodesReferenceStream(t *testing.T) {
+	// 16 x 'a': literal "a" + overlapping copy2(offset 1, length 15)
+	stream := []byte{0x10, 0x00, 'a', 0x3a, 0x01, 0x00}
+
+	decoded, err := compress.Decode(stream)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if string(decoded) != strings.Repeat("a", 16) {
+		t.Fatalf("unexpected output %q", decoded)
+	}
+
+	// offset before the start of the output
+	if _, err := compress.Decode([]byte{0x10, 0x00, 'a', 0x3a, 0x02, 0x00}); err != compress.ErrCorrupt {
+		t.Fatalf("Expected ErrCorrupt, got %v", err)
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	input := bytes.Repeat([]byte("timberlog "), 1000)
+
+	for _, codec := range []compress.Codec{compress.None, compress.Snappy, compress.Deflate} {
+		parsed, err := compress.ParseCodec(codec.String())
+		if err != nil || parsed != codec {
+			t.Fatalf("ParseCodec(%q) = %v, %v", codec.String(), parsed, err)
+		}
+
+		encoded, err := codec.Encode(input)
+		if err != nil {
+			t.Fatalf("%s: Encode failed: %v", codec, err)
+		}
+		decoded, err := codec.Decode(encoded, len(input))
+		if err != nil {
+			t.Fatalf("%s: Decode failed: %v", codec, err)
+		}
+		if !bytes.Equal(decoded, input) {
+			t.Fatalf("%s: round trip mismatch", codec)
+		}
+	}
+}
@@ -0,0 +1,440 @@
+package index_test
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/index"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+func makeEntries(n int) []index.IndexEntry {
+	entries := make([]index.IndexEntry, 0, n)
+	for i := range n {
+		entries = append(entries, index.IndexEntry{
+			Key:       fmt.Sprintf("key_%06d", i),
+			FileName:  "segment_1.log",
+			Offset:    int64(i * 100),
+			Timestamp: int64(1000 + i),
+		})
+	}
+	return entries
+}
+
+func collect(t *testing.T, tree *index.BPTree, pivot index.IndexEntry) []index.IndexEntry {
+	var results []index.IndexEntry
+	err := tree.Ascend(pivot, func(entry index.IndexEntry) bool {
+		results = append(results, entry)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Ascend failed: %v", err)
+	}
+	return results
+}
+
+func TestBPTreeInsertAndReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.bpt")
+
+	// tiny cache so pages get evicted and read back while inserting
+	tree, err := index.OpenBPTree(path, 4)
+	if err != nil {
+		t.Fatalf("OpenBPTree failed: %v", err)
+	}
+
+	entries := makeEntries(5000)
+	shuffled := append([]index.IndexEntry(nil), entries...)
+	rand.New(rand.NewSource(1)).Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+
+	for _, entry := range shuffled {
+		if err := tree.Set(entry); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+
+	// setting an existing entry replaces it
+	if err := tree.Set(entries[10]); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	if tree.Len() != len(entries) {
+		t.Fatalf("Expected %d entries, got %d", len(entries), tree.Len())
+	}
+
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	reopened, err := index.OpenBPTree(path, 4)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer reopened.Close()
+
+	all := collect(t, reopened, index.IndexEntry{})
+	if len(all) != len(entries) {
+		t.Fatalf("Expected %d entries after reopen, got %d", len(entries), len(all))
+	}
+	for i := range all {
+		if all[i] != entries[i] {
+			t.Fatalf("entry %d out of order: got %+v want %+v", i, all[i], entries[i])
+		}
+	}
+}
+
+func TestBPTreeRangeAndDelete(t *testing.T) {
+	tree, err := index.OpenBPTree(filepath.Join(t.TempDir(), "range.bpt"), 8)
+	if err != nil {
+		t.Fatalf("OpenBPTree failed: %v", err)
+	}
+	defer tree.Close()
+
+	entries := makeEntries(2000)
+	for _, entry := range entries {
+		if err := tree.Set(entry); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+
+	// range: keys [key_001500, key_001510)
+	var keys []string
+	tree.Ascend(index.IndexEntry{Key: "key_001500"}, func(entry index.IndexEntry) bool {
+		if entry.Key >= "key_001510" {
+			return false
+		}
+		keys = append(keys, entry.Key)
+		return true
+	})
+	if len(keys) != 10 || keys[0] != "key_001500" {
+		t.Fatalf("unexpected range result: %v", keys)
+	}
+
+	// delete every even entry
+	for i := 0; i < len(entries); i += 2 {
+		if err := tree.Delete(entries[i]); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+
+	remaining := collect(t, tree, index.IndexEntry{})
+	if len(remaining) != len(entries)/2 || tree.Len() != len(entries)/2 {
+		t.Fatalf("Expected %d entries after delete, got %d (Len %d)", len(entries)/2, len(remaining), tree.Len())
+	}
+	for _, entry := range remaining {
+		if entry.Offset/100%2 == 0 {
+			t.Fatalf("deleted entry still present: %+v", entry)
+		}
+	}
+}
+
+func TestBPTreeBulkLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bulk.bpt")
+
+	tree, err := index.OpenBPTree(path, 4)
+	if err != nil {
+		t.Fatalf("OpenBPTree failed: %v", err)
+	}
+
+	entries := makeEntries(20000)
+	if err := tree.BulkLoad(entries); err != nil {
+		t.Fatalf("BulkLoad failed: %v", err)
+	}
+
+	if err := tree.BulkLoad(entries); err != index.ErrTreeNotEmpty {
+		t.Fatalf("Expected ErrTreeNotEmpty, got %v", err)
+	}
+
+	// bulk loaded trees still accept inserts
+	extra := index.IndexEntry{Key: "key_010000a", FileName: "segment_2.log", Offset: 1, Timestamp: 1}
+	if err := tree.Set(extra); err != nil {
+		t.Fatalf("Set after bulk load failed: %v", err)
+	}
+	tree.Close()
+
+	reopened, err := index.OpenBPTree(path, 4)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer reopened.Close()
+
+	all := collect(t, reopened, index.IndexEntry{})
+	if len(all) != len(entries)+1 {
+		t.Fatalf("Expected %d entries, got %d", len(entries)+1, len(all))
+	}
+	if !sort.SliceIsSorted(all, func(i, j int) bool { return all[i].Key < all[j].Key }) {
+		t.Fatalf("bulk loaded entries are not in order")
+	}
+
+	unsorted, _ := index.OpenBPTree(filepath.Join(t.TempDir(), "unsorted.bpt"), 4)
+	defer unsorted.Close()
+	if err := unsorted.BulkLoad([]index.IndexEntry{entries[1], entries[0]}); err != index.ErrUnsortedInput {
+		t.Fatalf("Expected ErrUnsortedInput, got %v", err)
+	}
+}
+
+func TestIndexManagerDiskBackend(t *testing.T) {
+	dir := t.TempDir()
+
+	indexManager, err := index.NewIndexManagerWithBackend(index.DiskBackend(filepath.Join(dir, "index"), 4))
+	if err != nil {
+		t.Fatalf("NewIndexManagerWithBackend failed: %v", err)
+	}
+	defer indexManager.Close()
+
+	for i, entry := range makeEntries(100) {
+		logEntry := newLogEntry(entry.Timestamp)
+		if err := indexManager.Insert(logEntry, "segment_1.log", int64(i)); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+
+	if err := indexManager.PersistSegment(dir, "segment_1.log"); err != nil {
+		t.Fatalf("PersistSegment failed: %v", err)
+	}
+
+	results := indexManager.Search("timestamp", index.TimestampKey(1042))
+	if len(results) != 1 || results[0].Offset != 42 {
+		t.Fatalf("unexpected search result after persist: %+v", results)
+	}
+
+	// a fresh manager finds the sealed segment through its sidecar
+	restarted := index.NewIndexManager()
+	if err := restarted.LoadSegment(dir, "segment_1.log"); err != nil {
+		t.Fatalf("LoadSegment failed: %v", err)
+	}
+	if results := restarted.Search("timestamp", index.TimestampKey(1042)); len(results) != 1 {
+		t.Fatalf("Expected 1 result from sidecar, got %d", len(results))
+	}
+
+	// retention drops the sidecars together with the segment
+	if err := restarted.DropSegment(dir, "segment_1.log"); err != nil {
+		t.Fatalf("DropSegment failed: %v", err)
+	}
+	if results := restarted.Search("timestamp", index.TimestampKey(1042)); len(results) != 0 {
+		t.Fatalf("Expected no results after DropSegment, got %d", len(results))
+	}
+	if _, err := os.Stat(index.SidecarPath(dir, "segment_1.log", "timestamp")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the sidecar to be removed, stat returned %v", err)
+	}
+}
+
+func TestSidecarLookupAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	backend := index.DiskBackend(filepath.Join(dir, "index"), 4)
+
+	open := func() *index.IndexManager {
+		indexManager, err := index.NewIndexManagerWithBackend(backend)
+		if err != nil {
+			t.Fatalf("NewIndexManagerWithBackend failed: %v", err)
+		}
+		err = indexManager.CreateIndex("level", func(logEntry *types.LogEntry) string {
+			return string(logEntry.Level)
+		})
+		if err != nil {
+			t.Fatalf("CreateIndex failed: %v", err)
+		}
+		return indexManager
+	}
+
+	indexManager := open()
+	for i := range 100 {
+		logEntry := newLogEntry(int64(1000 + i))
+		if i%3 == 0 {
+			logEntry.Level = types.Error
+		}
+		if err := indexManager.Insert(logEntry, "segment_1.log", int64(i*64)); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	if err := indexManager.PersistSegment(dir, "segment_1.log"); err != nil {
+		t.Fatalf("PersistSegment failed: %v", err)
+	}
+
+	type lookup struct {
+		indexName  string
+		start, end int64
+		key        string
+	}
+	lookups := []lookup{
+		{"timestamp", 0, 0, ""},
+		{"timestamp", 1020, 1059, ""},
+		{"level", 0, 0, string(types.Error)},
+		{"level", 1010, 1050, string(types.Info)},
+	}
+
+	sealed := make([]map[string][]int64, len(lookups))
+	for i, l := range lookups {
+		sealed[i] = indexManager.Lookup(l.indexName, l.start, l.end, l.key)
+		if len(sealed[i]["segment_1.log"]) == 0 {
+			t.Fatalf("Lookup %+v found nothing before reopening", l)
+		}
+	}
+	if err := indexManager.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// the reopened manager only knows the segment through its sidecars
+	reopened := open()
+	defer reopened.Close()
+	if err := reopened.LoadSegment(dir, "segment_1.log"); err != nil {
+		t.Fatalf("LoadSegment failed: %v", err)
+	}
+	for i, l := range lookups {
+		got := reopened.Lookup(l.indexName, l.start, l.end, l.key)
+		if fmt.Sprint(got) != fmt.Sprint(sealed[i]) {
+			t.Fatalf("Lookup %+v after reopening = %v, want %v", l, got, sealed[i])
+		}
+	}
+}
+
+func TestLookupTimestampRangeAcrossDigits(t *testing.T) {
+	dir := t.TempDir()
+	indexManager := index.NewIndexManager()
+	defer indexManager.Close()
+
+	// unpadded, "50000" would sort between "5000" and "6000"
+	timestamps := []int64{5, 50, 500, 5000, 50000, 500000}
+	for i, timestamp := range timestamps {
+		segment := "segment_1.log"
+		if i%2 == 1 {
+			segment = "segment_2.log"
+		}
+		if err := indexManager.Insert(newLogEntry(timestamp), segment, timestamp); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	// one segment sealed, the other still in the active tree
+	if err := indexManager.PersistSegment(dir, "segment_1.log"); err != nil {
+		t.Fatalf("PersistSegment failed: %v", err)
+	}
+
+	tests := []struct {
+		start, end int64
+		want       string
+	}{
+		{40, 6000, "map[segment_1.log:[500] segment_2.log:[50 5000]]"},
+		{0, 499, "map[segment_1.log:[5] segment_2.log:[50]]"},
+		{5001, 0, "map[segment_1.log:[50000] segment_2.log:[500000]]"},
+		{0, 0, "map[segment_1.log:[5 500 50000] segment_2.log:[50 5000 500000]]"},
+		{6000, 40000, "map[]"},
+	}
+	for _, tt := range tests {
+		got := indexManager.Lookup("timestamp", tt.start, tt.end, "")
+		if fmt.Sprint(got) != tt.want {
+			t.Errorf("Lookup(%d, %d) = %v, want %s", tt.start, tt.end, got, tt.want)
+		}
+	}
+}
+
+func TestLoadSegmentIgnoresOutdatedTimestampSidecar(t *testing.T) {
+	// sidecars written when timestamp keys were plain decimals, then padded without an offset
+	for _, keys := range [][]string{{"1042", "999"}, {"0000000000000001042", "0000000000000000999"}} {
+		dir := t.TempDir()
+		tree, err := index.OpenBPTree(index.SidecarPath(dir, "segment_1.log", "timestamp"), 4)
+		if err != nil {
+			t.Fatalf("OpenBPTree failed: %v", err)
+		}
+		entries := []index.IndexEntry{
+			{Key: keys[0], FileName: "segment_1.log", Offset: 0, Timestamp: 1042},
+			{Key: keys[1], FileName: "segment_1.log", Offset: 64, Timestamp: 999},
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+		if err := tree.BulkLoad(entries); err != nil {
+			t.Fatalf("BulkLoad failed: %v", err)
+		}
+		if err := tree.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+
+		indexManager := index.NewIndexManager()
+		if err := indexManager.LoadSegment(dir, "segment_1.log"); err != nil {
+			t.Fatalf("LoadSegment failed: %v", err)
+		}
+		if indexManager.HasSegmentIndex("timestamp", "segment_1.log") {
+			t.Fatalf("Expected the sidecar with keys %v to be ignored so the segment gets scanned", keys)
+		}
+		indexManager.Close()
+	}
+}
+
+func TestTimestampKeyOrdersNegativeTimestamps(t *testing.T) {
+	timestamps := []int64{math.MinInt64, -5000, -50, -1, 0, 1, 50, 5000, math.MaxInt64}
+	for i := 1; i < len(timestamps); i++ {
+		previous, key := index.TimestampKey(timestamps[i-1]), index.TimestampKey(timestamps[i])
+		if len(key) != len(previous) || previous >= key {
+			t.Fatalf("TimestampKey(%d) = %s should sort before TimestampKey(%d) = %s",
+				timestamps[i-1], previous, timestamps[i], key)
+		}
+	}
+
+	dir := t.TempDir()
+	indexManager := index.NewIndexManager()
+	defer indexManager.Close()
+	for _, timestamp := range []int64{-5000, -50, -1, 1, 50} {
+		if err := indexManager.Insert(newLogEntry(timestamp), "segment_1.log", timestamp+10000); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	if err := indexManager.PersistSegment(dir, "segment_1.log"); err != nil {
+		t.Fatalf("PersistSegment failed: %v", err)
+	}
+
+	got := indexManager.Lookup("timestamp", -100, 10, "")
+	if fmt.Sprint(got) != "map[segment_1.log:[9950 9999 10001]]" {
+		t.Fatalf("Lookup(-100, 10) = %v", got)
+	}
+}
+
+func TestSealedSegmentsLeastRecentlyUsedClosed(t *testing.T) {
+	dir := t.TempDir()
+	indexManager := index.NewIndexManager()
+	defer indexManager.Close()
+	indexManager.SetMaxOpenSegments(2)
+
+	segments := []string{"segment_1.log", "segment_2.log", "segment_3.log"}
+	for i, segment := range segments {
+		for j := range 10 {
+			timestamp := int64(1000*(i+1) + j)
+			if err := indexManager.Insert(newLogEntry(timestamp), segment, int64(j*64)); err != nil {
+				t.Fatalf("Insert failed: %v", err)
+			}
+		}
+		if err := indexManager.PersistSegment(dir, segment); err != nil {
+			t.Fatalf("PersistSegment failed: %v", err)
+		}
+	}
+
+	// persisting the third closed the first
+	if indexManager.HasSegmentIndex("timestamp", "segment_1.log") ||
+		!indexManager.HasSegmentIndex("timestamp", "segment_2.log") || !indexManager.HasSegmentIndex("timestamp", "segment_3.log") {
+		t.Fatalf("Expected only the two most recent segments open")
+	}
+
+	// loading it again closes the least recently used one instead
+	if err := indexManager.LoadSegment(dir, "segment_1.log"); err != nil {
+		t.Fatalf("LoadSegment failed: %v", err)
+	}
+	if !indexManager.HasSegmentIndex("timestamp", "segment_1.log") || indexManager.HasSegmentIndex("timestamp", "segment_2.log") {
+		t.Fatalf("Expected segment_1 reopened and segment_2 closed")
+	}
+
+	// a lookup only walks the segments it is given, and reports those it covered
+	offsets, covered := indexManager.LookupSegments("timestamp", []string{"segment_1.log", "segment_2.log"}, 1000, 3009, "")
+	if fmt.Sprint(offsets) != "map[segment_1.log:[0 64 128 192 256 320 384 448 512 576]]" {
+		t.Fatalf("LookupSegments offsets = %v", offsets)
+	}
+	if fmt.Sprint(covered) != "map[segment_1.log:true segment_2.log:false]" {
+		t.Fatalf("LookupSegments covered = %v", covered)
+	}
+}
+
+func newLogEntry(timestamp int64) *types.LogEntry {
+	return &types.LogEntry{Timestamp: timestamp, Level: types.Info}
+}
@@ -1,7 +1,9 @@
 package ingest_test
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
 	"testing"
@@ -28,6 +30,7 @@ func TestIngestFlow(t *testing.T) {
 	)
 
 	segmentManager, _ := storage.NewSegmentManager(tmpDir, 1024*10) // 10 KB per segment
+	defer segmentManager.Close()
 
 	manifest, _ := storage.NewManifest(filepath.Join(tmpDir, "manifest.json"))
 
@@ -74,7 +77,7 @@ func TestIngestFlow(t *testing.T) {
 	// ---------------------------
 	// 7. Query index manager by timestamp
 	// ---------------------------
-	tsKey := fmt.Sprintf("%d", now)
+	tsKey := index.TimestampKey(now)
 	results := indexManager.Search("timestamp", tsKey)
 
 	if len(results) == 0 {
@@ -101,6 +104,7 @@ func TestRecoveryFlow(t *testing.T) {
 	}
 
 	segmentManager, _ := storage.NewSegmentManager(tmpDir, 1024*10)
+	defer segmentManager.Close()
 	manifest, _ := storage.NewManifest(filepath.Join(tmpDir, "manifest.json"))
 	buffer := &ingest.MemoryBuffer{}
 
@@ -149,12 +153,13 @@ func TestRecoveryFlow(t *testing.T) {
 	}
 
 	recoveredSegment, _ := storage.NewSegmentManager(tmpDir, 1024*10)
+	defer recoveredSegment.Close()
 	recoveredManifest, _ := storage.NewManifest(filepath.Join(tmpDir, "manifest.json"))
 	recoveredBuffer := &ingest.MemoryBuffer{}
 
 	recoveredIndexManager := index.NewIndexManager()
 	recoveredIndexManager.CreateIndex("timestamp", func(entry *types.LogEntry) string {
-		return fmt.Sprintf("%d", entry.Timestamp)
+		return index.TimestampKey(entry.Timestamp)
 	})
 
 	recoveredIngest := ingest.NewIngestManager(
@@ -188,7 +193,7 @@ func TestRecoveryFlow(t *testing.T) {
 	// Step 6: Verify index recovery
 	// ---------------------------
 	for i := 0; i < totalLogs; i++ {
-		tsKey := fmt.Sprintf("%d", now+int64(i*1000))
+		tsKey := index.TimestampKey(now + int64(i*1000))
 		results := recoveredIndexManager.Search("timestamp", tsKey)
 		if len(results) == 0 {
 			t.Errorf("Timestamp %s not found in recovered index", tsKey)
@@ -197,3 +202,132 @@ func TestRecoveryFlow(t *testing.T) {
 		}
 	}
 }
+
+func TestFlushKeepsEntriesAfterAppendFailure(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	walManager, err := storage.NewWALManager(tmpDir, filepath.Join(tmpDir, "wal.meta"))
+	if err != nil {
+		t.Fatalf("Failed to create WAL manager: %v", err)
+	}
+	defer walManager.Close()
+
+	segmentManager, _ := storage.NewSegmentManager(tmpDir, 1024*10)
+	t.Cleanup(func() { segmentManager.Close() })
+	manifest, _ := storage.NewManifest(filepath.Join(tmpDir, "manifest.json"))
+	buffer := &ingest.MemoryBuffer{}
+	ingestManager := ingest.NewIngestManager(
+		buffer, walManager, segmentManager, manifest, index.NewIndexManager(), time.Second,
+	)
+
+	appendLog := func(i int) {
+		entry := &types.LogEntry{Timestamp: int64(1000 + i), Level: types.Info, Message: fmt.Sprintf("log %d", i)}
+		if err := ingestManager.AppendLog(entry); err != nil {
+			t.Fatalf("AppendLog failed: %v", err)
+		}
+	}
+
+	appendLog(0)
+	appendLog(1)
+	// an entry the segment can't encode makes Append fail in the middle of the flush
+	buffer.Append(&types.LogEntry{Timestamp: 1002, Level: types.Info, Properties: map[string]interface{}{"v": math.Inf(1)}})
+	appendLog(3)
+
+	if err := ingestManager.Flush(); err == nil {
+		t.Fatalf("Expected Flush to fail on the unencodable entry")
+	}
+	if buffered := ingestManager.Buffered(); buffered != 2 {
+		t.Fatalf("Expected the 2 unwritten entries to stay buffered, got %d", buffered)
+	}
+
+	// without the bad entry the rest is written with its WAL position
+	logs, positions := buffer.Drain()
+	if logs[0].Timestamp != 1002 || logs[1].Timestamp != 1003 || positions[1] == (storage.WALPosition{}) {
+		t.Fatalf("unexpected buffer after the failed flush: %+v %+v", logs, positions)
+	}
+	buffer.Requeue(logs[1:], positions[1:])
+	if err := ingestManager.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	written, err := segmentManager.ReadSegment(filepath.Join(tmpDir, segmentManager.CurrFileName()), nil)
+	if err != nil {
+		t.Fatalf("ReadSegment failed: %v", err)
+	}
+	if len(written) != 3 {
+		t.Fatalf("Expected 3 entries in the segment, got %d", len(written))
+	}
+}
+
+// failingTree is an in-memory tree whose Set fails while fail is set
+type failingTree struct {
+	index.Tree
+	fail *bool
+}
+
+func (tree failingTree) Set(entry index.IndexEntry) error {
+	if *tree.fail {
+		return errors.New("index write failed")
+	}
+	return tree.Tree.Set(entry)
+}
+
+func TestFlushIndexFailureFallsBackToScan(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	walManager, err := storage.NewWALManager(tmpDir, filepath.Join(tmpDir, "wal.meta"))
+	if err != nil {
+		t.Fatalf("Failed to create WAL manager: %v", err)
+	}
+	defer walManager.Close()
+
+	fail := false
+	indexManager, _ := index.NewIndexManagerWithBackend(func(indexName string) (index.Tree, error) {
+		tree, err := index.MemoryBackend()(indexName)
+		return failingTree{Tree: tree, fail: &fail}, err
+	})
+
+	segmentManager, _ := storage.NewSegmentManager(tmpDir, 1024*10)
+	t.Cleanup(func() { segmentManager.Close() })
+	manifest, _ := storage.NewManifest(filepath.Join(tmpDir, "manifest.json"))
+	ingestManager := ingest.NewIngestManager(
+		&ingest.MemoryBuffer{}, walManager, segmentManager, manifest, indexManager, time.Second,
+	)
+
+	for i := range 3 {
+		entry := &types.LogEntry{Timestamp: int64(1000 + i), Level: types.Info, Message: fmt.Sprintf("log %d", i)}
+		if err := ingestManager.AppendLog(entry); err != nil {
+			t.Fatalf("AppendLog failed: %v", err)
+		}
+	}
+
+	fail = true
+	if err := ingestManager.Flush(); err == nil {
+		t.Fatalf("Expected Flush to fail on the index write")
+	}
+	fail = false
+	if err := ingestManager.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	// the first entry is stored without an index entry, so the index no longer covers the segment
+	active := segmentManager.CurrFileName()
+	if indexManager.HasSegmentIndex("timestamp", active) {
+		t.Fatalf("Expected the timestamp index to no longer cover %s", active)
+	}
+	written, err := segmentManager.ReadSegment(filepath.Join(tmpDir, active), nil)
+	if err != nil || len(written) != 3 {
+		t.Fatalf("Expected the 3 entries in the segment once, got %d (%v)", len(written), err)
+	}
+
+	// sealing it writes no sidecar that would claim otherwise
+	if err := indexManager.PersistSegment(tmpDir, active); err != nil {
+		t.Fatalf("PersistSegment failed: %v", err)
+	}
+	if indexManager.HasSegmentIndex("timestamp", active) {
+		t.Fatalf("Expected the sealed segment to stay unindexed")
+	}
+	if _, err := os.Stat(index.SidecarPath(tmpDir, active, "timestamp")); !os.IsNotExist(err) {
+		t.Fatalf("Expected no sidecar for the incomplete index, stat returned %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package ingest_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/index"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/ingest"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/storage"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+func walFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "wal_*.wal"))
+	if err != nil {
+		t.Fatalf("Glob failed: %v", err)
+	}
+	return files
+}
+
+func TestWALRotationReleasesSealedEntries(t *testing.T) {
+	tmpDir := t.TempDir()
+	metaPath := filepath.Join(tmpDir, "wal.meta")
+
+	options := storage.DefaultWALOptions()
+	options.Durability = storage.SyncEveryWrite
+	options.MaxFileSize = 1024
+
+	walManager, err := storage.NewWALManagerWithOptions(tmpDir, metaPath, options)
+	if err != nil {
+		t.Fatalf("NewWALManagerWithOptions failed: %v", err)
+	}
+
+	segmentManager, _ := storage.NewSegmentManager(tmpDir, 2048)
+	t.Cleanup(func() { segmentManager.Close() })
+	manifest, _ := storage.NewManifest(filepath.Join(tmpDir, "manifest.json"))
+	ingestManager := ingest.NewIngestManager(
+		&ingest.MemoryBuffer{}, walManager, segmentManager, manifest, index.NewIndexManager(), time.Second,
+	)
+
+	const totalLogs = 300
+	for i := range totalLogs {
+		entry := &types.LogEntry{
+			Timestamp:  int64(1000 + i),
+			Level:      types.Info,
+			Message:    fmt.Sprintf("rotation log %d", i),
+			Properties: map[string]interface{}{"service": "rotation"},
+		}
+		if err := ingestManager.AppendLog(entry); err != nil {
+			t.Fatalf("AppendLog failed: %v", err)
+		}
+		if i%10 == 9 {
+			if err := ingestManager.Flush(); err != nil {
+				t.Fatalf("Flush failed: %v", err)
+			}
+		}
+	}
+
+	if walManager.Meta.CurrentSeq < 5 {
+		t.Fatalf("Expected the WAL to rotate several times, current seq is %d", walManager.Meta.CurrentSeq)
+	}
+	if files := walFiles(t, tmpDir); len(files) > 3 {
+		t.Fatalf("Expected released WAL files to be deleted, found %v", files)
+	}
+	walManager.Close()
+
+	// simulate a crash in the middle of Rotate: the next file exists but the meta never saw it
+	next := filepath.Join(tmpDir, fmt.Sprintf("wal_%08d.wal", walManager.Meta.CurrentSeq+1))
+	if err := os.WriteFile(next, []byte{0x54, 0x4c}, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	recovered, err := storage.NewWALManagerWithOptions(tmpDir, metaPath, options)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer recovered.Close()
+
+	entries, err := recovered.ReplayAllUnflushed()
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+
+	// replay starts right after the last entry that reached a sealed segment
+	var sealed int
+	var maxSealed int64
+	for _, meta := range manifest.GetSegments() {
+		logs, err := segmentManager.ReadSegment(filepath.Join(tmpDir, meta.FileName), nil)
+		if err != nil {
+			t.Fatalf("ReadSegment failed: %v", err)
+		}
+		sealed += len(logs)
+		maxSealed = max(maxSealed, meta.MaxTimestamp)
+	}
+
+	if sealed == 0 {
+		t.Fatalf("Expected sealed segments in the manifest")
+	}
+	if sealed+len(entries) != totalLogs {
+		t.Fatalf("Expected %d sealed + replayed entries, got %d + %d", totalLogs, sealed, len(entries))
+	}
+	if len(entries) > 0 && entries[0].Timestamp != maxSealed+1 {
+		t.Fatalf("Expected replay to resume at %d, got %d", maxSealed+1, entries[0].Timestamp)
+	}
+}
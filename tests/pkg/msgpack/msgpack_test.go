@@ -0,0 +1,64 @@
+package msgpack_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/msgpack"
+)
+
+func TestRoundTrip(t *testing.T) {
+	values := []any{
+		nil, true, false,
+		int64(0), int64(127), int64(-32), int64(-33), int64(300), int64(-70000), int64(1 << 40),
+		uint64(1 << 63), 3.25,
+		"", "short", strings.Repeat("x", 40), strings.Repeat("y", 300), strings.Repeat("z", 70000),
+		[]byte{1, 2, 3},
+		msgpack.Ext{Type: 0, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}},
+		msgpack.Ext{Type: 5, Data: []byte{1, 2, 3}},
+		[]any{int64(1), "two", []any{}},
+		map[string]any{"a": int64(1), "nested": map[string]any{"list": []any{nil, 2.5}}},
+		make([]any, 20),
+	}
+
+	for _, value := range values {
+		data, err := msgpack.Marshal(value)
+		if err != nil {
+			t.Fatalf("Marshal(%v) failed: %v", value, err)
+		}
+		decoded, err := msgpack.Unmarshal(data)
+		if err != nil {
+			t.Fatalf("Unmarshal of %v failed: %v", value, err)
+		}
+		if !reflect.DeepEqual(decoded, value) {
+			t.Errorf("round trip changed %#v into %#v", value, decoded)
+		}
+	}
+}
+
+func TestDecodeStream(t *testing.T) {
+	var stream []byte
+	for _, value := range []any{"first", int64(2)} {
+		data, _ := msgpack.Marshal(value)
+		stream = append(stream, data...)
+	}
+
+	decoder := msgpack.NewDecoder(bytes.NewReader(stream))
+	first, _ := decoder.Decode()
+	second, _ := decoder.Decode()
+	if _, err := decoder.Decode(); err != io.EOF || first != "first" || second != int64(2) {
+		t.Errorf("unexpected stream values %v %v %v", first, second, err)
+	}
+
+	// a map declaring more entries than there are bytes
+	if _, err := msgpack.Unmarshal([]byte{0xdf, 0xff, 0xff, 0xff, 0xff, 0xa1, 'a'}); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected ErrUnexpectedEOF, got %v", err)
+	}
+	if _, err := msgpack.Unmarshal([]byte{0xc1}); !errors.Is(err, msgpack.ErrMalformed) {
+		t.Errorf("expected ErrMalformed, got %v", err)
+	}
+}
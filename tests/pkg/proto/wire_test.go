@@ -0,0 +1,68 @@
+package proto_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/proto"
+)
+
+func TestWireRoundTrip(t *testing.T) {
+	var writer proto.Writer
+	writer.Varint(1, 300)
+	writer.String(2, "hello")
+	writer.Double(3, 2.5)
+	writer.Message(4, func(nested *proto.Writer) {
+		nested.Bool(1, true)
+	})
+	writer.Varint(1000, 7) // unknown to the reader below, skipped
+
+	var number uint64
+	var text string
+	var double float64
+	var flag bool
+
+	err := proto.Walk(writer.Bytes(), func(reader *proto.Reader, field int, wireType proto.WireType) (bool, error) {
+		var err error
+		switch field {
+		case 1:
+			number, err = reader.Varint()
+		case 2:
+			text, err = reader.String()
+		case 3:
+			double, err = reader.Double()
+		case 4:
+			var nested []byte
+			if nested, err = reader.Bytes(); err == nil {
+				err = proto.Walk(nested, func(reader *proto.Reader, field int, wireType proto.WireType) (bool, error) {
+					value, err := reader.Varint()
+					flag = value == 1
+					return true, err
+				})
+			}
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+
+	if err != nil {
+		t.Fatalf("Walk failed: %v", err)
+	}
+	if number != 300 || text != "hello" || double != 2.5 || !flag {
+		t.Errorf("unexpected values %d %q %v %v", number, text, double, flag)
+	}
+}
+
+func TestWireMalformed(t *testing.T) {
+	var writer proto.Writer
+	writer.String(1, "truncated")
+	data := writer.Bytes()[:5]
+
+	err := proto.Walk(data, func(reader *proto.Reader, field int, wireType proto.WireType) (bool, error) {
+		return false, nil
+	})
+	if !errors.Is(err, proto.ErrMalformed) {
+		t.Errorf("expected ErrMalformed, got %v", err)
+	}
+}
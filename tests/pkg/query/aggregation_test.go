@@ -0,0 +1,204 @@
+package query_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/index"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/ingest"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/query"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/storage"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+// aggregationFixture ingests 40 logs one second apart over several segments:
+// every 4th is an ERROR from billing with status 500, the rest INFO from api with status 200..229
+func aggregationFixture(t *testing.T) (*query.QueryEngine, *storage.Manifest, string, int64) {
+	t.Helper()
+	tmpDir := t.TempDir()
+
+	walManager, _ := storage.NewWALManager(tmpDir, filepath.Join(tmpDir, "wal.meta"))
+	segmentManager, _ := storage.NewSegmentManager(tmpDir, 1024)
+	t.Cleanup(func() { segmentManager.Close() })
+	manifest, _ := storage.NewManifest(filepath.Join(tmpDir, "manifest.json"))
+	indexManager := index.NewIndexManager()
+	indexManager.CreateIndex("service", func(entry *types.LogEntry) string {
+		return entry.Service
+	})
+
+	ingestManager := ingest.NewIngestManager(
+		&ingest.MemoryBuffer{}, walManager, segmentManager, manifest, indexManager, 1*time.Second,
+	)
+
+	start := int64(1_700_000_000_000)
+	for i := range 40 {
+		entry := &types.LogEntry{
+			Timestamp:  start + int64(i*1000),
+			Level:      types.Info,
+			Service:    "api",
+			Message:    fmt.Sprintf("request %d", i),
+			Properties: map[string]interface{}{"status_code": float64(200 + i%30)},
+		}
+		if i%4 == 0 {
+			entry.Level = types.Error
+			entry.Service = "billing"
+			entry.Properties["status_code"] = float64(500)
+		}
+		if err := ingestManager.AppendLog(entry); err != nil {
+			t.Fatalf("AppendLog failed: %v", err)
+		}
+	}
+	if err := ingestManager.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if len(manifest.GetSegments()) < 2 {
+		t.Fatalf("expected several sealed segments")
+	}
+
+	return query.NewQueryEngine(indexManager, manifest, segmentManager), manifest, tmpDir, start
+}
+
+func TestAggregations(t *testing.T) {
+	engine, _, _, start := aggregationFixture(t)
+
+	results, err := engine.Aggregate(&query.Query{
+		Expression: `status_code >= 210`,
+		Aggregations: []query.Aggregation{
+			{Type: query.AggCount},
+			{Type: query.AggTerms, Field: "level"},
+			{Type: query.AggTerms, Field: "status_code", Size: 2, Name: "top_status"},
+			{Type: query.AggMin, Field: "status_code"},
+			{Type: query.AggMax, Field: "status_code"},
+			{Type: query.AggAvg, Field: "status_code"},
+			{Type: query.AggSum, Field: "status_code"},
+			{Type: query.AggPercentiles, Field: "status_code", Percents: []float64{0, 50, 100}},
+			{Type: query.AggDateHistogram, Interval: 10_000},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Aggregate failed: %v", err)
+	}
+
+	// matches: the 10 errors (500) and the infos with i%30 >= 10, i.e. i in 10..29 minus multiples of 4
+	if got := results["count"].Count; got != 25 {
+		t.Fatalf("count: expected 25, got %d", got)
+	}
+
+	levels := results["terms_level"].Buckets
+	if len(levels) != 2 || levels[0].Key != "INFO" || levels[0].Count != 15 || levels[1].Key != "ERROR" || levels[1].Count != 10 {
+		t.Errorf("terms_level: unexpected buckets %+v", levels)
+	}
+
+	top := results["top_status"]
+	if len(top.Buckets) != 2 || top.Buckets[0].Key != "500" || top.Buckets[0].Count != 10 || top.OtherCount != 14 {
+		t.Errorf("top_status: unexpected result %+v", top)
+	}
+
+	if min := results["min_status_code"].Value; min == nil || *min != 210 {
+		t.Errorf("min: expected 210, got %v", min)
+	}
+	if max := results["max_status_code"].Value; max == nil || *max != 500 {
+		t.Errorf("max: expected 500, got %v", max)
+	}
+	sum := *results["sum_status_code"].Value
+	if avg := *results["avg_status_code"].Value; avg != sum/25 {
+		t.Errorf("avg: expected %v, got %v", sum/25, avg)
+	}
+
+	percentiles := results["percentiles_status_code"].Percentiles
+	if percentiles["0"] != 210 || percentiles["100"] != 500 {
+		t.Errorf("percentiles: unexpected %v", percentiles)
+	}
+
+	buckets := results["date_histogram"].Buckets
+	if len(buckets) != 4 || buckets[0].Start != start {
+		t.Fatalf("date_histogram: unexpected buckets %+v", buckets)
+	}
+	// first 10 seconds: only the errors at 0, 4 and 8 match
+	if buckets[0].Count != 3 || buckets[1].Count != 10 {
+		t.Errorf("date_histogram: unexpected counts %+v", buckets)
+	}
+}
+
+// Aggregations over indexed fields never read the segments
+func TestAggregationsFromIndexes(t *testing.T) {
+	engine, manifest, tmpDir, start := aggregationFixture(t)
+
+	q := &query.Query{
+		StartTime: start + 5000,
+		EndTime:   start + 24_999,
+		Filters:   []query.FilterExpression{{Field: "service", Value: "billing"}},
+		Aggregations: []query.Aggregation{
+			{Type: query.AggCount},
+			{Type: query.AggTerms, Field: "service"},
+			{Type: query.AggMax, Field: "timestamp"},
+			{Type: query.AggDateHistogram, Interval: 10_000},
+		},
+	}
+
+	expected, err := engine.Aggregate(q)
+	if err != nil {
+		t.Fatalf("Aggregate failed: %v", err)
+	}
+
+	for _, segment := range manifest.GetSegments() {
+		os.Remove(filepath.Join(tmpDir, segment.FileName))
+	}
+	results, err := engine.Aggregate(q)
+	if err != nil {
+		t.Fatalf("Aggregate without segment files failed: %v", err)
+	}
+
+	// billing logs at 8, 12, 16, 20 and 24 seconds
+	if got := results["count"].Count; got != 5 || expected["count"].Count != 5 {
+		t.Errorf("count: expected 5, got %d", got)
+	}
+	if terms := results["terms_service"].Buckets; len(terms) != 1 || terms[0].Key != "billing" || terms[0].Count != 5 {
+		t.Errorf("terms_service: unexpected buckets %+v", terms)
+	}
+	if max := results["max_timestamp"].Value; max == nil || int64(*max) != start+24_000 {
+		t.Errorf("max_timestamp: expected %d, got %v", start+24_000, max)
+	}
+	if buckets := results["date_histogram"].Buckets; len(buckets) != 3 || buckets[0].Count != 1 || buckets[1].Count != 2 || buckets[2].Count != 2 {
+		t.Errorf("date_histogram: unexpected buckets %+v", buckets)
+	}
+
+	// a filter that needs the entries can't do without them
+	q.Expression = "request"
+	if _, err := engine.Aggregate(q); err == nil {
+		t.Errorf("expected reading the removed segments to fail")
+	}
+}
+
+func TestInvalidAggregation(t *testing.T) {
+	engine, _, _, _ := aggregationFixture(t)
+
+	for _, aggregation := range []query.Aggregation{
+		{Type: query.AggTerms},
+		{Type: query.AggDateHistogram},
+		{Type: query.AggPercentiles, Field: "status_code", Percents: []float64{101}},
+		{Type: "median", Field: "status_code"},
+	} {
+		_, err := engine.Aggregate(&query.Query{Aggregations: []query.Aggregation{aggregation}})
+		if !errors.Is(err, query.ErrInvalidAggregation) {
+			t.Errorf("%+v: expected ErrInvalidAggregation, got %v", aggregation, err)
+		}
+	}
+
+	// counts over part of the entries only would look like complete ones
+	page, err := engine.ExecutePage(&query.Query{Limit: 1})
+	if err != nil || page.NextCursor == "" {
+		t.Fatalf("expected a first page with a cursor, got %+v, %v", page, err)
+	}
+	_, err = engine.Aggregate(&query.Query{
+		Cursor:       page.NextCursor,
+		Aggregations: []query.Aggregation{{Type: query.AggTerms, Field: "service"}},
+	})
+	if !errors.Is(err, query.ErrInvalidAggregation) {
+		t.Errorf("expected a cursor to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package query_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/index"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/ingest"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/query"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/storage"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+func TestCompactionMergesSmallSegments(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	walManager, _ := storage.NewWALManager(tmpDir, filepath.Join(tmpDir, "wal.meta"))
+	segmentManager, _ := storage.NewSegmentManager(tmpDir, 512)
+	t.Cleanup(func() { segmentManager.Close() })
+	manifest, _ := storage.NewManifest(filepath.Join(tmpDir, "manifest.json"))
+	indexManager := index.NewIndexManager()
+
+	ingestManager := ingest.NewIngestManager(
+		&ingest.MemoryBuffer{}, walManager, segmentManager, manifest, indexManager, time.Second,
+	)
+
+	now := time.Now().UnixMilli()
+	total := 80
+	for i := range total {
+		// slightly out of order, the merged segment is sorted by time
+		timestamp := now + int64(i*1000)
+		if i%2 == 1 {
+			timestamp -= 1500
+		}
+		entry := &types.LogEntry{
+			Timestamp:  timestamp,
+			Level:      types.Info,
+			Message:    fmt.Sprintf("log %d", i),
+			Properties: map[string]interface{}{"service": "api"},
+		}
+		if err := ingestManager.AppendLog(entry); err != nil {
+			t.Fatalf("AppendLog failed: %v", err)
+		}
+	}
+	if err := ingestManager.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	before := manifest.GetSegments()
+	if len(before) < 5 {
+		t.Fatalf("Expected many small segments, got %d", len(before))
+	}
+
+	qe := query.NewQueryEngine(indexManager, manifest, segmentManager)
+	count := func() int {
+		results, err := qe.Execute(&query.Query{StartTime: now - 5000, EndTime: now + int64(total*1000), Limit: 1000, SortAsc: true})
+		if err != nil {
+			t.Fatalf("Execute failed: %v", err)
+		}
+		return len(results)
+	}
+	expected := count()
+
+	// a query still running holds a snapshot from before the compaction
+	running := manifest.Acquire()
+
+	compactor := storage.NewCompactor(segmentManager, manifest, indexManager, storage.CompactionOptions{
+		SmallSegmentSize: 1024,
+		TargetSize:       1 << 20,
+	})
+	merged, err := compactor.Compact()
+	if err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if len(merged) != 1 || len(manifest.GetSegments()) != 1 {
+		t.Fatalf("Expected all segments merged into one, got %d merged and manifest %+v", len(merged), manifest.GetSegments())
+	}
+
+	entries, err := segmentManager.ReadSegment(filepath.Join(tmpDir, merged[0].FileName), nil)
+	if err != nil {
+		t.Fatalf("ReadSegment failed: %v", err)
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Timestamp < entries[i-1].Timestamp {
+			t.Fatalf("merged segment is not sorted by time at %d", i)
+		}
+	}
+	if merged[0].MinTimestamp != entries[0].Timestamp || len(merged[0].Services) != 1 {
+		t.Fatalf("unexpected merged meta: %+v", merged[0])
+	}
+
+	// the running query can still read every segment of its snapshot
+	for _, segment := range running.Segments {
+		if _, err := segmentManager.ReadSegment(filepath.Join(tmpDir, segment.FileName), nil); err != nil {
+			t.Fatalf("segment %s vanished under a running query: %v", segment.FileName, err)
+		}
+	}
+
+	running.Release()
+	for _, segment := range before {
+		if _, err := os.Stat(filepath.Join(tmpDir, segment.FileName)); !os.IsNotExist(err) {
+			t.Fatalf("Expected %s to be deleted after release, stat returned %v", segment.FileName, err)
+		}
+		if _, err := os.Stat(index.SidecarPath(tmpDir, segment.FileName, "timestamp")); !os.IsNotExist(err) {
+			t.Fatalf("Expected the sidecar of %s to be deleted", segment.FileName)
+		}
+	}
+
+	if got := count(); got != expected {
+		t.Fatalf("Expected %d results after compaction, got %d", expected, got)
+	}
+
+	// the merged segment's sidecars serve a restarted node: logs 10..19 minus log 11 (shifted to 9.5s)
+	restarted := query.NewQueryEngine(index.NewIndexManager(), manifest, segmentManager)
+	results, err := restarted.Execute(&query.Query{StartTime: now + 10000, EndTime: now + 19000, Limit: 1000, SortAsc: true})
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if len(results) != 9 {
+		t.Fatalf("Expected 9 logs in range after restart, got %d", len(results))
+	}
+}
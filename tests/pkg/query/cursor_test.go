@@ -0,0 +1,109 @@
+package query_test
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/index"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/ingest"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/query"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/storage"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+func TestCursorPagination(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	walManager, _ := storage.NewWALManager(tmpDir, filepath.Join(tmpDir, "wal.meta"))
+	segmentManager, _ := storage.NewSegmentManager(tmpDir, 512)
+	t.Cleanup(func() { segmentManager.Close() })
+	manifest, _ := storage.NewManifest(filepath.Join(tmpDir, "manifest.json"))
+	indexManager := index.NewIndexManager()
+
+	ingestManager := ingest.NewIngestManager(
+		&ingest.MemoryBuffer{}, walManager, segmentManager, manifest, indexManager, 1*time.Second,
+	)
+	engine := query.NewQueryEngine(indexManager, manifest, segmentManager)
+
+	start := int64(1_700_000_000_000)
+	appendLogs := func(from, to int) {
+		for i := from; i < to; i++ {
+			// three logs per second, so pages end in the middle of equal timestamps
+			entry := &types.LogEntry{Timestamp: start + int64(i/3*1000), Level: types.Info, Message: fmt.Sprintf("log %d", i)}
+			if err := ingestManager.AppendLog(entry); err != nil {
+				t.Fatalf("AppendLog failed: %v", err)
+			}
+		}
+		if err := ingestManager.Flush(); err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+	}
+	appendLogs(0, 30)
+
+	// ascending, while more logs keep arriving
+	var seen []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 20 {
+			t.Fatalf("pagination doesn't end")
+		}
+
+		page, err := engine.ExecutePage(&query.Query{Limit: 7, SortAsc: true, Cursor: cursor})
+		if err != nil {
+			t.Fatalf("ExecutePage failed: %v", err)
+		}
+		for _, entry := range page.Entries {
+			seen = append(seen, entry.Message)
+		}
+
+		if pages == 1 {
+			appendLogs(30, 40)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	if len(seen) != 40 {
+		t.Fatalf("expected 40 logs over all pages, got %d: %v", len(seen), seen)
+	}
+	for i, message := range seen {
+		if want := fmt.Sprintf("log %d", i); message != want {
+			t.Fatalf("position %d: expected %q, got %q", i, want, message)
+		}
+	}
+
+	// descending
+	seen = nil
+	cursor = ""
+	for {
+		page, err := engine.ExecutePage(&query.Query{Limit: 9, Cursor: cursor})
+		if err != nil {
+			t.Fatalf("ExecutePage failed: %v", err)
+		}
+		for _, entry := range page.Entries {
+			seen = append(seen, entry.Message)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	if len(seen) != 40 {
+		t.Fatalf("expected 40 logs descending, got %d", len(seen))
+	}
+	for i, message := range seen {
+		if want := fmt.Sprintf("log %d", 39-i); message != want {
+			t.Fatalf("position %d: expected %q, got %q", i, want, message)
+		}
+	}
+
+	if _, err := engine.ExecutePage(&query.Query{Cursor: "not-a-cursor"}); !errors.Is(err, query.ErrInvalidCursor) {
+		t.Errorf("expected ErrInvalidCursor, got %v", err)
+	}
+}
@@ -28,6 +28,7 @@ func TestQueryEngineFlow(t *testing.T) {
 	)
 
 	segmentManager, _ := storage.NewSegmentManager(tmpDir, 1024*10) // 10 KB per segment
+	defer segmentManager.Close()
 
 	manifest, _ := storage.NewManifest(filepath.Join(tmpDir, "manifest.json"))
 
@@ -116,6 +117,7 @@ func TestMultipleQueries(t *testing.T) {
 	)
 
 	segmentManager, _ := storage.NewSegmentManager(tmpDir, 1024*10) // 10 KB per segment
+	defer segmentManager.Close()
 	manifest, _ := storage.NewManifest(filepath.Join(tmpDir, "manifest.json"))
 
 	// ---------------------------
@@ -328,3 +330,169 @@ func TestMultipleQueries(t *testing.T) {
 	})
 
 }
+
+func TestQueryAcrossRotatedSegments(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	walManager, _ := storage.NewWALManager(tmpDir, filepath.Join(tmpDir, "wal.meta"))
+	segmentManager, _ := storage.NewSegmentManager(tmpDir, 512) // small segments, rotates every few logs
+	t.Cleanup(func() { segmentManager.Close() })
+	manifest, _ := storage.NewManifest(filepath.Join(tmpDir, "manifest.json"))
+	indexManager := index.NewIndexManager()
+
+	ingestManager := ingest.NewIngestManager(
+		&ingest.MemoryBuffer{}, walManager, segmentManager, manifest, indexManager, 1*time.Second,
+	)
+
+	// ---------------------------
+	// 1. Append enough logs to rotate several times in one flush
+	// ---------------------------
+	now := time.Now().UnixMilli()
+	total := 60
+	for i := range total {
+		entry := &types.LogEntry{
+			Timestamp:  now + int64(i*1000),
+			Level:      types.Info,
+			Message:    fmt.Sprintf("log %d", i),
+			Properties: map[string]interface{}{"module": "auth"},
+		}
+		if i%10 == 0 {
+			entry.Level = types.Error
+		}
+		if err := ingestManager.AppendLog(entry); err != nil {
+			t.Fatalf("AppendLog failed: %v", err)
+		}
+	}
+
+	if err := ingestManager.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	if segments := manifest.GetSegments(); len(segments) < 3 {
+		t.Fatalf("Expected several rotated segments in manifest, got %d", len(segments))
+	}
+
+	// ---------------------------
+	// 2. Time range spanning segments must return exactly the entries in range
+	// ---------------------------
+	check := func(t *testing.T, qe *query.QueryEngine) {
+		q := &query.Query{
+			StartTime: now + 5000,
+			EndTime:   now + 44000,
+			Limit:     1000,
+			SortAsc:   true,
+		}
+
+		results, err := qe.Execute(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(results) != 40 {
+			t.Fatalf("Expected 40 logs, got %d", len(results))
+		}
+		for i, entry := range results {
+			if want := fmt.Sprintf("log %d", i+5); entry.Message != want {
+				t.Fatalf("result %d: expected %q, got %q", i, want, entry.Message)
+			}
+		}
+
+		q = &query.Query{
+			StartTime: now,
+			EndTime:   now + int64(total*1000),
+			Filters:   []query.FilterExpression{{Field: "Level", Value: string(types.Error)}},
+			Limit:     1000,
+			SortAsc:   true,
+		}
+
+		results, err = qe.Execute(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != total/10 {
+			t.Fatalf("Expected %d error logs, got %d", total/10, len(results))
+		}
+
+		q = &query.Query{
+			StartTime:  now,
+			EndTime:    now + int64(total*1000),
+			Expression: `NOT level:ERROR AND module:auth`,
+			Limit:      1000,
+			SortAsc:    true,
+		}
+
+		results, err = qe.Execute(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != total-total/10 {
+			t.Fatalf("Expected %d non error logs, got %d", total-total/10, len(results))
+		}
+	}
+
+	t.Run("LiveIndexes", func(t *testing.T) {
+		check(t, query.NewQueryEngine(indexManager, manifest, segmentManager))
+	})
+
+	// a restarted node only has the sidecar index files of the sealed segments
+	t.Run("ReloadedIndexes", func(t *testing.T) {
+		check(t, query.NewQueryEngine(index.NewIndexManager(), manifest, segmentManager))
+	})
+
+	// with one sidecar open at a time, loading each segment closes the previous one
+	t.Run("FewOpenSidecars", func(t *testing.T) {
+		reloaded := index.NewIndexManager()
+		reloaded.SetMaxOpenSegments(1)
+		check(t, query.NewQueryEngine(reloaded, manifest, segmentManager))
+	})
+}
+
+func TestStatsAfterRotation(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	walManager, _ := storage.NewWALManager(tmpDir, filepath.Join(tmpDir, "wal.meta"))
+	segmentManager, _ := storage.NewSegmentManager(tmpDir, 512)
+	t.Cleanup(func() { segmentManager.Close() })
+	manifest, _ := storage.NewManifest(filepath.Join(tmpDir, "manifest.json"))
+
+	ingestManager := ingest.NewIngestManager(
+		&ingest.MemoryBuffer{}, walManager, segmentManager, manifest, index.NewIndexManager(), 1*time.Second,
+	)
+
+	now := time.Now().UnixMilli()
+	for i := range 30 {
+		entry := &types.LogEntry{Timestamp: now + int64(i), Level: types.Info, Service: "api", Message: fmt.Sprintf("log %d", i)}
+		if err := ingestManager.AppendLog(entry); err != nil {
+			t.Fatalf("AppendLog failed: %v", err)
+		}
+	}
+	if err := ingestManager.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	segmentManager.WaitCompressed()
+
+	sealed := manifest.GetSegments()
+	if len(sealed) < 2 {
+		t.Fatalf("Expected several sealed segments, got %d", len(sealed))
+	}
+	var sealedBytes int64
+	for _, segment := range sealed {
+		sealedBytes += segment.Size
+	}
+
+	// the active segment holds the entry that triggered the last rotation
+	stats := query.NewQueryEngine(index.NewIndexManager(), manifest, segmentManager).Stats()
+	if stats.Segments != len(sealed)+1 || stats.OldestTimestamp != now || stats.NewestTimestamp != now+29 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// after a restart the active segment is empty and must not count
+	restarted, _ := storage.NewSegmentManager(tmpDir, 512)
+	stats = query.NewQueryEngine(index.NewIndexManager(), manifest, restarted).Stats()
+	if stats.Segments != len(sealed) || stats.Bytes != sealedBytes || stats.OldestTimestamp != now {
+		t.Fatalf("Expected only the %d sealed segments (%d bytes) from %d, got %+v", len(sealed), sealedBytes, now, stats)
+	}
+	if len(stats.Services) != 1 || stats.Services[0] != "api" {
+		t.Fatalf("unexpected services: %v", stats.Services)
+	}
+}
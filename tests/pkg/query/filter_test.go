@@ -0,0 +1,110 @@
+package query_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/query"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+// decoded like the write API does, so numbers are float64 and objects nested maps
+func decodeEntry(t *testing.T, raw string) types.LogEntry {
+	t.Helper()
+	var entry types.LogEntry
+	if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+		t.Fatalf("decode entry: %v", err)
+	}
+	return entry
+}
+
+func TestFieldFilterOperators(t *testing.T) {
+	entries := map[string]types.LogEntry{
+		"ok":      decodeEntry(t, `{"Timestamp":1000,"Level":"Info","Service":"api","Properties":{"status_code":200,"http":{"method":"GET","path":"/health"}}}`),
+		"created": decodeEntry(t, `{"Timestamp":2000,"Level":"Info","Service":"api","Properties":{"status_code":201,"http":{"method":"POST","path":"/users"},"user_id":"u-1"}}`),
+		"failed":  decodeEntry(t, `{"Timestamp":3000,"Level":"Error","Service":"billing","Properties":{"status_code":503,"http":{"method":"PUT","path":"/invoices/7"},"deployed":"2024-05-01T10:00:00Z"}}`),
+	}
+
+	cases := []struct {
+		filter query.FieldFilter
+		want   []string
+	}{
+		{query.FieldFilter{Field: "status_code", Value: "503"}, []string{"failed"}},
+		{query.FieldFilter{Field: "status_code", Op: query.OpGe, Value: "500"}, []string{"failed"}},
+		{query.FieldFilter{Field: "status_code", Op: query.OpLt, Value: "201"}, []string{"ok"}},
+		{query.FieldFilter{Field: "status_code", Op: query.OpNe, Value: "200"}, []string{"created", "failed"}},
+		{query.FieldFilter{Field: "timestamp", Op: query.OpGt, Value: "1500"}, []string{"created", "failed"}},
+		{query.FieldFilter{Field: "timestamp", Op: query.OpLe, Value: "1970-01-01T00:00:02Z"}, []string{"ok", "created"}},
+		{query.FieldFilter{Field: "deployed", Op: query.OpLt, Value: "2024-06-01T00:00:00+02:00"}, []string{"failed"}},
+		{query.FieldFilter{Field: "level", Op: query.OpEq, Value: "ERROR"}, []string{"failed"}},
+		{query.FieldFilter{Field: "http.method", Op: query.OpIn, Values: []string{"POST", "PUT"}}, []string{"created", "failed"}},
+		{query.FieldFilter{Field: "properties.http.path", Op: query.OpPrefix, Value: "/invoices/"}, []string{"failed"}},
+		{query.FieldFilter{Field: "http.path", Op: query.OpRegex, Value: `^/(users|health)$`}, []string{"ok", "created"}},
+		{query.FieldFilter{Field: "service", Op: query.OpGlob, Value: "b*g"}, []string{"failed"}},
+		{query.FieldFilter{Field: "user_id", Op: query.OpExists}, []string{"created"}},
+		{query.FieldFilter{Field: "user_id", Op: query.OpNotExists}, []string{"ok", "failed"}},
+		// != needs the field to be there
+		{query.FieldFilter{Field: "user_id", Op: query.OpNe, Value: "u-2"}, []string{"created"}},
+	}
+
+	for _, c := range cases {
+		filter := c.filter
+		t.Run(string(filter.Op)+" "+filter.Field, func(t *testing.T) {
+			if err := filter.Compile(); err != nil {
+				t.Fatalf("Compile failed: %v", err)
+			}
+
+			want := map[string]bool{}
+			for _, name := range c.want {
+				want[name] = true
+			}
+			for name, entry := range entries {
+				if got := filter.Apply(entry); got != want[name] {
+					t.Errorf("%s: expected match=%v, got %v", name, want[name], got)
+				}
+			}
+		})
+	}
+}
+
+func TestParseFilterOperators(t *testing.T) {
+	entry := decodeEntry(t, `{"Level":"Error","Host":"web-1","Message":"upstream timeout","Properties":{"status_code":504,"http":{"method":"POST"}}}`)
+
+	cases := map[string]bool{
+		`status_code >= 500 AND http.method:(POST, PUT)`: true,
+		`status_code<500`:             false,
+		`status_code!=504`:            false,
+		`host =~ "^web-[0-9]+$"`:      true,
+		`host:web*`:                   true,
+		`message:upstream*`:           true,
+		`http.method:(GET OR DELETE)`: false,
+		`status_code:*`:               true,
+		`NOT user_id:*`:               true,
+		`NOT status_code:*`:           false,
+		`level=error`:                 true,
+	}
+
+	for input, want := range cases {
+		filter, err := query.ParseFilter(input)
+		if err != nil {
+			t.Errorf("%s: ParseFilter failed: %v", input, err)
+			continue
+		}
+		if got := filter.Apply(entry); got != want {
+			t.Errorf("%s: expected match=%v, got %v", input, want, got)
+		}
+	}
+}
+
+func TestInvalidFieldFilter(t *testing.T) {
+	var parseError *query.ParseError
+	if _, err := query.ParseFilter(`path =~ "(unclosed"`); !errors.As(err, &parseError) || parseError.Column != 9 {
+		t.Errorf("expected a parse error at the regex, got %v", err)
+	}
+
+	filter := query.FieldFilter{Field: "status_code", Op: query.OpIn}
+	if err := filter.Compile(); !errors.Is(err, query.ErrInvalidFilter) {
+		t.Errorf("expected ErrInvalidFilter for an empty IN list, got %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package query_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/index"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/ingest"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/query"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/storage"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+func TestTopNAcrossSegments(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	walManager, _ := storage.NewWALManager(tmpDir, filepath.Join(tmpDir, "wal.meta"))
+	segmentManager, _ := storage.NewSegmentManager(tmpDir, 512)
+	t.Cleanup(func() { segmentManager.Close() })
+	manifest, _ := storage.NewManifest(filepath.Join(tmpDir, "manifest.json"))
+	indexManager := index.NewIndexManager()
+
+	ingestManager := ingest.NewIngestManager(
+		&ingest.MemoryBuffer{}, walManager, segmentManager, manifest, indexManager, 1*time.Second,
+	)
+	engine := query.NewQueryEngine(indexManager, manifest, segmentManager)
+
+	// 60 logs arriving in three rounds, each round earlier in time than the one before,
+	// so manifest order is the opposite of time order
+	start := int64(1_700_000_000_000)
+	for round := 2; round >= 0; round-- {
+		for i := round * 20; i < round*20+20; i++ {
+			entry := &types.LogEntry{Timestamp: start + int64(i*1000), Level: types.Info, Message: fmt.Sprintf("log %d", i)}
+			if i%3 == 0 {
+				entry.Level = types.Error
+			}
+			if err := ingestManager.AppendLog(entry); err != nil {
+				t.Fatalf("AppendLog failed: %v", err)
+			}
+		}
+		if err := ingestManager.Flush(); err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+	}
+
+	// latest 5 errors
+	results, err := engine.Execute(&query.Query{Expression: "level:ERROR", Limit: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"log 57", "log 54", "log 51", "log 48", "log 45"}
+	if len(results) != len(want) {
+		t.Fatalf("expected %d results, got %d", len(want), len(results))
+	}
+	for i, entry := range results {
+		if entry.Message != want[i] {
+			t.Errorf("result %d: expected %q, got %q", i, want[i], entry.Message)
+		}
+	}
+
+	// earliest 3
+	results, err = engine.Execute(&query.Query{Limit: 3, SortAsc: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, entry := range results {
+		if want := fmt.Sprintf("log %d", i); entry.Message != want {
+			t.Errorf("ascending result %d: expected %q, got %q", i, want, entry.Message)
+		}
+	}
+
+	// segments holding only older logs than the top 5 are never read
+	for _, segment := range manifest.GetSegments() {
+		if segment.MaxTimestamp < start+40_000 {
+			if err := os.Remove(filepath.Join(tmpDir, segment.FileName)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	results, err = engine.Execute(&query.Query{Limit: 5})
+	if err != nil {
+		t.Fatalf("top 5 read a segment it didn't need: %v", err)
+	}
+	if len(results) != 5 || results[0].Message != "log 59" || results[4].Message != "log 55" {
+		t.Errorf("unexpected latest logs: %v", results)
+	}
+}
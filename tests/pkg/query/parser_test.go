@@ -0,0 +1,83 @@
+package query_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/query"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+func TestParseFilterMatches(t *testing.T) {
+	entries := map[string]types.LogEntry{
+		"auth-error":    {Level: types.Error, Service: "auth", Host: "web-1", Message: "login failed"},
+		"billing-error": {Level: types.Error, Service: "billing", Host: "canary-2", Message: "card declined"},
+		"billing-info":  {Level: types.Info, Service: "billing", Host: "web-2", Message: "card charged"},
+		"search-error":  {Level: types.Error, Service: "search", Host: "web-3", Message: "timeout", Properties: map[string]interface{}{"region": "eu-west"}},
+	}
+
+	cases := []struct {
+		query string
+		want  []string
+	}{
+		{`level:ERROR AND (service:auth OR service:billing) AND NOT host:canary-*`, []string{"auth-error"}},
+		// AND binds tighter than OR
+		{`service:auth OR service:billing AND level:INFO`, []string{"auth-error", "billing-info"}},
+		{`(service:auth OR service:billing) AND level:INFO`, []string{"billing-info"}},
+		// implicit AND, lowercase keywords
+		{`level:ERROR not service:search`, []string{"auth-error", "billing-error"}},
+		{`NOT NOT service:search`, []string{"search-error"}},
+		// bare words and quoted phrases search the message
+		{`card`, []string{"billing-error", "billing-info"}},
+		{`"card declined" OR timeout`, []string{"billing-error", "search-error"}},
+		{`region:eu-*`, []string{"search-error"}},
+		{`host:"canary-*"`, nil}, // quoted: the * is literal
+		{`host:web-?`, []string{"auth-error", "billing-info", "search-error"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.query, func(t *testing.T) {
+			filter, err := query.ParseFilter(c.query)
+			if err != nil {
+				t.Fatalf("ParseFilter failed: %v", err)
+			}
+
+			want := map[string]bool{}
+			for _, name := range c.want {
+				want[name] = true
+			}
+			for name, entry := range entries {
+				if got := filter.Apply(entry); got != want[name] {
+					t.Errorf("%s: expected match=%v, got %v", name, want[name], got)
+				}
+			}
+		})
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	cases := []struct {
+		query  string
+		column int
+	}{
+		{``, 1},
+		{`level:`, 7},
+		{`level:ERROR AND`, 16},
+		{`(service:auth OR service:billing`, 33},
+		{`service:auth)`, 13},
+		{`message:"unterminated`, 9},
+		{`level:ERROR OR OR level:INFO`, 16},
+	}
+
+	for _, c := range cases {
+		_, err := query.ParseFilter(c.query)
+
+		var parseError *query.ParseError
+		if !errors.As(err, &parseError) {
+			t.Fatalf("%q: expected a ParseError, got %v", c.query, err)
+		}
+		if parseError.Column != c.column {
+			t.Errorf("%q: expected column %d, got %d (%v)", c.query, c.column, parseError.Column, err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package query_test
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/index"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/ingest"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/query"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/storage"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+func TestTailFollowsAppends(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	walManager, _ := storage.NewWALManager(tmpDir, filepath.Join(tmpDir, "wal.meta"))
+	segmentManager, _ := storage.NewSegmentManager(tmpDir, 1024)
+	t.Cleanup(func() { segmentManager.Close() })
+	manifest, _ := storage.NewManifest(filepath.Join(tmpDir, "manifest.json"))
+	ingestManager := ingest.NewIngestManager(
+		&ingest.MemoryBuffer{}, walManager, segmentManager, manifest, index.NewIndexManager(), 1*time.Second,
+	)
+
+	hub := query.NewTailHub()
+	ingestManager.OnAppend(func(entry *types.LogEntry) {
+		hub.Publish(*entry)
+	})
+
+	subscription, err := hub.Subscribe("level:ERROR")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	for i := range 6 {
+		entry := &types.LogEntry{Timestamp: int64(i), Level: types.Info, Message: fmt.Sprintf("log %d", i)}
+		if i%2 == 0 {
+			entry.Level = types.Error
+		}
+		if err := ingestManager.AppendLog(entry); err != nil {
+			t.Fatalf("AppendLog failed: %v", err)
+		}
+	}
+
+	for _, want := range []string{"log 0", "log 2", "log 4"} {
+		select {
+		case entry := <-subscription.Entries:
+			if entry.Message != want {
+				t.Fatalf("expected %q, got %q", want, entry.Message)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+
+	subscription.Close()
+	if _, open := <-subscription.Entries; open || hub.Subscribers() != 0 {
+		t.Errorf("expected a closed subscription to be gone")
+	}
+
+	if _, err := hub.Subscribe("level:("); err == nil {
+		t.Errorf("expected a parse error")
+	}
+}
+
+func TestTailSlowConsumers(t *testing.T) {
+	hub := query.NewTailHubWithOptions(query.TailOptions{BufferSize: 2})
+
+	dropping, _ := hub.SubscribeWithPolicy("", query.DropEntries)
+	disconnecting, _ := hub.SubscribeWithPolicy("", query.Disconnect)
+
+	for i := range 5 {
+		hub.Publish(types.LogEntry{Timestamp: int64(i), Message: fmt.Sprintf("log %d", i)})
+	}
+
+	// the dropping subscriber keeps the first two and counts the rest
+	if dropped := dropping.Dropped(); dropped != 3 {
+		t.Errorf("expected 3 dropped entries, got %d", dropped)
+	}
+	if first := <-dropping.Entries; first.Message != "log 0" {
+		t.Errorf("expected the oldest entry first, got %q", first.Message)
+	}
+	hub.Publish(types.LogEntry{Message: "log 5"})
+	if second, third := <-dropping.Entries, <-dropping.Entries; second.Message != "log 1" || third.Message != "log 5" {
+		t.Errorf("expected room for new entries once read, got %q and %q", second.Message, third.Message)
+	}
+
+	// the disconnecting one gets what fit, then its channel closes
+	received := 0
+	for range disconnecting.Entries {
+		received++
+	}
+	if received != 2 || !errors.Is(disconnecting.Err(), query.ErrSlowConsumer) {
+		t.Errorf("expected 2 entries and ErrSlowConsumer, got %d and %v", received, disconnecting.Err())
+	}
+	if hub.Subscribers() != 1 {
+		t.Errorf("expected only the dropping subscriber left, got %d", hub.Subscribers())
+	}
+}
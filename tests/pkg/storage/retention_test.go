@@ -0,0 +1,147 @@
+package storage_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/storage"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+func TestRetentionPolicyExpired(t *testing.T) {
+	now := time.Now()
+	hoursAgo := func(hours int) int64 { return now.Add(-time.Duration(hours) * time.Hour).UnixMilli() }
+
+	segments := []storage.SegmentMeta{
+		{FileName: "old_api.log", Size: 100, MaxTimestamp: hoursAgo(48), Services: []string{"api"}},
+		{FileName: "old_audit.log", Size: 100, MaxTimestamp: hoursAgo(47), Services: []string{"audit"}},
+		{FileName: "old_mixed.log", Size: 100, MaxTimestamp: hoursAgo(46), Services: []string{"api", "audit"}},
+		{FileName: "old_legacy.log", Size: 100, MaxTimestamp: hoursAgo(45)},
+		{FileName: "recent_1.log", Size: 100, MaxTimestamp: hoursAgo(2), Services: []string{"api"}},
+		{FileName: "recent_2.log", Size: 100, MaxTimestamp: hoursAgo(1), Services: []string{"api"}},
+	}
+
+	names := func(metas []storage.SegmentMeta) []string {
+		var result []string
+		for _, meta := range metas {
+			result = append(result, meta.FileName)
+		}
+		return result
+	}
+
+	// audit is kept for a week, a segment shared with audit stays as long as audit needs it
+	policy := storage.RetentionPolicy{
+		MaxAge:        24 * time.Hour,
+		ServiceMaxAge: map[string]time.Duration{"audit": 7 * 24 * time.Hour},
+	}
+	if got := names(policy.Expired(segments, now)); len(got) != 2 || got[0] != "old_api.log" || got[1] != "old_legacy.log" {
+		t.Fatalf("unexpected expired segments by age: %v", got)
+	}
+
+	// the size limit gives up the oldest segments first, whatever the service
+	policy = storage.RetentionPolicy{MaxTotalBytes: 250}
+	got := names(policy.Expired(segments, now))
+	if len(got) != 4 || got[0] != "old_api.log" || got[3] != "old_legacy.log" {
+		t.Fatalf("unexpected expired segments by size: %v", got)
+	}
+
+	if got := (storage.RetentionPolicy{}).Expired(segments, now); len(got) != 0 {
+		t.Fatalf("Expected an empty policy to keep everything, got %v", names(got))
+	}
+}
+
+func TestRetentionSharedSegmentKeepsLongestMaxAge(t *testing.T) {
+	now := time.Now()
+	dir := t.TempDir()
+	segmentManager, err := storage.NewSegmentManager(dir, 512)
+	if err != nil {
+		t.Fatalf("NewSegmentManager failed: %v", err)
+	}
+
+	// two services written at the same time share the segment, named by LogEntry.Service
+	old := now.Add(-3 * time.Hour).UnixMilli()
+	for i := 0; !segmentManager.IsSegmentRotated(); i++ {
+		service := "api"
+		if i%2 == 1 {
+			service = "debug"
+		}
+		entry := &types.LogEntry{Timestamp: old + int64(i), Level: types.Info, Service: service, Message: "shared"}
+		if _, err := segmentManager.Append(entry); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	shared := segmentManager.RotatedSegments()[0]
+	if len(shared.Services) != 2 || shared.Services[0] != "api" || shared.Services[1] != "debug" {
+		t.Fatalf("Expected the services of the entries in the segment meta, got %v", shared.Services)
+	}
+	debugOnly := storage.SegmentMeta{FileName: "debug.log", MaxTimestamp: old, Services: []string{"debug"}}
+	segments := []storage.SegmentMeta{shared, debugOnly}
+
+	// debug's shorter max age only expires the segment holding nothing else
+	policy := storage.RetentionPolicy{
+		MaxAge:        24 * time.Hour,
+		ServiceMaxAge: map[string]time.Duration{"debug": time.Hour},
+	}
+	if got := policy.Expired(segments, now); len(got) != 1 || got[0].FileName != "debug.log" {
+		t.Fatalf("Expected only debug.log to expire, got %+v", got)
+	}
+
+	// a longer one keeps the shared segment past MaxAge
+	policy = storage.RetentionPolicy{
+		MaxAge:        time.Hour,
+		ServiceMaxAge: map[string]time.Duration{"debug": 24 * time.Hour},
+	}
+	if got := policy.Expired(segments, now); len(got) != 0 {
+		t.Fatalf("Expected debug to keep both segments, got %+v", got)
+	}
+
+	policy = storage.RetentionPolicy{MaxAge: time.Hour}
+	if got := policy.Expired(segments, now); len(got) != 2 {
+		t.Fatalf("Expected both segments to expire, got %+v", got)
+	}
+}
+
+func TestRetentionManagerEnforce(t *testing.T) {
+	dir := t.TempDir()
+	manifest, err := storage.NewManifest(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		t.Fatalf("NewManifest failed: %v", err)
+	}
+
+	old := time.Now().Add(-48 * time.Hour).UnixMilli()
+	for _, segment := range []storage.SegmentMeta{
+		{FileName: "segment_1.log", Size: 10, MaxTimestamp: old},
+		{FileName: "segment_2.log", Size: 10, MaxTimestamp: time.Now().UnixMilli()},
+	} {
+		os.WriteFile(filepath.Join(dir, segment.FileName), []byte("data"), 0644)
+		manifest.AddSegment(segment)
+	}
+
+	retentionManager := storage.NewRetentionManager(dir, manifest, storage.RetentionPolicy{MaxAge: 24 * time.Hour}, time.Hour)
+
+	var dropped []string
+	retentionManager.OnDelete(func(meta storage.SegmentMeta) error {
+		dropped = append(dropped, meta.FileName)
+		return nil
+	})
+
+	deleted, err := retentionManager.Enforce()
+	if err != nil {
+		t.Fatalf("Enforce failed: %v", err)
+	}
+	if len(deleted) != 1 || deleted[0].FileName != "segment_1.log" || len(dropped) != 1 {
+		t.Fatalf("unexpected deletion: %+v, hook saw %v", deleted, dropped)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "segment_1.log")); !os.IsNotExist(err) {
+		t.Fatalf("Expected segment_1.log to be removed, stat returned %v", err)
+	}
+
+	// the saved manifest no longer lists it
+	reloaded, _ := storage.NewManifest(filepath.Join(dir, "manifest.json"))
+	if segments := reloaded.GetSegments(); len(segments) != 1 || segments[0].FileName != "segment_2.log" {
+		t.Fatalf("unexpected manifest after retention: %+v", segments)
+	}
+}
@@ -0,0 +1,333 @@
+package storage_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/compress"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/storage"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+// writeSegment appends n logs to a fresh segment and returns its path and record offsets
+func writeSegment(t *testing.T, dir string, n int) (*storage.SegmentManager, string, []int64) {
+	segmentManager, err := storage.NewSegmentManager(dir, 1024*1024)
+	if err != nil {
+		t.Fatalf("NewSegmentManager failed: %v", err)
+	}
+
+	now := time.Now().UnixMilli()
+	var offsets []int64
+	for i := range n {
+		offset, err := segmentManager.Append(&types.LogEntry{
+			Timestamp: now + int64(i),
+			Level:     types.Info,
+			Message:   fmt.Sprintf("log %d", i),
+		})
+		if err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+		offsets = append(offsets, offset)
+	}
+
+	if err := segmentManager.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	return segmentManager, filepath.Join(dir, segmentManager.CurrFileName()), offsets
+}
+
+func TestSegmentRoundTrip(t *testing.T) {
+	segmentManager, path, offsets := writeSegment(t, t.TempDir(), 10)
+
+	all, err := segmentManager.ReadSegment(path, nil)
+	if err != nil {
+		t.Fatalf("ReadSegment failed: %v", err)
+	}
+	if len(all) != 10 {
+		t.Fatalf("Expected 10 logs, got %d", len(all))
+	}
+
+	some, err := segmentManager.ReadSegment(path, []int64{offsets[3], offsets[7]})
+	if err != nil {
+		t.Fatalf("ReadSegment with offsets failed: %v", err)
+	}
+	if len(some) != 2 || some[0].Message != "log 3" || some[1].Message != "log 7" {
+		t.Fatalf("unexpected entries: %+v", some)
+	}
+}
+
+func TestSegmentDetectsBitRot(t *testing.T) {
+	segmentManager, path, offsets := writeSegment(t, t.TempDir(), 10)
+
+	data, _ := os.ReadFile(path)
+	data[offsets[5]+12] ^= 0xff // inside the payload of record 5
+	os.WriteFile(path, data, 0644)
+
+	_, err := segmentManager.ReadSegment(path, nil)
+
+	var corruptionErr *storage.CorruptionError
+	if !errors.As(err, &corruptionErr) || !errors.Is(err, storage.ErrCorruptRecord) {
+		t.Fatalf("Expected corrupt record error, got %v", err)
+	}
+	if corruptionErr.Offset != offsets[5] {
+		t.Fatalf("Expected corruption at offset %d, got %d", offsets[5], corruptionErr.Offset)
+	}
+}
+
+func TestSegmentDetectsTornWrite(t *testing.T) {
+	segmentManager, path, offsets := writeSegment(t, t.TempDir(), 10)
+
+	// cut the last record in half
+	info, _ := os.Stat(path)
+	os.Truncate(path, offsets[9]+(info.Size()-offsets[9])/2)
+
+	_, err := segmentManager.ReadSegment(path, nil)
+	if !errors.Is(err, storage.ErrTornRecord) {
+		t.Fatalf("Expected torn record error, got %v", err)
+	}
+
+	if _, err := segmentManager.ReadSegment(path, []int64{offsets[9]}); !errors.Is(err, storage.ErrTornRecord) {
+		t.Fatalf("Expected torn record error reading offset, got %v", err)
+	}
+}
+
+func TestLegacyJSONSegment(t *testing.T) {
+	dir := t.TempDir()
+	segmentManager, _, _ := writeSegment(t, dir, 0)
+
+	path := filepath.Join(dir, "segment_1.log")
+	legacy := `{"Timestamp":1,"Level":"INFO","Message":"first"}` + "\n" + `{"Timestamp":2,"Level":"ERROR","Message":"second"}` + "\n"
+	os.WriteFile(path, []byte(legacy), 0644)
+
+	entries, err := segmentManager.ReadSegment(path, nil)
+	if err != nil {
+		t.Fatalf("ReadSegment failed: %v", err)
+	}
+	if len(entries) != 2 || entries[1].Message != "second" {
+		t.Fatalf("unexpected legacy entries: %+v", entries)
+	}
+
+	second := int64(len(`{"Timestamp":1,"Level":"INFO","Message":"first"}` + "\n"))
+	entries, err = segmentManager.ReadSegment(path, []int64{second})
+	if err != nil || len(entries) != 1 || entries[0].Message != "second" {
+		t.Fatalf("unexpected legacy entry at offset: %+v %v", entries, err)
+	}
+}
+
+func TestCompressedSegment(t *testing.T) {
+	for _, codec := range []compress.Codec{compress.Snappy, compress.Deflate} {
+		t.Run(codec.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			segmentManager, err := storage.NewSegmentManagerWithOptions(dir, 64*1024, storage.SegmentOptions{
+				Codec:     codec,
+				BlockSize: 4096,
+			})
+			if err != nil {
+				t.Fatalf("NewSegmentManagerWithOptions failed: %v", err)
+			}
+
+			// fill the first segment, the next append seals it
+			var offsets []int64
+			var first string
+			for i := 0; ; i++ {
+				offset, err := segmentManager.Append(&types.LogEntry{
+					Timestamp:  int64(1000 + i),
+					Level:      types.Info,
+					Message:    fmt.Sprintf("request %d served", i),
+					Properties: map[string]interface{}{"service": "api"},
+				})
+				if err != nil {
+					t.Fatalf("Append failed: %v", err)
+				}
+				if i == 0 {
+					first = segmentManager.CurrFileName()
+				}
+				if segmentManager.IsSegmentRotated() {
+					break
+				}
+				offsets = append(offsets, offset)
+			}
+
+			// sealing leaves the segment plain, it is compressed once it is in the manifest
+			meta := segmentManager.RotatedSegments()[0]
+			if meta.FileName != first || meta.Codec != "" {
+				t.Fatalf("unexpected meta: %+v", meta)
+			}
+			manifest, _ := storage.NewManifest(filepath.Join(dir, "manifest.json"))
+			if err := manifest.AddSegment(meta); err != nil {
+				t.Fatalf("AddSegment failed: %v", err)
+			}
+			segmentManager.CompressSealed(manifest, meta)
+			segmentManager.WaitCompressed()
+
+			meta = manifest.GetSegments()[0]
+			if meta.FileName != first || meta.Codec != codec.String() {
+				t.Fatalf("unexpected meta: %+v", meta)
+			}
+			if meta.Size*3 > 64*1024 {
+				t.Fatalf("Expected the segment to shrink at least 3x, got %d bytes", meta.Size)
+			}
+
+			path := filepath.Join(dir, first)
+			all, err := segmentManager.ReadSegment(path, nil)
+			if err != nil {
+				t.Fatalf("ReadSegment failed: %v", err)
+			}
+			if len(all) != len(offsets) {
+				t.Fatalf("Expected %d logs, got %d", len(offsets), len(all))
+			}
+
+			// offsets taken while the segment was active still work
+			picked := []int64{offsets[0], offsets[1], offsets[len(offsets)/2], offsets[len(offsets)-1]}
+			some, err := segmentManager.ReadSegment(path, picked)
+			if err != nil {
+				t.Fatalf("ReadSegment with offsets failed: %v", err)
+			}
+			if len(some) != 4 || some[2].Message != fmt.Sprintf("request %d served", len(offsets)/2) {
+				t.Fatalf("unexpected entries: %+v", some)
+			}
+
+			// damage inside the first block
+			data, _ := os.ReadFile(path)
+			data[100] ^= 0xff
+			os.WriteFile(path, data, 0644)
+
+			var corruptionError *storage.CorruptionError
+			if _, err := segmentManager.ReadSegment(path, nil); !errors.As(err, &corruptionError) {
+				t.Fatalf("Expected a CorruptionError, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCompressSkipsRemovedSegment(t *testing.T) {
+	dir := t.TempDir()
+	segmentManager, err := storage.NewSegmentManager(dir, 256)
+	if err != nil {
+		t.Fatalf("NewSegmentManager failed: %v", err)
+	}
+	manifest, _ := storage.NewManifest(filepath.Join(dir, "manifest.json"))
+
+	for i := 0; !segmentManager.IsSegmentRotated(); i++ {
+		if _, err := segmentManager.Append(&types.LogEntry{Timestamp: int64(1000 + i), Level: types.Info, Message: "sealed soon"}); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	meta := segmentManager.RotatedSegments()[0]
+	path := filepath.Join(dir, meta.FileName)
+
+	// retention removed the segment before compression got to it
+	manifest.AddSegment(meta)
+	manifest.RemoveSegments([]string{meta.FileName})
+	segmentManager.CompressSealed(manifest, meta)
+	segmentManager.WaitCompressed()
+
+	if len(manifest.GetSegments()) != 0 {
+		t.Fatalf("Expected compression to leave the manifest alone, got %+v", manifest.GetSegments())
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("Expected the plain segment untouched: %v", err)
+	}
+
+	// the file deleted too, compression must not bring it back
+	segmentManager.CompressSealed(manifest, meta)
+	segmentManager.WaitCompressed()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected the segment to stay deleted, stat returned %v", err)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(tmp) != 0 {
+		t.Fatalf("Expected no leftover tmp files, got %v", tmp)
+	}
+}
+
+func TestSegmentRotateHookFailure(t *testing.T) {
+	dir := t.TempDir()
+	segmentManager, err := storage.NewSegmentManager(dir, 256)
+	if err != nil {
+		t.Fatalf("NewSegmentManager failed: %v", err)
+	}
+
+	failing := true
+	segmentManager.OnRotate(func(meta storage.SegmentMeta) error {
+		if failing {
+			return errors.New("index persist failed")
+		}
+		return nil
+	})
+
+	appendLog := func(i int) error {
+		_, err := segmentManager.Append(&types.LogEntry{Timestamp: int64(1000 + i), Level: types.Info, Message: "rotating soon"})
+		return err
+	}
+
+	i := 0
+	for ; ; i++ {
+		if err := appendLog(i); err != nil {
+			break
+		}
+	}
+	sealed := segmentManager.RotatedSegments()
+	if len(sealed) != 1 {
+		t.Fatalf("Expected the segment sealed once, got %+v", sealed)
+	}
+
+	// the failed hook leaves a fresh segment to write to, a retry doesn't seal again
+	failing = false
+	if err := appendLog(i); err != nil {
+		t.Fatalf("Append after the failed hook failed: %v", err)
+	}
+	if got := segmentManager.RotatedSegments(); len(got) != 1 {
+		t.Fatalf("Expected no second rotation, got %+v", got)
+	}
+	if segmentManager.CurrFileName() == sealed[0].FileName {
+		t.Fatalf("Expected a new active segment")
+	}
+
+	entries, err := segmentManager.ReadSegment(filepath.Join(dir, sealed[0].FileName), nil)
+	if err != nil || len(entries) != i {
+		t.Fatalf("Expected %d entries in the sealed segment, got %d (%v)", i, len(entries), err)
+	}
+}
+
+func TestSegmentManagerCloseWaitsAndRemovesStaleTmp(t *testing.T) {
+	dir := t.TempDir()
+
+	// a compression cut short by an exit
+	stale := filepath.Join(dir, "segment_1.log.tmp")
+	if err := os.WriteFile(stale, []byte("partial"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	segmentManager, err := storage.NewSegmentManager(dir, 256)
+	if err != nil {
+		t.Fatalf("NewSegmentManager failed: %v", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("Expected the stale tmp file removed, stat returned %v", err)
+	}
+
+	manifest, _ := storage.NewManifest(filepath.Join(dir, "manifest.json"))
+	for i := 0; !segmentManager.IsSegmentRotated(); i++ {
+		if _, err := segmentManager.Append(&types.LogEntry{Timestamp: int64(1000 + i), Level: types.Info, Message: "sealed soon"}); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	meta := segmentManager.RotatedSegments()[0]
+	manifest.AddSegment(meta)
+	segmentManager.CompressSealed(manifest, meta)
+
+	if err := segmentManager.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if segments := manifest.GetSegments(); len(segments) != 1 || segments[0].Codec == "" {
+		t.Fatalf("Expected Close to wait for the compression, got %+v", segments)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(tmp) != 0 {
+		t.Fatalf("Expected no leftover tmp files, got %v", tmp)
+	}
+}
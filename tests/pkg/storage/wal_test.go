@@ -0,0 +1,211 @@
+package storage_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/storage"
+	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
+)
+
+// writeWAL appends n logs to a fresh WAL, closes it and returns the file offsets of the records
+func writeWAL(t *testing.T, dir string, n int) (string, []int64) {
+	walManager, err := storage.NewWALManager(dir, filepath.Join(dir, "wal.meta"))
+	if err != nil {
+		t.Fatalf("NewWALManager failed: %v", err)
+	}
+
+	var offsets []int64
+	for i := range n {
+		offsets = append(offsets, walManager.Meta.LastOffset)
+		entry := &types.LogEntry{Timestamp: int64(i), Level: types.Info, Message: fmt.Sprintf("log %d", i)}
+		if err := walManager.Append(entry); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	walManager.Close()
+
+	return filepath.Join(dir, "wal_00000001.wal"), offsets
+}
+
+func reopenWAL(t *testing.T, dir string) *storage.WALManager {
+	walManager, err := storage.NewWALManager(dir, filepath.Join(dir, "wal.meta"))
+	if err != nil {
+		t.Fatalf("NewWALManager failed: %v", err)
+	}
+	t.Cleanup(func() { walManager.Close() })
+	return walManager
+}
+
+func TestWALTruncatesTornTail(t *testing.T) {
+	dir := t.TempDir()
+	path, offsets := writeWAL(t, dir, 5)
+
+	// crash in the middle of the last append
+	os.Truncate(path, offsets[4]+6)
+
+	entries, report, err := reopenWAL(t, dir).Recover(storage.RecoverStrict)
+	if err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+
+	if len(entries) != 4 || report.Records != 4 {
+		t.Fatalf("Expected 4 recovered logs, got %d (report %+v)", len(entries), report)
+	}
+	if report.DiscardedRecords != 1 || report.DiscardedBytes != 6 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	if info, _ := os.Stat(path); info.Size() != offsets[4] {
+		t.Fatalf("Expected WAL truncated to %d bytes, got %d", offsets[4], info.Size())
+	}
+}
+
+func TestWALCorruptionInTheMiddle(t *testing.T) {
+	dir := t.TempDir()
+	path, offsets := writeWAL(t, dir, 5)
+
+	data, _ := os.ReadFile(path)
+	data[offsets[2]+12] ^= 0xff
+	os.WriteFile(path, data, 0644)
+
+	_, _, err := reopenWAL(t, dir).Recover(storage.RecoverStrict)
+	var corruptionErr *storage.CorruptionError
+	if !errors.As(err, &corruptionErr) || corruptionErr.Offset != offsets[2] {
+		t.Fatalf("Expected corruption error at offset %d, got %v", offsets[2], err)
+	}
+
+	// strict mode must not touch the file
+	if info, _ := os.Stat(path); info.Size() != int64(len(data)) {
+		t.Fatalf("strict recovery modified the WAL")
+	}
+
+	entries, report, err := reopenWAL(t, dir).Recover(storage.RecoverRepair)
+	if err != nil {
+		t.Fatalf("repair failed: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 logs before the damage, got %d", len(entries))
+	}
+	if report.DiscardedRecords != 3 || report.DiscardedBytes != int64(len(data))-offsets[2] {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+}
+
+func TestWALDamagedLengthInTheMiddle(t *testing.T) {
+	dir := t.TempDir()
+	path, offsets := writeWAL(t, dir, 5)
+
+	// a length running past the end of the file looks like a torn write,
+	// but whole records follow it
+	data, _ := os.ReadFile(path)
+	binary.LittleEndian.PutUint32(data[offsets[2]:], 1<<20)
+	os.WriteFile(path, data, 0644)
+
+	_, _, err := reopenWAL(t, dir).Recover(storage.RecoverStrict)
+	var corruptionErr *storage.CorruptionError
+	if !errors.As(err, &corruptionErr) || corruptionErr.Offset != offsets[2] || !errors.Is(err, storage.ErrCorruptRecord) {
+		t.Fatalf("Expected corrupt record at offset %d, got %v", offsets[2], err)
+	}
+	if info, _ := os.Stat(path); info.Size() != int64(len(data)) {
+		t.Fatalf("strict recovery modified the WAL")
+	}
+
+	entries, _, err := reopenWAL(t, dir).Recover(storage.RecoverRepair)
+	if err != nil {
+		t.Fatalf("repair failed: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 logs before the damage, got %d", len(entries))
+	}
+}
+
+func TestWALReplaysLegacyJSONLines(t *testing.T) {
+	dir := t.TempDir()
+
+	legacy := `{"Timestamp":1,"Level":"INFO","Message":"old"}` + "\n" + `{"Timestamp":2,"Lev`
+	os.WriteFile(filepath.Join(dir, "wal_00000001.wal"), []byte(legacy), 0644)
+
+	walManager := reopenWAL(t, dir)
+
+	// new records go to a new file instead of being mixed into the JSON one
+	walManager.Append(&types.LogEntry{Timestamp: 3, Level: types.Info, Message: "new"})
+
+	entries, report, err := walManager.Recover(storage.RecoverStrict)
+	if err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Message != "old" || entries[1].Message != "new" {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+	if report.DiscardedRecords != 1 {
+		t.Fatalf("Expected the partial JSON line to be reported, got %+v", report)
+	}
+}
+
+func TestWALDurabilityModes(t *testing.T) {
+	modes := map[string]storage.DurabilityMode{
+		"SyncEveryWrite": storage.SyncEveryWrite,
+		"SyncBatch":      storage.SyncBatch,
+		"SyncInterval":   storage.SyncInterval,
+	}
+
+	for name, mode := range modes {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			options := storage.DefaultWALOptions()
+			options.Durability = mode
+
+			walManager, err := storage.NewWALManagerWithOptions(dir, filepath.Join(dir, "wal.meta"), options)
+			if err != nil {
+				t.Fatalf("NewWALManagerWithOptions failed: %v", err)
+			}
+
+			// concurrent appenders, batched together in SyncBatch mode
+			writers, perWriter := 20, 25
+			errs := make(chan error, writers)
+			for w := range writers {
+				go func() {
+					for i := range perWriter {
+						entry := &types.LogEntry{Timestamp: int64(w*1000 + i), Level: types.Info}
+						if err := walManager.Append(entry); err != nil {
+							errs <- err
+							return
+						}
+					}
+					errs <- nil
+				}()
+			}
+			for range writers {
+				if err := <-errs; err != nil {
+					t.Fatalf("Append failed: %v", err)
+				}
+			}
+
+			batch := []*types.LogEntry{{Level: types.Info}, {Level: types.Error}}
+			if err := walManager.AppendBatch(batch); err != nil {
+				t.Fatalf("AppendBatch failed: %v", err)
+			}
+			if err := walManager.Sync(); err != nil {
+				t.Fatalf("Sync failed: %v", err)
+			}
+
+			walManager.Close()
+			if err := walManager.Append(&types.LogEntry{Level: types.Info}); err == nil {
+				t.Fatalf("Expected append after close to fail")
+			}
+
+			entries, err := reopenWAL(t, dir).ReplayAllUnflushed()
+			if err != nil {
+				t.Fatalf("Replay failed: %v", err)
+			}
+			if len(entries) != writers*perWriter+len(batch) {
+				t.Fatalf("Expected %d entries, got %d", writers*perWriter+len(batch), len(entries))
+			}
+		})
+	}
+}
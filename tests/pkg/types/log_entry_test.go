@@ -2,6 +2,7 @@ package types_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/mrsridharpadmanaben/TimberLog/pkg/types"
 )
@@ -52,11 +53,33 @@ func TestIsValidLogLevel(t *testing.T) {
 	if !types.IsValidLogLevel(types.Info) || !types.IsValidLogLevel(types.Debug) || !types.IsValidLogLevel(types.Error) {
 		t.Errorf("expected levels to be valid")
 	}
+	if !types.IsValidLogLevel(types.Warn) || !types.IsValidLogLevel(types.Fatal) {
+		t.Errorf("expected WARN and FATAL to be valid")
+	}
 	if types.IsValidLogLevel("TRACE") {
 		t.Errorf("TRACE should not be valid")
 	}
 }
 
+func TestParseLogLevel(t *testing.T) {
+	cases := map[string]types.LogLevel{
+		"trace":   types.Debug,
+		"Info":    types.Info,
+		"notice":  types.Info,
+		"warning": types.Warn,
+		"err":     types.Error,
+		"crit":    types.Fatal,
+	}
+	for name, want := range cases {
+		if level, ok := types.ParseLogLevel(name); !ok || level != want {
+			t.Errorf("ParseLogLevel(%q) = %q, %v; want %q", name, level, ok, want)
+		}
+	}
+	if _, ok := types.ParseLogLevel("loud"); ok {
+		t.Errorf("expected unknown level name to be rejected")
+	}
+}
+
 func TestPropertiesHelpers(t *testing.T) {
 	log, _ := types.NewLogEntry(types.Info, "auth", "localhost", "test", "", nil)
 
@@ -74,3 +97,30 @@ func TestPropertiesHelpers(t *testing.T) {
 		t.Errorf("expected nonexistent Property to return false")
 	}
 }
+
+func TestNormalize(t *testing.T) {
+	now := time.UnixMilli(1_700_000_000_000)
+
+	entry := &types.LogEntry{Level: "error", Message: "boom"}
+	if err := entry.Normalize(now); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if entry.Level != types.Error || entry.Timestamp != now.UnixMilli() {
+		t.Errorf("expected ERROR at now, got %v at %d", entry.Level, entry.Timestamp)
+	}
+
+	entry = &types.LogEntry{Timestamp: 5, Properties: map[string]interface{}{"k": "v"}}
+	if err := entry.Normalize(now); err != nil || entry.Level != types.Info || entry.Timestamp != 5 {
+		t.Errorf("expected INFO keeping its timestamp, got %v at %d (%v)", entry.Level, entry.Timestamp, err)
+	}
+
+	for _, invalid := range []types.LogEntry{
+		{Level: "TRACE", Message: "x"},
+		{Timestamp: -1, Message: "x"},
+		{Level: types.Info},
+	} {
+		if err := invalid.Normalize(now); err == nil {
+			t.Errorf("expected %+v to be rejected", invalid)
+		}
+	}
+}